@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/caorushizi/mediago-core/internal/crypto"
 	"github.com/caorushizi/mediago-core/internal/downloader"
@@ -21,7 +24,7 @@ var version = "dev"
 
 func main() {
 	task := &model.Task{}
-	var headers []string
+	var headers, keyHeaders []string
 
 	rootCmd := &cobra.Command{
 		Use:     "mediago [url]",
@@ -31,13 +34,14 @@ func main() {
 		Long: `mediago - Streaming media downloader
 
 Supports HLS (m3u8) and DASH (mpd) protocols with concurrent segment
-downloading, AES-128 decryption, and automatic merging.
+downloading, AES-128 and CENC (cenc/cbcs) decryption, and automatic merging.
 
 DISCLAIMER: This software is for educational and research purposes only.
 Users are responsible for ensuring compliance with applicable laws.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			task.URL = args[0]
 			task.Headers = parseHeaders(headers)
+			task.KeyHeaders = parseKeyHeaders(keyHeaders)
 			return run(task)
 		},
 	}
@@ -57,46 +61,106 @@ Users are responsible for ensuring compliance with applicable laws.`,
 	// Download
 	f.IntVarP(&task.ThreadCount, "thread-count", "t", 8, "Concurrent download threads")
 	f.IntVarP(&task.RetryCount, "retry-count", "r", 3, "Retry count per segment")
+	f.BoolVar(&task.FallbackLower, "fallback-lower", false, "Switch to the next-lower variant when a segment fails on every mirror")
 
 	// Stream selection
 	f.BoolVar(&task.AutoSelect, "auto-select", false, "Auto-select best quality")
 	f.StringVar(&task.SelectVideo, "select-video", "", "Video stream filter")
 	f.StringVar(&task.SelectAudio, "select-audio", "", "Audio stream filter")
+	f.BoolVar(&task.Strict, "strict", false, "Fail on manifest problems instead of working around them")
+	f.StringArrayVar(&task.SkipPeriods, "skip-period", nil, "Leave out the DASH period with this id, e.g. an ad period (can be specified multiple times)")
+	f.Float64Var(&task.SkipPeriodsUnder, "skip-periods-under", 0, "Leave out DASH periods no longer than this many seconds")
+	f.BoolVar(&task.LazyPlaylists, "lazy-playlists", false, "Fetch HLS media playlists only for selected streams")
+	f.BoolVar(&task.Thumbnails, "thumbnails", false, "Download only the image or I-frame stream and save thumbnails")
 
 	// Merge
 	f.BoolVar(&task.NoMerge, "no-merge", false, "Download only, skip merge")
 	f.BoolVar(&task.DelAfterDone, "del-after-done", true, "Delete temp files after merge")
+	f.StringVar(&task.Package, "package", "", "Write a local offline package instead of merging (hls|dash)")
+	f.BoolVar(&task.PackageDecrypt, "package-decrypt", false, "Decrypt segments written to a package")
 	f.StringVar(&task.FfmpegPath, "ffmpeg-path", "ffmpeg", "Path to ffmpeg binary")
 	f.BoolVar(&task.BinaryMerge, "binary-merge", false, "Force binary concatenation")
+	f.StringVar(&task.SubtitleFormat, "sub-format", "vtt", "Subtitle output format: vtt or srt")
+	f.StringVar(&task.DiscontinuityMode, "discontinuity", model.DiscontinuityConcat, "Discontinuity handling: concat, retimestamp (needs ffmpeg) or split")
+	f.StringVar(&task.AdMode, "ads", model.AdsKeep, "Signalled ad breaks: keep, drop or chapters (writes <name>.ffmetadata)")
 
 	// Decrypt
-	f.StringArrayVar(&task.Key, "key", nil, "Decryption key in HEX (can be specified multiple times)")
+	f.StringArrayVar(&task.Key, "key", nil, "Decryption key as KID:KEY or KEY in HEX (can be specified multiple times)")
 	f.StringVar(&task.CustomHLSMethod, "custom-hls-method", "", "Force HLS encryption method")
 	f.StringVar(&task.CustomHLSKey, "custom-hls-key", "", "Force HLS key (HEX)")
 	f.StringVar(&task.CustomHLSIV, "custom-hls-iv", "", "Force HLS IV (HEX)")
+	f.BoolVar(&task.LenientDecrypt, "lenient-decrypt", false, "Decrypt segments with broken padding or unaligned length instead of failing")
+	f.BoolVar(&task.DropRemainder, "drop-remainder", false, "With --lenient-decrypt, drop the unaligned tail instead of keeping it")
+	f.StringVar(&task.KeyFile, "key-file", "", "AES-128 key file, or directory of key files named like the key URI")
+	f.StringArrayVar(&keyHeaders, "key-header", nil, "HTTP header for key requests, optionally per host or host:port as host=Name: Value")
+	f.StringVar(&task.KeyMethod, "key-method", "GET", "HTTP method for key requests")
+	f.StringVar(&task.KeyBody, "key-body", "", "Request body for key requests")
+	f.StringVar(&task.KeyJSONField, "key-json-field", "", "JSON field holding the key in key server responses (default \"key\")")
+
+	// Time range
+	f.StringVar(&task.Start, "start", "", "Download from this media time (seconds, mm:ss or HH:mm:ss)")
+	f.StringVar(&task.End, "end", "", "Download up to this media time (seconds, mm:ss or HH:mm:ss)")
+	f.StringVar(&task.FromTime, "from-time", "", "Download from this wall-clock time (RFC 3339), using program date times")
+	f.StringVar(&task.ToTime, "to-time", "", "Download up to this wall-clock time (RFC 3339)")
+	f.BoolVar(&task.PreciseCut, "precise-cut", false, "Re-encode to cut exactly at the requested range instead of segment boundaries (needs ffmpeg)")
 
 	// Live
 	f.BoolVar(&task.Live, "live", false, "Force live mode")
 	f.StringVar(&task.LiveDuration, "live-duration", "", "Recording duration (HH:mm:ss)")
 	f.IntVar(&task.LiveWaitTime, "live-wait-time", 0, "Playlist refresh interval in seconds")
+	f.BoolVar(&task.LowLatency, "low-latency", false, "Use LL-HLS blocking reloads and partial segments when the server supports them")
 
 	// Output
 	f.StringVar(&task.LogLevel, "log-level", "info", "Log level (debug/info/warn/error)")
 	f.BoolVar(&task.NoLog, "no-log", false, "Disable logging")
 
+	infoCmd := &cobra.Command{
+		Use:   "info [url]",
+		Short: "Print streams and DRM protection info without downloading",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			task.URL = args[0]
+			task.Headers = parseHeaders(headers)
+			return runInfo(task)
+		},
+	}
+	infoCmd.Flags().StringArrayVarP(&headers, "header", "H", nil, "Custom HTTP header (can be specified multiple times)")
+	rootCmd.AddCommand(infoCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
-func run(task *model.Task) error {
-	// Detect stream type and select parser
-	var p parser.Parser
-	switch parser.DetectType(task.URL) {
+// newParser detects the stream type, probing the URL when its extension
+// does not tell, and selects a parser. Detection and parsing go through
+// --proxy with --timeout.
+func newParser(ctx context.Context, task *model.Task) (parser.Parser, error) {
+	client := downloader.NewClient(task.Proxy, task.Timeout)
+	kind, err := parser.Detect(ctx, client, task.URL, task.Headers)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
 	case parser.StreamDASH:
-		p = &dash.Parser{}
+		return &dash.Parser{
+			Client:      client,
+			Strict:      task.Strict,
+			SkipPeriods: dash.SkipPeriods{IDs: task.SkipPeriods, MaxDuration: task.SkipPeriodsUnder},
+		}, nil
+	case parser.StreamHLS, parser.StreamUnknown:
+		// Unrecognized content is left to the HLS parser to report
+		return &hls.Parser{Client: client, Lazy: task.LazyPlaylists, Strict: task.Strict}, nil
 	default:
-		p = &hls.Parser{}
+		return nil, fmt.Errorf("unsupported stream type %s", kind)
+	}
+}
+
+func run(task *model.Task) error {
+	ctx := context.Background()
+	p, err := newParser(ctx, task)
+	if err != nil {
+		return err
 	}
 
 	var logFunc func(string, ...any)
@@ -107,20 +171,19 @@ func run(task *model.Task) error {
 	}
 
 	pipe := &pipeline.Pipeline{
-		Parser:     p,
-		Downloader: &downloader.HTTPDownloader{},
-		Decryptor:  &crypto.AES128Decryptor{},
-		OnLog:      logFunc,
+		Parser:        p,
+		Downloader:    &downloader.HTTPDownloader{},
+		Decryptor:     &crypto.AES128Decryptor{Lenient: task.LenientDecrypt, DropRemainder: task.DropRemainder},
+		CENCDecryptor: &crypto.CENCDecryptor{},
+		OnLog:         logFunc,
 	}
 
-	ctx := context.Background()
-
 	fmt.Printf("Downloading: %s\n", task.URL)
 	if task.SaveName != "" {
 		fmt.Printf("Save as: %s\n", task.SaveName)
 	}
 
-	err := pipe.Run(ctx, task, func(e model.ProgressEvent) {
+	err = pipe.Run(ctx, task, func(e model.ProgressEvent) {
 		fmt.Printf("\r[%d/%d] %.1f%% | %s",
 			e.CompletedSegments, e.TotalSegments, e.Percent, formatSpeed(e.Speed))
 	})
@@ -132,6 +195,162 @@ func run(task *model.Task) error {
 	return nil
 }
 
+func runInfo(task *model.Task) error {
+	ctx := context.Background()
+	p, err := newParser(ctx, task)
+	if err != nil {
+		return err
+	}
+
+	pipe := &pipeline.Pipeline{
+		Parser: p,
+		OnLog: func(format string, args ...any) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		},
+	}
+
+	result, err := pipe.Inspect(ctx, task)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Redirects) > 0 {
+		fmt.Printf("Redirected: %s -> %s\n", strings.Join(result.Redirects, " -> "), result.URL)
+	}
+	fmt.Printf("Streams: %d (live: %v)\n", len(result.Streams), result.IsLive)
+	for i, s := range result.Streams {
+		line := fmt.Sprintf("[%d] %s", i, s.MediaType)
+		if s.Resolution != "" {
+			line += " " + s.Resolution
+		}
+		if s.Language != "" {
+			line += " lang=" + s.Language
+		}
+		line += fmt.Sprintf(" bandwidth=%d", s.Bandwidth)
+		if s.Codecs != "" {
+			line += " codecs=" + s.Codecs
+		}
+		if s.Playlist != nil {
+			line += fmt.Sprintf(" segments=%d", len(s.Playlist.Segments))
+		}
+		if len(s.Mirrors) > 0 {
+			line += fmt.Sprintf(" mirrors=%d", len(s.Mirrors))
+		}
+		if s.MediaType != model.MediaVideo && s.GroupID != "" {
+			line += " group=" + s.GroupID
+		}
+		if s.Default {
+			line += " default"
+		}
+		for _, g := range []struct{ name, id string }{{"audio", s.AudioGroup}, {"subtitles", s.SubtitleGroup}, {"cc", s.CaptionGroup}} {
+			if g.id != "" {
+				line += fmt.Sprintf(" %s=%s", g.name, g.id)
+			}
+		}
+		fmt.Println(line)
+
+		for _, prot := range s.Protections {
+			fmt.Printf("    protection:%s\n", formatProtection(prot))
+		}
+		if s.Playlist != nil {
+			for _, m := range s.Playlist.Markers {
+				fmt.Printf("    ad break:%s\n", formatMarker(m))
+			}
+		}
+	}
+	for _, sd := range result.SessionData {
+		line := "Session data: " + sd.ID
+		if sd.Language != "" {
+			line += " lang=" + sd.Language
+		}
+		if sd.URI != "" {
+			line += fmt.Sprintf(" uri=%s (%d bytes)", sd.URI, len(sd.JSON))
+		} else {
+			line += fmt.Sprintf(" value=%q", sd.Value)
+		}
+		fmt.Println(line)
+	}
+	for _, k := range result.SessionKeys {
+		method := "AES-128"
+		if k.Method == model.EncryptCENC {
+			method = "SAMPLE-AES"
+		}
+		fmt.Printf("Session key: %s %s\n", method, k.KeyURL)
+	}
+	if result.Start != nil {
+		fmt.Printf("Start: %gs (precise: %v)\n", result.Start.TimeOffset, result.Start.Precise)
+	}
+	if result.IndependentSegments {
+		fmt.Println("Independent segments: yes")
+	}
+	if cs := result.ContentSteering; cs != nil {
+		fmt.Printf("Content steering: %s", cs.ServerURI)
+		if cs.PathwayID != "" {
+			fmt.Printf(" pathway=%s", cs.PathwayID)
+		}
+		fmt.Println()
+	}
+	if len(result.Warnings) > 0 {
+		fmt.Printf("Warnings: %d\n", len(result.Warnings))
+		for _, w := range result.Warnings {
+			fmt.Printf("    %s\n", w)
+		}
+	}
+	return nil
+}
+
+// drmSystems names well-known DRM system IDs.
+var drmSystems = map[string]string{
+	"edef8ba9-79d6-4ace-a3c8-27dcd51d21ed": "Widevine",
+	"9a04f079-9840-4286-ab92-e65be0885f95": "PlayReady",
+	"94ce86fb-07ff-4f43-adb8-93d2fa968ca2": "FairPlay",
+	"e2719d58-a985-b3c9-781a-b030af78d30e": "ClearKey",
+	"1077efec-c0b2-4d02-ace3-3c1e52e2fb4b": "W3C Common",
+}
+
+// formatProtection formats a protection entry for the info output.
+func formatProtection(p model.Protection) string {
+	var b strings.Builder
+	if p.Scheme != "" {
+		fmt.Fprintf(&b, " scheme=%s", p.Scheme)
+	}
+	if p.SystemID != "" {
+		fmt.Fprintf(&b, " system=%s", p.SystemID)
+		if name := drmSystems[p.SystemID]; name != "" {
+			fmt.Fprintf(&b, " (%s)", name)
+		}
+	}
+	if p.KID != "" {
+		fmt.Fprintf(&b, " kid=%s", p.KID)
+	}
+	if len(p.PSSH) > 0 {
+		fmt.Fprintf(&b, " pssh=%s", base64.StdEncoding.EncodeToString(p.PSSH))
+	}
+	return b.String()
+}
+
+// formatMarker formats an ad break for info output.
+func formatMarker(m model.Marker) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, " %s", strings.TrimPrefix(m.Tag, "#"))
+	if m.ID != "" {
+		fmt.Fprintf(&b, " id=%s", m.ID)
+	}
+	if !m.StartDate.IsZero() {
+		fmt.Fprintf(&b, " start=%s", m.StartDate.UTC().Format(time.RFC3339Nano))
+	}
+	if m.Duration > 0 {
+		fmt.Fprintf(&b, " duration=%gs", m.Duration)
+	}
+	if m.FirstSegment >= 0 {
+		fmt.Fprintf(&b, " segments=%d-%d", m.FirstSegment, m.LastSegment)
+	}
+	if m.SCTE35Out != "" {
+		fmt.Fprintf(&b, " scte35-out=%s", m.SCTE35Out)
+	}
+	return b.String()
+}
+
 // parseHeaders converts ["Key: Value", ...] to map[string]string.
 func parseHeaders(raw []string) map[string]string {
 	if len(raw) == 0 {
@@ -147,6 +366,38 @@ func parseHeaders(raw []string) map[string]string {
 	return m
 }
 
+// parseKeyHeaders converts ["[host=]Key: Value", ...] to headers by host,
+// where host may carry a port. Headers without a host are stored under ""
+// and apply to every key request.
+func parseKeyHeaders(raw []string) map[string]map[string]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	m := make(map[string]map[string]string)
+	for _, h := range raw {
+		host := ""
+		if prefix, rest, ok := strings.Cut(h, "="); ok && isHost(strings.TrimSpace(prefix)) {
+			host, h = strings.TrimSpace(prefix), rest
+		}
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			continue
+		}
+		if m[host] == nil {
+			m[host] = make(map[string]string)
+		}
+		m[host][strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return m
+}
+
+// isHost reports whether s is a host name with an optional port, rather
+// than the start of a header whose value contains "=".
+func isHost(s string) bool {
+	u, err := url.Parse("//" + s)
+	return err == nil && s != "" && u.Host == s
+}
+
 // formatSpeed formats bytes/sec to human-readable string.
 func formatSpeed(bytesPerSec int64) string {
 	switch {
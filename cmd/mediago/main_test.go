@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+func TestNewParser_ProbesThroughProxy(t *testing.T) {
+	// The stream host is only reachable through the proxy
+	var (
+		mu      sync.Mutex
+		proxied []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	}))
+	defer proxy.Close()
+
+	task := &model.Task{URL: "http://stream.example/live?id=1", Proxy: proxy.URL, Timeout: 5}
+	p, err := newParser(context.Background(), task)
+	if err != nil {
+		t.Fatalf("newParser: %v", err)
+	}
+	hp, ok := p.(*hls.Parser)
+	if !ok {
+		t.Fatalf("parser = %T, want *hls.Parser", p)
+	}
+	if _, err := hp.Parse(context.Background(), task.URL, nil); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "[http://stream.example/live?id=1 http://stream.example/live?id=1]"; fmt.Sprint(proxied) != want {
+		t.Errorf("proxied requests = %v, want the probe and the parse", proxied)
+	}
+}
+
+func TestParseKeyHeaders(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"Authorization: Bearer x", `map[:map[Authorization:Bearer x]]`},
+		{"keys.example.com=Authorization: Bearer x", `map[keys.example.com:map[Authorization:Bearer x]]`},
+		{"example.com:8443=Authorization: Bearer x", `map[example.com:8443:map[Authorization:Bearer x]]`},
+		{"127.0.0.1:8080=X-Token:abc", `map[127.0.0.1:8080:map[X-Token:abc]]`},
+		// "=" in the value does not make a host
+		{"Authorization: Basic dXNlcjpwYXNz==", `map[:map[Authorization:Basic dXNlcjpwYXNz==]]`},
+		{"Cookie:a=b", `map[:map[Cookie:a=b]]`},
+		{"no colon", `map[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := fmt.Sprint(parseKeyHeaders([]string{tt.raw})); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
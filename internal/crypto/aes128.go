@@ -4,42 +4,101 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"fmt"
+	"strings"
 )
 
 // AES128Decryptor implements AES-128-CBC decryption for HLS segments.
-type AES128Decryptor struct{}
+type AES128Decryptor struct {
+	// Lenient decrypts segments that are not block-aligned or have invalid
+	// PKCS7 padding instead of failing; see DecryptReport.
+	Lenient bool
+	// DropRemainder discards the unaligned tail in lenient mode instead of
+	// keeping it as is.
+	DropRemainder bool
+}
+
+// Repair describes what lenient decryption had to fix in a segment.
+type Repair struct {
+	Remainder        int  // trailing bytes past the last full block
+	RemainderDropped bool // the remainder was dropped rather than kept
+	BadPadding       bool // PKCS7 padding was invalid and left in place
+}
+
+func (r *Repair) String() string {
+	var parts []string
+	if r.Remainder > 0 {
+		action := "kept"
+		if r.RemainderDropped {
+			action = "dropped"
+		}
+		parts = append(parts, fmt.Sprintf("%d unaligned bytes %s", r.Remainder, action))
+	}
+	if r.BadPadding {
+		parts = append(parts, "invalid padding not removed")
+	}
+	return strings.Join(parts, ", ")
+}
 
 // Decrypt decrypts data using AES-128-CBC with PKCS7 unpadding.
 func (d *AES128Decryptor) Decrypt(data []byte, key []byte, iv []byte) ([]byte, error) {
+	out, _, err := d.DecryptReport(data, key, iv)
+	return out, err
+}
+
+// DecryptReport is like Decrypt but also returns what was repaired in
+// lenient mode, or nil if the segment decrypted cleanly. In lenient mode
+// only the block-aligned prefix is decrypted, and unpadding is skipped
+// when the padding is invalid.
+func (d *AES128Decryptor) DecryptReport(data []byte, key []byte, iv []byte) ([]byte, *Repair, error) {
 	if len(key) != 16 {
-		return nil, fmt.Errorf("invalid key length: %d, expected 16", len(key))
+		return nil, nil, fmt.Errorf("invalid key length: %d, expected 16", len(key))
 	}
 	if len(iv) != 16 {
-		return nil, fmt.Errorf("invalid IV length: %d, expected 16", len(iv))
+		return nil, nil, fmt.Errorf("invalid IV length: %d, expected 16", len(iv))
 	}
 	if len(data) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
-	if len(data)%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("data length %d is not a multiple of block size %d", len(data), aes.BlockSize)
+
+	var repair Repair
+	if rem := len(data) % aes.BlockSize; rem != 0 {
+		if !d.Lenient {
+			return nil, nil, fmt.Errorf("data length %d is not a multiple of block size %d", len(data), aes.BlockSize)
+		}
+		repair.Remainder = rem
+		repair.RemainderDropped = d.DropRemainder
 	}
+	aligned := len(data) - repair.Remainder
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("create cipher: %w", err)
+		return nil, nil, fmt.Errorf("create cipher: %w", err)
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 
-	decrypted := make([]byte, len(data))
-	mode.CryptBlocks(decrypted, data)
+	decrypted := make([]byte, aligned)
+	mode.CryptBlocks(decrypted, data[:aligned])
 
-	decrypted, err = pkcs7Unpad(decrypted)
-	if err != nil {
-		return nil, fmt.Errorf("unpad: %w", err)
+	if aligned > 0 {
+		unpadded, err := pkcs7Unpad(decrypted)
+		switch {
+		case err == nil:
+			decrypted = unpadded
+		case d.Lenient:
+			repair.BadPadding = true
+		default:
+			return nil, nil, fmt.Errorf("unpad: %w", err)
+		}
 	}
 
-	return decrypted, nil
+	if repair.Remainder > 0 && !repair.RemainderDropped {
+		decrypted = append(decrypted, data[aligned:]...)
+	}
+	if repair == (Repair{}) {
+		return decrypted, nil, nil
+	}
+	return decrypted, &repair, nil
 }
 
 // pkcs7Unpad removes PKCS7 padding from decrypted data.
@@ -94,3 +94,72 @@ func TestAES128Decryptor_InvalidDataLength(t *testing.T) {
 		t.Error("expected error for non-block-aligned data")
 	}
 }
+
+func TestAES128Decryptor_LenientTrailingGarbage(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+	plaintext := []byte("segment payload with trailing garbage")
+	data := append(aesEncrypt(plaintext, key, iv), "junk"...)
+
+	if _, err := (&AES128Decryptor{}).Decrypt(data, key, iv); err == nil {
+		t.Fatal("expected strict mode to reject unaligned data")
+	}
+
+	out, repair, err := (&AES128Decryptor{Lenient: true}).DecryptReport(data, key, iv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != string(plaintext)+"junk" {
+		t.Errorf("kept remainder: got %q", out)
+	}
+	if repair == nil || repair.Remainder != 4 || repair.RemainderDropped || repair.BadPadding {
+		t.Errorf("unexpected repair: %+v", repair)
+	}
+
+	out, repair, err = (&AES128Decryptor{Lenient: true, DropRemainder: true}).DecryptReport(data, key, iv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != string(plaintext) {
+		t.Errorf("dropped remainder: got %q", out)
+	}
+	if repair == nil || !repair.RemainderDropped || repair.String() != "4 unaligned bytes dropped" {
+		t.Errorf("unexpected repair: %v", repair)
+	}
+}
+
+func TestAES128Decryptor_LenientNoPadding(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+	plaintext := []byte("exactly 32 bytes, no padding at!")
+
+	block, _ := aes.NewCipher(key)
+	data := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, plaintext)
+
+	if _, err := (&AES128Decryptor{}).Decrypt(data, key, iv); err == nil {
+		t.Fatal("expected strict mode to reject invalid padding")
+	}
+
+	out, repair, err := (&AES128Decryptor{Lenient: true}).DecryptReport(data, key, iv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != string(plaintext) {
+		t.Errorf("got %q", out)
+	}
+	if repair == nil || !repair.BadPadding || repair.Remainder != 0 {
+		t.Errorf("unexpected repair: %+v", repair)
+	}
+}
+
+func TestAES128Decryptor_LenientCleanSegment(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+	data := aesEncrypt([]byte("clean"), key, iv)
+
+	out, repair, err := (&AES128Decryptor{Lenient: true}).DecryptReport(data, key, iv)
+	if err != nil || string(out) != "clean" || repair != nil {
+		t.Errorf("got %q, %+v, %v", out, repair, err)
+	}
+}
@@ -0,0 +1,408 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/caorushizi/mediago-core/internal/mp4"
+)
+
+// KeyMap maps lower-case hex KIDs to 16-byte content keys. A key given
+// without a KID is stored under "" and used for any KID without its own entry.
+type KeyMap map[string][]byte
+
+// ParseKeys parses keys in "KID:KEY" or "KEY" form, both in HEX.
+func ParseKeys(raw []string) (KeyMap, error) {
+	keys := make(KeyMap, len(raw))
+	for _, r := range raw {
+		kid, key := "", strings.TrimSpace(r)
+		if idx := strings.Index(key, ":"); idx >= 0 {
+			kid, key = normalizeHex(key[:idx]), key[idx+1:]
+			if b, err := hex.DecodeString(kid); err != nil || len(b) != 16 {
+				return nil, fmt.Errorf("invalid KID in %q: expected 32 hex characters", r)
+			}
+		}
+		b, err := hex.DecodeString(normalizeHex(key))
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid key in %q: expected 32 hex characters", r)
+		}
+		keys[kid] = b
+	}
+	return keys, nil
+}
+
+func normalizeHex(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	return strings.ToLower(strings.ReplaceAll(s, "-", ""))
+}
+
+// Lookup returns the key for a KID, falling back to the KID-less key.
+func (k KeyMap) Lookup(kid []byte) ([]byte, bool) {
+	if key, ok := k[hex.EncodeToString(kid)]; ok {
+		return key, true
+	}
+	key, ok := k[""]
+	return key, ok
+}
+
+// CENCTrack describes how one track of a protected fMP4 is encrypted.
+type CENCTrack struct {
+	TrackID           uint32
+	Scheme            string // "cenc" or "cbcs"
+	KID               []byte
+	IVSize            int
+	ConstantIV        []byte
+	CryptByteBlock    int
+	SkipByteBlock     int
+	DefaultSampleSize uint32 // from trex, used when fragments omit sizes
+}
+
+// CENCInfo holds the protection info read from an init segment.
+type CENCInfo struct {
+	Tracks map[uint32]*CENCTrack
+}
+
+// Scheme returns the protection scheme of the first protected track.
+func (c *CENCInfo) Scheme() string {
+	for _, t := range c.Tracks {
+		return t.Scheme
+	}
+	return ""
+}
+
+// CENCDecryptor decrypts Common Encryption (ISO/IEC 23001-7) protected
+// fragmented MP4 using the cenc (AES-CTR) and cbcs (AES-CBC pattern) schemes.
+type CENCDecryptor struct{}
+
+// DecryptInit reads the protection info of an init segment and returns a
+// copy with sinf and pssh boxes removed and encrypted sample entries
+// restored to their original format. info is nil when nothing is protected,
+// in which case the input is returned unchanged.
+func (d *CENCDecryptor) DecryptInit(data []byte) ([]byte, *CENCInfo, error) {
+	buf := append([]byte(nil), data...)
+	boxes, err := mp4.ReadBoxes(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read init segment: %w", err)
+	}
+	moov := mp4.Find(boxes, "moov")
+	if moov == nil {
+		return data, nil, nil
+	}
+
+	defaults := make(map[uint32]*mp4.Trex)
+	if mvex := moov.Child("mvex"); mvex != nil {
+		for _, b := range mvex.ChildrenOf("trex") {
+			trex, err := mp4.ParseTrex(b.Payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			defaults[trex.TrackID] = trex
+		}
+	}
+
+	info := &CENCInfo{Tracks: make(map[uint32]*CENCTrack)}
+	for _, trak := range moov.ChildrenOf("trak") {
+		tkhdBox := trak.Child("tkhd")
+		stsd := trak.Find("mdia", "minf", "stbl", "stsd")
+		if tkhdBox == nil || stsd == nil {
+			continue
+		}
+		tkhd, err := mp4.ParseTkhd(tkhdBox.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, entry := range stsd.Children {
+			if entry.Type != "encv" && entry.Type != "enca" {
+				continue
+			}
+			track, err := parseSinf(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("track %d: %w", tkhd.TrackID, err)
+			}
+			track.TrackID = tkhd.TrackID
+			if trex := defaults[tkhd.TrackID]; trex != nil {
+				track.DefaultSampleSize = trex.DefaultSampleSize
+			}
+			info.Tracks[tkhd.TrackID] = track
+		}
+	}
+
+	if len(info.Tracks) == 0 {
+		return data, nil, nil
+	}
+
+	moov.Children = removeBoxes(moov.Children, "pssh")
+	return mp4.Marshal(boxes), info, nil
+}
+
+// parseSinf reads the protection scheme of an encrypted sample entry and
+// rewrites the entry in place to its original format without the sinf box.
+func parseSinf(entry *mp4.Box) (*CENCTrack, error) {
+	sinf := entry.Child("sinf")
+	if sinf == nil {
+		return nil, fmt.Errorf("%s without sinf", entry.Type)
+	}
+	frma := sinf.Child("frma")
+	schm := sinf.Child("schm")
+	tencBox := sinf.Find("schi", "tenc")
+	if frma == nil || len(frma.Payload) < 4 || schm == nil || len(schm.Payload) < 8 || tencBox == nil {
+		return nil, fmt.Errorf("incomplete sinf in %s", entry.Type)
+	}
+
+	scheme := string(schm.Payload[4:8])
+	if scheme != "cenc" && scheme != "cbcs" {
+		return nil, fmt.Errorf("unsupported protection scheme %q", scheme)
+	}
+	tenc, err := mp4.ParseTenc(tencBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Type = string(frma.Payload[:4])
+	entry.Children = removeBoxes(entry.Children, "sinf")
+
+	return &CENCTrack{
+		Scheme:         scheme,
+		KID:            tenc.KID,
+		IVSize:         int(tenc.PerSampleIVSize),
+		ConstantIV:     tenc.ConstantIV,
+		CryptByteBlock: int(tenc.CryptByteBlock),
+		SkipByteBlock:  int(tenc.SkipByteBlock),
+	}, nil
+}
+
+func removeBoxes(boxes []*mp4.Box, typ string) []*mp4.Box {
+	out := boxes[:0:0]
+	for _, b := range boxes {
+		if b.Type != typ {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// DecryptSegment decrypts every protected sample of a media segment. The
+// segment layout is unchanged; only sample data is rewritten.
+func (d *CENCDecryptor) DecryptSegment(data []byte, info *CENCInfo, keys KeyMap) ([]byte, error) {
+	if info == nil || len(info.Tracks) == 0 {
+		return data, nil
+	}
+	buf := append([]byte(nil), data...)
+	boxes, err := mp4.ReadBoxes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read segment: %w", err)
+	}
+
+	ciphers := make(map[string]cipher.Block)
+	for _, moof := range boxes {
+		if moof.Type != "moof" {
+			continue
+		}
+		if err := decryptFragment(buf, moof, info, keys, ciphers); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// sampleRange is the byte range of one sample in the segment buffer.
+type sampleRange struct {
+	start, end int
+}
+
+func decryptFragment(buf []byte, moof *mp4.Box, info *CENCInfo, keys KeyMap, ciphers map[string]cipher.Block) error {
+	// Without explicit base offsets, the first traf's data starts relative to
+	// the moof and each following traf continues where the previous ended.
+	nextBase := moof.Offset
+
+	for _, traf := range moof.ChildrenOf("traf") {
+		tfhdBox := traf.Child("tfhd")
+		if tfhdBox == nil {
+			return fmt.Errorf("traf without tfhd")
+		}
+		tfhd, err := mp4.ParseTfhd(tfhdBox.Payload)
+		if err != nil {
+			return err
+		}
+		track := info.Tracks[tfhd.TrackID]
+
+		base := nextBase
+		switch {
+		case tfhd.HasBaseDataOffset:
+			base = int(tfhd.BaseDataOffset)
+		case tfhd.DefaultBaseIsMoof:
+			base = moof.Offset
+		}
+
+		defaultSize := tfhd.DefaultSampleSize
+		if defaultSize == 0 && track != nil {
+			defaultSize = track.DefaultSampleSize
+		}
+
+		var samples []sampleRange
+		pos := base
+		for _, trunBox := range traf.ChildrenOf("trun") {
+			trun, err := mp4.ParseTrun(trunBox.Payload)
+			if err != nil {
+				return err
+			}
+			if trun.HasDataOffset {
+				pos = base + int(trun.DataOffset)
+			}
+			for i := 0; i < int(trun.SampleCount); i++ {
+				size := int(defaultSize)
+				if trun.SampleSizes != nil {
+					size = int(trun.SampleSizes[i])
+				}
+				samples = append(samples, sampleRange{pos, pos + size})
+				pos += size
+			}
+		}
+		nextBase = pos
+
+		if track == nil || len(samples) == 0 {
+			continue
+		}
+		if pos > len(buf) || pos < 0 {
+			return fmt.Errorf("track %d: sample data exceeds segment size", tfhd.TrackID)
+		}
+
+		aux, err := readSampleAuxInfo(buf, traf, base, track, len(samples))
+		if err != nil {
+			return fmt.Errorf("track %d: %w", tfhd.TrackID, err)
+		}
+
+		kid := hex.EncodeToString(track.KID)
+		block := ciphers[kid]
+		if block == nil {
+			key, ok := keys.Lookup(track.KID)
+			if !ok {
+				return fmt.Errorf("no key for KID %s", kid)
+			}
+			if block, err = aes.NewCipher(key); err != nil {
+				return fmt.Errorf("create cipher: %w", err)
+			}
+			ciphers[kid] = block
+		}
+
+		for i, s := range samples {
+			if err := decryptSample(buf[s.start:s.end], track, aux[i], block); err != nil {
+				return fmt.Errorf("track %d sample %d: %w", tfhd.TrackID, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readSampleAuxInfo returns per-sample IVs and subsamples from senc, or from
+// the data referenced by saiz/saio when there is no senc box.
+func readSampleAuxInfo(buf []byte, traf *mp4.Box, base int, track *CENCTrack, count int) ([]mp4.SampleAuxInfo, error) {
+	var aux []mp4.SampleAuxInfo
+
+	if senc := traf.Child("senc"); senc != nil {
+		var err error
+		if aux, err = mp4.ParseSenc(senc.Payload, track.IVSize); err != nil {
+			return nil, err
+		}
+	} else if saizBox, saioBox := traf.Child("saiz"), traf.Child("saio"); saizBox != nil && saioBox != nil {
+		saiz, err := mp4.ParseSaiz(saizBox.Payload)
+		if err != nil {
+			return nil, err
+		}
+		offsets, err := mp4.ParseSaio(saioBox.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(offsets) == 0 {
+			return nil, fmt.Errorf("saio without offsets")
+		}
+		pos := base + int(offsets[0])
+		for i := 0; i < int(saiz.SampleCount); i++ {
+			if len(offsets) == int(saiz.SampleCount) {
+				pos = base + int(offsets[i])
+			}
+			size := saiz.Size(i)
+			if pos < 0 || pos+size > len(buf) {
+				return nil, fmt.Errorf("aux info for sample %d out of range", i)
+			}
+			info, err := mp4.ParseAuxInfo(buf[pos:pos+size], track.IVSize)
+			if err != nil {
+				return nil, err
+			}
+			aux = append(aux, info)
+			pos += size
+		}
+	} else {
+		return nil, fmt.Errorf("no sample encryption info (senc or saiz/saio)")
+	}
+
+	if len(aux) < count {
+		return nil, fmt.Errorf("encryption info for %d samples, fragment has %d", len(aux), count)
+	}
+	return aux, nil
+}
+
+// decryptSample decrypts one sample in place.
+func decryptSample(sample []byte, track *CENCTrack, aux mp4.SampleAuxInfo, block cipher.Block) error {
+	iv := aux.IV
+	if len(iv) == 0 {
+		iv = track.ConstantIV
+	}
+	if len(iv) == 8 {
+		iv = append(append([]byte(nil), iv...), make([]byte, 8)...)
+	}
+	if len(iv) != aes.BlockSize {
+		return fmt.Errorf("invalid IV length: %d", len(iv))
+	}
+
+	subsamples := aux.Subsamples
+	if len(subsamples) == 0 {
+		subsamples = []mp4.Subsample{{Protected: uint32(len(sample))}}
+	}
+
+	// cenc runs one CTR keystream across all protected ranges of a sample;
+	// cbcs restarts CBC with the same IV at each subsample.
+	var ctr cipher.Stream
+	if track.Scheme == "cenc" {
+		ctr = cipher.NewCTR(block, iv)
+	}
+
+	pos := 0
+	for _, sub := range subsamples {
+		pos += int(sub.Clear)
+		end := pos + int(sub.Protected)
+		if end > len(sample) {
+			return fmt.Errorf("subsample exceeds sample size %d", len(sample))
+		}
+		if ctr != nil {
+			ctr.XORKeyStream(sample[pos:end], sample[pos:end])
+		} else {
+			decryptPattern(sample[pos:end], block, iv, track.CryptByteBlock, track.SkipByteBlock)
+		}
+		pos = end
+	}
+	return nil
+}
+
+// decryptPattern decrypts a cbcs protected range: crypt blocks of every
+// crypt+skip are encrypted, and a trailing partial block is left in the clear.
+// A 0:0 pattern means every full block is encrypted.
+func decryptPattern(data []byte, block cipher.Block, iv []byte, crypt, skip int) {
+	if crypt == 0 && skip == 0 {
+		crypt = 1
+	}
+	mode := cipher.NewCBCDecrypter(block, iv)
+	for pos := 0; len(data)-pos >= aes.BlockSize; {
+		n := crypt * aes.BlockSize
+		if avail := (len(data) - pos) / aes.BlockSize * aes.BlockSize; n > avail {
+			n = avail
+		}
+		mode.CryptBlocks(data[pos:pos+n], data[pos:pos+n])
+		pos += n + skip*aes.BlockSize
+	}
+}
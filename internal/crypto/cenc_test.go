@@ -0,0 +1,299 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/mp4"
+)
+
+var (
+	testKID = []byte("kid-0123456789ab")
+	testKey = []byte("key-0123456789ab")
+)
+
+func box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], typ)
+	return append(out, body...)
+}
+
+func u8(v uint8) []byte { return []byte{v} }
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// buildInit builds a minimal protected init segment with one video track.
+func buildInit(scheme string, tencBody []byte) []byte {
+	encv := box("encv",
+		make([]byte, 78),
+		box("avcC", []byte{1, 2, 3}),
+		box("sinf",
+			box("frma", []byte("avc1")),
+			box("schm", u32(0), []byte(scheme), u32(0x10000)),
+			box("schi", box("tenc", tencBody)),
+		),
+	)
+	tkhd := box("tkhd", u32(0), u32(0), u32(0), u32(1), make([]byte, 68))
+	trak := box("trak", tkhd,
+		box("mdia", box("minf", box("stbl", box("stsd", u32(0), u32(1), encv)))))
+	mvex := box("mvex", box("trex", u32(0), u32(1), u32(1), u32(0), u32(0), u32(0)))
+	pssh := box("pssh", u32(0), make([]byte, 16), u32(0))
+	return append(box("ftyp", []byte("iso6"), u32(0)), box("moov", trak, mvex, pssh)...)
+}
+
+func cencTenc() []byte {
+	return bytes.Join([][]byte{u32(0), u8(0), u8(0), u8(1), u8(8), testKID}, nil)
+}
+
+func cbcsTenc(constantIV []byte) []byte {
+	return bytes.Join([][]byte{u32(1 << 24), u8(0), u8(1<<4 | 9), u8(1), u8(0), testKID, u8(uint8(len(constantIV))), constantIV}, nil)
+}
+
+// buildSegment builds a moof+mdat with the given samples and aux info boxes.
+// trafExtra is appended to traf after trun (senc, or saiz/saio).
+func buildSegment(samples [][]byte, trafExtra func(moofSize int) []byte) []byte {
+	build := func(dataOffset uint32, moofSize int) []byte {
+		trun := [][]byte{u32(0x201), u32(uint32(len(samples))), u32(dataOffset)}
+		for _, s := range samples {
+			trun = append(trun, u32(uint32(len(s))))
+		}
+		return box("moof",
+			box("mfhd", u32(0), u32(1)),
+			box("traf",
+				box("tfhd", u32(0x20000), u32(1)),
+				box("trun", trun...),
+				trafExtra(moofSize),
+			),
+		)
+	}
+	moofSize := len(build(0, 0))
+	moof := build(uint32(moofSize+8), moofSize)
+	return append(moof, box("mdat", samples...)...)
+}
+
+func sencBox(ivs [][]byte, subsamples [][]mp4.Subsample) []byte {
+	flags := uint32(0)
+	if subsamples != nil {
+		flags = 2
+	}
+	parts := [][]byte{u32(flags), u32(uint32(len(ivs)))}
+	for i, iv := range ivs {
+		parts = append(parts, iv)
+		if subsamples != nil {
+			parts = append(parts, u16(uint16(len(subsamples[i]))))
+			for _, s := range subsamples[i] {
+				parts = append(parts, u16(uint16(s.Clear)), u32(s.Protected))
+			}
+		}
+	}
+	return box("senc", parts...)
+}
+
+func ctrEncrypt(plain, iv []byte, subs []mp4.Subsample) []byte {
+	block, _ := aes.NewCipher(testKey)
+	full := append(append([]byte(nil), iv...), make([]byte, 16-len(iv))...)
+	stream := cipher.NewCTR(block, full)
+	out := append([]byte(nil), plain...)
+	pos := 0
+	for _, s := range subs {
+		pos += int(s.Clear)
+		stream.XORKeyStream(out[pos:pos+int(s.Protected)], out[pos:pos+int(s.Protected)])
+		pos += int(s.Protected)
+	}
+	return out
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys([]string{
+		hex.EncodeToString(testKID) + ":" + hex.EncodeToString(testKey),
+		"00112233445566778899aabbccddeeff",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, ok := keys.Lookup(testKID); !ok || !bytes.Equal(got, testKey) {
+		t.Errorf("KID lookup: got %x", got)
+	}
+	if got, ok := keys.Lookup(make([]byte, 16)); !ok || hex.EncodeToString(got) != "00112233445566778899aabbccddeeff" {
+		t.Errorf("fallback lookup: got %x", got)
+	}
+
+	for _, bad := range []string{"abcd", "zz:00112233445566778899aabbccddeeff", "00112233445566778899aabbccddeeff:12"} {
+		if _, err := ParseKeys([]string{bad}); err == nil {
+			t.Errorf("ParseKeys(%q): expected error", bad)
+		}
+	}
+}
+
+func TestCENCDecryptor_DecryptInit(t *testing.T) {
+	d := &CENCDecryptor{}
+	clear, info, err := d.DecryptInit(buildInit("cenc", cencTenc()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info == nil || info.Tracks[1] == nil {
+		t.Fatal("expected protection info for track 1")
+	}
+	track := info.Tracks[1]
+	if track.Scheme != "cenc" || track.IVSize != 8 || !bytes.Equal(track.KID, testKID) {
+		t.Errorf("unexpected track info: %+v", track)
+	}
+
+	boxes, err := mp4.ReadBoxes(clear)
+	if err != nil {
+		t.Fatalf("re-read init: %v", err)
+	}
+	var types []string
+	mp4.Walk(boxes, func(b *mp4.Box) { types = append(types, b.Type) })
+	for _, typ := range types {
+		if typ == "encv" || typ == "sinf" || typ == "pssh" {
+			t.Errorf("protection box %s left in init", typ)
+		}
+	}
+	if !bytes.Contains(clear, []byte("avc1")) || !bytes.Contains(clear, []byte("avcC")) {
+		t.Error("expected original sample entry avc1 with its avcC")
+	}
+}
+
+func TestCENCDecryptor_DecryptInit_Unprotected(t *testing.T) {
+	init := box("moov", box("trak", box("tkhd", u32(0), u32(0), u32(0), u32(1))))
+	out, info, err := (&CENCDecryptor{}).DecryptInit(init)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info != nil || !bytes.Equal(out, init) {
+		t.Error("expected unprotected init to be returned unchanged")
+	}
+}
+
+func TestCENCDecryptor_CENCSubsamples(t *testing.T) {
+	d := &CENCDecryptor{}
+	_, info, err := d.DecryptInit(buildInit("cenc", cencTenc()))
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	plain := [][]byte{
+		bytes.Repeat([]byte("A"), 50),
+		bytes.Repeat([]byte("B"), 37),
+	}
+	ivs := [][]byte{[]byte("iv000001"), []byte("iv000002")}
+	subs := [][]mp4.Subsample{
+		{{Clear: 5, Protected: 20}, {Clear: 3, Protected: 22}},
+		{{Clear: 0, Protected: 37}},
+	}
+	enc := [][]byte{ctrEncrypt(plain[0], ivs[0], subs[0]), ctrEncrypt(plain[1], ivs[1], subs[1])}
+
+	seg := buildSegment(enc, func(int) []byte { return sencBox(ivs, subs) })
+	out, err := d.DecryptSegment(seg, info, KeyMap{hex.EncodeToString(testKID): testKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != len(seg) {
+		t.Fatalf("segment size changed: %d -> %d", len(seg), len(out))
+	}
+	if !bytes.HasSuffix(out, append(append([]byte(nil), plain[0]...), plain[1]...)) {
+		t.Error("decrypted samples mismatch")
+	}
+}
+
+func TestCENCDecryptor_CBCSPattern(t *testing.T) {
+	constantIV := []byte("constant-iv-0123")
+	d := &CENCDecryptor{}
+	_, info, err := d.DecryptInit(buildInit("cbcs", cbcsTenc(constantIV)))
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	// 10 clear bytes, then 12 blocks + 5 trailing bytes protected with 1:9
+	plain := bytes.Repeat([]byte("0123456789abcdef"), 13)[:10+12*16+5]
+	enc := append([]byte(nil), plain...)
+	block, _ := aes.NewCipher(testKey)
+	mode := cipher.NewCBCEncrypter(block, constantIV)
+	protected := enc[10:]
+	mode.CryptBlocks(protected[0:16], protected[0:16])
+	mode.CryptBlocks(protected[160:176], protected[160:176])
+
+	subs := [][]mp4.Subsample{{{Clear: 10, Protected: uint32(len(protected))}}}
+	senc := func(int) []byte { return sencBox([][]byte{nil}, subs) }
+	seg := buildSegment([][]byte{enc}, senc)
+
+	out, err := d.DecryptSegment(seg, info, KeyMap{"": testKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.HasSuffix(out, plain) {
+		t.Error("decrypted sample mismatch")
+	}
+}
+
+func TestCENCDecryptor_SaizSaio(t *testing.T) {
+	d := &CENCDecryptor{}
+	_, info, err := d.DecryptInit(buildInit("cenc", cencTenc()))
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	plain := []byte("full-sample-encryption-without-subsamples")
+	iv := []byte("iv000009")
+	enc := ctrEncrypt(plain, iv, []mp4.Subsample{{Protected: uint32(len(plain))}})
+
+	// Aux info (the bare IV) is stored in the mdat right after the sample.
+	samples := [][]byte{enc, iv}
+	seg := buildSegment(samples[:1], func(moofSize int) []byte {
+		return append(
+			box("saiz", u32(0), u8(8), u32(1)),
+			box("saio", u32(0), u32(1), u32(uint32(moofSize+8+len(enc))))...,
+		)
+	})
+	seg = append(seg[:len(seg)-len(enc)-8], box("mdat", enc, iv)...)
+
+	out, err := d.DecryptSegment(seg, info, KeyMap{hex.EncodeToString(testKID): testKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(out, plain) {
+		t.Error("decrypted sample mismatch")
+	}
+}
+
+func TestCENCDecryptor_MissingKey(t *testing.T) {
+	d := &CENCDecryptor{}
+	_, info, _ := d.DecryptInit(buildInit("cenc", cencTenc()))
+	seg := buildSegment([][]byte{[]byte("data")}, func(int) []byte {
+		return sencBox([][]byte{[]byte("iv000001")}, nil)
+	})
+	if _, err := d.DecryptSegment(seg, info, KeyMap{}); err == nil {
+		t.Fatal("expected error when no key matches the KID")
+	}
+}
+
+func TestCENCDecryptor_UnsupportedScheme(t *testing.T) {
+	if _, _, err := (&CENCDecryptor{}).DecryptInit(buildInit("cens", cencTenc())); err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
+
+func TestInitProtections(t *testing.T) {
+	prots, err := InitProtections(buildInit("cbcs", cbcsTenc([]byte("constant-iv-0123"))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prots) != 2 {
+		t.Fatalf("expected tenc and pssh entries, got %d", len(prots))
+	}
+	if prots[0].Scheme != "cbcs" || prots[0].KID != hex.EncodeToString(testKID) {
+		t.Errorf("unexpected tenc entry: %+v", prots[0])
+	}
+	if prots[1].SystemID != "00000000-0000-0000-0000-000000000000" || len(prots[1].PSSH) != 32 {
+		t.Errorf("unexpected pssh entry: %+v", prots[1])
+	}
+}
@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrKeyNotHandled is returned by a KeyProvider that does not serve the
+// given key URI, so a KeyChain moves on to the next provider.
+var ErrKeyNotHandled = errors.New("key URI not handled by provider")
+
+// KeyProvider resolves an HLS key URI to a 16-byte AES key.
+type KeyProvider interface {
+	FetchKey(ctx context.Context, keyURL string) ([]byte, error)
+}
+
+// KeyChain tries each provider in order and returns the first key found.
+type KeyChain []KeyProvider
+
+// FetchKey implements KeyProvider.
+func (c KeyChain) FetchKey(ctx context.Context, keyURL string) ([]byte, error) {
+	for _, p := range c {
+		key, err := p.FetchKey(ctx, keyURL)
+		if errors.Is(err, ErrKeyNotHandled) {
+			continue
+		}
+		return key, err
+	}
+	return nil, fmt.Errorf("no key provider for %s", keyURL)
+}
+
+// DataURIKeyProvider decodes keys embedded as data: URIs in #EXT-X-KEY.
+type DataURIKeyProvider struct {
+	JSONField string
+}
+
+// FetchKey implements KeyProvider.
+func (p *DataURIKeyProvider) FetchKey(_ context.Context, keyURL string) ([]byte, error) {
+	if !strings.HasPrefix(keyURL, "data:") {
+		return nil, ErrKeyNotHandled
+	}
+	idx := strings.Index(keyURL, ",")
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed data URI key")
+	}
+	meta, payload := keyURL[len("data:"):idx], keyURL[idx+1:]
+
+	var raw []byte
+	if strings.HasSuffix(meta, ";base64") {
+		b, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, fmt.Errorf("decode data URI key: %w", err)
+		}
+		raw = b
+	} else {
+		s, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, fmt.Errorf("decode data URI key: %w", err)
+		}
+		raw = []byte(s)
+	}
+	return DecodeKey(raw, p.JSONField)
+}
+
+// FileKeyProvider reads keys from local disk. If Path is a file, it is used
+// for every key; if it is a directory, the key is read from the file named
+// after the last path element of the key URI.
+type FileKeyProvider struct {
+	Path      string
+	JSONField string
+}
+
+// FetchKey implements KeyProvider.
+func (p *FileKeyProvider) FetchKey(_ context.Context, keyURL string) ([]byte, error) {
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("key file: %w", err)
+	}
+
+	file := p.Path
+	if fi.IsDir() {
+		name := keyURL
+		if u, err := url.Parse(keyURL); err == nil && u.Path != "" {
+			name = u.Path
+		}
+		file = filepath.Join(p.Path, path.Base(name))
+		if _, err := os.Stat(file); err != nil {
+			// Fall through to the next provider, typically HTTP
+			return nil, ErrKeyNotHandled
+		}
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	key, err := DecodeKey(raw, p.JSONField)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", file, err)
+	}
+	return key, nil
+}
+
+// HTTPKeyProvider downloads keys from http(s) key servers.
+type HTTPKeyProvider struct {
+	Client  *http.Client
+	Headers map[string]string
+	// HostHeaders adds headers for requests to a specific key host,
+	// overriding Headers. A host with a port only matches that port and
+	// overrides the headers of the bare host.
+	HostHeaders map[string]map[string]string
+	// Method and Body allow key servers that expect a POST request.
+	Method    string
+	Body      string
+	JSONField string
+}
+
+// FetchKey implements KeyProvider.
+func (p *HTTPKeyProvider) FetchKey(ctx context.Context, keyURL string) ([]byte, error) {
+	u, err := url.Parse(keyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, ErrKeyNotHandled
+	}
+
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if p.Body != "" {
+		body = strings.NewReader(p.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, keyURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range p.HostHeaders[u.Hostname()] {
+		req.Header.Set(k, v)
+	}
+	if u.Host != u.Hostname() {
+		for k, v := range p.HostHeaders[u.Host] {
+			req.Header.Set(k, v)
+		}
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d fetching key", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read key response: %w", err)
+	}
+	return DecodeKey(raw, p.JSONField)
+}
+
+// DecodeKey turns a key server response into a 16-byte key. Raw 16-byte
+// bodies are used as is; otherwise the body is treated as hex or base64
+// text, or as a JSON object holding such text in jsonField (or in a "key"
+// field when jsonField is empty).
+func DecodeKey(raw []byte, jsonField string) ([]byte, error) {
+	if len(raw) == 16 && jsonField == "" {
+		return raw, nil
+	}
+
+	text := string(bytes.TrimSpace(raw))
+	if strings.HasPrefix(text, "{") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(text), &obj); err != nil {
+			return nil, fmt.Errorf("decode JSON key response: %w", err)
+		}
+		field := jsonField
+		if field == "" {
+			field = "key"
+		}
+		v, ok := obj[field].(string)
+		if !ok {
+			return nil, fmt.Errorf("JSON key response has no string field %q", field)
+		}
+		text = strings.TrimSpace(v)
+	}
+
+	if key, ok := decodeKeyText(text); ok {
+		return key, nil
+	}
+	if len(raw) == 16 {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("invalid key: got %d bytes (%q), want 16 raw bytes or 16 bytes as hex/base64", len(raw), truncate(text, 48))
+}
+
+// decodeKeyText decodes a hex or base64 key string.
+func decodeKeyText(s string) ([]byte, bool) {
+	hexStr := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(hexStr) == 32 {
+		if b, err := hex.DecodeString(hexStr); err == nil {
+			return b, true
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == 16 {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,236 @@
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var rawKey = []byte("0123456789abcdef")
+
+func TestDecodeKey(t *testing.T) {
+	hexKey := hex.EncodeToString(rawKey)
+	b64Key := base64.StdEncoding.EncodeToString(rawKey)
+
+	tests := []struct {
+		name  string
+		raw   string
+		field string
+	}{
+		{"raw bytes", string(rawKey), ""},
+		{"hex", hexKey + "\n", ""},
+		{"hex with 0x prefix", "0x" + hexKey, ""},
+		{"base64", b64Key, ""},
+		{"raw base64", strings.TrimRight(b64Key, "="), ""},
+		{"json default field", `{"key":"` + b64Key + `"}`, ""},
+		{"json custom field", `{"data":{"x":1},"k":"` + hexKey + `"}`, "k"},
+	}
+	for _, tt := range tests {
+		got, err := DecodeKey([]byte(tt.raw), tt.field)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if string(got) != string(rawKey) {
+			t.Errorf("%s: got %x", tt.name, got)
+		}
+	}
+}
+
+func TestDecodeKey_Invalid(t *testing.T) {
+	tests := map[string]struct {
+		raw, field, want string
+	}{
+		"short body":    {"key", "", "got 3 bytes"},
+		"short hex":     {"00112233", "", "want 16"},
+		"missing field": {`{"other":"x"}`, "", `no string field "key"`},
+		"bad json":      {`{"key":`, "", "decode JSON"},
+	}
+	for name, tt := range tests {
+		_, err := DecodeKey([]byte(tt.raw), tt.field)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tt.want, err)
+		}
+	}
+}
+
+func TestDataURIKeyProvider(t *testing.T) {
+	p := &DataURIKeyProvider{}
+	uris := []string{
+		"data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(rawKey),
+		"data:text/plain," + hex.EncodeToString(rawKey),
+	}
+	for _, uri := range uris {
+		got, err := p.FetchKey(context.Background(), uri)
+		if err != nil || string(got) != string(rawKey) {
+			t.Errorf("%s: got %x, %v", uri, got, err)
+		}
+	}
+
+	if _, err := p.FetchKey(context.Background(), "https://example.com/key"); err != ErrKeyNotHandled {
+		t.Errorf("expected ErrKeyNotHandled for http URI, got %v", err)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "key1.bin"), rawKey, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key2.txt"), []byte(hex.EncodeToString(rawKey)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directory: looked up by the key URI's last path element
+	p := &FileKeyProvider{Path: dir}
+	got, err := p.FetchKey(context.Background(), "https://example.com/keys/key1.bin?token=x")
+	if err != nil || string(got) != string(rawKey) {
+		t.Errorf("dir lookup: got %x, %v", got, err)
+	}
+	if _, err := p.FetchKey(context.Background(), "https://example.com/keys/other.bin"); err != ErrKeyNotHandled {
+		t.Errorf("expected ErrKeyNotHandled for missing file, got %v", err)
+	}
+
+	// Single file: used for every key
+	p = &FileKeyProvider{Path: filepath.Join(dir, "key2.txt")}
+	got, err = p.FetchKey(context.Background(), "https://example.com/anything")
+	if err != nil || string(got) != string(rawKey) {
+		t.Errorf("file lookup: got %x, %v", got, err)
+	}
+}
+
+func TestHTTPKeyProvider_Success(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(rawKey)
+	}))
+	defer server.Close()
+
+	got, err := (&HTTPKeyProvider{}).FetchKey(context.Background(), server.URL+"/key.bin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(rawKey) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestHTTPKeyProvider_HTTP404(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if _, err := (&HTTPKeyProvider{}).FetchKey(context.Background(), server.URL+"/key.bin"); err == nil {
+		t.Fatal("expected error for 404")
+	}
+}
+
+func TestHTTPKeyProvider_ServerDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	if _, err := (&HTTPKeyProvider{}).FetchKey(context.Background(), server.URL+"/key.bin"); err == nil {
+		t.Fatal("expected error when server is down")
+	}
+}
+
+func TestHTTPKeyProvider_HeadersAndPost(t *testing.T) {
+	var gotAuth, gotReferer, gotMethod, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotReferer = r.Header.Get("Referer")
+		gotMethod = r.Method
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.Write([]byte(`{"contentKey":"` + base64.StdEncoding.EncodeToString(rawKey) + `"}`))
+	}))
+	defer server.Close()
+
+	p := &HTTPKeyProvider{
+		Headers:     map[string]string{"Referer": "https://example.com", "Authorization": "Bearer task"},
+		HostHeaders: map[string]map[string]string{"127.0.0.1": {"Authorization": "Bearer key-server"}},
+		Method:      http.MethodPost,
+		Body:        `{"id":1}`,
+		JSONField:   "contentKey",
+	}
+	got, err := p.FetchKey(context.Background(), server.URL+"/key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(rawKey) {
+		t.Errorf("key mismatch: %x", got)
+	}
+	if gotAuth != "Bearer key-server" || gotReferer != "https://example.com" {
+		t.Errorf("headers: auth=%q referer=%q", gotAuth, gotReferer)
+	}
+	if gotMethod != http.MethodPost || gotBody != `{"id":1}` {
+		t.Errorf("request: %s %q", gotMethod, gotBody)
+	}
+}
+
+func TestHTTPKeyProvider_HostHeadersWithPort(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Write(rawKey)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name    string
+		headers map[string]map[string]string
+		want    string
+	}{
+		{"bare host", map[string]map[string]string{"127.0.0.1": {"Authorization": "host"}}, "host"},
+		{"host and port", map[string]map[string]string{"127.0.0.1": {"Authorization": "host"}, host: {"Authorization": "port"}}, "port"},
+		{"other port", map[string]map[string]string{"127.0.0.1:1": {"Authorization": "port"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotAuth = ""
+			p := &HTTPKeyProvider{HostHeaders: tt.headers}
+			if _, err := p.FetchKey(context.Background(), server.URL+"/key"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotAuth != tt.want {
+				t.Errorf("Authorization = %q, want %q", gotAuth, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyChain(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local.key"), rawKey, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(hex.EncodeToString(rawKey)))
+	}))
+	defer server.Close()
+
+	chain := KeyChain{&DataURIKeyProvider{}, &FileKeyProvider{Path: dir}, &HTTPKeyProvider{}}
+	for _, uri := range []string{server.URL + "/local.key", server.URL + "/remote.key"} {
+		got, err := chain.FetchKey(context.Background(), uri)
+		if err != nil || string(got) != string(rawKey) {
+			t.Errorf("%s: got %x, %v", uri, got, err)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected only the remote key to hit the server, got %d requests", hits)
+	}
+
+	if _, err := chain.FetchKey(context.Background(), "skd://key"); err == nil {
+		t.Error("expected error when no provider handles the URI")
+	}
+}
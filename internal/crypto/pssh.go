@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/mp4"
+)
+
+// InitProtections returns the protection info signalled inside an init
+// segment: one entry per pssh box and one per protected track's tenc.
+func InitProtections(data []byte) ([]model.Protection, error) {
+	boxes, err := mp4.ReadBoxes(data)
+	if err != nil {
+		return nil, fmt.Errorf("read init segment: %w", err)
+	}
+
+	var out []model.Protection
+	var walkErr error
+	mp4.Walk(boxes, func(b *mp4.Box) {
+		if walkErr != nil {
+			return
+		}
+		switch b.Type {
+		case "pssh":
+			raw := data[b.Offset : b.Offset+b.Size]
+			pssh, err := mp4.ParsePssh(raw)
+			if err != nil {
+				walkErr = err
+				return
+			}
+			out = append(out, model.Protection{
+				SystemID: pssh.SystemID,
+				KID:      pssh.KID(),
+				PSSH:     append([]byte(nil), raw...),
+			})
+		case "sinf":
+			schm, tencBox := b.Child("schm"), b.Find("schi", "tenc")
+			if tencBox == nil {
+				return
+			}
+			tenc, err := mp4.ParseTenc(tencBox.Payload)
+			if err != nil {
+				walkErr = err
+				return
+			}
+			p := model.Protection{KID: hex.EncodeToString(tenc.KID)}
+			if schm != nil && len(schm.Payload) >= 8 {
+				p.Scheme = string(schm.Payload[4:8])
+			}
+			out = append(out, p)
+		}
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	return out, nil
+}
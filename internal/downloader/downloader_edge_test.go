@@ -288,3 +288,18 @@ func TestBuildClient_NoProxy(t *testing.T) {
 		t.Fatal("expected non-nil client")
 	}
 }
+
+func TestNewClient(t *testing.T) {
+	client := NewClient("http://proxy.example.com:8080", 15)
+	if client.Timeout != 15*time.Second {
+		t.Errorf("timeout = %v", client.Timeout)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://cdn.example.com/seg.ts", nil)
+	proxy, err := client.Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example.com:8080" {
+		t.Errorf("proxy = %v, %v", proxy, err)
+	}
+	if client := NewClient("", 0); client.Timeout != 0 {
+		t.Errorf("timeout without limit = %v", client.Timeout)
+	}
+}
@@ -2,11 +2,13 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -211,3 +213,104 @@ func TestSegmentFilePath(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+func TestHTTPDownloader_SkipsGapSegments(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/gap.ts" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	segments := []model.Segment{
+		{Index: 0, URL: server.URL + "/seg0.ts"},
+		{Index: 1, URL: server.URL + "/gap.ts", Gap: true},
+		{Index: 2, URL: server.URL + "/seg2.ts"},
+	}
+
+	tmpDir := t.TempDir()
+	// Workers report progress concurrently, so the events may arrive out
+	// of order
+	var (
+		mu        sync.Mutex
+		lastEvent model.ProgressEvent
+	)
+	err := (&HTTPDownloader{}).Download(context.Background(), segments, Options{
+		TmpDir:      tmpDir,
+		ThreadCount: 2,
+		RetryCount:  1,
+	}, func(e model.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.CompletedSegments >= lastEvent.CompletedSegments {
+			lastEvent = e
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", requests.Load())
+	}
+	if _, err := os.Stat(SegmentFilePath(tmpDir, 1)); !os.IsNotExist(err) {
+		t.Error("gap segment must not leave a file")
+	}
+	if lastEvent.TotalSegments != 2 || lastEvent.Percent != 100 {
+		t.Errorf("progress: %+v", lastEvent)
+	}
+}
+
+func TestHTTPDownloader_MirrorFailover(t *testing.T) {
+	var primaryHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "mirror%s", r.URL.Path)
+	}))
+	defer mirror.Close()
+
+	var segments []model.Segment
+	for i := range 3 {
+		segments = append(segments, model.Segment{
+			Index:   i,
+			URL:     fmt.Sprintf("%s/seg%d.ts", primary.URL, i),
+			Mirrors: []string{fmt.Sprintf("%s/seg%d.ts", mirror.URL, i)},
+		})
+	}
+
+	tmpDir := t.TempDir()
+	dl := &HTTPDownloader{}
+	err := dl.Download(context.Background(), segments, Options{TmpDir: tmpDir, ThreadCount: 1}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := range segments {
+		data, _ := os.ReadFile(SegmentFilePath(tmpDir, i))
+		if want := fmt.Sprintf("mirror/seg%d.ts", i); string(data) != want {
+			t.Errorf("segment %d = %q, want %q", i, data, want)
+		}
+	}
+	// Later segments go to the working mirror first
+	if n := primaryHits.Load(); n != 1 {
+		t.Errorf("primary requested %d times, want 1", n)
+	}
+}
+
+func TestHTTPDownloader_SegmentError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	segments := []model.Segment{{Index: 7, URL: server.URL + "/seg7.ts", Mirrors: []string{server.URL + "/backup/seg7.ts"}}}
+	err := (&HTTPDownloader{}).Download(context.Background(), segments, Options{TmpDir: t.TempDir(), ThreadCount: 1}, nil)
+	var segErr *SegmentError
+	if !errors.As(err, &segErr) || segErr.Index != 7 {
+		t.Fatalf("err = %v, want *SegmentError for segment 7", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/caorushizi/mediago-core/internal/model"
 )
@@ -18,7 +19,21 @@ import (
 type HTTPDownloader struct {
 }
 
-// Download downloads all segments concurrently.
+// SegmentError is returned by Download when a segment could not be
+// fetched from its URL or any of its mirrors.
+type SegmentError struct {
+	Index int
+	URL   string
+	Err   error
+}
+
+func (e *SegmentError) Error() string { return e.Err.Error() }
+
+func (e *SegmentError) Unwrap() error { return e.Err }
+
+// Download downloads all segments concurrently. Gap segments are skipped
+// and leave no file behind. A segment that keeps failing is fetched from
+// its mirrors; once a mirror works, later segments try it first.
 func (d *HTTPDownloader) Download(ctx context.Context, segments []model.Segment, opts Options, onProgress func(model.ProgressEvent)) error {
 	if err := os.MkdirAll(opts.TmpDir, 0o755); err != nil {
 		return fmt.Errorf("create tmp dir: %w", err)
@@ -28,16 +43,25 @@ func (d *HTTPDownloader) Download(ctx context.Context, segments []model.Segment,
 	tracker := NewSpeedTracker()
 	defer tracker.Stop()
 
-	total := len(segments)
+	total := 0
+	for i := range segments {
+		if !segments[i].Gap {
+			total++
+		}
+	}
 	var completed atomic.Int32
 
 	// Semaphore for concurrency control
 	sem := make(chan struct{}, opts.ThreadCount)
 	var wg sync.WaitGroup
 	var firstErr atomic.Value
+	var source atomic.Int32 // preferred position in URL + Mirrors
 
 	for i := range segments {
 		seg := &segments[i]
+		if seg.Gap {
+			continue
+		}
 		wg.Add(1)
 
 		go func() {
@@ -57,11 +81,26 @@ func (d *HTTPDownloader) Download(ctx context.Context, segments []model.Segment,
 			}
 
 			outPath := SegmentFilePath(opts.TmpDir, seg.Index)
-			err := WithRetry(opts.RetryCount, func() error {
-				return d.downloadSegment(ctx, client, seg, outPath, opts.Headers, tracker)
-			})
+			urls := append([]string{seg.URL}, seg.Mirrors...)
+			start := int(source.Load()) % len(urls)
+			var err error
+			for i := range urls {
+				k := (start + i) % len(urls)
+				err = WithRetry(opts.RetryCount, func() error {
+					return d.downloadSegment(ctx, client, seg, urls[k], outPath, opts.Headers, tracker)
+				})
+				if err == nil {
+					if k != start {
+						source.Store(int32(k))
+					}
+					break
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
 			if err != nil {
-				firstErr.CompareAndSwap(nil, err)
+				firstErr.CompareAndSwap(nil, &SegmentError{Index: seg.Index, URL: seg.URL, Err: err})
 				return
 			}
 
@@ -85,9 +124,9 @@ func (d *HTTPDownloader) Download(ctx context.Context, segments []model.Segment,
 	return nil
 }
 
-// downloadSegment downloads a single segment to a file.
-func (d *HTTPDownloader) downloadSegment(ctx context.Context, client *http.Client, seg *model.Segment, outPath string, headers map[string]string, tracker *SpeedTracker) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seg.URL, nil)
+// downloadSegment downloads a single segment from rawURL to a file.
+func (d *HTTPDownloader) downloadSegment(ctx context.Context, client *http.Client, seg *model.Segment, rawURL, outPath string, headers map[string]string, tracker *SpeedTracker) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
 		return err
 	}
@@ -139,10 +178,17 @@ func (d *HTTPDownloader) downloadSegment(ctx context.Context, client *http.Clien
 
 // buildClient creates an http.Client with the given options.
 func (d *HTTPDownloader) buildClient(opts Options) *http.Client {
+	return NewClient(opts.Proxy, 0) // per-segment timeout handled via context
+}
+
+// NewClient creates an http.Client that connects through proxy, if set,
+// and gives up on a request after timeout seconds, 0 for no limit. It is
+// the client for requests made outside a download, such as manifests.
+func NewClient(proxy string, timeout int) *http.Client {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 
-	if opts.Proxy != "" {
-		proxyURL, err := url.Parse(opts.Proxy)
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
 		if err == nil {
 			transport.Proxy = http.ProxyURL(proxyURL)
 		}
@@ -150,7 +196,7 @@ func (d *HTTPDownloader) buildClient(opts Options) *http.Client {
 
 	return &http.Client{
 		Transport: transport,
-		Timeout:   0, // per-segment timeout handled via context
+		Timeout:   time.Duration(timeout) * time.Second,
 	}
 }
 
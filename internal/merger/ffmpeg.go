@@ -6,12 +6,22 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 // FFmpegMerger merges TS segment files into a single output using ffmpeg concat demuxer.
 type FFmpegMerger struct {
 	FFmpegPath string // path to ffmpeg binary, defaults to "ffmpeg"
+	// Metadata is written as container metadata, e.g. "title".
+	Metadata map[string]string
+	// Chapters is an FFmpeg metadata file whose chapters are written to
+	// the output, if set.
+	Chapters string
+	// Retimestamp regenerates presentation timestamps and shifts the
+	// output to start at zero, for inputs whose timestamps do not follow
+	// on from one another.
+	Retimestamp bool
 }
 
 func (m *FFmpegMerger) Merge(ctx context.Context, segmentFiles []string, output string) error {
@@ -31,15 +41,32 @@ func (m *FFmpegMerger) Merge(ctx context.Context, segmentFiles []string, output
 	}
 	defer os.Remove(listPath)
 
-	args := []string{
-		"-y",
+	args := []string{"-y"}
+	if m.Retimestamp {
+		args = append(args, "-fflags", "+genpts")
+	}
+	args = append(args,
 		"-f", "concat",
 		"-safe", "0",
 		"-i", listPath,
+	)
+	args = append(args, m.chapterArgs()...)
+	args = append(args,
 		"-c", "copy",
 		"-movflags", "+faststart",
-		output,
+	)
+	if m.Retimestamp {
+		args = append(args, "-avoid_negative_ts", "make_zero")
+	}
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-metadata", k+"="+m.Metadata[k])
 	}
+	args = append(args, output)
 
 	cmd := exec.CommandContext(ctx, ffmpeg, args...)
 	cmd.Stdout = os.Stdout
@@ -52,6 +79,15 @@ func (m *FFmpegMerger) Merge(ctx context.Context, segmentFiles []string, output
 	return nil
 }
 
+// chapterArgs returns the input and mapping arguments that add the
+// chapters of m.Chapters to an output made from input 0.
+func (m *FFmpegMerger) chapterArgs() []string {
+	if m.Chapters == "" {
+		return nil
+	}
+	return []string{"-i", m.Chapters, "-map_metadata", "1"}
+}
+
 // writeConcatList writes an ffmpeg concat demuxer input file.
 func writeConcatList(path string, files []string) error {
 	var b strings.Builder
@@ -0,0 +1,31 @@
+package merger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ExtractFrames decodes every video frame of input into numbered JPEG
+// images. pattern is an ffmpeg image sequence pattern such as
+// "thumbs/%04d.jpg"; numbering starts at 1.
+func (m *FFmpegMerger) ExtractFrames(ctx context.Context, input, pattern string) error {
+	ffmpeg := m.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+
+	// passthrough keeps one image per decoded frame instead of
+	// duplicating or dropping frames to a constant rate
+	args := []string{"-y", "-i", input, "-an", "-vsync", "passthrough", "-q:v", "2", pattern}
+
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg extract frames: %w", err)
+	}
+	return nil
+}
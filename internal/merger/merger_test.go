@@ -250,3 +250,92 @@ func TestFFmpegMerger_CmdRunError(t *testing.T) {
 		t.Error("expected error when ffmpeg fails")
 	}
 }
+
+func TestFFmpegMerger_Metadata(t *testing.T) {
+	// Fake ffmpeg that writes its arguments to the output file
+	tmpDir := t.TempDir()
+	fakeFFmpeg := filepath.Join(tmpDir, "ffmpeg")
+	script := "#!/bin/sh\nfor a; do out=$a; done\necho \"$@\" > \"$out\"\n"
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(tmpDir, "seg_0.ts")}
+	os.WriteFile(files[0], []byte("data"), 0o644)
+
+	output := filepath.Join(tmpDir, "output.mp4")
+	m := &FFmpegMerger{FFmpegPath: fakeFFmpeg, Metadata: map[string]string{"title": "My Show", "artist": "Someone"}}
+	if err := m.Merge(context.Background(), files, output); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	args, _ := os.ReadFile(output)
+	if want := "-metadata artist=Someone -metadata title=My Show " + output; !strings.Contains(string(args), want) {
+		t.Errorf("args %q missing %q", args, want)
+	}
+}
+
+func TestFFmpegMerger_Chapters(t *testing.T) {
+	// Fake ffmpeg that writes its arguments to the output file
+	tmpDir := t.TempDir()
+	fakeFFmpeg := filepath.Join(tmpDir, "ffmpeg")
+	script := "#!/bin/sh\nfor a; do out=$a; done\necho \"$@\" > \"$out\"\n"
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(tmpDir, "seg_0.ts")}
+	os.WriteFile(files[0], []byte("data"), 0o644)
+	chapters := filepath.Join(tmpDir, "out.ffmetadata")
+
+	m := &FFmpegMerger{FFmpegPath: fakeFFmpeg, Chapters: chapters}
+	output := filepath.Join(tmpDir, "output.mp4")
+	if err := m.Merge(context.Background(), files, output); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	args, _ := os.ReadFile(output)
+	if want := "_concat_list.txt -i " + chapters + " -map_metadata 1 -c copy"; !strings.Contains(string(args), want) {
+		t.Errorf("merge args %q missing %q", args, want)
+	}
+
+	trimmed := filepath.Join(tmpDir, "trimmed.mp4")
+	if err := m.Trim(context.Background(), output, trimmed, 2, 5); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	args, _ = os.ReadFile(trimmed)
+	if want := "-y -ss 2.000 -i " + output + " -i " + chapters + " -map_metadata 1 -t 5.000"; !strings.HasPrefix(string(args), want) {
+		t.Errorf("trim args %q, want prefix %q", args, want)
+	}
+}
+
+func TestFFmpegMerger_ChaptersInOutput(t *testing.T) {
+	requireFFmpeg(t)
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe not found, skipping")
+	}
+	tmpDir := t.TempDir()
+
+	var files []string
+	for i := range 2 {
+		seg := filepath.Join(tmpDir, fmt.Sprintf("seg_%d.ts", i))
+		gen := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=2:size=64x64:rate=10",
+			"-c:v", "mpeg2video", "-f", "mpegts", seg)
+		if out, err := gen.CombinedOutput(); err != nil {
+			t.Skipf("cannot generate test segment: %v\n%s", err, out)
+		}
+		files = append(files, seg)
+	}
+	chapters := filepath.Join(tmpDir, "out.ffmetadata")
+	meta := ";FFMETADATA1\n\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=2000\ntitle=Part 1\n\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=2000\nEND=4000\ntitle=Ad break 1\n"
+	os.WriteFile(chapters, []byte(meta), 0o644)
+
+	output := filepath.Join(tmpDir, "output.mp4")
+	m := &FFmpegMerger{Chapters: chapters}
+	if err := m.Merge(context.Background(), files, output); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "chapter_tags=title", "-of", "csv=p=0", output).Output()
+	if err != nil {
+		t.Fatalf("ffprobe: %v", err)
+	}
+	if got := strings.Fields(strings.ReplaceAll(string(out), " ", "_")); fmt.Sprint(got) != "[Part_1 Ad_break_1]" {
+		t.Errorf("chapters in output = %v", got)
+	}
+}
@@ -0,0 +1,43 @@
+package merger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Trim cuts input to the range starting at start seconds and lasting
+// duration seconds (0 = to the end), writing output. Streams are
+// re-encoded so the cut lands exactly on the requested times rather than
+// on the nearest keyframes. Chapters, if set, are already on the
+// timeline of the cut output.
+func (m *FFmpegMerger) Trim(ctx context.Context, input, output string, start, duration float64) error {
+	ffmpeg := m.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+
+	args := []string{"-y", "-ss", formatSeconds(start), "-i", input}
+	// Chapters are given on the cut timeline, so they come from a file
+	// the seek does not apply to
+	args = append(args, m.chapterArgs()...)
+	if duration > 0 {
+		args = append(args, "-t", formatSeconds(duration))
+	}
+	args = append(args, "-map", "0", "-movflags", "+faststart", output)
+
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg trim: %w", err)
+	}
+	return nil
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
@@ -1,14 +1,72 @@
 package model
 
+import "time"
+
 // Segment represents a single downloadable piece of a stream.
 type Segment struct {
-	Index      int
-	URL        string
-	Duration   float64
-	Title      string
-	StartRange int64
-	StopRange  int64
+	Index       int
+	URL         string
+	Duration    float64
+	Title       string
+	StartRange  int64
+	StopRange   int64
 	EncryptInfo *EncryptInfo
+
+	// Init is the init section of the segment when its playlist changes
+	// init sections partway through; segments sharing an init point to
+	// the same Segment. Nil means Playlist.MediaInit.
+	Init *Segment
+
+	// Mirrors are alternative URLs of the same segment, from the mirrors
+	// of its stream, tried in order when URL keeps failing.
+	Mirrors []string
+
+	// Discontinuity is the discontinuity sequence number: segments with
+	// the same number share a timeline and encoding.
+	Discontinuity int
+
+	// ProgramDateTime is the wall-clock time of the segment start, zero
+	// when the playlist does not carry one.
+	ProgramDateTime time.Time
+
+	// Tiles describes the thumbnail grid of an image playlist segment.
+	Tiles *Tiles
+
+	// Gap marks a segment announced by EXT-X-GAP as unavailable; it is
+	// never downloaded.
+	Gap bool
+
+	// Ad marks a segment inside an ad break signalled by a cue marker
+	// (see Playlist.Markers).
+	Ad bool
+
+	// Parts lists the LL-HLS partial segments that make up this segment,
+	// present only near the live edge.
+	Parts []Part
+}
+
+// Part is an LL-HLS partial segment from EXT-X-PART.
+type Part struct {
+	URL         string
+	Duration    float64
+	Independent bool // starts with an independent frame
+	Gap         bool // unavailable, must not be downloaded
+	StartRange  int64
+	StopRange   int64
+}
+
+// HasRange returns true if this part uses byte-range requests.
+func (p *Part) HasRange() bool {
+	return p.StartRange > 0 || p.StopRange > 0
+}
+
+// Tiles describes a thumbnail sheet from EXT-X-TILES: a grid of Columns x
+// Rows thumbnails of Resolution, each covering Duration seconds.
+type Tiles struct {
+	Resolution string
+	Columns    int
+	Rows       int
+	Duration   float64
 }
 
 // HasRange returns true if this segment uses byte-range requests.
@@ -30,4 +88,5 @@ type EncryptMethod int
 const (
 	EncryptNone EncryptMethod = iota
 	EncryptAES128
+	EncryptCENC // sample-level Common Encryption (cenc/cbcs) inside fMP4
 )
@@ -1,5 +1,10 @@
 package model
 
+import (
+	"fmt"
+	"time"
+)
+
 // StreamSpec represents a single variant stream (video, audio, etc.).
 type StreamSpec struct {
 	MediaType  MediaType
@@ -13,6 +18,57 @@ type StreamSpec struct {
 	Channels   string
 	URL        string
 	Playlist   *Playlist
+
+	// Mirrors are the URLs of equivalent copies of the stream: the
+	// playlists of redundant HLS variants, or the alternative base URLs of
+	// a DASH representation. Their segments are tried when one fails.
+	Mirrors []string
+
+	// Rendition groups a variant plays with (HLS STREAM-INF AUDIO,
+	// SUBTITLES and CLOSED-CAPTIONS). A rendition's own group is GroupID.
+	AudioGroup    string
+	SubtitleGroup string
+	CaptionGroup  string
+
+	// Rendition flags from HLS EXT-X-MEDIA.
+	Default         bool
+	AutoSelect      bool
+	Characteristics string
+
+	// Protections lists the DRM systems and keys signalled for this stream.
+	Protections []Protection
+}
+
+// Protection describes one DRM system or content key signalled for a stream,
+// from the manifest or from pssh/tenc boxes in the init segment.
+type Protection struct {
+	SystemID string // DRM system UUID, empty for a plain scheme/KID signal
+	Scheme   string // protection scheme or HLS METHOD, e.g. "cenc", "cbcs", "SAMPLE-AES"
+	KID      string // key ID as 32 lower-case hex characters
+	PSSH     []byte // raw pssh box including its header
+}
+
+// AddProtection appends p unless an identical entry is already present.
+func (s *StreamSpec) AddProtection(p Protection) {
+	for _, e := range s.Protections {
+		if e.SystemID == p.SystemID && e.Scheme == p.Scheme && e.KID == p.KID && string(e.PSSH) == string(p.PSSH) {
+			return
+		}
+	}
+	s.Protections = append(s.Protections, p)
+}
+
+// KIDs returns the distinct key IDs across all protections.
+func (s *StreamSpec) KIDs() []string {
+	var kids []string
+	seen := make(map[string]bool)
+	for _, p := range s.Protections {
+		if p.KID != "" && !seen[p.KID] {
+			seen[p.KID] = true
+			kids = append(kids, p.KID)
+		}
+	}
+	return kids
 }
 
 // MediaType identifies the type of stream.
@@ -22,13 +78,266 @@ const (
 	MediaVideo MediaType = iota
 	MediaAudio
 	MediaSubtitle
+	MediaIFrame // HLS I-frame (trick play) stream
+	MediaImage  // HLS image stream of thumbnail tiles
 )
 
+// String returns a human-readable name for the media type.
+func (t MediaType) String() string {
+	switch t {
+	case MediaVideo:
+		return "video"
+	case MediaAudio:
+		return "audio"
+	case MediaSubtitle:
+		return "subtitle"
+	case MediaIFrame:
+		return "iframe"
+	case MediaImage:
+		return "image"
+	default:
+		return "unknown"
+	}
+}
+
+// IsTrickPlay reports whether the media type is an I-frame or image
+// stream, which is only downloaded in thumbnail mode.
+func (t MediaType) IsTrickPlay() bool {
+	return t == MediaIFrame || t == MediaImage
+}
+
 // Playlist holds parsed segment information for a stream.
 type Playlist struct {
-	IsLive          bool
-	TargetDuration  float64
-	TotalDuration   float64
-	MediaInit       *Segment
-	Segments        []Segment
+	IsLive         bool
+	TargetDuration float64
+	TotalDuration  float64
+	MediaInit      *Segment // init section of the first segment
+	Segments       []Segment
+
+	// IFramesOnly and ImagesOnly mark trick play playlists whose segments
+	// are single I-frames or thumbnail images.
+	IFramesOnly bool
+	ImagesOnly  bool
+
+	// Discontinuities holds the indices into Segments where a new
+	// discontinuity group starts, excluding the first segment.
+	Discontinuities []int
+
+	// Low-Latency HLS: PartTarget is EXT-X-PART-INF PART-TARGET, and
+	// PendingParts are the parts published so far of the segment that
+	// follows the last one in Segments.
+	PartTarget    float64
+	ServerControl *ServerControl
+	PreloadHint   *PreloadHint
+	PendingParts  []Part
+
+	// SkippedSegments is the EXT-X-SKIP count of a delta update: that many
+	// segments before the first one in Segments were left out.
+	SkippedSegments int
+
+	// Markers lists the ad breaks signalled by cue tags, in playlist
+	// order. The segments inside a break have Ad set.
+	Markers []Marker
+
+	// UpdatePeriod is the DASH minimumUpdatePeriod of a live MPD in
+	// seconds: how often it is reloaded to pick up new segments.
+	UpdatePeriod float64
+}
+
+// Marker is an ad break signalled in a media playlist by
+// EXT-X-CUE-OUT/EXT-X-CUE-IN or by an EXT-X-DATERANGE with SCTE-35 data.
+type Marker struct {
+	Tag       string    // signalling tag, e.g. "#EXT-X-CUE-OUT" or "#EXT-X-DATERANGE"
+	ID        string    // DATERANGE ID
+	Class     string    // DATERANGE CLASS
+	StartDate time.Time // DATERANGE START-DATE, zero for cue tags
+	EndDate   time.Time // DATERANGE END-DATE, zero if not signalled
+	Duration  float64   // signalled break duration in seconds, 0 if unknown
+	// Elapsed is how far the break had run when the playlist starts, for
+	// a break first seen through EXT-X-CUE-OUT-CONT.
+	Elapsed float64
+
+	// SCTE-35 splice info sections as hex strings, as in the DATERANGE
+	// attributes; cue tags carry theirs in EXT-OATCLS-SCTE35 or SCTE35.
+	SCTE35Out string
+	SCTE35In  string
+	SCTE35Cmd string
+
+	// FirstSegment and LastSegment are the Index of the first and last
+	// segment in the break, -1 if no segment of the playlist falls in it.
+	FirstSegment int
+	LastSegment  int
+}
+
+// ServerControl holds the EXT-X-SERVER-CONTROL playlist delivery
+// directives of an LL-HLS server.
+type ServerControl struct {
+	CanBlockReload    bool
+	CanSkipUntil      float64 // seconds, 0 = delta updates not supported
+	CanSkipDateRanges bool
+	HoldBack          float64
+	PartHoldBack      float64
+}
+
+// PreloadHint is an EXT-X-PRELOAD-HINT for a resource the server will
+// publish next. Length 0 means the hint runs to the end of the resource.
+type PreloadHint struct {
+	Type       string // "PART" or "MAP"
+	URL        string
+	StartRange int64
+	Length     int64
+	Ranged     bool // BYTERANGE-START is given, if only as 0
+}
+
+// Trim keeps only the segments overlapping the media time range
+// [start, end), using segment durations; end <= 0 means to the end. It
+// returns the media time at which the first kept segment that is not a
+// gap starts.
+func (p *Playlist) Trim(start, end float64) float64 {
+	var pos, offset float64
+	first := true
+	p.filter(func(seg *Segment) bool {
+		segStart, segEnd := pos, pos+seg.Duration
+		pos = segEnd
+		if segEnd <= start || (end > 0 && segStart >= end) {
+			return false
+		}
+		if first && !seg.Gap {
+			offset, first = segStart, false
+		}
+		return true
+	})
+	return offset
+}
+
+// TrimWallClock keeps only the segments whose program date time range
+// overlaps [from, to); a zero bound is open. Segments without a program
+// date time are dropped.
+func (p *Playlist) TrimWallClock(from, to time.Time) {
+	p.filter(func(seg *Segment) bool {
+		if seg.ProgramDateTime.IsZero() {
+			return false
+		}
+		end := seg.ProgramDateTime.Add(time.Duration(seg.Duration * float64(time.Second)))
+		if !from.IsZero() && !end.After(from) {
+			return false
+		}
+		return to.IsZero() || seg.ProgramDateTime.Before(to)
+	})
+}
+
+// DropGaps removes the segments marked with EXT-X-GAP and returns how
+// many were removed.
+func (p *Playlist) DropGaps() int {
+	n := len(p.Segments)
+	p.filter(func(seg *Segment) bool { return !seg.Gap })
+	return n - len(p.Segments)
+}
+
+// DropAds removes the segments inside ad breaks and returns how many were
+// removed.
+func (p *Playlist) DropAds() int {
+	n := len(p.Segments)
+	p.filter(func(seg *Segment) bool { return !seg.Ad })
+	return n - len(p.Segments)
+}
+
+// ApplyDelta merges a delta update (EXT-X-SKIP) requested against p and
+// returns the full playlist. The skipped segments are taken from p, which
+// must still hold all of them. A playlist without skipped segments is
+// returned as is.
+func (p *Playlist) ApplyDelta(delta *Playlist) (*Playlist, error) {
+	if delta.SkippedSegments == 0 {
+		return delta, nil
+	}
+	if len(delta.Segments) == 0 {
+		return nil, fmt.Errorf("delta update without segments")
+	}
+
+	known := make(map[int]Segment, len(p.Segments))
+	for _, seg := range p.Segments {
+		known[seg.Index] = seg
+	}
+
+	merged := *delta
+	merged.SkippedSegments = 0
+	merged.Segments = make([]Segment, 0, delta.SkippedSegments+len(delta.Segments))
+	next := delta.Segments[0].Index
+	for i := next - delta.SkippedSegments; i < next; i++ {
+		seg, ok := known[i]
+		if !ok {
+			return nil, fmt.Errorf("delta update skips segment %d, which is not in the previous playlist", i)
+		}
+		merged.Segments = append(merged.Segments, seg)
+	}
+	merged.Segments = append(merged.Segments, delta.Segments...)
+	if merged.MediaInit == nil {
+		merged.MediaInit = p.MediaInit
+	}
+	merged.filter(func(*Segment) bool { return true })
+	return &merged, nil
+}
+
+// InitOf returns the init section of seg, nil for segments without one.
+func (p *Playlist) InitOf(seg *Segment) *Segment {
+	if seg.Init != nil {
+		return seg.Init
+	}
+	return p.MediaInit
+}
+
+// Inits returns the distinct init sections used by the segments, in
+// segment order.
+func (p *Playlist) Inits() []*Segment {
+	var inits []*Segment
+	seen := make(map[int]bool)
+	for i := range p.Segments {
+		if init := p.InitOf(&p.Segments[i]); init != nil && !seen[init.Index] {
+			seen[init.Index] = true
+			inits = append(inits, init)
+		}
+	}
+	if len(p.Segments) == 0 && p.MediaInit != nil {
+		inits = append(inits, p.MediaInit)
+	}
+	return inits
+}
+
+// filter keeps the segments for which keep returns true and recomputes the
+// total duration and discontinuity boundaries.
+func (p *Playlist) filter(keep func(*Segment) bool) {
+	var kept []Segment
+	for i := range p.Segments {
+		if keep(&p.Segments[i]) {
+			kept = append(kept, p.Segments[i])
+		}
+	}
+
+	p.Segments = kept
+	p.TotalDuration = 0
+	p.Discontinuities = nil
+	for i, seg := range kept {
+		p.TotalDuration += seg.Duration
+		if i > 0 && seg.Discontinuity != kept[i-1].Discontinuity {
+			p.Discontinuities = append(p.Discontinuities, i)
+		}
+	}
+}
+
+// DiscontinuityGroups splits Segments at each discontinuity boundary.
+// A playlist without discontinuities yields a single group.
+func (p *Playlist) DiscontinuityGroups() [][]Segment {
+	if len(p.Segments) == 0 {
+		return nil
+	}
+	var groups [][]Segment
+	start := 0
+	for _, b := range p.Discontinuities {
+		if b <= start || b >= len(p.Segments) {
+			continue
+		}
+		groups = append(groups, p.Segments[start:b])
+		start = b
+	}
+	return append(groups, p.Segments[start:])
 }
@@ -1,14 +1,16 @@
 package model
 
+import "fmt"
+
 // Task represents a download task with all user-provided parameters.
 type Task struct {
-	URL     string
-	SaveDir string
+	URL      string
+	SaveDir  string
 	SaveName string
-	TmpDir  string
-	Headers map[string]string
-	Proxy   string
-	Timeout int
+	TmpDir   string
+	Headers  map[string]string
+	Proxy    string
+	Timeout  int
 
 	ThreadCount int
 	RetryCount  int
@@ -16,20 +18,82 @@ type Task struct {
 	AutoSelect  bool
 	SelectVideo string
 	SelectAudio string
+	// LazyPlaylists fetches HLS media playlists only for selected streams.
+	LazyPlaylists bool
+	// Strict fails on manifest problems the parser would otherwise work
+	// around, such as malformed numbers or unknown tags.
+	Strict bool
+	// SkipPeriods and SkipPeriodsUnder leave DASH periods out of the
+	// streams stitched across periods: those with the given ids, and
+	// those no longer than SkipPeriodsUnder seconds, as inserted ads are.
+	SkipPeriods      []string
+	SkipPeriodsUnder float64
+
+	// Package writes the selected streams as an offline-playable local
+	// package ("hls" or "dash") instead of merging them.
+	Package string
+	// PackageDecrypt decrypts packaged segments instead of keeping them
+	// encrypted with their keys saved alongside.
+	PackageDecrypt bool
+
+	// FallbackLower retries a video stream whose segments fail on every
+	// mirror with the next-lower bandwidth variant.
+	FallbackLower bool
 
 	NoMerge      bool
 	DelAfterDone bool
 	FfmpegPath   string
 	BinaryMerge  bool
+	// Metadata is written into outputs merged with ffmpeg, e.g. "title".
+	// It defaults to the HLS session data of the same names.
+	Metadata map[string]string
 
 	Key             []string
 	CustomHLSMethod string
 	CustomHLSKey    string
 	CustomHLSIV     string
 
+	// KeyFile is a key file, or a directory of key files named after the
+	// last path element of each key URI, tried before the key server.
+	KeyFile string
+	// KeyHeaders adds headers to key requests, by key host. Headers under
+	// the "" host apply to every key request.
+	KeyHeaders   map[string]map[string]string
+	KeyMethod    string
+	KeyBody      string
+	KeyJSONField string
+
+	// LenientDecrypt tolerates unaligned segments and invalid padding;
+	// DropRemainder drops the unaligned tail instead of keeping it.
+	LenientDecrypt bool
+	DropRemainder  bool
+
+	// DiscontinuityMode selects how discontinuity groups are merged.
+	DiscontinuityMode string
+	// AdMode selects what happens to segments inside signalled ad breaks.
+	AdMode string
+	// SubtitleFormat is the output format for WebVTT subtitles: vtt or srt.
+	SubtitleFormat string
+	// Thumbnails downloads only an image or I-frame stream and saves its
+	// thumbnails instead of the video.
+	Thumbnails bool
+
+	// Start and End limit the download to a media time range; PreciseCut
+	// trims the merged output exactly instead of at segment boundaries.
+	Start      string
+	End        string
+	PreciseCut bool
+	// FromTime and ToTime limit the download to a wall-clock window in
+	// RFC 3339, matched against segment program date times.
+	FromTime string
+	ToTime   string
+
 	Live         bool
 	LiveDuration string
 	LiveWaitTime int
+	// LowLatency records LL-HLS streams with blocking playlist reloads
+	// and partial segment downloads.
+	LowLatency bool
 
 	LogLevel string
 	NoLog    bool
@@ -44,6 +108,20 @@ type ProgressEvent struct {
 	IsLive            bool
 }
 
+// Discontinuity modes for Task.DiscontinuityMode.
+const (
+	DiscontinuityConcat      = "concat"      // join all groups into one file as is
+	DiscontinuityRetimestamp = "retimestamp" // merge each group, then join with continuous timestamps
+	DiscontinuitySplit       = "split"       // write one output part per group
+)
+
+// Ad modes for Task.AdMode.
+const (
+	AdsKeep     = "keep"     // download ad breaks like any other segment
+	AdsDrop     = "drop"     // leave ad break segments out of the download
+	AdsChapters = "chapters" // keep them and write the breaks as chapters
+)
+
 // MergeType defines how segments should be merged.
 type MergeType int
 
@@ -58,4 +136,74 @@ type ParseResult struct {
 	Streams   []StreamSpec
 	MergeType MergeType
 	IsLive    bool
+	// URL is the manifest URL after redirects, which relative URIs are
+	// resolved against. Redirects lists the URLs that redirected to it,
+	// starting with the requested one; it is empty without redirects.
+	URL       string
+	Redirects []string
+	// Warnings lists manifest problems the parser worked around.
+	Warnings []ParseWarning
+	// Failed lists streams left out because their playlist could not be
+	// fetched or parsed.
+	Failed []StreamFailure
+
+	// Session-level HLS tags. They come from the master playlist, except
+	// Start and IndependentSegments, which a media playlist given on its
+	// own may also carry.
+	SessionData         []SessionData
+	SessionKeys         []EncryptInfo // EXT-X-SESSION-KEY, for prefetching
+	Start               *StartOffset  // EXT-X-START, nil without one
+	IndependentSegments bool          // every segment starts with a key frame
+	ContentSteering     *ContentSteering
+}
+
+// SessionData is an EXT-X-SESSION-DATA entry, which carries either a Value
+// or the URI of a JSON document.
+type SessionData struct {
+	ID       string // DATA-ID, e.g. "com.apple.hls.title"
+	Value    string
+	URI      string
+	JSON     []byte // document at URI, nil if it could not be fetched
+	Language string
+}
+
+// StartOffset is the preferred point to start playback from EXT-X-START,
+// in seconds; a negative TimeOffset counts back from the end.
+type StartOffset struct {
+	TimeOffset float64
+	Precise    bool
+}
+
+// ContentSteering is the EXT-X-CONTENT-STEERING steering manifest and the
+// initial pathway.
+type ContentSteering struct {
+	ServerURI string
+	PathwayID string
+}
+
+// ParseWarning is a manifest problem a parser worked around, such as a
+// malformed number, an unknown tag or a segment URI without #EXTINF.
+type ParseWarning struct {
+	URL     string // manifest the problem is in
+	Line    int    // 1-based line number, 0 if unknown
+	Tag     string // tag or element, e.g. "#EXTINF" or "Period@duration"
+	Message string
+}
+
+// String formats the warning as "url:line: tag: message".
+func (w ParseWarning) String() string {
+	s := w.URL
+	if w.Line > 0 {
+		s += fmt.Sprintf(":%d", w.Line)
+	}
+	if w.Tag != "" {
+		s += ": " + w.Tag
+	}
+	return s + ": " + w.Message
+}
+
+// StreamFailure records a stream whose playlist failed to load.
+type StreamFailure struct {
+	Stream StreamSpec
+	Err    error
 }
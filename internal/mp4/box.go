@@ -0,0 +1,171 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Box is a parsed ISO BMFF box. Container boxes have their children parsed;
+// Payload then holds only the bytes before the first child (for example the
+// fixed fields of a sample entry). Leaf boxes keep their whole payload.
+type Box struct {
+	Type     string
+	Offset   int // offset of the box header in the source buffer
+	Size     int // total size including header, as read from the source
+	Payload  []byte
+	Children []*Box
+}
+
+// containers lists box types whose payload is entirely child boxes.
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+	"mvex": true, "moof": true, "traf": true, "edts": true, "dinf": true,
+	"sinf": true, "schi": true,
+}
+
+// ReadBoxes parses all boxes in data, descending into known containers,
+// sample descriptions and encrypted sample entries.
+func ReadBoxes(data []byte) ([]*Box, error) {
+	return readBoxes(data, 0)
+}
+
+func readBoxes(data []byte, base int) ([]*Box, error) {
+	var boxes []*Box
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, fmt.Errorf("truncated box header at offset %d", base+pos)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, fmt.Errorf("truncated largesize header for %s at offset %d", typ, base+pos)
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < header || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid size %d for %s at offset %d", size, typ, base+pos)
+		}
+
+		box := &Box{
+			Type:    typ,
+			Offset:  base + pos,
+			Size:    size,
+			Payload: data[pos+header : pos+size],
+		}
+		if skip := childOffset(typ, box.Payload); skip >= 0 && skip <= len(box.Payload) {
+			children, err := readBoxes(box.Payload[skip:], box.Offset+header+skip)
+			if err != nil {
+				return nil, err
+			}
+			box.Children = children
+			box.Payload = box.Payload[:skip]
+		}
+		boxes = append(boxes, box)
+		pos += size
+	}
+	return boxes, nil
+}
+
+// childOffset returns where child boxes start inside a box payload, or -1
+// if the box is not descended into.
+func childOffset(typ string, payload []byte) int {
+	switch {
+	case containers[typ]:
+		return 0
+	case typ == "stsd":
+		return 8 // version/flags + entry_count
+	case typ == "encv":
+		return 78 // VisualSampleEntry fields
+	case typ == "enca":
+		// AudioSampleEntry fields; QuickTime v1/v2 sound descriptions are longer
+		if len(payload) < 10 {
+			return -1
+		}
+		switch binary.BigEndian.Uint16(payload[8:]) {
+		case 1:
+			return 44
+		case 2:
+			return 64
+		default:
+			return 28
+		}
+	default:
+		return -1
+	}
+}
+
+// Child returns the first direct child of the given type, or nil.
+func (b *Box) Child(typ string) *Box {
+	for _, c := range b.Children {
+		if c.Type == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// ChildrenOf returns all direct children of the given type.
+func (b *Box) ChildrenOf(typ string) []*Box {
+	var out []*Box
+	for _, c := range b.Children {
+		if c.Type == typ {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Find walks a path of box types from b and returns the first match, or nil.
+func (b *Box) Find(path ...string) *Box {
+	cur := b
+	for _, typ := range path {
+		if cur = cur.Child(typ); cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// Find returns the first top-level box of the given type, or nil.
+func Find(boxes []*Box, typ string) *Box {
+	for _, b := range boxes {
+		if b.Type == typ {
+			return b
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every box in the tree, depth first.
+func Walk(boxes []*Box, fn func(*Box)) {
+	for _, b := range boxes {
+		fn(b)
+		Walk(b.Children, fn)
+	}
+}
+
+// Bytes serializes the box, recomputing sizes from its current contents.
+func (b *Box) Bytes() []byte {
+	body := append([]byte(nil), b.Payload...)
+	body = append(body, Marshal(b.Children)...)
+
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], b.Type)
+	return append(out, body...)
+}
+
+// Marshal serializes a list of boxes.
+func Marshal(boxes []*Box) []byte {
+	var out []byte
+	for _, b := range boxes {
+		out = append(out, b.Bytes()...)
+	}
+	return out
+}
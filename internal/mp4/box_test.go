@@ -0,0 +1,128 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], typ)
+	return append(out, body...)
+}
+
+func TestReadBoxes_Nested(t *testing.T) {
+	data := append(
+		box("ftyp", []byte("iso6")),
+		box("moov", box("trak", box("tkhd", make([]byte, 20))), box("udta", []byte("x")))...,
+	)
+
+	boxes, err := ReadBoxes(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(boxes) != 2 {
+		t.Fatalf("expected 2 top-level boxes, got %d", len(boxes))
+	}
+
+	moov := Find(boxes, "moov")
+	if moov == nil || moov.Offset != 12 {
+		t.Fatalf("expected moov at offset 12, got %+v", moov)
+	}
+	tkhd := moov.Find("trak", "tkhd")
+	if tkhd == nil || len(tkhd.Payload) != 20 {
+		t.Fatal("expected tkhd with 20-byte payload")
+	}
+	if tkhd.Offset != 12+8+8 {
+		t.Errorf("tkhd offset: got %d", tkhd.Offset)
+	}
+	if udta := moov.Child("udta"); udta == nil || udta.Children != nil {
+		t.Error("expected udta to be kept as a leaf box")
+	}
+}
+
+func TestMarshal_RoundTripAndResize(t *testing.T) {
+	data := box("moov", box("trak", box("tkhd", []byte{1, 2, 3})), box("pssh", []byte{4}))
+	boxes, err := ReadBoxes(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := Marshal(boxes); !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch:\n got %x\nwant %x", got, data)
+	}
+
+	moov := boxes[0]
+	moov.Children = moov.ChildrenOf("trak")
+	want := box("moov", box("trak", box("tkhd", []byte{1, 2, 3})))
+	if got := Marshal(boxes); !bytes.Equal(got, want) {
+		t.Errorf("resized moov mismatch:\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestReadBoxes_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated header": {0, 0, 0},
+		"size too large":   {0, 0, 0, 64, 'f', 'r', 'e', 'e'},
+		"size too small":   {0, 0, 0, 4, 'f', 'r', 'e', 'e'},
+	}
+	for name, data := range tests {
+		if _, err := ReadBoxes(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseTrun(t *testing.T) {
+	var p []byte
+	p = binary.BigEndian.AppendUint32(p, 0x000201) // data_offset + sample_size
+	p = binary.BigEndian.AppendUint32(p, 2)
+	p = binary.BigEndian.AppendUint32(p, 100)
+	p = binary.BigEndian.AppendUint32(p, 10)
+	p = binary.BigEndian.AppendUint32(p, 20)
+
+	trun, err := ParseTrun(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !trun.HasDataOffset || trun.DataOffset != 100 {
+		t.Errorf("data offset: got %d", trun.DataOffset)
+	}
+	if len(trun.SampleSizes) != 2 || trun.SampleSizes[1] != 20 {
+		t.Errorf("sample sizes: got %v", trun.SampleSizes)
+	}
+
+	if _, err := ParseTrun(p[:12]); err == nil {
+		t.Error("expected error for truncated trun")
+	}
+}
+
+func TestParsePssh_Version1(t *testing.T) {
+	var p []byte
+	p = binary.BigEndian.AppendUint32(p, 1<<24)
+	p = append(p, 0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce, 0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed)
+	p = binary.BigEndian.AppendUint32(p, 1)
+	p = append(p, bytes.Repeat([]byte{0xab}, 16)...)
+	p = binary.BigEndian.AppendUint32(p, 3)
+	p = append(p, 'x', 'y', 'z')
+
+	pssh, err := ParsePssh(box("pssh", p))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pssh.SystemID != "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" {
+		t.Errorf("system ID: got %s", pssh.SystemID)
+	}
+	if pssh.KID() != "abababababababababababababababab" {
+		t.Errorf("KID: got %s", pssh.KID())
+	}
+	if string(pssh.Data) != "xyz" {
+		t.Errorf("data: got %q", pssh.Data)
+	}
+
+	if _, err := ParsePssh(box("free", p)); err == nil {
+		t.Error("expected error for non-pssh box")
+	}
+}
@@ -0,0 +1,387 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// reader is a bounds-checked big-endian cursor over a box payload.
+type reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.pos+n > len(r.buf) {
+		r.err = fmt.Errorf("need %d bytes at offset %d, have %d", n, r.pos, len(r.buf)-r.pos)
+		return false
+	}
+	return true
+}
+
+func (r *reader) u8() uint8 {
+	if !r.need(1) {
+		return 0
+	}
+	v := r.buf[r.pos]
+	r.pos++
+	return v
+}
+
+func (r *reader) u16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf[r.pos:])
+	r.pos += 2
+	return v
+}
+
+func (r *reader) u32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return v
+}
+
+func (r *reader) bytes(n int) []byte {
+	if !r.need(n) {
+		return nil
+	}
+	v := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return v
+}
+
+// fullBox consumes the version/flags header of a full box.
+func (r *reader) fullBox() (uint8, uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0xFFFFFF
+}
+
+// Tkhd holds the fields of a track header box that we need.
+type Tkhd struct {
+	TrackID uint32
+}
+
+// ParseTkhd parses a tkhd payload.
+func ParseTkhd(payload []byte) (*Tkhd, error) {
+	r := &reader{buf: payload}
+	version, _ := r.fullBox()
+	if version == 1 {
+		r.bytes(16) // creation + modification time
+	} else {
+		r.bytes(8)
+	}
+	t := &Tkhd{TrackID: r.u32()}
+	if r.err != nil {
+		return nil, fmt.Errorf("tkhd: %w", r.err)
+	}
+	return t, nil
+}
+
+// Trex holds per-track fragment defaults from a trex box.
+type Trex struct {
+	TrackID               uint32
+	DefaultSampleDuration uint32
+	DefaultSampleSize     uint32
+}
+
+// ParseTrex parses a trex payload.
+func ParseTrex(payload []byte) (*Trex, error) {
+	r := &reader{buf: payload}
+	r.fullBox()
+	t := &Trex{TrackID: r.u32()}
+	r.u32() // default_sample_description_index
+	t.DefaultSampleDuration = r.u32()
+	t.DefaultSampleSize = r.u32()
+	if r.err != nil {
+		return nil, fmt.Errorf("trex: %w", r.err)
+	}
+	return t, nil
+}
+
+// Tenc is a track encryption box.
+type Tenc struct {
+	CryptByteBlock  uint8
+	SkipByteBlock   uint8
+	IsProtected     bool
+	PerSampleIVSize uint8
+	KID             []byte
+	ConstantIV      []byte
+}
+
+// ParseTenc parses a tenc payload.
+func ParseTenc(payload []byte) (*Tenc, error) {
+	r := &reader{buf: payload}
+	version, _ := r.fullBox()
+	r.u8() // reserved
+	t := &Tenc{}
+	pattern := r.u8()
+	if version > 0 {
+		t.CryptByteBlock = pattern >> 4
+		t.SkipByteBlock = pattern & 0x0F
+	}
+	t.IsProtected = r.u8() == 1
+	t.PerSampleIVSize = r.u8()
+	t.KID = r.bytes(16)
+	if t.IsProtected && t.PerSampleIVSize == 0 {
+		t.ConstantIV = r.bytes(int(r.u8()))
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("tenc: %w", r.err)
+	}
+	return t, nil
+}
+
+// Tfhd is a track fragment header box.
+type Tfhd struct {
+	TrackID               uint32
+	BaseDataOffset        uint64
+	HasBaseDataOffset     bool
+	DefaultBaseIsMoof     bool
+	DefaultSampleDuration uint32
+	DefaultSampleSize     uint32
+}
+
+// ParseTfhd parses a tfhd payload.
+func ParseTfhd(payload []byte) (*Tfhd, error) {
+	r := &reader{buf: payload}
+	_, flags := r.fullBox()
+	t := &Tfhd{TrackID: r.u32()}
+	if flags&0x01 != 0 {
+		t.BaseDataOffset = r.u64()
+		t.HasBaseDataOffset = true
+	}
+	if flags&0x02 != 0 {
+		r.u32() // sample_description_index
+	}
+	if flags&0x08 != 0 {
+		t.DefaultSampleDuration = r.u32()
+	}
+	if flags&0x10 != 0 {
+		t.DefaultSampleSize = r.u32()
+	}
+	t.DefaultBaseIsMoof = flags&0x20000 != 0
+	if r.err != nil {
+		return nil, fmt.Errorf("tfhd: %w", r.err)
+	}
+	return t, nil
+}
+
+// Trun is a track fragment run box. SampleSizes is nil when the run
+// relies on default sizes.
+type Trun struct {
+	SampleCount     uint32
+	DataOffset      int32
+	HasDataOffset   bool
+	SampleSizes     []uint32
+	SampleDurations []uint32
+}
+
+// ParseTrun parses a trun payload.
+func ParseTrun(payload []byte) (*Trun, error) {
+	r := &reader{buf: payload}
+	_, flags := r.fullBox()
+	t := &Trun{SampleCount: r.u32()}
+	if flags&0x001 != 0 {
+		t.DataOffset = int32(r.u32())
+		t.HasDataOffset = true
+	}
+	if flags&0x004 != 0 {
+		r.u32() // first_sample_flags
+	}
+	for i := uint32(0); i < t.SampleCount && r.err == nil; i++ {
+		if flags&0x100 != 0 {
+			t.SampleDurations = append(t.SampleDurations, r.u32())
+		}
+		if flags&0x200 != 0 {
+			t.SampleSizes = append(t.SampleSizes, r.u32())
+		}
+		if flags&0x400 != 0 {
+			r.u32() // sample_flags
+		}
+		if flags&0x800 != 0 {
+			r.u32() // sample_composition_time_offset
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("trun: %w", r.err)
+	}
+	return t, nil
+}
+
+// Subsample is one clear/protected byte range pair within a sample.
+type Subsample struct {
+	Clear     uint32
+	Protected uint32
+}
+
+// SampleAuxInfo is the per-sample encryption info from senc or saiz/saio.
+type SampleAuxInfo struct {
+	IV         []byte
+	Subsamples []Subsample
+}
+
+// ParseSenc parses a senc payload. ivSize comes from the track's tenc.
+func ParseSenc(payload []byte, ivSize int) ([]SampleAuxInfo, error) {
+	r := &reader{buf: payload}
+	_, flags := r.fullBox()
+	count := r.u32()
+	var infos []SampleAuxInfo
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		infos = append(infos, readAuxInfo(r, ivSize, flags&0x02 != 0))
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("senc: %w", r.err)
+	}
+	return infos, nil
+}
+
+// ParseAuxInfo parses one sample's auxiliary encryption info as located by
+// saiz/saio. Subsamples are present when the info is longer than the IV.
+func ParseAuxInfo(data []byte, ivSize int) (SampleAuxInfo, error) {
+	r := &reader{buf: data}
+	info := readAuxInfo(r, ivSize, len(data) > ivSize)
+	if r.err != nil {
+		return info, fmt.Errorf("aux info: %w", r.err)
+	}
+	return info, nil
+}
+
+func readAuxInfo(r *reader, ivSize int, hasSubsamples bool) SampleAuxInfo {
+	var info SampleAuxInfo
+	if ivSize > 0 {
+		info.IV = r.bytes(ivSize)
+	}
+	if hasSubsamples {
+		n := r.u16()
+		for j := uint16(0); j < n && r.err == nil; j++ {
+			info.Subsamples = append(info.Subsamples, Subsample{Clear: uint32(r.u16()), Protected: r.u32()})
+		}
+	}
+	return info
+}
+
+// Saiz is a sample auxiliary information sizes box.
+type Saiz struct {
+	DefaultSize uint8
+	SampleCount uint32
+	Sizes       []uint8
+}
+
+// Size returns the aux info size of sample i.
+func (s *Saiz) Size(i int) int {
+	if s.DefaultSize != 0 {
+		return int(s.DefaultSize)
+	}
+	if i < len(s.Sizes) {
+		return int(s.Sizes[i])
+	}
+	return 0
+}
+
+// ParseSaiz parses a saiz payload.
+func ParseSaiz(payload []byte) (*Saiz, error) {
+	r := &reader{buf: payload}
+	_, flags := r.fullBox()
+	if flags&0x01 != 0 {
+		r.bytes(8) // aux_info_type + aux_info_type_parameter
+	}
+	s := &Saiz{DefaultSize: r.u8(), SampleCount: r.u32()}
+	if s.DefaultSize == 0 {
+		s.Sizes = r.bytes(int(s.SampleCount))
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("saiz: %w", r.err)
+	}
+	return s, nil
+}
+
+// ParseSaio parses a saio payload and returns its offsets.
+func ParseSaio(payload []byte) ([]uint64, error) {
+	r := &reader{buf: payload}
+	version, flags := r.fullBox()
+	if flags&0x01 != 0 {
+		r.bytes(8)
+	}
+	count := r.u32()
+	var offsets []uint64
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		if version == 0 {
+			offsets = append(offsets, uint64(r.u32()))
+		} else {
+			offsets = append(offsets, r.u64())
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("saio: %w", r.err)
+	}
+	return offsets, nil
+}
+
+// Pssh is a protection system specific header box.
+type Pssh struct {
+	SystemID string   // UUID with dashes, lower case
+	KIDs     []string // lower-case hex, only present in version 1 boxes
+	Data     []byte
+}
+
+// ParsePssh parses a complete pssh box, header included.
+func ParsePssh(box []byte) (*Pssh, error) {
+	boxes, err := ReadBoxes(box)
+	if err != nil {
+		return nil, fmt.Errorf("pssh: %w", err)
+	}
+	if len(boxes) != 1 || boxes[0].Type != "pssh" {
+		return nil, fmt.Errorf("pssh: not a pssh box")
+	}
+
+	r := &reader{buf: boxes[0].Payload}
+	version, _ := r.fullBox()
+	p := &Pssh{SystemID: FormatUUID(r.bytes(16))}
+	if version > 0 {
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			p.KIDs = append(p.KIDs, hex.EncodeToString(r.bytes(16)))
+		}
+	}
+	p.Data = r.bytes(int(r.u32()))
+	if r.err != nil {
+		return nil, fmt.Errorf("pssh: %w", r.err)
+	}
+	return p, nil
+}
+
+// KID returns the first KID listed in the box, or "".
+func (p *Pssh) KID() string {
+	if len(p.KIDs) == 0 {
+		return ""
+	}
+	return p.KIDs[0]
+}
+
+// FormatUUID formats 16 bytes as a lower-case UUID string.
+func FormatUUID(b []byte) string {
+	if len(b) != 16 {
+		return hex.EncodeToString(b)
+	}
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -5,28 +5,51 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser"
 )
 
 // Parser implements the parser.Parser interface for DASH streams.
 type Parser struct {
 	Client *http.Client
+	// Strict fails the parse on any manifest warning instead of working
+	// around the problem.
+	Strict bool
+	// SkipPeriods leaves matching periods, such as inserted ads, out of
+	// the streams stitched across periods.
+	SkipPeriods SkipPeriods
 }
 
-// Parse fetches and parses a DASH MPD URL.
+// Parse fetches and parses a DASH MPD URL. Relative URLs resolve against
+// the MPD URL after redirects.
 func (p *Parser) Parse(ctx context.Context, url string, headers map[string]string) (*model.ParseResult, error) {
-	content, err := p.fetch(ctx, url, headers)
+	content, chain, err := p.fetch(ctx, url, headers)
 	if err != nil {
 		return nil, fmt.Errorf("fetch MPD: %w", err)
 	}
-	return ParseMPD(content, url)
+	finalURL := chain[len(chain)-1]
+	result, err := parseMPD(content, finalURL, time.Now(), p.SkipPeriods)
+	if err != nil {
+		return nil, err
+	}
+	if p.Strict {
+		if err := parser.CheckStrict(result.Warnings); err != nil {
+			return nil, err
+		}
+	}
+	result.URL = finalURL
+	result.Redirects = chain[:len(chain)-1]
+	return result, nil
 }
 
-func (p *Parser) fetch(ctx context.Context, url string, headers map[string]string) (string, error) {
+// fetch downloads content from a URL with custom headers. It also returns
+// the redirect chain, whose last element is the URL the content came from.
+func (p *Parser) fetch(ctx context.Context, url string, headers map[string]string) (string, []string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
@@ -39,17 +62,17 @@ func (p *Parser) fetch(ctx context.Context, url string, headers map[string]strin
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		return "", nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	return string(body), nil
+	return string(body), parser.RedirectChain(resp), nil
 }
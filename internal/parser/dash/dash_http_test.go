@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,6 +37,35 @@ func TestParser_Parse_VOD(t *testing.T) {
 	}
 }
 
+func TestParser_Parse_Redirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/abc", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/edge/vod/manifest.mpd", http.StatusFound)
+	})
+	mux.HandleFunc("/edge/vod/manifest.mpd", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, vodMPD)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/s/abc", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	final := server.URL + "/edge/vod/manifest.mpd"
+	if result.URL != final {
+		t.Errorf("URL: %s", result.URL)
+	}
+	if len(result.Redirects) != 1 || result.Redirects[0] != server.URL+"/s/abc" {
+		t.Errorf("Redirects: %v", result.Redirects)
+	}
+	if got := result.Streams[0].Playlist.MediaInit.URL; got != server.URL+"/edge/vod/video_720p_init.mp4" {
+		t.Errorf("init URL resolved against the requested URL: %s", got)
+	}
+}
+
 func TestParser_Parse_HTTP404(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -148,3 +178,18 @@ func TestParser_Parse_EmptyResponse(t *testing.T) {
 		t.Fatal("expected error for empty MPD")
 	}
 }
+
+func TestParser_Parse_Strict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<MPD type="static" mediaPresentationDuration="1 minute"><Period/></MPD>`)
+	}))
+	defer server.Close()
+
+	if _, err := (&Parser{Client: server.Client()}).Parse(context.Background(), server.URL+"/manifest.mpd", nil); err != nil {
+		t.Fatalf("lenient parse: %v", err)
+	}
+	_, err := (&Parser{Client: server.Client(), Strict: true}).Parse(context.Background(), server.URL+"/manifest.mpd", nil)
+	if err == nil || !strings.Contains(err.Error(), `strict: `+server.URL+`/manifest.mpd: MPD@mediaPresentationDuration: invalid duration "1 minute"`) {
+		t.Errorf("expected strict error, got %v", err)
+	}
+}
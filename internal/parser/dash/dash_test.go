@@ -1,6 +1,8 @@
 package dash
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 
 	"github.com/caorushizi/mediago-core/internal/model"
@@ -224,6 +226,45 @@ func TestParseMPD_BaseURLResolution(t *testing.T) {
 	}
 }
 
+func TestParseMPD_MirrorBaseURLs(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT8S">
+  <BaseURL>https://cdn-a.example.com/</BaseURL>
+  <BaseURL>https://cdn-b.example.com/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <BaseURL>content/</BaseURL>
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="seg_$Number$.m4s" initialization="init.mp4" duration="4" timescale="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://origin.example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s := result.Streams[0]
+	if want := []string{"https://cdn-b.example.com/content/"}; !slices.Equal(s.Mirrors, want) {
+		t.Errorf("stream mirrors = %v, want %v", s.Mirrors, want)
+	}
+	pl := s.Playlist
+	if pl.MediaInit.URL != "https://cdn-a.example.com/content/init.mp4" ||
+		!slices.Equal(pl.MediaInit.Mirrors, []string{"https://cdn-b.example.com/content/init.mp4"}) {
+		t.Errorf("init = %s, mirrors %v", pl.MediaInit.URL, pl.MediaInit.Mirrors)
+	}
+	if len(pl.Segments) != 2 {
+		t.Fatalf("expected 2 segments, got %d", len(pl.Segments))
+	}
+	for i, seg := range pl.Segments {
+		want := fmt.Sprintf("https://cdn-b.example.com/content/seg_%d.m4s", i+1)
+		if !slices.Equal(seg.Mirrors, []string{want}) {
+			t.Errorf("segment %d mirrors = %v, want [%s]", i, seg.Mirrors, want)
+		}
+	}
+}
+
 func TestParseISO8601Duration(t *testing.T) {
 	tests := []struct {
 		input string
@@ -284,3 +325,105 @@ func TestReplaceVars(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+// widevinePSSH is a version 0 Widevine pssh box with empty data, base64.
+const widevinePSSH = "AAAAIHBzc2gAAAAA7e+LqXnWSs6jyCfc1R0h7QAAAAA="
+
+func TestParseMPD_ContentProtection(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" xmlns:cenc="urn:mpeg:cenc:2013"
+     type="static" mediaPresentationDuration="PT4S">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc"
+                         cenc:default_KID="10000000-1000-1000-1000-100000000001"/>
+      <ContentProtection schemeIdUri="urn:uuid:EDEF8BA9-79D6-4ACE-A3C8-27DCD51D21ED">
+        <cenc:pssh>` + widevinePSSH + `</cenc:pssh>
+      </ContentProtection>
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="v_$Number$.m4s" initialization="v_init.mp4" duration="2" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prots := result.Streams[0].Protections
+	if len(prots) != 2 {
+		t.Fatalf("expected 2 protections, got %d", len(prots))
+	}
+	if prots[0].Scheme != "cenc" || prots[0].KID != "10000000100010001000100000000001" {
+		t.Errorf("unexpected mp4protection entry: %+v", prots[0])
+	}
+	if prots[1].SystemID != "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" || len(prots[1].PSSH) != 32 {
+		t.Errorf("unexpected Widevine entry: %+v", prots[1])
+	}
+
+	kids := result.Streams[0].KIDs()
+	if len(kids) != 1 || kids[0] != "10000000100010001000100000000001" {
+		t.Errorf("KIDs: got %v", kids)
+	}
+}
+
+func TestParseMPD_ProgramDateTime(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static"
+     availabilityStartTime="2024-05-01T14:00:00Z" mediaPresentationDuration="PT20S">
+  <Period id="p0" duration="PT8S">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="v_$Time$.m4s" timescale="1000" presentationTimeOffset="90000">
+          <SegmentTimeline>
+            <S t="90000" d="4000" r="1"/>
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period id="p1" duration="PT12S">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="w_$Number$.m4s" duration="6"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, s := range result.Streams {
+		for _, seg := range s.Playlist.Segments {
+			got = append(got, seg.ProgramDateTime.Format("15:04:05"))
+		}
+	}
+	if want := "[14:00:00 14:00:04 14:00:08 14:00:14]"; fmt.Sprint(got) != want {
+		t.Errorf("program date times: got %v, want %s", got, want)
+	}
+}
+
+func TestParseMPD_NoAvailabilityStartTime(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT4S">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="v_$Number$.m4s" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.Streams[0].Playlist.Segments[0].ProgramDateTime.IsZero() {
+		t.Error("expected zero program date time without availabilityStartTime")
+	}
+}
@@ -0,0 +1,109 @@
+package dash
+
+import (
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMPD_LiveWindow(t *testing.T) {
+	ast := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		attrs    string
+		period   string
+		template string
+		now      time.Duration // since availabilityStartTime
+		files    []string
+		warnings int
+	}{
+		{
+			name:     "duration template",
+			attrs:    `timeShiftBufferDepth="PT20S" suggestedPresentationDelay="PT4S"`,
+			template: `<SegmentTemplate media="v_$Number$.m4s" duration="4" startNumber="1"/>`,
+			now:      100 * time.Second,
+			// Live edge at 96s, buffer from 76s
+			files: []string{"v_20.m4s", "v_21.m4s", "v_22.m4s", "v_23.m4s", "v_24.m4s"},
+		},
+		{
+			name:     "later period",
+			attrs:    `timeShiftBufferDepth="PT20S"`,
+			period:   `start="PT60S"`,
+			template: `<SegmentTemplate media="v_$Number$.m4s" duration="4" startNumber="1"/>`,
+			now:      100 * time.Second,
+			// 40s into the period, buffer from 20s
+			files: []string{"v_6.m4s", "v_7.m4s", "v_8.m4s", "v_9.m4s", "v_10.m4s"},
+		},
+		{
+			name:     "timeline repeated to the live edge",
+			attrs:    `timeShiftBufferDepth="PT20S" suggestedPresentationDelay="PT4S"`,
+			template: `<SegmentTemplate media="v_$Time$.m4s" timescale="1"><SegmentTimeline><S t="0" d="4" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			now:      100 * time.Second,
+			files:    []string{"v_76.m4s", "v_80.m4s", "v_84.m4s", "v_88.m4s", "v_92.m4s"},
+		},
+		{
+			name:     "default time shift buffer",
+			template: `<SegmentTemplate media="v_$Number$.m4s" duration="30"/>`,
+			now:      24 * time.Hour,
+			files:    []string{"v_2879.m4s", "v_2880.m4s"},
+		},
+		{
+			name:     "not started yet",
+			template: `<SegmentTemplate media="v_$Number$.m4s" duration="4"/>`,
+			now:      -10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mpd := `<MPD type="dynamic" availabilityStartTime="2024-01-01T00:00:00Z" minimumUpdatePeriod="PT2S" ` + tt.attrs + `>
+  <Period ` + tt.period + `>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">` + tt.template + `</Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+			result, err := parseMPD(mpd, "https://example.com/live.mpd", ast.Add(tt.now), SkipPeriods{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !result.IsLive {
+				t.Error("expected live")
+			}
+			p := result.Streams[0].Playlist
+			var files []string
+			for _, seg := range p.Segments {
+				files = append(files, path.Base(seg.URL))
+			}
+			if !slices.Equal(files, tt.files) {
+				t.Errorf("segments = %v, want %v", files, tt.files)
+			}
+			if p.UpdatePeriod != 2 {
+				t.Errorf("UpdatePeriod = %v, want 2", p.UpdatePeriod)
+			}
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("warnings = %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestParseMPD_LiveWithoutAvailabilityStartTime(t *testing.T) {
+	mpd := `<MPD type="dynamic">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="v_$Number$.m4s" duration="4"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := parseMPD(mpd, "https://example.com/live.mpd", time.Now(), SkipPeriods{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Warnings) == 0 || !strings.Contains(result.Warnings[0].Message, "segment window unknown") {
+		t.Errorf("warnings = %v", result.Warnings)
+	}
+}
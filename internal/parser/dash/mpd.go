@@ -1,69 +1,79 @@
 package dash
 
 import (
+	"encoding/base64"
 	"encoding/xml"
 	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/mp4"
 	"github.com/caorushizi/mediago-core/internal/parser/hls"
 )
 
 // MPD XML structures
 
 type MPD struct {
-	XMLName                   xml.Name `xml:"MPD"`
-	Type                      string   `xml:"type,attr"`
-	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
-	MinBufferTime             string   `xml:"minBufferTime,attr"`
-	BaseURL                   string   `xml:"BaseURL"`
-	Periods                   []Period `xml:"Period"`
+	XMLName                    xml.Name `xml:"MPD"`
+	Type                       string   `xml:"type,attr"`
+	MediaPresentationDuration  string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime              string   `xml:"minBufferTime,attr"`
+	AvailabilityStartTime      string   `xml:"availabilityStartTime,attr"`
+	MinimumUpdatePeriod        string   `xml:"minimumUpdatePeriod,attr"`
+	TimeShiftBufferDepth       string   `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string   `xml:"suggestedPresentationDelay,attr"`
+	BaseURL                    []string `xml:"BaseURL"`
+	Periods                    []Period `xml:"Period"`
 }
 
 type Period struct {
-	ID              string          `xml:"id,attr"`
-	Duration        string          `xml:"duration,attr"`
-	BaseURL         string          `xml:"BaseURL"`
-	AdaptationSets  []AdaptationSet `xml:"AdaptationSet"`
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	Duration       string          `xml:"duration,attr"`
+	BaseURL        []string        `xml:"BaseURL"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
 }
 
 type AdaptationSet struct {
-	ID                   string               `xml:"id,attr"`
-	ContentType          string               `xml:"contentType,attr"`
-	MimeType             string               `xml:"mimeType,attr"`
-	Lang                 string               `xml:"lang,attr"`
-	Codecs               string               `xml:"codecs,attr"`
-	FrameRate            string               `xml:"frameRate,attr"`
-	BaseURL              string               `xml:"BaseURL"`
-	SegmentTemplate      *SegmentTemplate     `xml:"SegmentTemplate"`
-	ContentProtection    []ContentProtection  `xml:"ContentProtection"`
-	Representations      []Representation     `xml:"Representation"`
+	ID                string              `xml:"id,attr"`
+	ContentType       string              `xml:"contentType,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	Lang              string              `xml:"lang,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	FrameRate         string              `xml:"frameRate,attr"`
+	BaseURL           []string            `xml:"BaseURL"`
+	SegmentTemplate   *SegmentTemplate    `xml:"SegmentTemplate"`
+	ContentProtection []ContentProtection `xml:"ContentProtection"`
+	Representations   []Representation    `xml:"Representation"`
 }
 
 type Representation struct {
-	ID              string           `xml:"id,attr"`
-	Bandwidth       int64            `xml:"bandwidth,attr"`
-	Codecs          string           `xml:"codecs,attr"`
-	Width           int              `xml:"width,attr"`
-	Height          int              `xml:"height,attr"`
-	MimeType        string           `xml:"mimeType,attr"`
-	BaseURL         string           `xml:"BaseURL"`
-	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
-	SegmentList     *SegmentList     `xml:"SegmentList"`
-	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	ID                string              `xml:"id,attr"`
+	Bandwidth         int64               `xml:"bandwidth,attr"`
+	Codecs            string              `xml:"codecs,attr"`
+	Width             int                 `xml:"width,attr"`
+	Height            int                 `xml:"height,attr"`
+	MimeType          string              `xml:"mimeType,attr"`
+	BaseURL           []string            `xml:"BaseURL"`
+	SegmentTemplate   *SegmentTemplate    `xml:"SegmentTemplate"`
+	SegmentList       *SegmentList        `xml:"SegmentList"`
+	SegmentBase       *SegmentBase        `xml:"SegmentBase"`
+	ContentProtection []ContentProtection `xml:"ContentProtection"`
 }
 
 type SegmentTemplate struct {
-	Media              string          `xml:"media,attr"`
-	Initialization     string          `xml:"initialization,attr"`
-	Duration           int64           `xml:"duration,attr"`
-	Timescale          int64           `xml:"timescale,attr"`
-	StartNumber        int64           `xml:"startNumber,attr"`
-	SegmentTimeline    *SegmentTimeline `xml:"SegmentTimeline"`
+	Media                  string           `xml:"media,attr"`
+	Initialization         string           `xml:"initialization,attr"`
+	Duration               int64            `xml:"duration,attr"`
+	Timescale              int64            `xml:"timescale,attr"`
+	StartNumber            int64            `xml:"startNumber,attr"`
+	PresentationTimeOffset int64            `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *SegmentTimeline `xml:"SegmentTimeline"`
 }
 
 type SegmentTimeline struct {
@@ -100,50 +110,113 @@ type Initialization struct {
 
 type ContentProtection struct {
 	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+	DefaultKID  string `xml:"default_KID,attr"` // cenc:default_KID
+	PSSH        string `xml:"pssh"`             // cenc:pssh, base64
+}
+
+// defaultTimeShiftBuffer is the window, in seconds, of a live MPD without
+// timeShiftBufferDepth. Its buffer is unbounded then, and a recording
+// would otherwise start at availabilityStartTime.
+const defaultTimeShiftBuffer = 60
+
+// liveWindow is the wall-clock state that decides which segments of a
+// dynamic MPD are available.
+type liveWindow struct {
+	now             time.Time
+	timeShiftBuffer float64 // seconds of media kept behind the live edge
+	delay           float64 // suggestedPresentationDelay in seconds
+}
+
+// span returns the available window in seconds from periodStart: from the
+// start of the time shift buffer to the live edge, which is held back by
+// the suggested presentation delay.
+func (w *liveWindow) span(periodStart time.Time) (from, to float64) {
+	to = w.now.Sub(periodStart).Seconds() - w.delay
+	return to - w.timeShiftBuffer, to
 }
 
 // ParseMPD parses an MPD manifest and returns streams with segment info.
+// The segments of a live MPD are those available at the current time.
+// Problems it works around are listed in ParseResult.Warnings.
 func ParseMPD(content string, baseURL string) (*model.ParseResult, error) {
+	return parseMPD(content, baseURL, time.Now(), SkipPeriods{})
+}
+
+// parseMPD parses an MPD manifest as of now, leaving out the periods
+// matched by skip.
+func parseMPD(content string, baseURL string, now time.Time, skip SkipPeriods) (*model.ParseResult, error) {
 	var mpd MPD
 	if err := xml.Unmarshal([]byte(content), &mpd); err != nil {
 		return nil, fmt.Errorf("unmarshal MPD: %w", err)
 	}
 
+	d := &diagnostics{url: baseURL}
 	isLive := mpd.Type == "dynamic"
-	mpdDuration := parseISO8601Duration(mpd.MediaPresentationDuration)
+	mpdDuration := d.duration("MPD@mediaPresentationDuration", mpd.MediaPresentationDuration)
 
-	// Resolve MPD-level BaseURL
-	mpdBaseURL := baseURL
-	if mpd.BaseURL != "" {
-		mpdBaseURL = hls.ResolveURL(baseURL, mpd.BaseURL)
-	}
+	// Each level may list several BaseURLs; the first combination is the
+	// primary, the others are mirrors
+	mpdBaseURLs := resolveBaseURLs([]string{baseURL}, mpd.BaseURL)
 
-	var streams []model.StreamSpec
+	// Wall-clock anchor for segment program date times
+	availabilityStart := parseDateTime(mpd.AvailabilityStartTime)
+	if mpd.AvailabilityStartTime != "" && availabilityStart.IsZero() {
+		d.warnf("MPD@availabilityStartTime", "invalid date time %q", mpd.AvailabilityStartTime)
+	}
 
-	for _, period := range mpd.Periods {
-		periodBaseURL := mpdBaseURL
-		if period.BaseURL != "" {
-			periodBaseURL = hls.ResolveURL(mpdBaseURL, period.BaseURL)
+	var window *liveWindow
+	var updatePeriod float64
+	if isLive {
+		updatePeriod = d.duration("MPD@minimumUpdatePeriod", mpd.MinimumUpdatePeriod)
+		if availabilityStart.IsZero() {
+			d.warnf("MPD@availabilityStartTime", "live MPD without availabilityStartTime, segment window unknown")
+		} else {
+			window = &liveWindow{
+				now:             now,
+				timeShiftBuffer: d.duration("MPD@timeShiftBufferDepth", mpd.TimeShiftBufferDepth),
+				delay:           d.duration("MPD@suggestedPresentationDelay", mpd.SuggestedPresentationDelay),
+			}
+			if window.timeShiftBuffer == 0 {
+				window.timeShiftBuffer = defaultTimeShiftBuffer
+			}
 		}
+	}
 
-		periodDuration := parseISO8601Duration(period.Duration)
+	var periods [][]periodStream
+	starts := periodStarts(d, mpd.Periods)
+	for pi, period := range mpd.Periods {
+		periodBaseURLs := resolveBaseURLs(mpdBaseURLs, period.BaseURL)
+
+		// A period without a duration lasts until the next one starts, or
+		// the last one until the end of the presentation
+		periodOffset := starts[pi]
+		periodDuration := d.duration("Period@duration", period.Duration)
 		if periodDuration == 0 {
-			periodDuration = mpdDuration
+			if pi+1 < len(mpd.Periods) {
+				periodDuration = max(starts[pi+1]-periodOffset, 0)
+			} else {
+				periodDuration = max(mpdDuration-periodOffset, 0)
+			}
+		}
+		if skip.match(period.ID, periodDuration) {
+			continue
 		}
 
+		var periodStart time.Time
+		if !availabilityStart.IsZero() {
+			periodStart = availabilityStart.Add(seconds(periodOffset))
+		}
+
+		var streams []periodStream
+		seen := make(map[string]int) // representations so far by key
 		for _, as := range period.AdaptationSets {
-			asBaseURL := periodBaseURL
-			if as.BaseURL != "" {
-				asBaseURL = hls.ResolveURL(periodBaseURL, as.BaseURL)
-			}
+			asBaseURLs := resolveBaseURLs(periodBaseURLs, as.BaseURL)
 
 			mediaType := detectMediaType(as.ContentType, as.MimeType, as.Codecs)
 
 			for _, rep := range as.Representations {
-				repBaseURL := asBaseURL
-				if rep.BaseURL != "" {
-					repBaseURL = hls.ResolveURL(asBaseURL, rep.BaseURL)
-				}
+				repBaseURLs := resolveBaseURLs(asBaseURLs, rep.BaseURL)
 
 				codecs := rep.Codecs
 				if codecs == "" {
@@ -164,32 +237,95 @@ func ParseMPD(content string, baseURL string) (*model.ParseResult, error) {
 					Resolution: resolution,
 				}
 
+				for _, cp := range as.ContentProtection {
+					spec.AddProtection(parseContentProtection(cp))
+				}
+				for _, cp := range rep.ContentProtection {
+					spec.AddProtection(parseContentProtection(cp))
+				}
+
 				// Build segment list from template, list, or base
-				playlist, err := buildPlaylist(rep, as, repBaseURL, periodDuration, isLive)
+				playlist, err := buildPlaylist(d, rep, as, repBaseURLs[0], periodDuration, window, periodStart)
 				if err != nil {
 					return nil, fmt.Errorf("build playlist for rep %s: %w", rep.ID, err)
 				}
+				if isLive {
+					playlist.IsLive = true
+					playlist.UpdatePeriod = updatePeriod
+					for _, seg := range playlist.Segments {
+						playlist.TargetDuration = max(playlist.TargetDuration, seg.Duration)
+					}
+				}
+				for _, mirror := range repBaseURLs[1:] {
+					// Same segment info, so the lists line up one to one
+					mp, err := buildPlaylist(&diagnostics{}, rep, as, mirror, periodDuration, window, periodStart)
+					if err != nil {
+						continue
+					}
+					addSegmentMirrors(playlist, mp)
+					spec.Mirrors = append(spec.Mirrors, mirror)
+				}
 				spec.Playlist = playlist
 
-				streams = append(streams, spec)
+				base := streamKey(&spec, as.ID, 0)
+				streams = append(streams, periodStream{key: streamKey(&spec, as.ID, seen[base]), spec: spec})
+				seen[base]++
 			}
 		}
+		periods = append(periods, streams)
 	}
+	streams := stitchPeriods(d, periods)
 
 	result := &model.ParseResult{
 		Streams:   streams,
 		IsLive:    isLive,
 		MergeType: model.MergeBinary, // DASH uses fMP4 typically
+		Warnings:  d.warnings,
 	}
 
 	return result, nil
 }
 
-// buildPlaylist constructs a Playlist from the representation's segment info.
-func buildPlaylist(rep Representation, as AdaptationSet, baseURL string, periodDuration float64, isLive bool) (*model.Playlist, error) {
-	playlist := &model.Playlist{
-		IsLive: isLive,
+// resolveBaseURLs resolves the BaseURL elements of one MPD level against
+// each base URL of its parent, first element first. A level without
+// BaseURL elements inherits its parent's.
+func resolveBaseURLs(parents, refs []string) []string {
+	if len(refs) == 0 {
+		return parents
+	}
+	var urls []string
+	for _, ref := range refs {
+		for _, parent := range parents {
+			u := hls.ResolveURL(parent, strings.TrimSpace(ref))
+			if !slices.Contains(urls, u) {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// addSegmentMirrors adds the URLs of mirror, built from another base URL,
+// to the matching segments of playlist.
+func addSegmentMirrors(playlist, mirror *model.Playlist) {
+	if len(mirror.Segments) != len(playlist.Segments) {
+		return
+	}
+	for i := range playlist.Segments {
+		if u := mirror.Segments[i].URL; u != playlist.Segments[i].URL {
+			playlist.Segments[i].Mirrors = append(playlist.Segments[i].Mirrors, u)
+		}
+	}
+	if init, m := playlist.MediaInit, mirror.MediaInit; init != nil && m != nil && m.URL != init.URL {
+		init.Mirrors = append(init.Mirrors, m.URL)
 	}
+}
+
+// buildPlaylist constructs a Playlist from the representation's segment info.
+// periodStart is the wall-clock start of the period, zero if unknown; window
+// limits the segments of a live MPD and is nil otherwise.
+func buildPlaylist(d *diagnostics, rep Representation, as AdaptationSet, baseURL string, periodDuration float64, window *liveWindow, periodStart time.Time) (*model.Playlist, error) {
+	playlist := &model.Playlist{}
 
 	// Prefer representation-level SegmentTemplate, fall back to AdaptationSet-level
 	tmpl := rep.SegmentTemplate
@@ -202,25 +338,46 @@ func buildPlaylist(rep Representation, as AdaptationSet, baseURL string, periodD
 		"$Bandwidth$":        strconv.FormatInt(rep.Bandwidth, 10),
 	}
 
+	var err error
 	switch {
 	case tmpl != nil:
-		return buildFromTemplate(tmpl, baseURL, periodDuration, isLive, vars)
+		playlist, err = buildFromTemplate(tmpl, baseURL, periodDuration, window, vars, periodStart)
+		if err == nil && len(playlist.Segments) == 0 && window == nil {
+			d.warnf("SegmentTemplate", "no segments for Representation %q: needs a SegmentTimeline, or a duration and a known period duration", rep.ID)
+		}
+		return playlist, err
 	case rep.SegmentList != nil:
-		return buildFromSegmentList(rep.SegmentList, baseURL, periodDuration)
+		playlist, err = buildFromSegmentList(d, rep.SegmentList, baseURL, periodDuration)
 	case rep.SegmentBase != nil:
-		return buildFromSegmentBase(rep.SegmentBase, baseURL, periodDuration)
+		playlist, err = buildFromSegmentBase(d, rep.SegmentBase, baseURL, periodDuration)
 	default:
 		// Single segment: BaseURL is the content
 		playlist.Segments = []model.Segment{
 			{Index: 0, URL: baseURL, Duration: periodDuration},
 		}
 		playlist.TotalDuration = periodDuration
-		return playlist, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Segments follow each other from the period start
+	if !periodStart.IsZero() {
+		at := periodStart
+		for i := range playlist.Segments {
+			playlist.Segments[i].ProgramDateTime = at
+			at = at.Add(seconds(playlist.Segments[i].Duration))
+		}
+	}
+	return playlist, nil
 }
 
-func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration float64, isLive bool, vars map[string]string) (*model.Playlist, error) {
-	playlist := &model.Playlist{IsLive: isLive}
+// buildFromTemplate lists the segments of a SegmentTemplate. With a live
+// window, only segments that have ended by the live edge and are still in
+// the time shift buffer are listed, numbered by their position in the
+// period.
+func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration float64, window *liveWindow, vars map[string]string, periodStart time.Time) (*model.Playlist, error) {
+	playlist := &model.Playlist{}
 
 	timescale := tmpl.Timescale
 	if timescale == 0 {
@@ -246,13 +403,41 @@ func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration flo
 		var currentTime int64
 		segIndex := 0
 
-		for _, s := range tmpl.SegmentTimeline.S {
+		var from, to float64
+		if window != nil && !periodStart.IsZero() {
+			from, to = window.span(periodStart)
+		} else {
+			window = nil
+		}
+
+		timeline := tmpl.SegmentTimeline.S
+		for si, s := range timeline {
 			if s.T > 0 {
 				currentTime = s.T
 			}
 			repeatCount := s.R
-			if repeatCount < 0 && periodDuration > 0 {
-				repeatCount = int64(math.Ceil(periodDuration*float64(timescale)/float64(s.D))) - 1
+			if repeatCount < 0 && s.D > 0 {
+				switch {
+				case periodDuration > 0:
+					repeatCount = int64(math.Ceil(periodDuration*float64(timescale)/float64(s.D))) - 1
+				case window != nil:
+					// Repeats up to the live edge or the next S element
+					end := tmpl.PresentationTimeOffset + int64(to*float64(timescale))
+					if si+1 < len(timeline) && timeline[si+1].T > 0 {
+						end = min(end, timeline[si+1].T)
+					}
+					repeatCount = (end-currentTime)/s.D - 1
+				}
+			}
+
+			if window != nil && s.D > 0 {
+				// Skip the segments that have left the time shift buffer
+				fromTime := tmpl.PresentationTimeOffset + int64(from*float64(timescale))
+				if skip := min((fromTime-currentTime)/s.D, repeatCount+1); skip > 0 {
+					currentTime += skip * s.D
+					segIndex += int(skip)
+					repeatCount -= skip
+				}
 			}
 
 			for j := int64(0); j <= repeatCount; j++ {
@@ -263,11 +448,15 @@ func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration flo
 				mediaURL := replaceVars(tmpl.Media, segVars)
 				duration := float64(s.D) / float64(timescale)
 
-				playlist.Segments = append(playlist.Segments, model.Segment{
+				seg := model.Segment{
 					Index:    segIndex,
 					URL:      hls.ResolveURL(baseURL, mediaURL),
 					Duration: duration,
-				})
+				}
+				if !periodStart.IsZero() {
+					seg.ProgramDateTime = periodStart.Add(seconds(float64(currentTime-tmpl.PresentationTimeOffset) / float64(timescale)))
+				}
+				playlist.Segments = append(playlist.Segments, seg)
 				playlist.TotalDuration += duration
 
 				currentTime += s.D
@@ -277,26 +466,38 @@ func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration flo
 	} else if tmpl.Duration > 0 {
 		// Duration-based segments
 		segDuration := float64(tmpl.Duration) / float64(timescale)
-		totalSegments := int(math.Ceil(periodDuration / segDuration))
+		first, totalSegments := 0, int(math.Ceil(periodDuration/segDuration))
+		if window != nil && !periodStart.IsZero() {
+			from, to := window.span(periodStart)
+			first = max(int(math.Floor(from/segDuration)), 0)
+			// Segments that have ended by the live edge, within the period
+			if live := int(math.Floor(to / segDuration)); periodDuration == 0 || live < totalSegments {
+				totalSegments = live
+			}
+		}
 
-		for i := 0; i < totalSegments; i++ {
+		for i := first; i < totalSegments; i++ {
 			segVars := copyVars(vars)
 			segVars["$Number$"] = strconv.FormatInt(startNumber+int64(i), 10)
 
 			mediaURL := replaceVars(tmpl.Media, segVars)
 
 			dur := segDuration
-			// Last segment may be shorter
+			// Last segment of a period may be shorter
 			remaining := periodDuration - float64(i)*segDuration
-			if remaining < segDuration {
+			if periodDuration > 0 && remaining < segDuration {
 				dur = remaining
 			}
 
-			playlist.Segments = append(playlist.Segments, model.Segment{
+			seg := model.Segment{
 				Index:    i,
 				URL:      hls.ResolveURL(baseURL, mediaURL),
 				Duration: dur,
-			})
+			}
+			if !periodStart.IsZero() {
+				seg.ProgramDateTime = periodStart.Add(seconds(float64(i) * segDuration))
+			}
+			playlist.Segments = append(playlist.Segments, seg)
 			playlist.TotalDuration += dur
 		}
 	}
@@ -304,7 +505,7 @@ func buildFromTemplate(tmpl *SegmentTemplate, baseURL string, periodDuration flo
 	return playlist, nil
 }
 
-func buildFromSegmentList(sl *SegmentList, baseURL string, periodDuration float64) (*model.Playlist, error) {
+func buildFromSegmentList(d *diagnostics, sl *SegmentList, baseURL string, periodDuration float64) (*model.Playlist, error) {
 	playlist := &model.Playlist{}
 
 	timescale := sl.Timescale
@@ -320,7 +521,7 @@ func buildFromSegmentList(sl *SegmentList, baseURL string, periodDuration float6
 			URL:   hls.ResolveURL(baseURL, sl.Initialization.SourceURL),
 		}
 		if sl.Initialization.Range != "" {
-			start, stop := parseRange(sl.Initialization.Range)
+			start, stop := d.parseRange("Initialization@range", sl.Initialization.Range)
 			initSeg.StartRange = start
 			initSeg.StopRange = stop
 		}
@@ -334,7 +535,7 @@ func buildFromSegmentList(sl *SegmentList, baseURL string, periodDuration float6
 			Duration: segDuration,
 		}
 		if su.MediaRange != "" {
-			start, stop := parseRange(su.MediaRange)
+			start, stop := d.parseRange("SegmentURL@mediaRange", su.MediaRange)
 			seg.StartRange = start
 			seg.StopRange = stop
 		}
@@ -345,7 +546,7 @@ func buildFromSegmentList(sl *SegmentList, baseURL string, periodDuration float6
 	return playlist, nil
 }
 
-func buildFromSegmentBase(sb *SegmentBase, baseURL string, periodDuration float64) (*model.Playlist, error) {
+func buildFromSegmentBase(d *diagnostics, sb *SegmentBase, baseURL string, periodDuration float64) (*model.Playlist, error) {
 	playlist := &model.Playlist{}
 
 	if sb.Initialization != nil {
@@ -358,7 +559,7 @@ func buildFromSegmentBase(sb *SegmentBase, baseURL string, periodDuration float6
 			URL:   initURL,
 		}
 		if sb.Initialization.Range != "" {
-			start, stop := parseRange(sb.Initialization.Range)
+			start, stop := d.parseRange("Initialization@range", sb.Initialization.Range)
 			initSeg.StartRange = start
 			initSeg.StopRange = stop
 		}
@@ -374,6 +575,39 @@ func buildFromSegmentBase(sb *SegmentBase, baseURL string, periodDuration float6
 	return playlist, nil
 }
 
+// parseContentProtection converts a ContentProtection element. The generic
+// mp4protection element carries the scheme; DRM-specific elements are
+// identified by a urn:uuid scheme and may embed a pssh box.
+func parseContentProtection(cp ContentProtection) model.Protection {
+	p := model.Protection{KID: normalizeKID(cp.DefaultKID)}
+
+	scheme := strings.ToLower(cp.SchemeIdUri)
+	switch {
+	case strings.HasPrefix(scheme, "urn:uuid:"):
+		p.SystemID = strings.TrimPrefix(scheme, "urn:uuid:")
+	case scheme == "urn:mpeg:dash:mp4protection:2011":
+		p.Scheme = cp.Value
+	}
+
+	if raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(cp.PSSH), "")); err == nil && len(raw) > 0 {
+		p.PSSH = raw
+		if pssh, err := mp4.ParsePssh(raw); err == nil {
+			if p.SystemID == "" {
+				p.SystemID = pssh.SystemID
+			}
+			if p.KID == "" {
+				p.KID = pssh.KID()
+			}
+		}
+	}
+	return p
+}
+
+// normalizeKID converts a UUID-style KID to 32 lower-case hex characters.
+func normalizeKID(kid string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(kid), "-", ""))
+}
+
 // replaceVars replaces template variables like $Number$, $RepresentationID$, etc.
 func replaceVars(template string, vars map[string]string) string {
 	result := template
@@ -403,6 +637,45 @@ func copyVars(vars map[string]string) map[string]string {
 	return m
 }
 
+// diagnostics collects the warnings for one MPD. encoding/xml keeps no
+// line numbers, so warnings name the element and attribute instead.
+type diagnostics struct {
+	url      string
+	warnings []model.ParseWarning
+}
+
+func (d *diagnostics) warnf(tag, format string, args ...any) {
+	d.warnings = append(d.warnings, model.ParseWarning{
+		URL:     d.url,
+		Tag:     tag,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// iso8601Duration matches the durations parseISO8601Duration understands.
+var iso8601Duration = regexp.MustCompile(`^P(\d+(\.\d+)?D)?(T(\d+(\.\d+)?H)?(\d+(\.\d+)?M)?(\d+(\.\d+)?S)?)?$`)
+
+// duration parses an xs:duration attribute, warning if it is malformed or
+// uses years or months.
+func (d *diagnostics) duration(tag, s string) float64 {
+	if s != "" && !iso8601Duration.MatchString(s) {
+		d.warnf(tag, "invalid duration %q", s)
+	}
+	return parseISO8601Duration(s)
+}
+
+// byteRange matches a "start-end" byte range.
+var byteRange = regexp.MustCompile(`^\d+-\d+$`)
+
+// parseRange parses a "start-end" byte range, warning if it is malformed.
+func (d *diagnostics) parseRange(tag, r string) (int64, int64) {
+	start, end := parseRange(r)
+	if !byteRange.MatchString(r) || end < start {
+		d.warnf(tag, "invalid byte range %q", r)
+	}
+	return start, end
+}
+
 // parseRange parses "start-end" byte range.
 func parseRange(r string) (int64, int64) {
 	parts := strings.SplitN(r, "-", 2)
@@ -496,3 +769,18 @@ func ParseDuration(s string) (time.Duration, error) {
 	}
 	return 0, fmt.Errorf("invalid duration: %s", s)
 }
+
+// parseDateTime parses an xs:dateTime attribute such as
+// availabilityStartTime. Values without a zone are taken as UTC.
+func parseDateTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -1,6 +1,7 @@
 package dash
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -108,3 +109,61 @@ func TestParseMPD_SegmentListNoInit(t *testing.T) {
 		t.Errorf("expected 2 segments, got %d", len(pl.Segments))
 	}
 }
+
+func TestParseMPD_Warnings(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static"
+     mediaPresentationDuration="P1Y" availabilityStartTime="soon">
+  <Period duration="PT6S">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="2000000">
+        <SegmentList duration="3" timescale="1">
+          <Initialization sourceURL="init.mp4" range="0-"/>
+          <SegmentURL media="seg1.m4s" mediaRange="100-199"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" mimeType="audio/mp4">
+      <Representation id="a1" bandwidth="128000">
+        <SegmentTemplate media="a_$Number$.m4s" initialization="a_init.mp4"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		`https://example.com/manifest.mpd: MPD@mediaPresentationDuration: invalid duration "P1Y"`,
+		`https://example.com/manifest.mpd: MPD@availabilityStartTime: invalid date time "soon"`,
+		`https://example.com/manifest.mpd: Initialization@range: invalid byte range "0-"`,
+		`https://example.com/manifest.mpd: SegmentTemplate: no segments for Representation "a1": needs a SegmentTimeline, or a duration and a known period duration`,
+	}
+	var got []string
+	for _, w := range result.Warnings {
+		got = append(got, w.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseMPD_NoWarnings(t *testing.T) {
+	for name, mpd := range map[string]string{
+		"vod":         vodMPD,
+		"timeline":    timelineMPD,
+		"segmentList": segmentListMPD,
+		"segmentBase": segmentBaseMPD,
+		"baseURL":     baseURLMPD,
+	} {
+		result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, w := range result.Warnings {
+			t.Errorf("%s: unexpected warning %s", name, w)
+		}
+	}
+}
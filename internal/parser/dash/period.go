@@ -0,0 +1,143 @@
+package dash
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// SkipPeriods selects the periods of an MPD that are left out, typically
+// the ad periods inserted between content periods.
+type SkipPeriods struct {
+	IDs         []string // Period@id values
+	MaxDuration float64  // periods no longer than this, in seconds; 0 for none
+}
+
+// match reports whether a period with the given id and duration in
+// seconds is skipped. A period of unknown duration is only skipped by id.
+func (s SkipPeriods) match(id string, duration float64) bool {
+	if id != "" && slices.Contains(s.IDs, id) {
+		return true
+	}
+	return s.MaxDuration > 0 && duration > 0 && duration <= s.MaxDuration
+}
+
+// periodStarts returns the start of each period in seconds from the start
+// of the presentation: its Period@start, or the end of the period before
+// it.
+func periodStarts(d *diagnostics, periods []Period) []float64 {
+	starts := make([]float64, len(periods))
+	var next float64
+	for i, period := range periods {
+		if period.Start != "" {
+			next = d.duration("Period@start", period.Start)
+		}
+		starts[i] = next
+		// Period@duration is reported when the period is parsed
+		next += parseISO8601Duration(period.Duration)
+	}
+	return starts
+}
+
+// periodStream is a stream of one period with the key that matches it to
+// the same stream in other periods.
+type periodStream struct {
+	key  string
+	spec model.StreamSpec
+}
+
+// streamKey identifies a representation across periods by media type,
+// AdaptationSet id, language, codecs and resolution. n tells apart the
+// representations of one period that share all of those, as the rungs of
+// a bitrate ladder may.
+func streamKey(spec *model.StreamSpec, asID string, n int) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d", spec.MediaType, asID, spec.Language, spec.Codecs, spec.Resolution, n)
+}
+
+// stitchPeriods joins the streams of consecutive periods into one stream
+// per representation, in order of first appearance. A stream missing from
+// some periods has no segments for them.
+func stitchPeriods(d *diagnostics, periods [][]periodStream) []model.StreamSpec {
+	var streams []model.StreamSpec
+	index := make(map[string]int) // key to position in streams
+	for _, period := range periods {
+		for _, ps := range period {
+			i, ok := index[ps.key]
+			if ok && !appendPeriod(&streams[i], &ps.spec) {
+				d.warnf("Period", "Representation %q has no init section in a later period, listed as a separate stream", ps.spec.GroupID)
+				ok = false
+			}
+			if !ok {
+				index[ps.key] = len(streams)
+				streams = append(streams, ps.spec)
+			}
+		}
+	}
+	return streams
+}
+
+// appendPeriod appends the segments of next, the same representation in a
+// later period, to stream. Each period starts a new discontinuity, and its
+// segments point to their own init section when it differs. It returns
+// false, leaving stream unchanged, if next has no init section while
+// stream has one: its segments would be merged with a foreign one.
+func appendPeriod(stream, next *model.StreamSpec) bool {
+	playlist, np := stream.Playlist, next.Playlist
+	if len(np.Segments) > 0 && len(playlist.Segments) > 0 && np.MediaInit == nil && playlist.MediaInit != nil {
+		return false
+	}
+
+	for _, p := range next.Protections {
+		stream.AddProtection(p)
+	}
+	for _, m := range next.Mirrors {
+		if !slices.Contains(stream.Mirrors, m) {
+			stream.Mirrors = append(stream.Mirrors, m)
+		}
+	}
+
+	if len(np.Segments) == 0 {
+		return true
+	}
+	if len(playlist.Segments) == 0 {
+		// Nothing of the earlier periods is available, as when a live
+		// window has moved past them
+		np.IsLive = np.IsLive || playlist.IsLive
+		stream.Playlist = np
+		return true
+	}
+
+	inits := playlist.Inits()
+	init := np.MediaInit
+	if init != nil {
+		if i := slices.IndexFunc(inits, func(s *model.Segment) bool { return sameInit(s, init) }); i >= 0 {
+			init = inits[i]
+		} else {
+			init.Index = -1 - len(inits)
+		}
+	}
+
+	offset := len(playlist.Segments)
+	playlist.Discontinuities = append(playlist.Discontinuities, offset)
+	for _, b := range np.Discontinuities {
+		playlist.Discontinuities = append(playlist.Discontinuities, offset+b)
+	}
+	last := playlist.Segments[offset-1]
+	for _, seg := range np.Segments {
+		seg.Index = len(playlist.Segments)
+		seg.Discontinuity += last.Discontinuity + 1
+		if init != playlist.MediaInit {
+			seg.Init = init
+		}
+		playlist.Segments = append(playlist.Segments, seg)
+	}
+	playlist.TotalDuration += np.TotalDuration
+	playlist.TargetDuration = max(playlist.TargetDuration, np.TargetDuration)
+	return true
+}
+
+// sameInit reports whether two init sections are the same bytes.
+func sameInit(a, b *model.Segment) bool {
+	return a.URL == b.URL && a.StartRange == b.StartRange && a.StopRange == b.StopRange
+}
@@ -0,0 +1,226 @@
+package dash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+const multiPeriodMPD = `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT50S">
+  <Period id="main-1">
+    <BaseURL>main1/</BaseURL>
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.64001f">
+      <SegmentTemplate media="$RepresentationID$_$Number$.m4s" initialization="/init/$RepresentationID$.mp4" duration="10"/>
+      <Representation id="v720" bandwidth="1000000" width="1280" height="720"/>
+      <Representation id="v1080" bandwidth="3000000" width="1920" height="1080"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="audio" mimeType="audio/mp4" codecs="mp4a.40.2" lang="en">
+      <SegmentTemplate media="a_$Number$.m4s" initialization="/init/a.mp4" duration="10"/>
+      <Representation id="a" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+  <Period id="ad" start="PT20S">
+    <BaseURL>ad/</BaseURL>
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.64001f">
+      <SegmentTemplate media="ad_$Number$.m4s" initialization="ad_init.mp4" duration="10"/>
+      <Representation id="ad720" bandwidth="800000" width="1280" height="720"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="audio" mimeType="audio/mp4" codecs="mp4a.40.2" lang="en">
+      <SegmentTemplate media="ad_a_$Number$.m4s" initialization="ad_a_init.mp4" duration="10"/>
+      <Representation id="ad_a" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+  <Period id="main-2" start="PT30S">
+    <BaseURL>main2/</BaseURL>
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.64001f">
+      <SegmentTemplate media="$RepresentationID$_$Number$.m4s" initialization="/init/$RepresentationID$.mp4" duration="10"/>
+      <Representation id="v720" bandwidth="1000000" width="1280" height="720"/>
+      <Representation id="v1080" bandwidth="3000000" width="1920" height="1080"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="audio" mimeType="audio/mp4" codecs="mp4a.40.2" lang="en">
+      <SegmentTemplate media="a_$Number$.m4s" initialization="/init/a.mp4" duration="10"/>
+      <Representation id="a" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+// describe lists the segments of a stream as path:discontinuity:init.
+func describe(p *model.Playlist) string {
+	var parts []string
+	for i := range p.Segments {
+		seg := &p.Segments[i]
+		init := "-"
+		if in := p.InitOf(seg); in != nil {
+			init = strings.TrimPrefix(in.URL, "https://example.com/")
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%s", strings.TrimPrefix(seg.URL, "https://example.com/"), seg.Discontinuity, init))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseMPD_StitchPeriods(t *testing.T) {
+	result, err := ParseMPD(multiPeriodMPD, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("warnings: %v", result.Warnings)
+	}
+	if len(result.Streams) != 3 {
+		t.Fatalf("expected 3 stitched streams, got %d", len(result.Streams))
+	}
+
+	tests := []struct {
+		group    string
+		segments string
+		inits    int
+	}{
+		{
+			group:    "v720",
+			segments: "main1/v720_1.m4s:0:init/v720.mp4 main1/v720_2.m4s:0:init/v720.mp4 ad/ad_1.m4s:1:ad/ad_init.mp4 main2/v720_1.m4s:2:init/v720.mp4 main2/v720_2.m4s:2:init/v720.mp4",
+			inits:    2,
+		},
+		{
+			// Missing from the ad period
+			group:    "v1080",
+			segments: "main1/v1080_1.m4s:0:init/v1080.mp4 main1/v1080_2.m4s:0:init/v1080.mp4 main2/v1080_1.m4s:1:init/v1080.mp4 main2/v1080_2.m4s:1:init/v1080.mp4",
+			inits:    1,
+		},
+		{
+			group:    "a",
+			segments: "main1/a_1.m4s:0:init/a.mp4 main1/a_2.m4s:0:init/a.mp4 ad/ad_a_1.m4s:1:ad/ad_a_init.mp4 main2/a_1.m4s:2:init/a.mp4 main2/a_2.m4s:2:init/a.mp4",
+			inits:    2,
+		},
+	}
+	for i, tt := range tests {
+		s := result.Streams[i]
+		if s.GroupID != tt.group {
+			t.Errorf("stream %d: GroupID = %q, want %q", i, s.GroupID, tt.group)
+			continue
+		}
+		if got := describe(s.Playlist); got != tt.segments {
+			t.Errorf("%s segments:\n got %s\nwant %s", tt.group, got, tt.segments)
+		}
+		if got := len(s.Playlist.Inits()); got != tt.inits {
+			t.Errorf("%s: %d inits, want %d", tt.group, got, tt.inits)
+		}
+		for j, seg := range s.Playlist.Segments {
+			if seg.Index != j {
+				t.Errorf("%s: segment %d has index %d", tt.group, j, seg.Index)
+			}
+		}
+	}
+	if d := result.Streams[0].Playlist.TotalDuration; d != 50 {
+		t.Errorf("TotalDuration = %v, want 50", d)
+	}
+}
+
+func TestParseMPD_SkipPeriods(t *testing.T) {
+	tests := []struct {
+		name string
+		skip SkipPeriods
+		want string
+	}{
+		{
+			name: "by id",
+			skip: SkipPeriods{IDs: []string{"ad"}},
+			want: "main1/v720_1.m4s:0:init/v720.mp4 main1/v720_2.m4s:0:init/v720.mp4 main2/v720_1.m4s:1:init/v720.mp4 main2/v720_2.m4s:1:init/v720.mp4",
+		},
+		{
+			name: "by duration",
+			skip: SkipPeriods{MaxDuration: 10},
+			want: "main1/v720_1.m4s:0:init/v720.mp4 main1/v720_2.m4s:0:init/v720.mp4 main2/v720_1.m4s:1:init/v720.mp4 main2/v720_2.m4s:1:init/v720.mp4",
+		},
+		{
+			name: "first period",
+			skip: SkipPeriods{IDs: []string{"main-1"}},
+			want: "ad/ad_1.m4s:0:ad/ad_init.mp4 main2/v720_1.m4s:1:init/v720.mp4 main2/v720_2.m4s:1:init/v720.mp4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseMPD(multiPeriodMPD, "https://example.com/manifest.mpd", time.Now(), tt.skip)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := describe(result.Streams[0].Playlist); got != tt.want {
+				t.Errorf("segments:\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMPD_StitchedPeriodsAreDiscontinuityGroups(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <Period id="p0" duration="PT4S">
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="p0_$Number$.m4s" initialization="init.mp4" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period id="p1">
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="p1_$Number$.m4s" initialization="init.mp4" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var groups []string
+	for _, g := range result.Streams[0].Playlist.DiscontinuityGroups() {
+		var names []string
+		for _, seg := range g {
+			names = append(names, strings.TrimPrefix(seg.URL, "https://example.com/"))
+		}
+		groups = append(groups, strings.Join(names, ","))
+	}
+	if want := "[p0_1.m4s,p0_2.m4s p1_1.m4s,p1_2.m4s,p1_3.m4s]"; fmt.Sprint(groups) != want {
+		t.Errorf("groups = %v, want %s", groups, want)
+	}
+}
+
+func TestParseMPD_PeriodWithoutInitIsNotStitched(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT8S">
+  <Period id="p0" duration="PT4S">
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="p0_$Number$.m4s" initialization="init.mp4" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period id="p1">
+    <AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="p1_$Number$.m4s" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(result.Streams))
+	}
+	if got := describe(result.Streams[0].Playlist); got != "p0_1.m4s:0:init.mp4 p0_2.m4s:0:init.mp4" {
+		t.Errorf("first stream: %s", got)
+	}
+	if got := describe(result.Streams[1].Playlist); got != "p1_1.m4s:0:- p1_2.m4s:0:-" {
+		t.Errorf("second stream: %s", got)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0].Message, "no init section") {
+		t.Errorf("warnings = %v", result.Warnings)
+	}
+}
@@ -1,6 +1,14 @@
 package parser
 
-import "strings"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
 
 // StreamType represents the detected protocol type.
 type StreamType int
@@ -9,8 +17,29 @@ const (
 	StreamUnknown StreamType = iota
 	StreamHLS
 	StreamDASH
+	StreamMSS // Microsoft Smooth Streaming manifest
+	StreamMP4 // plain MP4 file rather than a manifest
+	StreamTS  // plain MPEG-TS file rather than a manifest
 )
 
+// String returns a human-readable name for the stream type.
+func (t StreamType) String() string {
+	switch t {
+	case StreamHLS:
+		return "hls"
+	case StreamDASH:
+		return "dash"
+	case StreamMSS:
+		return "mss"
+	case StreamMP4:
+		return "mp4"
+	case StreamTS:
+		return "ts"
+	default:
+		return "unknown"
+	}
+}
+
 // DetectType detects the stream type from a URL.
 func DetectType(url string) StreamType {
 	lower := strings.ToLower(url)
@@ -29,3 +58,96 @@ func DetectType(url string) StreamType {
 		return StreamUnknown
 	}
 }
+
+// sniffLen is how much of a response DetectContent looks at.
+const sniffLen = 512
+
+// contentTypes maps response media types to stream types.
+var contentTypes = map[string]StreamType{
+	"application/vnd.apple.mpegurl": StreamHLS,
+	"application/x-mpegurl":         StreamHLS,
+	"audio/mpegurl":                 StreamHLS,
+	"audio/x-mpegurl":               StreamHLS,
+	"application/dash+xml":          StreamDASH,
+	"application/vnd.ms-sstr+xml":   StreamMSS,
+	"video/mp4":                     StreamMP4,
+	"audio/mp4":                     StreamMP4,
+	"video/mp2t":                    StreamTS,
+}
+
+// DetectContent detects the stream type from the first bytes of a
+// response and its Content-Type header. The bytes win, since servers
+// often send manifests as text/plain or application/octet-stream.
+func DetectContent(contentType string, head []byte) StreamType {
+	if t := sniff(head); t != StreamUnknown {
+		return t
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return StreamUnknown
+	}
+	return contentTypes[strings.ToLower(mediaType)]
+}
+
+func sniff(head []byte) StreamType {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+
+	// Binary containers
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return StreamMP4
+	}
+	// Two sync bytes one 188-byte packet apart
+	if len(head) > 188 && head[0] == 0x47 && head[188] == 0x47 {
+		return StreamTS
+	}
+
+	// Text manifests, possibly behind a BOM or an XML declaration
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("#EXTM3U")):
+		return StreamHLS
+	case bytes.Contains(text, []byte("<MPD")):
+		return StreamDASH
+	case bytes.Contains(text, []byte("<SmoothStreamingMedia")):
+		return StreamMSS
+	}
+	return StreamUnknown
+}
+
+// Detect determines the stream type of a URL. A .m3u8 or .mpd extension
+// is trusted as is; otherwise the URL is requested and its Content-Type
+// and first bytes are inspected. A nil client uses http.DefaultClient.
+func Detect(ctx context.Context, client *http.Client, url string, headers map[string]string) (StreamType, error) {
+	if t := DetectType(url); t != StreamUnknown {
+		return t, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return StreamUnknown, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return StreamUnknown, fmt.Errorf("probe stream type: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return StreamUnknown, fmt.Errorf("probe stream type: HTTP %d", resp.StatusCode)
+	}
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, sniffLen))
+	if err != nil {
+		return StreamUnknown, fmt.Errorf("probe stream type: %w", err)
+	}
+	return DetectContent(resp.Header.Get("Content-Type"), head), nil
+}
@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		url  string
+		want StreamType
+	}{
+		{"https://example.com/video.m3u8", StreamHLS},
+		{"https://example.com/VIDEO.M3U8?token=abc", StreamHLS},
+		{"https://example.com/list.m3u", StreamHLS},
+		{"https://example.com/manifest.mpd?x=1", StreamDASH},
+		{"https://example.com/playlist?id=123", StreamUnknown},
+		{"https://example.com/manifest(format=mpd-time-csf)", StreamUnknown},
+	}
+	for _, tt := range tests {
+		if got := DetectType(tt.url); got != tt.want {
+			t.Errorf("DetectType(%q) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDetectContent(t *testing.T) {
+	ts := make([]byte, 376)
+	ts[0], ts[188] = 0x47, 0x47
+
+	tests := []struct {
+		name        string
+		contentType string
+		head        []byte
+		want        StreamType
+	}{
+		{"hls bytes", "text/plain", []byte("#EXTM3U\n#EXT-X-VERSION:3\n"), StreamHLS},
+		{"hls with BOM", "", []byte("\xef\xbb\xbf\r\n#EXTM3U\n"), StreamHLS},
+		{"dash bytes", "application/octet-stream", []byte(`<?xml version="1.0"?>` + "\n" + `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011">`), StreamDASH},
+		{"smooth bytes", "text/xml", []byte(`<?xml version="1.0"?><SmoothStreamingMedia MajorVersion="2">`), StreamMSS},
+		{"mp4 bytes", "", []byte("\x00\x00\x00\x18ftypmp42"), StreamMP4},
+		{"ts bytes", "", ts, StreamTS},
+		{"text starting with G", "", []byte("Gone"), StreamUnknown},
+		{"hls content type", "application/vnd.apple.mpegurl; charset=utf-8", []byte("garbage"), StreamHLS},
+		{"x-mpegurl content type", "Application/X-MpegURL", nil, StreamHLS},
+		{"dash content type", "application/dash+xml", nil, StreamDASH},
+		{"ts content type", "video/MP2T", nil, StreamTS},
+		{"bytes win over content type", "application/dash+xml", []byte("#EXTM3U\n"), StreamHLS},
+		{"unknown", "text/html", []byte("<html><body>not found</body></html>"), StreamUnknown},
+		{"bad content type", ";;", nil, StreamUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContent(tt.contentType, tt.head); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	var probes int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist", func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		if r.Header.Get("Cookie") != "session=1" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("#EXTM3U\n"))
+	})
+	mux.HandleFunc("/manifest(format=mpd-time-csf)", func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Write(bytes.Repeat([]byte(" "), 2048))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	headers := map[string]string{"Cookie": "session=1"}
+	tests := []struct {
+		path string
+		want StreamType
+	}{
+		{"/playlist?id=123", StreamHLS},
+		{"/manifest(format=mpd-time-csf)", StreamDASH},
+		{"/video.m3u8", StreamHLS}, // extension, no request
+	}
+	for _, tt := range tests {
+		got, err := Detect(context.Background(), server.Client(), server.URL+tt.path, headers)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, got, tt.want)
+		}
+	}
+	if probes != 2 {
+		t.Errorf("expected 2 probe requests, got %d", probes)
+	}
+
+	_, err := Detect(context.Background(), server.Client(), server.URL+"/playlist", nil)
+	if err == nil || !strings.Contains(err.Error(), "HTTP 403") {
+		t.Errorf("expected HTTP error, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package hls
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// cueTolerance is how far the segments of a break may fall short of its
+// signalled duration and still cover it, for rounded segment durations.
+const cueTolerance = 0.5
+
+// cueTracker collects the ad breaks of a media playlist while it is
+// parsed. EXT-X-CUE-OUT breaks are applied to segments as they are read;
+// EXT-X-DATERANGE breaks are placed by program date time once the whole
+// playlist is known.
+type cueTracker struct {
+	markers    []model.Marker
+	open       int            // index into markers of the break in progress, -1 if none
+	dateRanges map[string]int // DATERANGE ID -> index into markers
+	lines      map[int]int    // index into markers -> line of its tag
+	scte35     string         // EXT-OATCLS-SCTE35 awaiting its EXT-X-CUE-OUT
+}
+
+func newCueTracker() *cueTracker {
+	return &cueTracker{open: -1, dateRanges: make(map[string]int), lines: make(map[int]int)}
+}
+
+// cueOut handles an EXT-X-CUE-OUT tag on line n, which starts a break at
+// the next segment. Its duration is either the plain tag value or a
+// DURATION attribute.
+func (t *cueTracker) cueOut(d *diagnostics, n int, line string) {
+	attrs := ParseAttributes(line)
+	val := attrs["DURATION"]
+	if v := GetAttribute(line, ""); val == "" && !strings.Contains(v, "=") {
+		val = v
+	}
+	m := model.Marker{
+		Tag:       TagCueOut,
+		Duration:  d.parseFloat(n, line, "duration", val),
+		SCTE35Out: t.takeSCTE35(d, n, line, attrs["SCTE35"]),
+	}
+	t.start(m, n)
+}
+
+// cueOutCont handles an EXT-X-CUE-OUT-CONT tag on line n. It only starts
+// a break when the playlist begins in the middle of one; either form,
+// "ElapsedTime=5,Duration=30" or "5/30", is accepted.
+func (t *cueTracker) cueOutCont(d *diagnostics, n int, line string) {
+	attrs := ParseAttributes(line)
+	elapsed, duration := attrs["ElapsedTime"], attrs["Duration"]
+	if v := GetAttribute(line, ""); !strings.Contains(v, "=") {
+		elapsed, duration, _ = strings.Cut(v, "/")
+	}
+	if t.open >= 0 {
+		if m := &t.markers[t.open]; m.Duration == 0 {
+			m.Duration = d.parseFloat(n, line, "duration", duration)
+		}
+		return
+	}
+	m := model.Marker{
+		Tag:       TagCueOut,
+		Elapsed:   d.parseFloat(n, line, "elapsed time", elapsed),
+		Duration:  d.parseFloat(n, line, "duration", duration),
+		SCTE35Out: t.takeSCTE35(d, n, line, attrs["SCTE35"]),
+	}
+	t.start(m, n)
+}
+
+// cueIn ends the break in progress.
+func (t *cueTracker) cueIn() {
+	t.open = -1
+}
+
+// oatcls holds an EXT-OATCLS-SCTE35 splice info section for the
+// EXT-X-CUE-OUT that follows it.
+func (t *cueTracker) oatcls(line string) {
+	t.scte35 = GetAttribute(line, "")
+}
+
+// takeSCTE35 returns the base64 splice info section of a cue tag, or the
+// pending EXT-OATCLS-SCTE35 one, as a DATERANGE style hex string.
+func (t *cueTracker) takeSCTE35(d *diagnostics, n int, line, val string) string {
+	if val == "" {
+		val, t.scte35 = t.scte35, ""
+	}
+	if val == "" {
+		return ""
+	}
+	b, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		d.warnf(n, line, "invalid SCTE-35 data %q", val)
+		return ""
+	}
+	return "0x" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+func (t *cueTracker) start(m model.Marker, n int) {
+	m.FirstSegment, m.LastSegment = -1, -1
+	t.markers = append(t.markers, m)
+	t.open = len(t.markers) - 1
+	t.lines[t.open] = n
+}
+
+// dateRange handles an EXT-X-DATERANGE tag on line n. Only ranges with
+// SCTE-35 data are ad breaks; a later tag with the same ID adds to the
+// earlier one, typically its END-DATE and SCTE35-IN.
+func (t *cueTracker) dateRange(d *diagnostics, n int, line string) {
+	attrs := ParseAttributes(line)
+	if attrs["SCTE35-OUT"] == "" && attrs["SCTE35-IN"] == "" && attrs["SCTE35-CMD"] == "" {
+		return
+	}
+	id := attrs["ID"]
+	if id == "" {
+		d.warnf(n, line, "missing ID")
+	}
+
+	idx, ok := t.dateRanges[id]
+	if !ok || id == "" {
+		t.markers = append(t.markers, model.Marker{Tag: TagDateRange, ID: id, FirstSegment: -1, LastSegment: -1})
+		idx = len(t.markers) - 1
+		t.dateRanges[id] = idx
+		t.lines[idx] = n
+	}
+	m := &t.markers[idx]
+	date := func(name string) time.Time {
+		val := attrs[name]
+		if val == "" {
+			return time.Time{}
+		}
+		tm := ParseDateTime(val)
+		if tm.IsZero() {
+			d.warnf(n, line, "invalid %s %q", name, val)
+		}
+		return tm
+	}
+	set := func(dst *string, name string) {
+		if v := attrs[name]; v != "" {
+			*dst = v
+		}
+	}
+	set(&m.Class, "CLASS")
+	set(&m.SCTE35Out, "SCTE35-OUT")
+	set(&m.SCTE35In, "SCTE35-IN")
+	set(&m.SCTE35Cmd, "SCTE35-CMD")
+	if tm := date("START-DATE"); !tm.IsZero() {
+		m.StartDate = tm
+	}
+	if tm := date("END-DATE"); !tm.IsZero() {
+		m.EndDate = tm
+	}
+	if v := attrs["DURATION"]; v != "" {
+		m.Duration = d.parseFloat(n, line, "DURATION", v)
+	} else if v := attrs["PLANNED-DURATION"]; v != "" && m.Duration == 0 {
+		m.Duration = d.parseFloat(n, line, "PLANNED-DURATION", v)
+	}
+}
+
+// segment marks seg as an ad if a cue break is in progress.
+func (t *cueTracker) segment(seg *model.Segment) {
+	if t.open < 0 {
+		return
+	}
+	seg.Ad = true
+	m := &t.markers[t.open]
+	if m.FirstSegment < 0 {
+		m.FirstSegment = seg.Index
+	}
+	m.LastSegment = seg.Index
+}
+
+// finish places the DATERANGE breaks on the segments, ends cue breaks
+// that ran past their signalled duration without an EXT-X-CUE-IN, and
+// stores the markers in the playlist.
+func (t *cueTracker) finish(playlist *model.Playlist, d *diagnostics) {
+	segs := playlist.Segments
+	for i := range t.markers {
+		m := &t.markers[i]
+		switch {
+		case m.Tag == TagCueOut && m.Duration > 0 && m.FirstSegment >= 0:
+			left := m.Duration - m.Elapsed
+			first, last := m.FirstSegment, m.LastSegment
+			var covered float64
+			for j := range segs {
+				seg := &segs[j]
+				if seg.Index < first || seg.Index > last {
+					continue
+				}
+				if covered >= left-cueTolerance {
+					seg.Ad = false
+					continue
+				}
+				m.LastSegment = seg.Index
+				covered += seg.Duration
+			}
+
+		case m.Tag == TagDateRange && m.SCTE35Out != "" && !m.StartDate.IsZero():
+			if len(segs) == 0 || segs[0].ProgramDateTime.IsZero() {
+				d.warnf(t.lines[i], TagDateRange, "ad break cannot be placed without #EXT-X-PROGRAM-DATE-TIME")
+				continue
+			}
+			end := m.EndDate
+			if end.IsZero() && m.Duration > 0 {
+				end = m.StartDate.Add(seconds(m.Duration))
+			}
+			for j := range segs {
+				seg := &segs[j]
+				// Segment midpoints tolerate rounded dates
+				mid := seg.ProgramDateTime.Add(seconds(seg.Duration / 2))
+				if mid.Before(m.StartDate) || (!end.IsZero() && !mid.Before(end)) {
+					continue
+				}
+				seg.Ad = true
+				if m.FirstSegment < 0 {
+					m.FirstSegment = seg.Index
+				}
+				m.LastSegment = seg.Index
+			}
+		}
+	}
+	playlist.Markers = t.markers
+}
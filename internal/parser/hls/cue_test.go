@@ -0,0 +1,175 @@
+package hls
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// adIndices returns the Index of every segment marked as an ad.
+func adIndices(p *model.Playlist) []int {
+	var ads []int
+	for _, seg := range p.Segments {
+		if seg.Ad {
+			ads = append(ads, seg.Index)
+		}
+	}
+	return ads
+}
+
+func TestParseMediaPlaylist_CueMarkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		ads      []int
+		markers  []model.Marker
+		warnings int
+	}{
+		{
+			name: "cue out and in",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXTINF:10,
+s0.ts
+#EXT-OATCLS-SCTE35:/DAlAAAAAAAAAP/wFAUAAAABf+/+AAAAAH4AKTLgAAEAAAAAAAA=
+#EXT-X-CUE-OUT:30
+#EXTINF:10,
+s1.ts
+#EXT-X-CUE-OUT-CONT:ElapsedTime=10,Duration=30
+#EXTINF:10,
+s2.ts
+#EXT-X-CUE-OUT-CONT:ElapsedTime=20,Duration=30
+#EXTINF:10,
+s3.ts
+#EXT-X-CUE-IN
+#EXTINF:10,
+s4.ts
+#EXT-X-ENDLIST
+`,
+			ads: []int{1, 2, 3},
+			markers: []model.Marker{{
+				Tag: TagCueOut, Duration: 30, FirstSegment: 1, LastSegment: 3,
+				SCTE35Out: "0xFC302500000000000000FFF01405000000017FEFFE000000007E002932E00001000000000000",
+			}},
+		},
+		{
+			name: "duration ends break without cue in",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-CUE-OUT:DURATION=12
+#EXTINF:6,
+s0.ts
+#EXTINF:5.96,
+s1.ts
+#EXTINF:6,
+s2.ts
+#EXT-X-ENDLIST
+`,
+			ads:     []int{100, 101},
+			markers: []model.Marker{{Tag: TagCueOut, Duration: 12, FirstSegment: 100, LastSegment: 101}},
+		},
+		{
+			name: "playlist starts inside a break",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-CUE-OUT-CONT:18/30
+#EXTINF:6,
+s0.ts
+#EXT-X-CUE-OUT-CONT:24/30
+#EXTINF:6,
+s1.ts
+#EXTINF:6,
+s2.ts
+`,
+			ads:     []int{0, 1},
+			markers: []model.Marker{{Tag: TagCueOut, Elapsed: 18, Duration: 30, FirstSegment: 0, LastSegment: 1}},
+		},
+		{
+			name: "open break runs to the live edge",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6,
+s0.ts
+#EXT-X-CUE-OUT
+#EXTINF:6,
+s1.ts
+`,
+			ads:     []int{1},
+			markers: []model.Marker{{Tag: TagCueOut, FirstSegment: 1, LastSegment: 1}},
+		},
+		{
+			name: "daterange placed by program date time",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXT-X-DATERANGE:ID="ad1",CLASS="com.example.ad",START-DATE="2024-01-01T00:00:10.000Z",PLANNED-DURATION=20,SCTE35-OUT=0xFC01
+#EXT-X-DATERANGE:ID="chapter",START-DATE="2024-01-01T00:00:00Z"
+#EXTINF:10,
+s0.ts
+#EXTINF:10,
+s1.ts
+#EXTINF:10,
+s2.ts
+#EXT-X-DATERANGE:ID="ad1",START-DATE="2024-01-01T00:00:10.000Z",END-DATE="2024-01-01T00:00:30.000Z",SCTE35-IN=0xFC02
+#EXTINF:10,
+s3.ts
+#EXT-X-ENDLIST
+`,
+			ads: []int{1, 2},
+			markers: []model.Marker{{
+				Tag: TagDateRange, ID: "ad1", Class: "com.example.ad",
+				StartDate: time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC),
+				EndDate:   time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC),
+				Duration:  20, SCTE35Out: "0xFC01", SCTE35In: "0xFC02",
+				FirstSegment: 1, LastSegment: 2,
+			}},
+		},
+		{
+			name: "daterange without program date time",
+			content: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-DATERANGE:ID="ad1",START-DATE="2024-01-01T00:00:10Z",DURATION=10,SCTE35-OUT=0xFC01
+#EXTINF:10,
+s0.ts
+#EXT-X-ENDLIST
+`,
+			markers: []model.Marker{{
+				Tag: TagDateRange, ID: "ad1", StartDate: time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC),
+				Duration: 10, SCTE35Out: "0xFC01", FirstSegment: -1, LastSegment: -1,
+			}},
+			warnings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &diagnostics{url: "http://example.com/media.m3u8"}
+			p, err := parseMediaPlaylist(tt.content, "http://example.com/", nil, d)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if got := adIndices(p); !slices.Equal(got, tt.ads) {
+				t.Errorf("ad segments = %v, want %v", got, tt.ads)
+			}
+			if len(p.Markers) != len(tt.markers) {
+				t.Fatalf("markers = %+v, want %+v", p.Markers, tt.markers)
+			}
+			for i, m := range p.Markers {
+				want := tt.markers[i]
+				if !m.StartDate.Equal(want.StartDate) || !m.EndDate.Equal(want.EndDate) {
+					t.Errorf("marker %d dates = %v-%v, want %v-%v", i, m.StartDate, m.EndDate, want.StartDate, want.EndDate)
+				}
+				m.StartDate, m.EndDate, want.StartDate, want.EndDate = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+				if m != want {
+					t.Errorf("marker %d = %+v\nwant %+v", i, m, want)
+				}
+			}
+			if len(d.warnings) != tt.warnings {
+				t.Errorf("warnings = %v, want %d", d.warnings, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package hls
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TagDefine declares a playlist variable.
+const TagDefine = "#EXT-X-DEFINE"
+
+// variableRef matches a {$name} variable reference.
+var variableRef = regexp.MustCompile(`\{\$([A-Za-z0-9_-]+)\}`)
+
+// lineError is a problem with one playlist line.
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// substituteVariables processes the #EXT-X-DEFINE tags of a playlist and
+// replaces {$name} references in the lines after each definition. NAME/VALUE
+// defines a variable, QUERYPARAM takes it from the query of playlistURL and
+// IMPORT takes it from imports, the variables of the master playlist.
+//
+// All lines are processed even on error: references that cannot be
+// resolved are left as is, and the first problem is returned.
+func substituteVariables(lines []string, playlistURL string, imports map[string]string) ([]string, map[string]string, error) {
+	vars := make(map[string]string)
+	var firstErr error
+	fail := func(err *lineError) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		line = variableRef.ReplaceAllStringFunc(line, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			if v, ok := vars[name]; ok {
+				return v
+			}
+			fail(&lineError{i + 1, fmt.Sprintf("undefined variable %q", name)})
+			return ref
+		})
+		out[i] = line
+
+		if !strings.HasPrefix(strings.TrimSpace(line), TagDefine) {
+			continue
+		}
+		attrs := ParseAttributes(strings.TrimSpace(line))
+		switch {
+		case attrs["NAME"] != "":
+			vars[attrs["NAME"]] = attrs["VALUE"]
+		case attrs["IMPORT"] != "":
+			name := attrs["IMPORT"]
+			v, ok := imports[name]
+			if !ok {
+				fail(&lineError{i + 1, fmt.Sprintf("imported variable %q is not defined in the master playlist", name)})
+				continue
+			}
+			vars[name] = v
+		case attrs["QUERYPARAM"] != "":
+			name := attrs["QUERYPARAM"]
+			u, err := url.Parse(playlistURL)
+			if err != nil || !u.Query().Has(name) {
+				fail(&lineError{i + 1, fmt.Sprintf("query parameter %q not in playlist URL", name)})
+				continue
+			}
+			vars[name] = u.Query().Get(name)
+		default:
+			fail(&lineError{i + 1, "invalid " + TagDefine})
+		}
+	}
+	return out, vars, firstErr
+}
+
+// MasterVariables returns the variables a master playlist defines, which
+// its media playlists can IMPORT.
+func MasterVariables(content, baseURL string) map[string]string {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	_, vars, _ := substituteVariables(lines, baseURL, nil)
+	return vars
+}
@@ -0,0 +1,129 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaPlaylist_DefineAndQueryParam(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-DEFINE:NAME="cdn",VALUE="https://cdn.example.com/v1"
+#EXT-X-DEFINE:QUERYPARAM="token"
+#EXT-X-KEY:METHOD=AES-128,URI="{$cdn}/key?token={$token}"
+#EXTINF:4.0,
+{$cdn}/seg0.ts?token={$token}
+#EXTINF:4.0,
+{$cdn}/seg1.ts?token={$token}
+#EXT-X-ENDLIST
+`
+	pl, err := ParseMediaPlaylist(content, "https://origin.example.com/media.m3u8?token=abc123&x=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := pl.Segments[1].URL; got != "https://cdn.example.com/v1/seg1.ts?token=abc123" {
+		t.Errorf("segment URL: %s", got)
+	}
+	if got := pl.Segments[0].EncryptInfo.KeyURL; got != "https://cdn.example.com/v1/key?token=abc123" {
+		t.Errorf("key URL: %s", got)
+	}
+}
+
+func TestParseMediaPlaylist_DefineErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		define  string
+		imports map[string]string
+		want    string
+	}{
+		{"undefined reference", "", nil, `line 4: undefined variable "base"`},
+		{"missing import", `#EXT-X-DEFINE:IMPORT="base"`, map[string]string{"other": "x"}, `imported variable "base" is not defined`},
+		{"missing query param", `#EXT-X-DEFINE:QUERYPARAM="base"`, nil, `query parameter "base" not in playlist URL`},
+		{"import ok", `#EXT-X-DEFINE:IMPORT="base"`, map[string]string{"base": "http://x"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "#EXTM3U\n" + tt.define + "\n#EXTINF:4.0,\n{$base}/seg0.ts\n"
+			pl, err := ParseMediaPlaylistWithImports(content, "http://example.com/media.m3u8", tt.imports)
+			if tt.want == "" {
+				if err != nil || pl.Segments[0].URL != "http://x/seg0.ts" {
+					t.Errorf("err=%v playlist=%+v", err, pl)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestParseMasterPlaylist_Define(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-DEFINE:NAME="path",VALUE="streams/v2"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="{$path}/audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aud"
+{$path}/video.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=500000
+{$missing}/low.m3u8
+`
+	streams := ParseMasterPlaylist(content, "http://example.com/master.m3u8")
+	var urls []string
+	for _, s := range streams {
+		urls = append(urls, s.URL)
+	}
+	want := []string{
+		"http://example.com/streams/v2/audio.m3u8",
+		"http://example.com/streams/v2/video.m3u8",
+		"http://example.com/%7B$missing%7D/low.m3u8",
+	}
+	if fmt.Sprint(urls) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", urls, want)
+	}
+	if vars := MasterVariables(content, "http://example.com/master.m3u8"); vars["path"] != "streams/v2" || len(vars) != 1 {
+		t.Errorf("master variables: %v", vars)
+	}
+}
+
+func TestParser_ImportsSurviveMediaReload(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-DEFINE:NAME=\"auth\",VALUE=\"sig=42\"\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nmedia.m3u8?{$auth}\n")
+	})
+	mux.HandleFunc("/media.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery == "" {
+			http.Error(w, "missing signature", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-DEFINE:IMPORT=\"auth\"\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts?{$auth}\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("parse master: %v", err)
+	}
+	stream := result.Streams[0]
+	if stream.URL != server.URL+"/media.m3u8?sig=42" {
+		t.Fatalf("variant URL: %s", stream.URL)
+	}
+	if got := stream.Playlist.Segments[0].URL; got != server.URL+"/seg0.ts?sig=42" {
+		t.Errorf("segment URL: %s", got)
+	}
+
+	// A live reload fetches the media playlist directly, with new query
+	// parameters, and must still resolve the imported variable
+	reload, err := p.Parse(context.Background(), stream.URL+"&_HLS_msn=1", nil)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := reload.Streams[0].Playlist.Segments[0].URL; got != server.URL+"/seg0.ts?sig=42" {
+		t.Errorf("reloaded segment URL: %s", got)
+	}
+}
@@ -0,0 +1,95 @@
+package hls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// knownTags are the tags the parser handles or deliberately ignores. Any
+// other #EXT tag is reported as unknown.
+var knownTags = map[string]bool{
+	TagExtM3U: true, TagExtInf: true, TagStreamInf: true, TagMedia: true,
+	TagKey: true, TagMap: true, TagByteRange: true, TagTargetDuration: true,
+	TagMediaSequence: true, TagDiscontinuity: true, TagDiscontinuitySeq: true,
+	TagEndList: true, TagPlaylistType: true, TagProgramDateTime: true,
+	TagIFrameStreamInf: true, TagIFramesOnly: true, TagImageStreamInf: true,
+	TagImagesOnly: true, TagTiles: true, TagPartInf: true, TagPart: true,
+	TagPreloadHint: true, TagServerControl: true, TagSkip: true, TagGap: true,
+	TagDefine: true, TagDateRange: true, TagCueOut: true, TagCueOutCont: true,
+	TagCueIn: true, TagOATCLSSCTE35: true, TagSessionData: true,
+	TagSessionKey: true, TagStart: true, TagIndependentSegs: true,
+	TagContentSteering: true,
+
+	// No effect on what is downloaded
+	"#EXT-X-VERSION":          true,
+	"#EXT-X-RENDITION-REPORT": true,
+	"#EXT-X-BITRATE":          true,
+	"#EXT-X-ALLOW-CACHE":      true,
+}
+
+// diagnostics collects the warnings for one playlist. A nil *diagnostics
+// discards them.
+type diagnostics struct {
+	url      string
+	warnings []model.ParseWarning
+}
+
+// warnf records a warning about line n, the trimmed text of that line.
+func (d *diagnostics) warnf(n int, line, format string, args ...any) {
+	if d == nil {
+		return
+	}
+	d.warnings = append(d.warnings, model.ParseWarning{
+		URL:     d.url,
+		Line:    n,
+		Tag:     tagName(line),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkTag warns about an unknown #EXT tag.
+func (d *diagnostics) checkTag(n int, line string) {
+	if strings.HasPrefix(line, "#EXT") && !knownTags[tagName(line)] {
+		d.warnf(n, line, "unknown tag")
+	}
+}
+
+// parseFloat parses a decimal value, warning if it is malformed. Empty
+// values are absent optional attributes and parse as 0 silently.
+func (d *diagnostics) parseFloat(n int, line, name, val string) float64 {
+	if val == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		d.warnf(n, line, "invalid %s %q", name, val)
+	}
+	return f
+}
+
+// parseInt is parseFloat for decimal integers.
+func (d *diagnostics) parseInt(n int, line, name, val string) int64 {
+	if val == "" {
+		return 0
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		d.warnf(n, line, "invalid %s %q", name, val)
+	}
+	return i
+}
+
+// tagName returns the tag of a playlist line, e.g. "#EXTINF", or "" for a
+// URI line.
+func tagName(line string) string {
+	if !strings.HasPrefix(line, "#") {
+		return ""
+	}
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
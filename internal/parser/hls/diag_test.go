@@ -0,0 +1,157 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaPlaylist_Warnings(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:ten
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-PLAYLIST-TYPE:LIVE
+#EXT-X-BYTERANGE:100@0
+#EXT-X-SPLICEPOINT-SCTE35:/DAIAAAAAAAAAAAQAAZ/I0VniQAQAgBDVUVJQAAAAH+cAAAAAA==
+#EXTINF:4.0,
+#EXTINF:abc,
+seg8.ts
+#EXT-X-PROGRAM-DATE-TIME:yesterday
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:12x@0
+seg9.ts
+orphan.ts
+#EXT-X-MAP:BYTERANGE="10@0"
+# plain comments are fine
+#EXTINF:4.0,
+`
+	d := &diagnostics{url: "http://example.com/media.m3u8"}
+	pl, err := parseMediaPlaylist(content, d.url, nil, d)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"2 #EXT-X-TARGETDURATION invalid duration \"ten\"",
+		"4 #EXT-X-PLAYLIST-TYPE unknown playlist type \"LIVE\"",
+		"5 #EXT-X-BYTERANGE no #EXTINF before the tag",
+		"6 #EXT-X-SPLICEPOINT-SCTE35 unknown tag",
+		"8 #EXTINF invalid duration \"abc\"",
+		"7 #EXTINF no URI follows, segment dropped",
+		"10 #EXT-X-PROGRAM-DATE-TIME invalid date time \"yesterday\"",
+		"12 #EXT-X-BYTERANGE invalid byte range \"12x@0\"",
+		"14  URI without #EXTINF ignored",
+		"15 #EXT-X-MAP missing URI",
+		"17 #EXTINF no URI follows, segment dropped",
+	}
+	var got []string
+	for _, w := range d.warnings {
+		if w.URL != d.url {
+			t.Errorf("warning URL: %s", w.URL)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s", w.Line, w.Tag, w.Message))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The parse itself still works around every problem
+	if len(pl.Segments) != 2 || pl.Segments[0].URL != "http://example.com/seg8.ts" || pl.Segments[0].Index != 8 {
+		t.Errorf("segments: %+v", pl.Segments)
+	}
+}
+
+func TestParseMediaPlaylist_NoWarnings(t *testing.T) {
+	for name, content := range map[string]string{
+		"media":     mediaPlaylist,
+		"encrypted": encryptedPlaylist,
+		"byterange": byteRangePlaylist,
+		"live":      livePlaylist,
+	} {
+		d := &diagnostics{}
+		if _, err := parseMediaPlaylist(content, "https://example.com/", nil, d); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, w := range d.warnings {
+			t.Errorf("%s: unexpected warning %s", name, w)
+		}
+	}
+}
+
+func TestParseMasterPlaylist_Warnings(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="angle",NAME="Side",URI="side.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:RESOLUTION=640x360,FRAME-RATE=thirty
+low.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=1000
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="{$codecs}"
+high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000
+`
+	d := &diagnostics{url: "http://example.com/master.m3u8"}
+	streams := parseMasterPlaylist(content, d.url, d)
+	if len(streams) != 3 {
+		t.Fatalf("expected 3 streams, got %d", len(streams))
+	}
+
+	want := []string{
+		"7 #EXT-X-STREAM-INF undefined variable \"codecs\"",
+		"2 #EXT-X-MEDIA VIDEO renditions are not supported, skipped",
+		"4 #EXT-X-STREAM-INF missing BANDWIDTH",
+		"4 #EXT-X-STREAM-INF invalid FRAME-RATE \"thirty\"",
+		"6 #EXT-X-I-FRAME-STREAM-INF missing URI",
+		"9 #EXT-X-STREAM-INF no URI follows",
+	}
+	var got []string
+	for _, w := range d.warnings {
+		got = append(got, fmt.Sprintf("%d %s %s", w.Line, w.Tag, w.Message))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParser_Parse_Strict(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow.m3u8\n")
+	})
+	mux.HandleFunc("/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nseg0.ts\n#EXT-X-VENDOR-THING\n#EXT-X-ENDLIST\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	lenient := &Parser{Client: server.Client()}
+	result, err := lenient.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %v", result.Warnings)
+	}
+	want := server.URL + "/low.m3u8:5: #EXT-X-VENDOR-THING: unknown tag"
+	if got := result.Warnings[0].String(); got != want {
+		t.Errorf("warning: got %q, want %q", got, want)
+	}
+
+	strict := &Parser{Client: server.Client(), Strict: true}
+	_, err = strict.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err == nil || !strings.Contains(err.Error(), "strict: "+want) {
+		t.Errorf("expected strict error, got %v", err)
+	}
+
+	// Lazily resolved playlists are checked when they are loaded
+	lazy := &Parser{Client: server.Client(), Strict: true, Lazy: true}
+	result, err = lazy.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("lazy parse: %v", err)
+	}
+	if err := lazy.ResolvePlaylists(context.Background(), result, result.Streams, nil); err == nil {
+		t.Error("expected strict error from ResolvePlaylists")
+	}
+}
@@ -5,74 +5,275 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser"
 )
 
+// defaultConcurrency is how many media playlists are fetched at once.
+const defaultConcurrency = 8
+
 // Parser implements the parser.Parser interface for HLS streams.
 type Parser struct {
 	Client *http.Client
+
+	// Concurrency limits parallel media playlist requests; 0 means 8.
+	Concurrency int
+	// Lazy leaves the media playlists of a master playlist unfetched;
+	// ResolvePlaylists loads them once streams are selected.
+	Lazy bool
+	// Strict fails the parse on any manifest warning instead of working
+	// around the problem.
+	Strict bool
+
+	// imports keeps the master playlist variables by media playlist URL,
+	// so a media playlist reloaded on its own can still IMPORT them.
+	mu      sync.Mutex
+	imports map[string]map[string]string
 }
 
 // Parse fetches and parses an HLS URL, returning streams with their segment lists.
+// Media playlists of a master playlist are fetched concurrently; streams
+// whose playlist fails are dropped and listed in ParseResult.Failed.
+// Relative URIs resolve against each playlist's URL after redirects.
+// Problems the parser works around are listed in ParseResult.Warnings.
 func (p *Parser) Parse(ctx context.Context, url string, headers map[string]string) (*model.ParseResult, error) {
-	content, err := p.fetch(ctx, url, headers)
+	content, chain, err := p.fetch(ctx, url, headers)
 	if err != nil {
 		return nil, fmt.Errorf("fetch m3u8: %w", err)
 	}
 
-	result := &model.ParseResult{}
+	baseURL := chain[len(chain)-1]
+	result := &model.ParseResult{
+		URL:       baseURL,
+		Redirects: chain[:len(chain)-1],
+	}
 
 	if IsMasterPlaylist(content) {
-		streams := ParseMasterPlaylist(content, url)
-
-		// Fetch each stream's media playlist
-		for i := range streams {
-			s := &streams[i]
-			if s.URL == "" {
-				continue
+		d := &diagnostics{url: baseURL}
+		streams := parseMasterPlaylist(content, baseURL, d)
+		parseSession(content, baseURL, d, result)
+		p.fetchSessionData(ctx, result.SessionData, headers, d)
+		result.Warnings = d.warnings
+		vars := MasterVariables(content, baseURL)
+		for _, s := range streams {
+			for _, u := range append([]string{s.URL}, s.Mirrors...) {
+				p.setImports(u, vars)
 			}
-			mediaContent, err := p.fetch(ctx, s.URL, headers)
-			if err != nil {
-				return nil, fmt.Errorf("fetch media playlist for %s: %w", s.URL, err)
+		}
+
+		if !p.Lazy {
+			loads := p.fetchPlaylists(ctx, streams, headers)
+			if err := ctx.Err(); err != nil {
+				return nil, err
 			}
-			playlist, err := ParseMediaPlaylist(mediaContent, s.URL)
-			if err != nil {
-				return nil, fmt.Errorf("parse media playlist: %w", err)
+			var ok []model.StreamSpec
+			for i, s := range streams {
+				if err := loads[i].err; err != nil {
+					result.Failed = append(result.Failed, model.StreamFailure{Stream: s, Err: err})
+					continue
+				}
+				result.Warnings = append(result.Warnings, loads[i].warnings...)
+				ok = append(ok, s)
+				if s.Playlist != nil && s.Playlist.IsLive {
+					result.IsLive = true
+				}
 			}
-			s.Playlist = playlist
-
-			if playlist.IsLive {
-				result.IsLive = true
+			if len(ok) == 0 && len(result.Failed) > 0 {
+				f := result.Failed[0]
+				return nil, fmt.Errorf("all media playlists failed: %s: %w", f.Stream.URL, f.Err)
 			}
+			streams = ok
 		}
 
 		result.Streams = streams
 	} else {
 		// Single media playlist
-		playlist, err := ParseMediaPlaylist(content, url)
+		d := &diagnostics{url: baseURL}
+		playlist, err := parseMediaPlaylist(content, baseURL, p.getImports(url), d)
 		if err != nil {
 			return nil, fmt.Errorf("parse media playlist: %w", err)
 		}
+		parseSession(content, baseURL, d, result)
+		result.Warnings = d.warnings
 
 		stream := model.StreamSpec{
 			MediaType: model.MediaVideo,
 			URL:       url,
 			Playlist:  playlist,
 		}
+		for _, prot := range ParseProtections(content) {
+			stream.AddProtection(prot)
+		}
 		result.Streams = []model.StreamSpec{stream}
 		result.IsLive = playlist.IsLive
 	}
 
+	if p.Strict {
+		if err := parser.CheckStrict(result.Warnings); err != nil {
+			return nil, err
+		}
+	}
+
 	// Determine merge type based on content
 	result.MergeType = detectMergeType(result.Streams)
 
 	return result, nil
 }
 
+// ResolvePlaylists loads the media playlists a lazy Parse left out for the
+// given streams, and updates the live flag and merge type of result to
+// match them. Unlike Parse, any failure is an error.
+func (p *Parser) ResolvePlaylists(ctx context.Context, result *model.ParseResult, streams []model.StreamSpec, headers map[string]string) error {
+	var warnings []model.ParseWarning
+	for i, load := range p.fetchPlaylists(ctx, streams, headers) {
+		if load.err != nil {
+			return fmt.Errorf("%s: %w", streams[i].URL, load.err)
+		}
+		warnings = append(warnings, load.warnings...)
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+	if p.Strict {
+		if err := parser.CheckStrict(warnings); err != nil {
+			return err
+		}
+	}
+	for _, s := range streams {
+		if s.Playlist != nil && s.Playlist.IsLive {
+			result.IsLive = true
+		}
+	}
+	result.MergeType = detectMergeType(streams)
+	return nil
+}
+
+// loadResult is the outcome of loading one media playlist.
+type loadResult struct {
+	warnings []model.ParseWarning
+	err      error
+}
+
+// fetchPlaylists loads the media playlist of every stream that has a URL
+// but no playlist yet, at most Concurrency at a time. The returned results
+// are indexed like streams.
+func (p *Parser) fetchPlaylists(ctx context.Context, streams []model.StreamSpec, headers map[string]string) []loadResult {
+	limit := p.Concurrency
+	if limit <= 0 {
+		limit = defaultConcurrency
+	}
+	loads := make([]loadResult, len(streams))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i := range streams {
+		s := &streams[i]
+		if s.URL == "" || s.Playlist != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				loads[i].err = ctx.Err()
+				return
+			}
+			loads[i] = p.loadPlaylist(ctx, s, headers)
+		}()
+	}
+	wg.Wait()
+	return loads
+}
+
+// loadPlaylist fetches and parses the media playlist of one stream, and
+// those of its mirrors as segment backups. If the stream's own playlist
+// fails, the first mirror that loads takes its place.
+func (p *Parser) loadPlaylist(ctx context.Context, s *model.StreamSpec, headers map[string]string) loadResult {
+	urls := append([]string{s.URL}, s.Mirrors...)
+	var res loadResult
+	for i, u := range urls {
+		playlist, content, warnings, err := p.loadMediaPlaylist(ctx, u, headers)
+		if ctx.Err() != nil {
+			return loadResult{err: ctx.Err()}
+		}
+		if s.Playlist != nil {
+			// A broken mirror only leaves segments without a backup
+			if err == nil {
+				addSegmentMirrors(s.Playlist, playlist)
+			}
+			continue
+		}
+		if err != nil {
+			if res.err == nil {
+				res.err = err
+			}
+			continue
+		}
+		if i > 0 {
+			s.URL = u
+			s.Mirrors = append(slices.Clone(urls[i+1:]), urls[:i]...)
+		}
+		s.Playlist = playlist
+		for _, prot := range ParseProtections(content) {
+			s.AddProtection(prot)
+		}
+		res = loadResult{warnings: warnings}
+	}
+	return res
+}
+
+// loadMediaPlaylist fetches and parses one media playlist, returning it
+// with its content and warnings.
+func (p *Parser) loadMediaPlaylist(ctx context.Context, rawURL string, headers map[string]string) (*model.Playlist, string, []model.ParseWarning, error) {
+	content, chain, err := p.fetch(ctx, rawURL, headers)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("fetch media playlist: %w", err)
+	}
+	d := &diagnostics{url: chain[len(chain)-1]}
+	playlist, err := parseMediaPlaylist(content, d.url, p.getImports(rawURL), d)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("parse media playlist: %w", err)
+	}
+	return playlist, content, d.warnings, nil
+}
+
+// importsKey drops the query, which changes on live reloads.
+func importsKey(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		return rawURL[:i]
+	}
+	return rawURL
+}
+
+func (p *Parser) setImports(mediaURL string, vars map[string]string) {
+	if len(vars) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.imports == nil {
+		p.imports = make(map[string]map[string]string)
+	}
+	p.imports[importsKey(mediaURL)] = vars
+}
+
+func (p *Parser) getImports(mediaURL string) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.imports[importsKey(mediaURL)]
+}
+
 // detectMergeType checks if streams use fMP4 (binary merge) or TS (ffmpeg merge).
 func detectMergeType(streams []model.StreamSpec) model.MergeType {
 	for _, s := range streams {
+		if s.MediaType.IsTrickPlay() {
+			continue
+		}
 		if s.Playlist != nil && s.Playlist.MediaInit != nil {
 			return model.MergeBinary // fMP4 with init segment
 		}
@@ -80,11 +281,12 @@ func detectMergeType(streams []model.StreamSpec) model.MergeType {
 	return model.MergeFFmpeg // TS segments
 }
 
-// fetch downloads content from a URL with custom headers.
-func (p *Parser) fetch(ctx context.Context, url string, headers map[string]string) (string, error) {
+// fetch downloads content from a URL with custom headers. It also returns
+// the redirect chain, whose last element is the URL the content came from.
+func (p *Parser) fetch(ctx context.Context, url string, headers map[string]string) (string, []string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
@@ -97,17 +299,17 @@ func (p *Parser) fetch(ctx context.Context, url string, headers map[string]strin
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		return "", nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	return string(body), nil
+	return string(body), parser.RedirectChain(resp), nil
 }
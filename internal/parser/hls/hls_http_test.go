@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -65,6 +67,53 @@ seg0.ts
 	}
 }
 
+func TestParser_Parse_Redirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/go/xyz", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cdn/master.m3u8", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/cdn/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/edge1/live/master.m3u8?token=t", http.StatusFound)
+	})
+	mux.HandleFunc("/edge1/live/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow/index.m3u8\n")
+	})
+	mux.HandleFunc("/edge1/live/low/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/edge2/low/index.m3u8", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/edge2/low/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/go/xyz", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := server.URL + "/edge1/live/master.m3u8?token=t"; result.URL != want {
+		t.Errorf("URL: got %s, want %s", result.URL, want)
+	}
+	wantChain := []string{server.URL + "/go/xyz", server.URL + "/cdn/master.m3u8"}
+	if fmt.Sprint(result.Redirects) != fmt.Sprint(wantChain) {
+		t.Errorf("Redirects: got %v, want %v", result.Redirects, wantChain)
+	}
+
+	s := result.Streams[0]
+	if s.URL != server.URL+"/edge1/live/low/index.m3u8" {
+		t.Errorf("variant URL: %s", s.URL)
+	}
+	seg := s.Playlist.Segments[0]
+	if seg.URL != server.URL+"/edge2/low/seg0.ts" {
+		t.Errorf("segment URL: %s", seg.URL)
+	}
+	if seg.EncryptInfo == nil || seg.EncryptInfo.KeyURL != server.URL+"/edge2/low/key.bin" {
+		t.Errorf("key: %+v", seg.EncryptInfo)
+	}
+}
+
 func TestParser_Parse_SingleMediaPlaylist(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, `#EXTM3U
@@ -182,6 +231,143 @@ low/index.m3u8
 	}
 }
 
+func TestParser_Parse_VariantFailureTolerated(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO="aud"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,AUDIO="aud"
+high/index.m3u8
+`)
+	})
+	mux.HandleFunc("/high/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(result.Streams))
+	}
+	for _, s := range result.Streams {
+		if s.Playlist == nil || len(s.Playlist.Segments) != 1 {
+			t.Errorf("stream %s: playlist not loaded", s.URL)
+		}
+	}
+	if len(result.Failed) != 1 {
+		t.Fatalf("expected 1 failed stream, got %d", len(result.Failed))
+	}
+	f := result.Failed[0]
+	if f.Stream.URL != server.URL+"/high/index.m3u8" || !strings.Contains(f.Err.Error(), "HTTP 404") {
+		t.Errorf("failed stream: %s: %v", f.Stream.URL, f.Err)
+	}
+}
+
+func TestParser_Parse_ConcurrentFetch(t *testing.T) {
+	const variants = 6
+	var (
+		mu       sync.Mutex
+		inFlight int
+		peak     int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n")
+		for i := range variants {
+			fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d\nv%d.m3u8\n", (i+1)*100000, i)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client(), Concurrency: 3}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Streams) != variants {
+		t.Fatalf("expected %d streams, got %d", variants, len(result.Streams))
+	}
+	// Order follows the master playlist, not completion
+	for i, s := range result.Streams {
+		if want := fmt.Sprintf("%s/v%d.m3u8", server.URL, i); s.URL != want || s.Playlist == nil {
+			t.Errorf("stream %d: %s, playlist=%v", i, s.URL, s.Playlist != nil)
+		}
+	}
+	if peak < 2 || peak > 3 {
+		t.Errorf("expected 2-3 concurrent fetches, peak was %d", peak)
+	}
+}
+
+func TestParser_Parse_Lazy(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000
+high.m3u8
+`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.0,\nseg0.m4s\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client(), Lazy: true}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fetched) != 0 {
+		t.Fatalf("lazy parse fetched %v", fetched)
+	}
+	if result.Streams[0].Playlist != nil || result.IsLive {
+		t.Fatal("expected unresolved streams")
+	}
+
+	selected := result.Streams[1:]
+	if err := p.ResolvePlaylists(context.Background(), result, selected, nil); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if len(fetched) != 1 || fetched[0] != "/high.m3u8" {
+		t.Errorf("fetched %v", fetched)
+	}
+	if selected[0].Playlist == nil || len(selected[0].Playlist.Segments) != 1 {
+		t.Fatal("selected playlist not loaded")
+	}
+	if !result.IsLive || result.MergeType != model.MergeBinary {
+		t.Errorf("result not updated: live=%v merge=%d", result.IsLive, result.MergeType)
+	}
+}
+
 func TestParser_Parse_ContextCancelled(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(5 * time.Second)
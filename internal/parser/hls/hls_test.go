@@ -112,6 +112,38 @@ func TestParseMasterPlaylist(t *testing.T) {
 	}
 }
 
+func TestParseMasterPlaylist_RenditionGroups(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="a/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="Described",LANGUAGE="en",AUTOSELECT=NO,CHARACTERISTICS="public.accessibility.describes-video",URI="a/ad.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+v/hi.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=500000,AUDIO="aud",CLOSED-CAPTIONS=NONE
+v/lo.m3u8
+`
+	streams := ParseMasterPlaylist(content, "https://example.com/master.m3u8")
+	if len(streams) != 4 {
+		t.Fatalf("expected 4 streams, got %d", len(streams))
+	}
+
+	main, ad := streams[0], streams[1]
+	if !main.Default || !main.AutoSelect || main.Characteristics != "" {
+		t.Errorf("unexpected main audio flags: %+v", main)
+	}
+	if ad.Default || ad.AutoSelect || ad.Characteristics != "public.accessibility.describes-video" {
+		t.Errorf("unexpected described audio flags: %+v", ad)
+	}
+
+	hi, lo := streams[2], streams[3]
+	if hi.AudioGroup != "aud" || hi.SubtitleGroup != "subs" || hi.CaptionGroup != "cc" {
+		t.Errorf("unexpected hi groups: audio=%q subs=%q cc=%q", hi.AudioGroup, hi.SubtitleGroup, hi.CaptionGroup)
+	}
+	if lo.AudioGroup != "aud" || lo.CaptionGroup != "" {
+		t.Errorf("unexpected lo groups: audio=%q cc=%q", lo.AudioGroup, lo.CaptionGroup)
+	}
+}
+
 func TestParseMediaPlaylist(t *testing.T) {
 	playlist, err := ParseMediaPlaylist(mediaPlaylist, "https://example.com/playlist.m3u8")
 	if err != nil {
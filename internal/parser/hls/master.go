@@ -1,7 +1,7 @@
 package hls
 
 import (
-	"strconv"
+	"errors"
 	"strings"
 
 	"github.com/caorushizi/mediago-core/internal/model"
@@ -9,27 +9,47 @@ import (
 
 // ParseMasterPlaylist parses an HLS master playlist and returns a list of variant streams.
 func ParseMasterPlaylist(content string, baseURL string) []model.StreamSpec {
+	return parseMasterPlaylist(content, baseURL, nil)
+}
+
+// parseMasterPlaylist parses a master playlist, reporting what it skips or
+// cannot parse to d.
+func parseMasterPlaylist(content string, baseURL string, d *diagnostics) []model.StreamSpec {
 	var streams []model.StreamSpec
 	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	// Unresolvable references are left as is and fail on request
+	lines, _, err := substituteVariables(lines, baseURL, nil)
+	var lerr *lineError
+	if errors.As(err, &lerr) {
+		d.warnf(lerr.line, strings.TrimSpace(lines[lerr.line-1]), "%s", lerr.msg)
+	}
 
 	for i := 0; i < len(lines); i++ {
 		line := strings.TrimSpace(lines[i])
+		n := i + 1
+		d.checkTag(n, line)
 
 		if strings.HasPrefix(line, TagStreamInf) {
 			spec := model.StreamSpec{
 				MediaType: model.MediaVideo,
 			}
 
-			if bw := GetAttribute(line, "BANDWIDTH"); bw != "" {
-				spec.Bandwidth, _ = strconv.ParseInt(bw, 10, 64)
+			bw := GetAttribute(line, "BANDWIDTH")
+			if bw == "" {
+				d.warnf(n, line, "missing BANDWIDTH")
 			}
+			spec.Bandwidth = d.parseInt(n, line, "BANDWIDTH", bw)
 			if avgBw := GetAttribute(line, "AVERAGE-BANDWIDTH"); avgBw != "" {
-				spec.Bandwidth, _ = strconv.ParseInt(avgBw, 10, 64)
+				spec.Bandwidth = d.parseInt(n, line, "AVERAGE-BANDWIDTH", avgBw)
 			}
 			spec.Codecs = GetAttribute(line, "CODECS")
 			spec.Resolution = GetAttribute(line, "RESOLUTION")
-			if fr := GetAttribute(line, "FRAME-RATE"); fr != "" {
-				spec.FrameRate, _ = strconv.ParseFloat(fr, 64)
+			spec.FrameRate = d.parseFloat(n, line, "FRAME-RATE", GetAttribute(line, "FRAME-RATE"))
+			spec.AudioGroup = GetAttribute(line, "AUDIO")
+			spec.SubtitleGroup = GetAttribute(line, "SUBTITLES")
+			// CLOSED-CAPTIONS is a quoted group ID or the enumerated NONE
+			if cc := GetAttribute(line, "CLOSED-CAPTIONS"); cc != "NONE" {
+				spec.CaptionGroup = cc
 			}
 
 			// Next non-empty, non-comment line is the playlist URL
@@ -40,6 +60,28 @@ func ParseMasterPlaylist(content string, baseURL string) []model.StreamSpec {
 					break
 				}
 			}
+			if spec.URL == "" {
+				d.warnf(n, line, "no URI follows")
+			}
+			streams = append(streams, spec)
+
+		} else if strings.HasPrefix(line, TagIFrameStreamInf) || strings.HasPrefix(line, TagImageStreamInf) {
+			// Trick play streams carry their playlist in the URI attribute
+			uri := GetAttribute(line, "URI")
+			if uri == "" {
+				d.warnf(n, line, "missing URI")
+				continue
+			}
+			spec := model.StreamSpec{
+				MediaType:  model.MediaIFrame,
+				Codecs:     GetAttribute(line, "CODECS"),
+				Resolution: GetAttribute(line, "RESOLUTION"),
+				URL:        ResolveURL(baseURL, uri),
+			}
+			if strings.HasPrefix(line, TagImageStreamInf) {
+				spec.MediaType = model.MediaImage
+			}
+			spec.Bandwidth = d.parseInt(n, line, "BANDWIDTH", GetAttribute(line, "BANDWIDTH"))
 			streams = append(streams, spec)
 
 		} else if strings.HasPrefix(line, TagMedia) {
@@ -52,10 +94,13 @@ func ParseMasterPlaylist(content string, baseURL string) []model.StreamSpec {
 			}
 
 			spec := model.StreamSpec{
-				GroupID:  GetAttribute(line, "GROUP-ID"),
-				Language: GetAttribute(line, "LANGUAGE"),
-				Name:     GetAttribute(line, "NAME"),
-				URL:      ResolveURL(baseURL, uri),
+				GroupID:         GetAttribute(line, "GROUP-ID"),
+				Language:        GetAttribute(line, "LANGUAGE"),
+				Name:            GetAttribute(line, "NAME"),
+				URL:             ResolveURL(baseURL, uri),
+				Default:         strings.EqualFold(GetAttribute(line, "DEFAULT"), "YES"),
+				AutoSelect:      strings.EqualFold(GetAttribute(line, "AUTOSELECT"), "YES"),
+				Characteristics: GetAttribute(line, "CHARACTERISTICS"),
 			}
 
 			switch strings.ToUpper(mediaType) {
@@ -65,13 +110,14 @@ func ParseMasterPlaylist(content string, baseURL string) []model.StreamSpec {
 			case "SUBTITLES":
 				spec.MediaType = model.MediaSubtitle
 			default:
+				d.warnf(n, line, "%s renditions are not supported, skipped", mediaType)
 				continue
 			}
 			streams = append(streams, spec)
 		}
 	}
 
-	return streams
+	return groupMirrors(streams)
 }
 
 // IsMasterPlaylist checks if the content is a master playlist.
@@ -1,52 +1,168 @@
 package hls
 
 import (
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/mp4"
 )
 
 // ParseMediaPlaylist parses an HLS media playlist and returns a Playlist with segments.
 func ParseMediaPlaylist(content string, baseURL string) (*model.Playlist, error) {
+	return ParseMediaPlaylistWithImports(content, baseURL, nil)
+}
+
+// ParseMediaPlaylistWithImports parses a media playlist whose
+// #EXT-X-DEFINE IMPORT tags refer to imports, the variables of its master
+// playlist.
+func ParseMediaPlaylistWithImports(content string, baseURL string, imports map[string]string) (*model.Playlist, error) {
+	return parseMediaPlaylist(content, baseURL, imports, nil)
+}
+
+// parseMediaPlaylist parses a media playlist, reporting what it skips or
+// cannot parse to d.
+func parseMediaPlaylist(content string, baseURL string, imports map[string]string, d *diagnostics) (*model.Playlist, error) {
 	playlist := &model.Playlist{}
 
 	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	lines, _, err := substituteVariables(lines, baseURL, imports)
+	if err != nil {
+		return nil, fmt.Errorf("variables: %w", err)
+	}
 
 	var (
 		segIndex       int
 		currentEncrypt *model.EncryptInfo
 		currentSeg     *model.Segment
+		currentInit    *model.Segment   // init section of the next segment
+		inits          []*model.Segment // distinct EXT-X-MAP sections
 		expectSegment  bool
 		prevRange      int64 // tracks end of previous byte-range for consecutive ranges
 		isEndList      bool
+		discSeq        int
+		discPending    bool      // a discontinuity precedes the next segment
+		pendingPDT     time.Time // program date time for the next segment
+		pendingTiles   *model.Tiles
+		pendingParts   []model.Part // LL-HLS parts of the next segment
+		prevPartRange  int64
+		pendingGap     bool
+		extInfLine     int // line of the #EXTINF awaiting its URI
+		cues           = newCueTracker()
 	)
+	// SAMPLE-AES only means CENC sample encryption in fMP4 segments
+	fmp4 := slices.ContainsFunc(lines, func(l string) bool {
+		return strings.HasPrefix(strings.TrimSpace(l), TagMap)
+	})
 
 	for i := 0; i < len(lines); i++ {
 		line := strings.TrimSpace(lines[i])
 		if line == "" {
 			continue
 		}
+		n := i + 1
+		d.checkTag(n, line)
 
 		switch {
 		case strings.HasPrefix(line, TagTargetDuration):
-			val := GetAttribute(line, "")
-			playlist.TargetDuration, _ = strconv.ParseFloat(val, 64)
+			playlist.TargetDuration = d.parseFloat(n, line, "duration", GetAttribute(line, ""))
 
 		case strings.HasPrefix(line, TagMediaSequence):
+			segIndex = int(d.parseInt(n, line, "sequence number", GetAttribute(line, "")))
+
+		case strings.HasPrefix(line, TagDiscontinuitySeq):
+			discSeq = int(d.parseInt(n, line, "sequence number", GetAttribute(line, "")))
+
+		case strings.HasPrefix(line, TagProgramDateTime):
 			val := GetAttribute(line, "")
-			segIndex, _ = strconv.Atoi(val)
+			pendingPDT = ParseDateTime(val)
+			if pendingPDT.IsZero() {
+				d.warnf(n, line, "invalid date time %q", val)
+			}
+
+		case strings.HasPrefix(line, TagIFramesOnly):
+			playlist.IFramesOnly = true
+
+		case strings.HasPrefix(line, TagImagesOnly):
+			playlist.ImagesOnly = true
+
+		case strings.HasPrefix(line, TagTiles):
+			// Usually between #EXTINF and the URI, like #EXT-X-BYTERANGE
+			if currentSeg != nil {
+				currentSeg.Tiles = parseTiles(d, n, line)
+			} else {
+				pendingTiles = parseTiles(d, n, line)
+			}
+
+		case strings.HasPrefix(line, TagServerControl):
+			playlist.ServerControl = parseServerControl(d, n, line)
+
+		case strings.HasPrefix(line, TagPartInf):
+			playlist.PartTarget = d.parseFloat(n, line, "PART-TARGET", ParseAttributes(line)["PART-TARGET"])
+
+		case strings.HasPrefix(line, TagPart):
+			part := parsePart(d, n, line, baseURL, prevPartRange)
+			if part.HasRange() {
+				prevPartRange = part.StopRange + 1
+			}
+			pendingParts = append(pendingParts, part)
+
+		case strings.HasPrefix(line, TagSkip):
+			// Delta update: the skipped segments keep their sequence numbers
+			skipped := int(d.parseInt(n, line, "SKIPPED-SEGMENTS", ParseAttributes(line)["SKIPPED-SEGMENTS"]))
+			playlist.SkippedSegments += skipped
+			segIndex += skipped
+
+		case strings.HasPrefix(line, TagGap):
+			if currentSeg != nil {
+				currentSeg.Gap = true
+			} else {
+				pendingGap = true
+			}
+
+		case strings.HasPrefix(line, TagCueOutCont):
+			cues.cueOutCont(d, n, line)
+
+		case strings.HasPrefix(line, TagCueOut):
+			cues.cueOut(d, n, line)
+
+		case strings.HasPrefix(line, TagCueIn):
+			cues.cueIn()
+
+		case strings.HasPrefix(line, TagOATCLSSCTE35):
+			cues.oatcls(line)
+
+		case strings.HasPrefix(line, TagDateRange):
+			cues.dateRange(d, n, line)
+
+		case strings.HasPrefix(line, TagPreloadHint):
+			attrs := ParseAttributes(line)
+			start, ranged := attrs["BYTERANGE-START"]
+			hint := &model.PreloadHint{
+				Type:   attrs["TYPE"],
+				URL:    ResolveURL(baseURL, attrs["URI"]),
+				Ranged: ranged,
+			}
+			hint.StartRange = d.parseInt(n, line, "BYTERANGE-START", start)
+			hint.Length = d.parseInt(n, line, "BYTERANGE-LENGTH", attrs["BYTERANGE-LENGTH"])
+			playlist.PreloadHint = hint
 
 		case strings.HasPrefix(line, TagPlaylistType):
-			val := GetAttribute(line, "")
-			if strings.ToUpper(val) == "VOD" {
+			switch val := GetAttribute(line, ""); strings.ToUpper(val) {
+			case "VOD":
 				isEndList = true
+			case "EVENT":
+			default:
+				d.warnf(n, line, "unknown playlist type %q", val)
 			}
 
 		case strings.HasPrefix(line, TagKey):
-			enc, err := parseEncryptInfo(line, baseURL)
+			enc, err := parseEncryptInfo(line, baseURL, fmp4)
 			if err != nil {
 				return nil, fmt.Errorf("parse key: %w", err)
 			}
@@ -55,31 +171,40 @@ func ParseMediaPlaylist(content string, baseURL string) (*model.Playlist, error)
 		case strings.HasPrefix(line, TagMap):
 			uri := GetAttribute(line, "URI")
 			if uri == "" {
+				d.warnf(n, line, "missing URI")
 				continue
 			}
+			// Init sections are numbered -1, -2, ... so that each has its
+			// own file; one that is repeated keeps its first number
 			initSeg := &model.Segment{
-				Index: -1,
+				Index: -1 - len(inits),
 				URL:   ResolveURL(baseURL, uri),
 			}
 			// Parse byte-range for init segment
 			if br := GetAttribute(line, "BYTERANGE"); br != "" {
-				start, stop := parseByteRange(br, 0)
-				initSeg.StartRange = start
-				initSeg.StopRange = stop
+				initSeg.StartRange, initSeg.StopRange = parseByteRange(d, n, line, br, 0)
 			}
 			if currentEncrypt != nil {
 				initSeg.EncryptInfo = copyEncryptInfo(currentEncrypt)
 			}
-			playlist.MediaInit = initSeg
+			if known := findInit(inits, initSeg); known != nil {
+				currentInit = known
+				continue
+			}
+			inits = append(inits, initSeg)
+			currentInit = initSeg
+			if playlist.MediaInit == nil {
+				playlist.MediaInit = initSeg
+			}
 
 		case strings.HasPrefix(line, TagByteRange):
 			val := GetAttribute(line, "")
-			if currentSeg != nil {
-				start, stop := parseByteRange(val, prevRange)
-				currentSeg.StartRange = start
-				currentSeg.StopRange = stop
-				prevRange = stop + 1
+			if currentSeg == nil {
+				d.warnf(n, line, "no #EXTINF before the tag")
+				continue
 			}
+			currentSeg.StartRange, currentSeg.StopRange = parseByteRange(d, n, line, val, prevRange)
+			prevRange = currentSeg.StopRange + 1
 
 		case strings.HasPrefix(line, TagExtInf):
 			val := GetAttribute(line, "")
@@ -88,13 +213,32 @@ func ParseMediaPlaylist(content string, baseURL string) (*model.Playlist, error)
 			if idx := strings.Index(val, ","); idx >= 0 {
 				durStr = val[:idx]
 			}
-			dur, _ := strconv.ParseFloat(durStr, 64)
+			dur, err := strconv.ParseFloat(strings.TrimSpace(durStr), 64)
+			if err != nil {
+				d.warnf(n, line, "invalid duration %q", durStr)
+			}
+			if expectSegment {
+				d.warnf(extInfLine, TagExtInf, "no URI follows, segment dropped")
+			}
 			playlist.TotalDuration += dur
 
+			// EXT-X-DISCONTINUITY-SEQUENCE already numbers the first segment
+			if discPending && len(playlist.Segments) > 0 {
+				discSeq++
+				playlist.Discontinuities = append(playlist.Discontinuities, len(playlist.Segments))
+			}
+			discPending = false
 			currentSeg = &model.Segment{
-				Index:    segIndex,
-				Duration: dur,
+				Index:         segIndex,
+				Duration:      dur,
+				Discontinuity: discSeq,
+				Init:          currentInit,
 			}
+			currentSeg.ProgramDateTime, pendingPDT = pendingPDT, time.Time{}
+			currentSeg.Tiles, pendingTiles = pendingTiles, nil
+			currentSeg.Parts, pendingParts = pendingParts, nil
+			currentSeg.Gap, pendingGap = pendingGap, false
+			cues.segment(currentSeg)
 			if currentEncrypt != nil {
 				iv := currentEncrypt.IV
 				if iv == nil {
@@ -109,12 +253,13 @@ func ParseMediaPlaylist(content string, baseURL string) (*model.Playlist, error)
 			}
 			segIndex++
 			expectSegment = true
+			extInfLine = n
 
 		case strings.HasPrefix(line, TagEndList):
 			isEndList = true
 
 		case strings.HasPrefix(line, TagDiscontinuity):
-			// Continue to next segment, no special handling needed in simplified version
+			discPending = true
 
 		case !strings.HasPrefix(line, "#") && expectSegment:
 			if currentSeg != nil {
@@ -126,16 +271,115 @@ func ParseMediaPlaylist(content string, baseURL string) (*model.Playlist, error)
 
 		case !strings.HasPrefix(line, "#") && !expectSegment:
 			// Standalone URL without #EXTINF (rare but handle gracefully)
+			d.warnf(n, line, "URI without #EXTINF ignored")
 		}
 	}
+	if expectSegment {
+		d.warnf(extInfLine, TagExtInf, "no URI follows, segment dropped")
+	}
 
+	playlist.PendingParts = pendingParts
 	playlist.IsLive = !isEndList
+	extrapolateDateTimes(playlist.Segments)
+	cues.finish(playlist, d)
 
 	return playlist, nil
 }
 
+// ParseDateTime parses an EXT-X-PROGRAM-DATE-TIME value. Besides RFC 3339,
+// it accepts the "+0000" offsets some packagers write. It returns the zero
+// time if the value cannot be parsed.
+func ParseDateTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// extrapolateDateTimes fills in program date times for segments without a
+// tag, counting forward from the previous tagged segment, or backward from
+// the first one for segments before it.
+func extrapolateDateTimes(segs []model.Segment) {
+	first := -1
+	for i := range segs {
+		switch {
+		case !segs[i].ProgramDateTime.IsZero():
+			if first < 0 {
+				first = i
+			}
+		case i > 0 && !segs[i-1].ProgramDateTime.IsZero():
+			segs[i].ProgramDateTime = segs[i-1].ProgramDateTime.Add(seconds(segs[i-1].Duration))
+		}
+	}
+	for i := first - 1; i >= 0; i-- {
+		segs[i].ProgramDateTime = segs[i+1].ProgramDateTime.Add(-seconds(segs[i].Duration))
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// parseServerControl parses an EXT-X-SERVER-CONTROL tag on line n.
+func parseServerControl(d *diagnostics, n int, line string) *model.ServerControl {
+	attrs := ParseAttributes(line)
+	return &model.ServerControl{
+		CanBlockReload:    attrs["CAN-BLOCK-RELOAD"] == "YES",
+		CanSkipDateRanges: attrs["CAN-SKIP-DATERANGES"] == "YES",
+		CanSkipUntil:      d.parseFloat(n, line, "CAN-SKIP-UNTIL", attrs["CAN-SKIP-UNTIL"]),
+		HoldBack:          d.parseFloat(n, line, "HOLD-BACK", attrs["HOLD-BACK"]),
+		PartHoldBack:      d.parseFloat(n, line, "PART-HOLD-BACK", attrs["PART-HOLD-BACK"]),
+	}
+}
+
+// parsePart parses an EXT-X-PART tag. A BYTERANGE without an offset
+// continues from the previous part's range.
+func parsePart(d *diagnostics, n int, line, baseURL string, prevRange int64) model.Part {
+	attrs := ParseAttributes(line)
+	if attrs["URI"] == "" {
+		d.warnf(n, line, "missing URI")
+	}
+	part := model.Part{
+		URL:         ResolveURL(baseURL, attrs["URI"]),
+		Duration:    d.parseFloat(n, line, "DURATION", attrs["DURATION"]),
+		Independent: attrs["INDEPENDENT"] == "YES",
+		Gap:         attrs["GAP"] == "YES",
+	}
+	if br := attrs["BYTERANGE"]; br != "" {
+		part.StartRange, part.StopRange = parseByteRange(d, n, line, br, prevRange)
+	}
+	return part
+}
+
+// parseTiles parses an EXT-X-TILES tag, e.g.
+// #EXT-X-TILES:RESOLUTION=320x180,LAYOUT=5x4,DURATION=2.002
+func parseTiles(d *diagnostics, n int, line string) *model.Tiles {
+	tiles := &model.Tiles{
+		Resolution: GetAttribute(line, "RESOLUTION"),
+		Columns:    1,
+		Rows:       1,
+	}
+	if layout := GetAttribute(line, "LAYOUT"); layout != "" {
+		cols, rows, _ := strings.Cut(layout, "x")
+		c, errC := strconv.Atoi(cols)
+		r, errR := strconv.Atoi(rows)
+		if errC != nil || errR != nil || c <= 0 || r <= 0 {
+			d.warnf(n, line, "invalid LAYOUT %q", layout)
+		} else {
+			tiles.Columns, tiles.Rows = c, r
+		}
+	}
+	tiles.Duration = d.parseFloat(n, line, "DURATION", GetAttribute(line, "DURATION"))
+	return tiles
+}
+
 // parseEncryptInfo extracts encryption details from a #EXT-X-KEY line.
-func parseEncryptInfo(line, baseURL string) (*model.EncryptInfo, error) {
+// SAMPLE-AES is accepted as CENC for fMP4 segments only: in MPEG-TS it
+// encrypts NAL units and ADTS frames, which cannot be decrypted here.
+func parseEncryptInfo(line, baseURL string, fmp4 bool) (*model.EncryptInfo, error) {
 	method := GetAttribute(line, "METHOD")
 	if method == "" || strings.ToUpper(method) == "NONE" {
 		return nil, nil
@@ -146,6 +390,12 @@ func parseEncryptInfo(line, baseURL string) (*model.EncryptInfo, error) {
 	switch strings.ToUpper(method) {
 	case "AES-128":
 		info.Method = model.EncryptAES128
+	case "SAMPLE-AES", "SAMPLE-AES-CTR":
+		if !fmp4 {
+			return nil, fmt.Errorf("unsupported encryption method: %s on MPEG-TS segments", method)
+		}
+		// fMP4 sample encryption, decrypted from the segment boxes
+		info.Method = model.EncryptCENC
 	default:
 		return nil, fmt.Errorf("unsupported encryption method: %s", method)
 	}
@@ -169,17 +419,87 @@ func parseEncryptInfo(line, baseURL string) (*model.EncryptInfo, error) {
 	return info, nil
 }
 
-// parseByteRange parses a BYTERANGE value like "1024@0" or "1024".
-// Returns (startRange, stopRange).
-func parseByteRange(val string, prevEnd int64) (int64, int64) {
+// keyFormatSystems maps non-UUID KEYFORMAT values to DRM system IDs.
+var keyFormatSystems = map[string]string{
+	"com.apple.streamingkeydelivery": "94ce86fb-07ff-4f43-adb8-93d2fa968ca2", // FairPlay
+	"com.microsoft.playready":        "9a04f079-9840-4286-ab92-e65be0885f95",
+}
+
+// ParseProtections collects the key signalling of every #EXT-X-KEY tag:
+// METHOD, KEYFORMAT, KEYID, and pssh boxes embedded as data: URIs.
+func ParseProtections(content string) []model.Protection {
+	var out []model.Protection
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, TagKey) {
+			continue
+		}
+		method := GetAttribute(line, "METHOD")
+		if method == "" || strings.ToUpper(method) == "NONE" {
+			continue
+		}
+
+		p := model.Protection{Scheme: method}
+
+		keyFormat := GetAttribute(line, "KEYFORMAT")
+		switch {
+		case strings.HasPrefix(strings.ToLower(keyFormat), "urn:uuid:"):
+			p.SystemID = strings.ToLower(keyFormat[len("urn:uuid:"):])
+		case keyFormatSystems[keyFormat] != "":
+			p.SystemID = keyFormatSystems[keyFormat]
+		}
+
+		if keyID := GetAttribute(line, "KEYID"); keyID != "" {
+			keyID = strings.TrimPrefix(strings.TrimPrefix(keyID, "0x"), "0X")
+			p.KID = strings.ToLower(keyID)
+		}
+
+		if raw := decodeDataURI(GetAttribute(line, "URI")); raw != nil {
+			if pssh, err := mp4.ParsePssh(raw); err == nil {
+				p.PSSH = raw
+				if p.SystemID == "" {
+					p.SystemID = pssh.SystemID
+				}
+				if p.KID == "" {
+					p.KID = pssh.KID()
+				}
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// decodeDataURI returns the payload of a base64 data: URI, or nil.
+func decodeDataURI(uri string) []byte {
+	if !strings.HasPrefix(uri, "data:") {
+		return nil
+	}
+	idx := strings.Index(uri, ",")
+	if idx < 0 || !strings.HasSuffix(uri[:idx], ";base64") {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(uri[idx+1:])
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// parseByteRange parses a BYTERANGE value like "1024@0" or "1024" on
+// line n. Returns (startRange, stopRange).
+func parseByteRange(d *diagnostics, n int, line, val string, prevEnd int64) (int64, int64) {
 	parts := strings.SplitN(val, "@", 2)
-	length, _ := strconv.ParseInt(parts[0], 10, 64)
+	length, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || length <= 0 {
+		d.warnf(n, line, "invalid byte range %q", val)
+	}
 
-	var offset int64
+	offset := prevEnd
 	if len(parts) == 2 {
-		offset, _ = strconv.ParseInt(parts[1], 10, 64)
-	} else {
-		offset = prevEnd
+		if offset, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			d.warnf(n, line, "invalid byte range %q", val)
+		}
 	}
 	return offset, offset + length - 1
 }
@@ -213,3 +533,14 @@ func copyEncryptInfo(src *model.EncryptInfo) *model.EncryptInfo {
 	}
 	return dst
 }
+
+// findInit returns the init section in inits with the URL and byte range
+// of init, or nil.
+func findInit(inits []*model.Segment, init *model.Segment) *model.Segment {
+	for _, known := range inits {
+		if known.URL == init.URL && known.StartRange == init.StartRange && known.StopRange == init.StopRange {
+			return known
+		}
+	}
+	return nil
+}
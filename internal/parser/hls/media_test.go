@@ -1,7 +1,9 @@
 package hls
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/caorushizi/mediago-core/internal/model"
 )
@@ -70,7 +72,7 @@ func TestCopyEncryptInfo(t *testing.T) {
 }
 
 func TestParseEncryptInfo_MethodNone(t *testing.T) {
-	info, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=NONE`, "https://example.com/")
+	info, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=NONE`, "https://example.com/", false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -80,7 +82,7 @@ func TestParseEncryptInfo_MethodNone(t *testing.T) {
 }
 
 func TestParseEncryptInfo_EmptyMethod(t *testing.T) {
-	info, err := parseEncryptInfo(`#EXT-X-KEY:URI="key.bin"`, "https://example.com/")
+	info, err := parseEncryptInfo(`#EXT-X-KEY:URI="key.bin"`, "https://example.com/", false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -90,14 +92,43 @@ func TestParseEncryptInfo_EmptyMethod(t *testing.T) {
 }
 
 func TestParseEncryptInfo_UnsupportedMethod(t *testing.T) {
-	_, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.bin"`, "https://example.com/")
+	_, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.bin"`, "https://example.com/", false)
 	if err == nil {
 		t.Fatal("expected error for unsupported method")
 	}
 }
 
+func TestParseEncryptInfo_SampleAESFMP4(t *testing.T) {
+	for _, method := range []string{"SAMPLE-AES", "SAMPLE-AES-CTR"} {
+		info, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=`+method+`,URI="skd://key"`, "https://example.com/", true)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", method, err)
+		}
+		if info.Method != model.EncryptCENC {
+			t.Errorf("%s: expected EncryptCENC, got %d", method, info.Method)
+		}
+	}
+}
+
+func TestParseMediaPlaylist_SampleAES(t *testing.T) {
+	ts := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\"\n#EXTINF:4.0,\nseg0.ts\n#EXT-X-ENDLIST\n"
+	if _, err := ParseMediaPlaylist(ts, "https://example.com/"); err == nil {
+		t.Error("expected error for SAMPLE-AES on MPEG-TS segments")
+	}
+
+	// The key may come before the map
+	fmp4 := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\"\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.0,\nseg0.m4s\n#EXT-X-ENDLIST\n"
+	playlist, err := ParseMediaPlaylist(fmp4, "https://example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if enc := playlist.Segments[0].EncryptInfo; enc == nil || enc.Method != model.EncryptCENC {
+		t.Errorf("EncryptInfo = %+v, want CENC", enc)
+	}
+}
+
 func TestParseEncryptInfo_InvalidIV(t *testing.T) {
-	_, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0xZZZZ`, "https://example.com/")
+	_, err := parseEncryptInfo(`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0xZZZZ`, "https://example.com/", false)
 	if err == nil {
 		t.Fatal("expected error for invalid hex IV")
 	}
@@ -206,6 +237,49 @@ seg0.m4s
 	}
 }
 
+func TestParseMediaPlaylist_MultipleMaps(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="init_a.mp4"
+#EXTINF:10.0,
+seg0.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init_b.mp4"
+#EXTINF:10.0,
+seg1.m4s
+#EXT-X-MAP:URI="init_b.mp4"
+#EXTINF:10.0,
+seg2.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init_a.mp4"
+#EXTINF:10.0,
+seg3.m4s
+#EXT-X-ENDLIST
+`
+	playlist, err := ParseMediaPlaylist(content, "https://example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if playlist.MediaInit == nil || playlist.MediaInit.URL != "https://example.com/init_a.mp4" {
+		t.Fatalf("MediaInit = %+v, want init_a.mp4", playlist.MediaInit)
+	}
+
+	wantURLs := []string{"init_a.mp4", "init_b.mp4", "init_b.mp4", "init_a.mp4"}
+	wantIndices := []int{-1, -2, -2, -1}
+	for i, seg := range playlist.Segments {
+		if seg.Init == nil || seg.Init.URL != "https://example.com/"+wantURLs[i] || seg.Init.Index != wantIndices[i] {
+			t.Errorf("segment %d init = %+v, want %s (%d)", i, seg.Init, wantURLs[i], wantIndices[i])
+		}
+	}
+	if playlist.Segments[0].Init != playlist.Segments[3].Init {
+		t.Error("expected a repeated map to share its init section")
+	}
+	if inits := playlist.Inits(); len(inits) != 2 {
+		t.Errorf("Inits() = %d, want 2", len(inits))
+	}
+}
+
 func TestParseMediaPlaylist_DiscontinuityTag(t *testing.T) {
 	content := `#EXTM3U
 #EXT-X-TARGETDURATION:10
@@ -223,6 +297,48 @@ seg1.ts
 	if len(playlist.Segments) != 2 {
 		t.Errorf("expected 2 segments, got %d", len(playlist.Segments))
 	}
+	if playlist.Segments[0].Discontinuity != 0 || playlist.Segments[1].Discontinuity != 1 {
+		t.Errorf("discontinuity numbers: got %d, %d", playlist.Segments[0].Discontinuity, playlist.Segments[1].Discontinuity)
+	}
+}
+
+func TestParseMediaPlaylist_DiscontinuityGroups(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-DISCONTINUITY-SEQUENCE:7
+#EXT-X-DISCONTINUITY
+#EXTINF:10.0,
+a0.ts
+#EXTINF:10.0,
+a1.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:5.0,
+ad0.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:10.0,
+b0.ts
+`
+	playlist, err := ParseMediaPlaylist(content, "https://example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []int
+	for _, seg := range playlist.Segments {
+		got = append(got, seg.Discontinuity)
+	}
+	if fmt.Sprint(got) != "[7 7 8 9]" {
+		t.Errorf("discontinuity numbers: got %v", got)
+	}
+	if fmt.Sprint(playlist.Discontinuities) != "[2 3]" {
+		t.Errorf("boundaries: got %v", playlist.Discontinuities)
+	}
+
+	groups := playlist.DiscontinuityGroups()
+	if len(groups) != 3 || len(groups[0]) != 2 || groups[1][0].Index != 102 || groups[2][0].URL != "https://example.com/b0.ts" {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
 }
 
 func TestGetAttribute_UnclosedQuote(t *testing.T) {
@@ -321,3 +437,269 @@ video.m3u8
 		t.Errorf("expected 800000 (avg bandwidth), got %d", streams[0].Bandwidth)
 	}
 }
+
+func TestParseProtections(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="data:text/plain;base64,AAAAIHBzc2gAAAAA7e+LqXnWSs6jyCfc1R0h7QAAAAA=",KEYID=0x10000000100010001000100000000001,KEYFORMAT="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4.0,
+seg0.m4s
+`
+	prots := ParseProtections(content)
+	if len(prots) != 2 {
+		t.Fatalf("expected 2 protections, got %d", len(prots))
+	}
+
+	wv := prots[0]
+	if wv.SystemID != "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" || wv.KID != "10000000100010001000100000000001" {
+		t.Errorf("unexpected Widevine entry: %+v", wv)
+	}
+	if len(wv.PSSH) != 32 || wv.Scheme != "SAMPLE-AES" {
+		t.Errorf("expected 32-byte pssh and SAMPLE-AES scheme, got %d bytes, %q", len(wv.PSSH), wv.Scheme)
+	}
+
+	if prots[1].SystemID != "94ce86fb-07ff-4f43-adb8-93d2fa968ca2" || prots[1].PSSH != nil {
+		t.Errorf("unexpected FairPlay entry: %+v", prots[1])
+	}
+}
+
+func TestParseMediaPlaylist_ProgramDateTime(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.0,
+seg0.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T14:00:06.000Z
+#EXTINF:6.0,
+seg1.ts
+#EXTINF:4.5,
+seg2.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T16:00:00.000+0200
+#EXTINF:6.0,
+seg3.ts
+#EXTINF:6.0,
+seg4.ts
+#EXT-X-ENDLIST
+`
+	playlist, err := ParseMediaPlaylist(content, "https://example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"2024-05-01T14:00:00Z", // extrapolated backward
+		"2024-05-01T14:00:06Z", // tagged
+		"2024-05-01T14:00:12Z", // extrapolated forward
+		"2024-05-01T14:00:00Z", // tagged after discontinuity, +0200 offset
+		"2024-05-01T14:00:06Z", // extrapolated forward
+	}
+	for i, seg := range playlist.Segments {
+		if got := seg.ProgramDateTime.UTC().Format(time.RFC3339Nano); got != want[i] {
+			t.Errorf("segment %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestParseMediaPlaylist_NoProgramDateTime(t *testing.T) {
+	playlist, err := ParseMediaPlaylist("#EXTM3U\n#EXTINF:6.0,\nseg0.ts\n", "https://example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !playlist.Segments[0].ProgramDateTime.IsZero() {
+		t.Errorf("expected zero program date time, got %v", playlist.Segments[0].ProgramDateTime)
+	}
+}
+
+func TestParseMasterPlaylist_TrickPlayStreams(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720
+video.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,CODECS="avc1.4d401f",RESOLUTION=640x360,URI="iframe.m3u8"
+#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=12000,RESOLUTION=320x180,CODECS="jpeg",URI="images/tiles.m3u8"
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=1000
+`
+	streams := ParseMasterPlaylist(content, "http://example.com/live/master.m3u8")
+	if len(streams) != 3 {
+		t.Fatalf("expected 3 streams, got %d", len(streams))
+	}
+	if streams[0].MediaType != model.MediaVideo || streams[0].URL != "http://example.com/live/video.m3u8" {
+		t.Errorf("variant: %+v", streams[0])
+	}
+	iframe := streams[1]
+	if iframe.MediaType != model.MediaIFrame || iframe.Bandwidth != 86000 || iframe.Resolution != "640x360" ||
+		iframe.Codecs != "avc1.4d401f" || iframe.URL != "http://example.com/live/iframe.m3u8" {
+		t.Errorf("I-frame stream: %+v", iframe)
+	}
+	image := streams[2]
+	if image.MediaType != model.MediaImage || image.Bandwidth != 12000 || image.URL != "http://example.com/live/images/tiles.m3u8" {
+		t.Errorf("image stream: %+v", image)
+	}
+	if !model.MediaImage.IsTrickPlay() || model.MediaVideo.IsTrickPlay() {
+		t.Error("IsTrickPlay")
+	}
+}
+
+func TestParseMediaPlaylist_IFramesOnly(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-I-FRAMES-ONLY
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:9400@376
+main.mp4
+#EXTINF:3.5,
+#EXT-X-BYTERANGE:7800@1200000
+main.mp4
+#EXT-X-ENDLIST
+`
+	pl, err := ParseMediaPlaylist(content, "http://example.com/iframe.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !pl.IFramesOnly || pl.ImagesOnly {
+		t.Errorf("IFramesOnly=%v ImagesOnly=%v", pl.IFramesOnly, pl.ImagesOnly)
+	}
+	if pl.MediaInit == nil || len(pl.Segments) != 2 {
+		t.Fatalf("init=%v segments=%d", pl.MediaInit, len(pl.Segments))
+	}
+	if s := pl.Segments[1]; s.StartRange != 1200000 || s.StopRange != 1207799 {
+		t.Errorf("byte range: %d-%d", s.StartRange, s.StopRange)
+	}
+}
+
+func TestParseMediaPlaylist_ImageTiles(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:20
+#EXT-X-IMAGES-ONLY
+#EXTINF:20.0,
+#EXT-X-TILES:RESOLUTION=320x180,LAYOUT=2x2,DURATION=5.000
+tile1.jpg
+#EXTINF:20.0,
+#EXT-X-TILES:RESOLUTION=320x180,LAYOUT=bad
+tile2.jpg
+#EXTINF:6.0,
+tile3.jpg
+#EXT-X-ENDLIST
+`
+	pl, err := ParseMediaPlaylist(content, "http://example.com/images/tiles.m3u8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !pl.ImagesOnly || len(pl.Segments) != 3 {
+		t.Fatalf("ImagesOnly=%v segments=%d", pl.ImagesOnly, len(pl.Segments))
+	}
+	want := model.Tiles{Resolution: "320x180", Columns: 2, Rows: 2, Duration: 5}
+	if got := pl.Segments[0].Tiles; got == nil || *got != want {
+		t.Errorf("tiles[0]: got %+v, want %+v", got, want)
+	}
+	if got := pl.Segments[1].Tiles; got == nil || got.Columns != 1 || got.Rows != 1 || got.Duration != 0 {
+		t.Errorf("tiles[1] with bad layout: %+v", got)
+	}
+	if pl.Segments[2].Tiles != nil {
+		t.Errorf("tiles[2]: %+v", pl.Segments[2].Tiles)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attrs := ParseAttributes(`#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=1.0,HOLD-BACK=6.0,URI="a,b=c.mp4",CAN-BLOCK-RELOAD=YES`)
+	want := map[string]string{"PART-HOLD-BACK": "1.0", "HOLD-BACK": "6.0", "URI": "a,b=c.mp4", "CAN-BLOCK-RELOAD": "YES"}
+	if fmt.Sprint(attrs) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", attrs, want)
+	}
+	if len(ParseAttributes("#EXT-X-ENDLIST")) != 0 {
+		t.Error("expected no attributes")
+	}
+}
+
+func TestParseMediaPlaylist_LowLatency(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-VERSION:9
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.0,CAN-SKIP-UNTIL=24.0,HOLD-BACK=12.0
+#EXT-X-PART-INF:PART-TARGET=0.5
+#EXT-X-MEDIA-SEQUENCE:270
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+seg270.mp4
+#EXT-X-PART:DURATION=0.5,URI="part271.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.5,URI="part271.1.mp4"
+#EXTINF:1.0,
+seg271.mp4
+#EXT-X-PART:DURATION=0.5,URI="seg272.mp4",BYTERANGE=1000@0,INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.5,URI="seg272.mp4",BYTERANGE=800
+#EXT-X-PART:DURATION=0.5,URI="part272.2.mp4",GAP=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg272.mp4",BYTERANGE-START=1800
+`
+	pl, err := ParseMediaPlaylist(content, "http://example.com/live/index.m3u8?_HLS_msn=272&_HLS_part=2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantSC := model.ServerControl{CanBlockReload: true, CanSkipUntil: 24, HoldBack: 12, PartHoldBack: 1}
+	if pl.ServerControl == nil || *pl.ServerControl != wantSC {
+		t.Errorf("server control: %+v", pl.ServerControl)
+	}
+	if pl.PartTarget != 0.5 {
+		t.Errorf("part target: %v", pl.PartTarget)
+	}
+	if len(pl.Segments) != 2 || len(pl.Segments[0].Parts) != 0 || len(pl.Segments[1].Parts) != 2 {
+		t.Fatalf("segments/parts: %+v", pl.Segments)
+	}
+	if p := pl.Segments[1].Parts[0]; p.URL != "http://example.com/live/part271.0.mp4" || !p.Independent || p.Duration != 0.5 {
+		t.Errorf("part 271.0: %+v", p)
+	}
+	if pl.Segments[1].Index != 271 {
+		t.Errorf("segment index: %d", pl.Segments[1].Index)
+	}
+
+	pending := pl.PendingParts
+	if len(pending) != 3 {
+		t.Fatalf("pending parts: %+v", pending)
+	}
+	if pending[0].StartRange != 0 || pending[0].StopRange != 999 || pending[1].StartRange != 1000 || pending[1].StopRange != 1799 {
+		t.Errorf("pending ranges: %+v", pending[:2])
+	}
+	if !pending[2].Gap || pending[1].Gap {
+		t.Errorf("gap flags: %+v", pending)
+	}
+	wantHint := model.PreloadHint{Type: "PART", URL: "http://example.com/live/seg272.mp4", StartRange: 1800, Ranged: true}
+	if pl.PreloadHint == nil || *pl.PreloadHint != wantHint {
+		t.Errorf("preload hint: %+v", pl.PreloadHint)
+	}
+	if pl.TotalDuration != 5 {
+		t.Errorf("parts must not count towards total duration: %v", pl.TotalDuration)
+	}
+}
+
+func TestParseMediaPlaylist_SkipAndGap(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=24.0
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-SKIP:SKIPPED-SEGMENTS=6
+#EXTINF:4.0,
+seg106.ts
+#EXT-X-GAP
+#EXTINF:4.0,
+seg107.ts
+#EXTINF:4.0,
+#EXT-X-GAP
+seg108.ts
+#EXTINF:4.0,
+seg109.ts
+`
+	pl, err := ParseMediaPlaylist(content, "http://example.com/live.m3u8?_HLS_skip=YES")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pl.SkippedSegments != 6 || pl.ServerControl == nil || pl.ServerControl.CanSkipUntil != 24 {
+		t.Errorf("skipped=%d server control=%+v", pl.SkippedSegments, pl.ServerControl)
+	}
+	var got []string
+	for _, s := range pl.Segments {
+		got = append(got, fmt.Sprintf("%d:%v", s.Index, s.Gap))
+	}
+	if fmt.Sprint(got) != "[106:false 107:true 108:true 109:false]" {
+		t.Errorf("segments: %v", got)
+	}
+}
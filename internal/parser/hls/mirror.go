@@ -0,0 +1,143 @@
+package hls
+
+import (
+	"slices"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// groupMirrors folds redundant variants into the first variant they copy:
+// variants with the same type, bandwidth, codecs, resolution and frame
+// rate become its Mirrors. Backup variants usually point at their own
+// rendition groups; those renditions become mirrors of the matching
+// renditions, by type, language and name, of the first variant's groups.
+// Variants whose groups do not match that way are kept as they are.
+func groupMirrors(streams []model.StreamSpec) []model.StreamSpec {
+	type variantKey struct {
+		mediaType  model.MediaType
+		bandwidth  int64
+		codecs     string
+		resolution string
+		frameRate  float64
+	}
+	first := make(map[variantKey]int)
+	drop := make(map[int]bool)
+
+	for i := range streams {
+		s := &streams[i]
+		if s.URL == "" || (s.MediaType != model.MediaVideo && !s.MediaType.IsTrickPlay()) {
+			continue
+		}
+		key := variantKey{s.MediaType, s.Bandwidth, s.Codecs, s.Resolution, s.FrameRate}
+		j, ok := first[key]
+		if !ok {
+			first[key] = i
+			continue
+		}
+		primary := &streams[j]
+		if primary.URL == s.URL {
+			continue
+		}
+		var pairs [][2]int
+		matched := true
+		for _, g := range [][2]string{
+			{primary.AudioGroup, s.AudioGroup},
+			{primary.SubtitleGroup, s.SubtitleGroup},
+		} {
+			p, ok := matchRenditions(streams, g[0], g[1])
+			if !ok {
+				matched = false
+				break
+			}
+			pairs = append(pairs, p...)
+		}
+		if !matched || primary.CaptionGroup != s.CaptionGroup {
+			continue
+		}
+
+		primary.Mirrors = append(primary.Mirrors, s.URL)
+		drop[i] = true
+		// Renditions are shared by all variants of their group
+		for _, p := range pairs {
+			r := &streams[p[0]]
+			if url := streams[p[1]].URL; !slices.Contains(r.Mirrors, url) {
+				r.Mirrors = append(r.Mirrors, url)
+			}
+			drop[p[1]] = true
+		}
+	}
+	if len(drop) == 0 {
+		return streams
+	}
+
+	kept := streams[:0:0]
+	for i, s := range streams {
+		if !drop[i] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// matchRenditions pairs the renditions of a backup group with those of
+// the primary group, returning [primary, backup] stream indices. Groups
+// that are the same need no pairing.
+func matchRenditions(streams []model.StreamSpec, primary, backup string) ([][2]int, bool) {
+	if primary == backup {
+		return nil, true
+	}
+	if primary == "" || backup == "" {
+		return nil, false
+	}
+	type renditionKey struct {
+		mediaType      model.MediaType
+		language, name string
+	}
+	byKey := make(map[renditionKey]int)
+	for i, s := range streams {
+		if s.GroupID == primary && s.MediaType != model.MediaVideo {
+			byKey[renditionKey{s.MediaType, s.Language, s.Name}] = i
+		}
+	}
+	var pairs [][2]int
+	for i, s := range streams {
+		if s.GroupID != backup || s.MediaType == model.MediaVideo {
+			continue
+		}
+		j, ok := byKey[renditionKey{s.MediaType, s.Language, s.Name}]
+		if !ok {
+			return nil, false
+		}
+		pairs = append(pairs, [2]int{j, i})
+	}
+	return pairs, len(pairs) == len(byKey)
+}
+
+// addSegmentMirrors adds the segment URLs of a mirror playlist to the
+// segments of playlist with the same media sequence number and byte range,
+// and those of its init sections to the init sections in the same place.
+func addSegmentMirrors(playlist, mirror *model.Playlist) {
+	byIndex := make(map[int]*model.Segment, len(mirror.Segments))
+	for i := range mirror.Segments {
+		byIndex[mirror.Segments[i].Index] = &mirror.Segments[i]
+	}
+	for i := range playlist.Segments {
+		seg := &playlist.Segments[i]
+		if m, ok := byIndex[seg.Index]; ok && sameResource(seg, m) {
+			seg.Mirrors = append(seg.Mirrors, m.URL)
+		}
+	}
+	mirrorInits := make(map[int]*model.Segment)
+	for _, m := range mirror.Inits() {
+		mirrorInits[m.Index] = m
+	}
+	for _, init := range playlist.Inits() {
+		if m, ok := mirrorInits[init.Index]; ok && sameResource(init, m) {
+			init.Mirrors = append(init.Mirrors, m.URL)
+		}
+	}
+}
+
+func sameResource(a, b *model.Segment) bool {
+	return a.URL != b.URL && a.StartRange == b.StartRange && a.StopRange == b.StopRange
+}
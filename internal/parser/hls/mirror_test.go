@@ -0,0 +1,115 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+func TestParseMasterPlaylist_RedundantVariants(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",URI="a/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud-backup",NAME="English",LANGUAGE="en",URI="b/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud"
+a/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aud"
+a/high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud-backup"
+b/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aud-backup"
+b/high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="other"
+c/high.m3u8
+`
+	streams := ParseMasterPlaylist(content, "https://example.com/master.m3u8")
+
+	var got []string
+	for _, s := range streams {
+		got = append(got, fmt.Sprintf("%s %s %v", s.MediaType, s.URL, s.Mirrors))
+	}
+	want := []string{
+		"audio https://example.com/a/en.m3u8 [https://example.com/b/en.m3u8]",
+		"video https://example.com/a/low.m3u8 [https://example.com/b/low.m3u8]",
+		"video https://example.com/a/high.m3u8 [https://example.com/b/high.m3u8]",
+		// Its audio group has no rendition to pair with, so it stays
+		"video https://example.com/c/high.m3u8 []",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("streams:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestParser_Parse_MirrorPlaylists(t *testing.T) {
+	media := func(prefix string) string {
+		return fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:4,\n%[1]s/s10.ts\n#EXTINF:4,\n%[1]s/s11.ts\n#EXT-X-ENDLIST\n", prefix)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+a/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+b/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+c/low.m3u8
+`)
+	})
+	mux.HandleFunc("/a/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+	mux.HandleFunc("/b/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, media("http://cdn-b"))
+	})
+	mux.HandleFunc("/c/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, media("http://cdn-c"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Streams) != 1 || len(result.Failed) != 0 {
+		t.Fatalf("streams = %d, failed = %v", len(result.Streams), result.Failed)
+	}
+
+	// The first mirror that loads replaces the failed playlist
+	s := result.Streams[0]
+	if s.URL != server.URL+"/b/low.m3u8" {
+		t.Errorf("URL = %s", s.URL)
+	}
+	if want := []string{server.URL + "/c/low.m3u8", server.URL + "/a/low.m3u8"}; !slices.Equal(s.Mirrors, want) {
+		t.Errorf("mirrors = %v, want %v", s.Mirrors, want)
+	}
+	for _, seg := range s.Playlist.Segments {
+		want := []string{fmt.Sprintf("http://cdn-c/s%d.ts", seg.Index)}
+		if seg.URL != fmt.Sprintf("http://cdn-b/s%d.ts", seg.Index) || !slices.Equal(seg.Mirrors, want) {
+			t.Errorf("segment %d = %s %v", seg.Index, seg.URL, seg.Mirrors)
+		}
+	}
+}
+
+func TestAddSegmentMirrors_ByteRanges(t *testing.T) {
+	playlist := &model.Playlist{Segments: []model.Segment{
+		{Index: 1, URL: "a/all.ts", StartRange: 0, StopRange: 99},
+		{Index: 2, URL: "a/all.ts", StartRange: 100, StopRange: 199},
+	}}
+	mirror := &model.Playlist{Segments: []model.Segment{
+		{Index: 1, URL: "b/all.ts", StartRange: 0, StopRange: 99},
+		{Index: 2, URL: "b/all.ts", StartRange: 100, StopRange: 249},
+	}}
+	addSegmentMirrors(playlist, mirror)
+	if m := playlist.Segments[0].Mirrors; !slices.Equal(m, []string{"b/all.ts"}) {
+		t.Errorf("segment 1 mirrors = %v", m)
+	}
+	if m := playlist.Segments[1].Mirrors; m != nil {
+		t.Errorf("segment 2 has a different range but got mirrors %v", m)
+	}
+}
@@ -0,0 +1,104 @@
+package hls
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// parseSession reads the session-level tags of a playlist into result:
+// EXT-X-SESSION-DATA, EXT-X-SESSION-KEY, EXT-X-START,
+// EXT-X-INDEPENDENT-SEGMENTS and EXT-X-CONTENT-STEERING.
+func parseSession(content, baseURL string, d *diagnostics, result *model.ParseResult) {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	// Variable problems were already reported by the playlist parser
+	lines, _, _ = substituteVariables(lines, baseURL, nil)
+
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		n := i + 1
+		switch {
+		case strings.HasPrefix(line, TagSessionData):
+			attrs := ParseAttributes(line)
+			sd := model.SessionData{
+				ID:       attrs["DATA-ID"],
+				Value:    attrs["VALUE"],
+				Language: attrs["LANGUAGE"],
+			}
+			if uri := attrs["URI"]; uri != "" {
+				sd.URI = ResolveURL(baseURL, uri)
+			}
+			switch {
+			case sd.ID == "":
+				d.warnf(n, line, "missing DATA-ID")
+				continue
+			case (sd.Value == "") == (sd.URI == ""):
+				d.warnf(n, line, "needs exactly one of VALUE and URI")
+				continue
+			}
+			result.SessionData = append(result.SessionData, sd)
+
+		case strings.HasPrefix(line, TagSessionKey):
+			// The container is unknown here; session keys are only
+			// prefetched, and only for AES-128
+			enc, err := parseEncryptInfo(line, baseURL, true)
+			if err != nil {
+				d.warnf(n, line, "%v", err)
+				continue
+			}
+			if enc == nil {
+				d.warnf(n, line, "METHOD=NONE is not allowed")
+				continue
+			}
+			result.SessionKeys = append(result.SessionKeys, *enc)
+
+		case strings.HasPrefix(line, TagStart):
+			attrs := ParseAttributes(line)
+			if attrs["TIME-OFFSET"] == "" {
+				d.warnf(n, line, "missing TIME-OFFSET")
+				continue
+			}
+			result.Start = &model.StartOffset{
+				TimeOffset: d.parseFloat(n, line, "TIME-OFFSET", attrs["TIME-OFFSET"]),
+				Precise:    attrs["PRECISE"] == "YES",
+			}
+
+		case strings.HasPrefix(line, TagIndependentSegs):
+			result.IndependentSegments = true
+
+		case strings.HasPrefix(line, TagContentSteering):
+			attrs := ParseAttributes(line)
+			if attrs["SERVER-URI"] == "" {
+				d.warnf(n, line, "missing SERVER-URI")
+				continue
+			}
+			result.ContentSteering = &model.ContentSteering{
+				ServerURI: ResolveURL(baseURL, attrs["SERVER-URI"]),
+				PathwayID: attrs["PATHWAY-ID"],
+			}
+		}
+	}
+}
+
+// fetchSessionData fetches the JSON documents of session data given by
+// URI. Documents that fail to load or are not JSON are left out.
+func (p *Parser) fetchSessionData(ctx context.Context, data []model.SessionData, headers map[string]string, d *diagnostics) {
+	for i := range data {
+		sd := &data[i]
+		if sd.URI == "" {
+			continue
+		}
+		body, _, err := p.fetch(ctx, sd.URI, headers)
+		if err != nil {
+			d.warnf(0, TagSessionData, "%s: fetch %s: %v", sd.ID, sd.URI, err)
+			continue
+		}
+		if !json.Valid([]byte(body)) {
+			d.warnf(0, TagSessionData, "%s: %s is not JSON", sd.ID, sd.URI)
+			continue
+		}
+		sd.JSON = []byte(body)
+	}
+}
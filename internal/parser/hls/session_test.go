@@ -0,0 +1,99 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+func TestParser_Parse_SessionTags(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-30.5,PRECISE=YES
+#EXT-X-SESSION-DATA:DATA-ID="com.apple.hls.title",VALUE="My Show",LANGUAGE="en"
+#EXT-X-SESSION-DATA:DATA-ID="com.example.info",URI="info.json"
+#EXT-X-SESSION-DATA:DATA-ID="com.example.broken",URI="missing.json"
+#EXT-X-SESSION-DATA:VALUE="no id"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="keys/k1.bin"
+#EXT-X-CONTENT-STEERING:SERVER-URI="steering.json",PATHWAY-ID="CDN-A"
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+low.m3u8
+`)
+	})
+	mux.HandleFunc("/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/info.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"season":1}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/master.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !result.IndependentSegments {
+		t.Error("expected independent segments")
+	}
+	if s := result.Start; s == nil || s.TimeOffset != -30.5 || !s.Precise {
+		t.Errorf("Start = %+v", s)
+	}
+	if len(result.SessionData) != 3 {
+		t.Fatalf("SessionData = %+v", result.SessionData)
+	}
+	if sd := result.SessionData[0]; sd.ID != "com.apple.hls.title" || sd.Value != "My Show" || sd.Language != "en" {
+		t.Errorf("title = %+v", sd)
+	}
+	if sd := result.SessionData[1]; sd.URI != server.URL+"/info.json" || string(sd.JSON) != `{"season":1}` {
+		t.Errorf("info = %+v", sd)
+	}
+	if sd := result.SessionData[2]; sd.JSON != nil {
+		t.Errorf("broken = %+v", sd)
+	}
+	if len(result.SessionKeys) != 1 || result.SessionKeys[0].Method != model.EncryptAES128 || result.SessionKeys[0].KeyURL != server.URL+"/keys/k1.bin" {
+		t.Errorf("SessionKeys = %+v", result.SessionKeys)
+	}
+	if cs := result.ContentSteering; cs == nil || cs.ServerURI != server.URL+"/steering.json" || cs.PathwayID != "CDN-A" {
+		t.Errorf("ContentSteering = %+v", cs)
+	}
+
+	var messages []string
+	for _, w := range result.Warnings {
+		messages = append(messages, w.Message)
+	}
+	got := strings.Join(messages, "\n")
+	for _, want := range []string{"missing DATA-ID", "com.example.broken: fetch " + server.URL + "/missing.json"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("warnings %q missing %q", got, want)
+		}
+	}
+}
+
+func TestParser_Parse_MediaPlaylistStart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-START:TIME-OFFSET=10\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	}))
+	defer server.Close()
+
+	p := &Parser{Client: server.Client()}
+	result, err := p.Parse(context.Background(), server.URL+"/media.m3u8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := result.Start; s == nil || s.TimeOffset != 10 || s.Precise {
+		t.Errorf("Start = %+v", s)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("warnings = %v", result.Warnings)
+	}
+}
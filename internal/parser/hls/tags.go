@@ -7,19 +7,41 @@ import (
 
 // HLS tag constants.
 const (
-	TagExtM3U             = "#EXTM3U"
-	TagExtInf             = "#EXTINF"
-	TagStreamInf          = "#EXT-X-STREAM-INF"
-	TagMedia              = "#EXT-X-MEDIA"
-	TagKey                = "#EXT-X-KEY"
-	TagMap                = "#EXT-X-MAP"
-	TagByteRange          = "#EXT-X-BYTERANGE"
-	TagTargetDuration     = "#EXT-X-TARGETDURATION"
-	TagMediaSequence      = "#EXT-X-MEDIA-SEQUENCE"
-	TagDiscontinuity      = "#EXT-X-DISCONTINUITY"
-	TagEndList            = "#EXT-X-ENDLIST"
-	TagPlaylistType       = "#EXT-X-PLAYLIST-TYPE"
-	TagProgramDateTime    = "#EXT-X-PROGRAM-DATE-TIME"
+	TagExtM3U           = "#EXTM3U"
+	TagExtInf           = "#EXTINF"
+	TagStreamInf        = "#EXT-X-STREAM-INF"
+	TagMedia            = "#EXT-X-MEDIA"
+	TagKey              = "#EXT-X-KEY"
+	TagMap              = "#EXT-X-MAP"
+	TagByteRange        = "#EXT-X-BYTERANGE"
+	TagTargetDuration   = "#EXT-X-TARGETDURATION"
+	TagMediaSequence    = "#EXT-X-MEDIA-SEQUENCE"
+	TagDiscontinuity    = "#EXT-X-DISCONTINUITY"
+	TagDiscontinuitySeq = "#EXT-X-DISCONTINUITY-SEQUENCE"
+	TagEndList          = "#EXT-X-ENDLIST"
+	TagPlaylistType     = "#EXT-X-PLAYLIST-TYPE"
+	TagProgramDateTime  = "#EXT-X-PROGRAM-DATE-TIME"
+	TagIFrameStreamInf  = "#EXT-X-I-FRAME-STREAM-INF"
+	TagIFramesOnly      = "#EXT-X-I-FRAMES-ONLY"
+	TagImageStreamInf   = "#EXT-X-IMAGE-STREAM-INF"
+	TagImagesOnly       = "#EXT-X-IMAGES-ONLY"
+	TagTiles            = "#EXT-X-TILES"
+	TagPartInf          = "#EXT-X-PART-INF"
+	TagPart             = "#EXT-X-PART"
+	TagPreloadHint      = "#EXT-X-PRELOAD-HINT"
+	TagServerControl    = "#EXT-X-SERVER-CONTROL"
+	TagSkip             = "#EXT-X-SKIP"
+	TagGap              = "#EXT-X-GAP"
+	TagDateRange        = "#EXT-X-DATERANGE"
+	TagCueOut           = "#EXT-X-CUE-OUT"
+	TagCueOutCont       = "#EXT-X-CUE-OUT-CONT"
+	TagCueIn            = "#EXT-X-CUE-IN"
+	TagOATCLSSCTE35     = "#EXT-OATCLS-SCTE35"
+	TagSessionData      = "#EXT-X-SESSION-DATA"
+	TagSessionKey       = "#EXT-X-SESSION-KEY"
+	TagStart            = "#EXT-X-START"
+	TagIndependentSegs  = "#EXT-X-INDEPENDENT-SEGMENTS"
+	TagContentSteering  = "#EXT-X-CONTENT-STEERING"
 )
 
 // GetAttribute extracts the value of a key from an HLS tag line.
@@ -61,6 +83,49 @@ func GetAttribute(line, key string) string {
 	return strings.TrimSpace(val[:end])
 }
 
+// ParseAttributes parses the attribute list of a tag line into a map of
+// unquoted values. Unlike GetAttribute it matches whole attribute names,
+// so HOLD-BACK is not confused with PART-HOLD-BACK.
+func ParseAttributes(line string) map[string]string {
+	attrs := make(map[string]string)
+	idx := strings.Index(line, ":")
+	if idx < 0 {
+		return attrs
+	}
+	rest := line[idx+1:]
+
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+
+		var val string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				val, rest = rest[1:], ""
+			} else {
+				val, rest = rest[1:end+1], rest[end+2:]
+			}
+			// Skip to the comma after the closing quote
+			if c := strings.Index(rest, ","); c >= 0 {
+				rest = rest[c+1:]
+			} else {
+				rest = ""
+			}
+		} else if c := strings.Index(rest, ","); c >= 0 {
+			val, rest = strings.TrimSpace(rest[:c]), rest[c+1:]
+		} else {
+			val, rest = strings.TrimSpace(rest), ""
+		}
+		attrs[name] = val
+	}
+	return attrs
+}
+
 // ResolveURL resolves a possibly relative URL against a base URL.
 func ResolveURL(baseURL, ref string) string {
 	if ref == "" {
@@ -10,3 +10,10 @@ import (
 type Parser interface {
 	Parse(ctx context.Context, url string, headers map[string]string) (*model.ParseResult, error)
 }
+
+// PlaylistResolver is implemented by parsers that can defer fetching media
+// playlists. ResolvePlaylists loads the playlists of the given streams,
+// typically the selected ones, and updates result to match.
+type PlaylistResolver interface {
+	ResolvePlaylists(ctx context.Context, result *model.ParseResult, streams []model.StreamSpec, headers map[string]string) error
+}
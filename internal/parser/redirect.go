@@ -0,0 +1,21 @@
+package parser
+
+import "net/http"
+
+// RedirectChain returns the URLs a request went through to produce resp,
+// in request order: the original URL, any redirect targets, and last the
+// URL the response actually came from.
+func RedirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append(chain, req.URL.String())
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
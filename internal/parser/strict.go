@@ -0,0 +1,20 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// CheckStrict turns manifest warnings into an error for strict parsing.
+// It returns nil if there are none.
+func CheckStrict(warnings []model.ParseWarning) error {
+	switch len(warnings) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("strict: %s", warnings[0])
+	default:
+		return fmt.Errorf("strict: %s (and %d more warnings)", warnings[0], len(warnings)-1)
+	}
+}
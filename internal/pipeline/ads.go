@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// chapter is a span of the merged output, in seconds.
+type chapter struct {
+	Start, End float64
+	Title      string
+}
+
+// applyAdMode drops the ad break segments of a playlist, or returns the
+// chapters to write for them, as selected by task.AdMode.
+func (p *Pipeline) applyAdMode(task *model.Task, playlist *model.Playlist) ([]chapter, error) {
+	switch task.AdMode {
+	case "", model.AdsKeep:
+		return nil, nil
+	case model.AdsDrop:
+		breaks := adBreaks(playlist.Segments)
+		if n := playlist.DropAds(); n > 0 {
+			p.logf("[ads] dropping %d segments in %d ad breaks", n, breaks)
+		}
+		if len(playlist.Segments) == 0 {
+			return nil, fmt.Errorf("all segments are in ad breaks")
+		}
+		return nil, nil
+	case model.AdsChapters:
+		chapters := adChapters(playlist.Segments)
+		if len(chapters) == 0 {
+			p.logf("[ads] no ad breaks signalled, no chapters written")
+		}
+		return chapters, nil
+	default:
+		return nil, fmt.Errorf("unknown ad mode %q", task.AdMode)
+	}
+}
+
+// adChapters splits the timeline of segs into alternating content and ad
+// break chapters. It returns nil if no segment is an ad.
+func adChapters(segs []model.Segment) []chapter {
+	if adBreaks(segs) == 0 {
+		return nil
+	}
+	var chapters []chapter
+	var pos float64
+	ads, parts := 0, 0
+	for i, seg := range segs {
+		if i == 0 || seg.Ad != segs[i-1].Ad {
+			title := ""
+			if seg.Ad {
+				ads++
+				title = fmt.Sprintf("Ad break %d", ads)
+			} else {
+				parts++
+				title = fmt.Sprintf("Part %d", parts)
+			}
+			chapters = append(chapters, chapter{Start: pos, Title: title})
+		}
+		pos += seg.Duration
+		chapters[len(chapters)-1].End = pos
+	}
+	return chapters
+}
+
+// adBreaks counts the runs of consecutive ad segments in segs.
+func adBreaks(segs []model.Segment) int {
+	n := 0
+	for i, seg := range segs {
+		if seg.Ad && (i == 0 || !segs[i-1].Ad) {
+			n++
+		}
+	}
+	return n
+}
+
+// cutChapters moves chapters onto the timeline of a precisely cut output,
+// dropping those that end up outside it.
+func cutChapters(chapters []chapter, cut *timeCut) []chapter {
+	var out []chapter
+	for _, c := range chapters {
+		c.Start = max(c.Start-cut.Start, 0)
+		c.End -= cut.Start
+		if cut.Duration > 0 {
+			c.End = min(c.End, cut.Duration)
+		}
+		if c.End > c.Start {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// writeChapters writes chapters as an FFmpeg metadata file next to the
+// output and returns its path, or "" for split output, which has no
+// single timeline to put them on. The merge embeds the file in the
+// output when ffmpeg writes it.
+func (p *Pipeline) writeChapters(task *model.Task, outputName string, chapters []chapter) (string, error) {
+	if task.DiscontinuityMode == model.DiscontinuitySplit {
+		p.logf("[ads] chapters skipped for split output")
+		return "", nil
+	}
+	var b bytes.Buffer
+	b.WriteString(";FFMETADATA1\n")
+	for _, c := range chapters {
+		fmt.Fprintf(&b, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(math.Round(c.Start*1000)), int64(math.Round(c.End*1000)), c.Title)
+	}
+	name := outputName + ".ffmetadata"
+	path := filepath.Join(outputDir(task), name)
+	if err := os.MkdirAll(outputDir(task), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	p.logf("[ads] chapters: %s (%d chapters)", name, len(chapters))
+	return path, nil
+}
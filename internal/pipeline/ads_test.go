@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+const adPlaylist = `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXTINF:10.0,
+seg0.ts
+#EXT-X-CUE-OUT:15
+#EXTINF:10.0,
+ad0.ts
+#EXTINF:5.0,
+ad1.ts
+#EXT-X-CUE-IN
+#EXTINF:10.0,
+seg1.ts
+#EXT-X-ENDLIST
+`
+
+func runAdTask(t *testing.T, mode string, requested *[]string, setup ...func(*model.Task)) (string, []string, error) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, adPlaylist)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if requested != nil {
+			*requested = append(*requested, name)
+		}
+		w.Write([]byte(name))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	var logs []string
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/video.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "out",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 1,
+		RetryCount:  1,
+		BinaryMerge: true,
+		AdMode:      mode,
+	}
+	for _, f := range setup {
+		f(task)
+	}
+	return saveDir, logs, pipe.Run(context.Background(), task, nil)
+}
+
+func TestPipeline_DropAds(t *testing.T) {
+	var requested []string
+	saveDir, logs, err := runAdTask(t, model.AdsDrop, &requested)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range requested {
+		if strings.HasPrefix(name, "ad") {
+			t.Errorf("ad segment %s was requested", name)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+	if string(data) != "seg0.tsseg1.ts" {
+		t.Errorf("output: %q", data)
+	}
+	if !slices.Contains(logs, "[ads] dropping 2 segments in 1 ad breaks") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestPipeline_AdChapters(t *testing.T) {
+	saveDir, logs, err := runAdTask(t, model.AdsChapters, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+	if string(data) != "seg0.tsad0.tsad1.tsseg1.ts" {
+		t.Errorf("output: %q", data)
+	}
+	meta, err := os.ReadFile(filepath.Join(saveDir, "out.ffmetadata"))
+	if err != nil {
+		t.Fatalf("chapters missing: %v", err)
+	}
+	want := `;FFMETADATA1
+
+[CHAPTER]
+TIMEBASE=1/1000
+START=0
+END=10000
+title=Part 1
+
+[CHAPTER]
+TIMEBASE=1/1000
+START=10000
+END=25000
+title=Ad break 1
+
+[CHAPTER]
+TIMEBASE=1/1000
+START=25000
+END=35000
+title=Part 2
+`
+	if string(meta) != want {
+		t.Errorf("chapters:\n%s\nwant:\n%s", meta, want)
+	}
+	if !slices.Contains(logs, "[ads] binary merge cannot embed chapters, apply out.ffmetadata with ffmpeg") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestPipeline_AdChaptersEmbedded(t *testing.T) {
+	// Fake ffmpeg that writes its arguments to the output file
+	dir := t.TempDir()
+	fakeFFmpeg := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\nfor a; do out=$a; done\necho \"$@\" > \"$out\"\n"
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(*model.Task)
+		args     string // ffmpeg call writing the output
+		chapters string // START/END of the chapters
+	}{
+		{
+			name:     "ffmpeg merge",
+			setup:    func(task *model.Task) { task.BinaryMerge = false },
+			args:     "-y -f concat -safe 0 -i ",
+			chapters: "0-10000 10000-25000 25000-35000",
+		},
+		{
+			// The binary merge cannot embed them, the cut can
+			name:     "precise cut",
+			setup:    func(task *model.Task) { task.Start, task.End, task.PreciseCut = "5", "30", true },
+			args:     "-y -ss 5.000 -i ",
+			chapters: "0-5000 5000-20000 20000-25000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveDir, _, err := runAdTask(t, model.AdsChapters, nil, func(task *model.Task) {
+				task.FfmpegPath = fakeFFmpeg
+				tt.setup(task)
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			args, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+			meta := filepath.Join(saveDir, "out.ffmetadata")
+			if !strings.HasPrefix(string(args), tt.args) || !strings.Contains(string(args), " -i "+meta+" -map_metadata 1 ") {
+				t.Errorf("ffmpeg args %q do not embed %s", args, meta)
+			}
+			data, err := os.ReadFile(meta)
+			if err != nil {
+				t.Fatalf("chapters missing: %v", err)
+			}
+			var spans []string
+			for _, block := range strings.Split(string(data), "[CHAPTER]")[1:] {
+				var start, end int
+				fmt.Sscanf(strings.TrimSpace(block), "TIMEBASE=1/1000\nSTART=%d\nEND=%d", &start, &end)
+				spans = append(spans, fmt.Sprintf("%d-%d", start, end))
+			}
+			if got := strings.Join(spans, " "); got != tt.chapters {
+				t.Errorf("chapters = %s, want %s", got, tt.chapters)
+			}
+		})
+	}
+}
+
+func TestPipeline_UnknownAdMode(t *testing.T) {
+	_, _, err := runAdTask(t, "skip", nil)
+	if err == nil || !strings.Contains(err.Error(), `unknown ad mode "skip"`) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCutChapters(t *testing.T) {
+	chapters := []chapter{
+		{Start: 0, End: 10, Title: "Part 1"},
+		{Start: 10, End: 25, Title: "Ad break 1"},
+		{Start: 25, End: 35, Title: "Part 2"},
+	}
+	got := cutChapters(chapters, &timeCut{Start: 12, Duration: 8})
+	want := []chapter{{Start: 0, End: 8, Title: "Ad break 1"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("cutChapters = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/caorushizi/mediago-core/internal/crypto"
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// Inspect parses the manifest without downloading any media. Protection info
+// that is only signalled inside init segments (pssh and tenc boxes) is added
+// by fetching each stream's init segment.
+func (p *Pipeline) Inspect(ctx context.Context, task *model.Task) (*model.ParseResult, error) {
+	result, err := p.Parser.Parse(ctx, task.URL, task.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	client := downloader.NewClient(task.Proxy, task.Timeout)
+	for i := range result.Streams {
+		s := &result.Streams[i]
+		if s.Playlist == nil || s.Playlist.MediaInit == nil {
+			continue
+		}
+		data, err := fetchSegment(ctx, client, s.Playlist.MediaInit, task.Headers)
+		if err != nil {
+			p.logf("[info] stream[%d]: fetch init segment: %v", i, err)
+			continue
+		}
+		prots, err := crypto.InitProtections(data)
+		if err != nil {
+			p.logf("[info] stream[%d]: read init segment: %v", i, err)
+			continue
+		}
+		for _, prot := range prots {
+			s.AddProtection(prot)
+		}
+	}
+
+	return result, nil
+}
+
+// fetchSegment downloads a single segment into memory.
+func fetchSegment(ctx context.Context, client *http.Client, seg *model.Segment, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if seg.HasRange() {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.StartRange, seg.StopRange))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("HTTP %d fetching segment", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
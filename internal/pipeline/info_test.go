@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+func TestInspect_FetchesInitThroughProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="http://cdn.example/init.mp4"
+#EXTINF:4.0,
+http://cdn.example/seg0.m4s
+#EXT-X-ENDLIST
+`)
+	}))
+	defer origin.Close()
+
+	// The CDN is only reachable through the proxy
+	var (
+		mu      sync.Mutex
+		proxied []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		w.Write([]byte("not an init segment"))
+	}))
+	defer proxy.Close()
+
+	pipe := &Pipeline{Parser: &hls.Parser{Client: origin.Client()}}
+	task := &model.Task{URL: origin.URL + "/video.m3u8", Proxy: proxy.URL, Timeout: 5}
+	if _, err := pipe.Inspect(context.Background(), task); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(proxied) != "[http://cdn.example/init.mp4]" {
+		t.Errorf("proxied requests = %v", proxied)
+	}
+}
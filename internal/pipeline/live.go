@@ -3,6 +3,8 @@ package pipeline
 import (
 	"context"
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
 	"time"
 
@@ -18,13 +20,29 @@ type LiveRecorder struct {
 	Parser     parser.Parser
 	Downloader downloader.Downloader
 	Decryptor  *crypto.AES128Decryptor
-	Opts       LiveOptions
+	// KeyProvider resolves AES-128 key URIs; nil builds one from the task.
+	KeyProvider crypto.KeyProvider
+	Opts        LiveOptions
+	OnLog       func(format string, args ...any) // nil = silent
+
+	// Keys seeds the key cache with keys already fetched, by key URL,
+	// such as prefetched session keys.
+	Keys map[string][]byte
+}
+
+func (r *LiveRecorder) logf(format string, args ...any) {
+	if r.OnLog != nil {
+		r.OnLog(format, args...)
+	}
 }
 
 // LiveOptions configures live recording behavior.
 type LiveOptions struct {
 	MaxDuration time.Duration // 0 = unlimited
 	WaitTime    time.Duration // playlist refresh interval, 0 = auto
+	// LowLatency uses LL-HLS blocking playlist reloads and downloads
+	// partial segments when the server supports them.
+	LowLatency bool
 }
 
 // Record starts live recording. It refreshes the playlist periodically,
@@ -38,19 +56,29 @@ func (r *LiveRecorder) Record(ctx context.Context, task *model.Task, stream *mod
 		return fmt.Errorf("create tmp dir: %w", err)
 	}
 
-	// Track which segments we've already downloaded by URL
+	// Track which segments we've already downloaded by URL and byte range
 	downloaded := make(map[string]bool)
+	// Init sections downloaded so far, by URL and byte range, with the
+	// index their file is saved under
+	inits := make(map[string]*model.Segment)
+	// Keys are cached by URL across refreshes; a rotated key shows up
+	// as a new URL and gets fetched on first use.
+	keys := maps.Clone(r.Keys)
+	if keys == nil {
+		keys = make(map[string][]byte)
+	}
 	var totalDownloaded int
 	startTime := time.Now()
 
 	// Determine refresh interval
 	refreshInterval := r.Opts.WaitTime
 	if refreshInterval == 0 {
-		if stream.Playlist != nil && stream.Playlist.TargetDuration > 0 {
-			refreshInterval = time.Duration(stream.Playlist.TargetDuration) * time.Second
-		} else {
-			refreshInterval = 5 * time.Second
-		}
+		refreshInterval = defaultRefreshInterval(stream.Playlist)
+	}
+	// DASH streams are reloaded from the MPD
+	reloadURL := stream.URL
+	if reloadURL == "" {
+		reloadURL = task.URL
 	}
 
 	// Apply max duration via context
@@ -62,51 +90,52 @@ func (r *LiveRecorder) Record(ctx context.Context, task *model.Task, stream *mod
 
 	// Download initial segments
 	if stream.Playlist != nil {
-		n, err := r.downloadNewSegments(ctx, task, stream.Playlist, tmpDir, downloaded, totalDownloaded, onProgress)
+		n, err := r.downloadNewSegments(ctx, task, stream.Playlist, tmpDir, downloaded, inits, keys, totalDownloaded, onProgress)
 		if err != nil {
 			return err
 		}
 		totalDownloaded += n
 	}
 
+	if r.Opts.LowLatency {
+		if pl := stream.Playlist; pl != nil && pl.ServerControl != nil && pl.ServerControl.CanBlockReload {
+			return r.recordLowLatency(ctx, task, stream, tmpDir, downloaded, inits, keys, totalDownloaded, startTime, onProgress)
+		}
+		r.logf("[live] server does not support blocking reload, using periodic refresh")
+	}
+
 	// Refresh loop
+	current := stream.Playlist
 	ticker := time.NewTicker(refreshInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			if ctx.Err() == context.DeadlineExceeded {
-				elapsed := time.Since(startTime).Truncate(time.Second)
-				fmt.Printf("\nLive recording duration reached (%s), recorded %d segments\n", elapsed, totalDownloaded)
-				return nil
-			}
-			return ctx.Err()
+			return recordingStopped(ctx, startTime, totalDownloaded)
 
 		case <-ticker.C:
 			// Refresh playlist
-			result, err := r.Parser.Parse(ctx, stream.URL, task.Headers)
+			playlist, err := r.refresh(ctx, task, reloadURL, stream, current)
 			if err != nil {
 				fmt.Printf("\nWarning: refresh failed: %v, retrying...\n", err)
 				continue
 			}
-
-			if len(result.Streams) == 0 || result.Streams[0].Playlist == nil {
+			if playlist == nil {
 				continue
 			}
-
-			playlist := result.Streams[0].Playlist
+			current = playlist
 
 			// Check if stream ended
 			if !playlist.IsLive {
-				n, _ := r.downloadNewSegments(ctx, task, playlist, tmpDir, downloaded, totalDownloaded, onProgress)
+				n, _ := r.downloadNewSegments(ctx, task, playlist, tmpDir, downloaded, inits, keys, totalDownloaded, onProgress)
 				totalDownloaded += n
 				elapsed := time.Since(startTime).Truncate(time.Second)
 				fmt.Printf("\nLive stream ended. Recorded %d segments in %s\n", totalDownloaded, elapsed)
 				return nil
 			}
 
-			n, err := r.downloadNewSegments(ctx, task, playlist, tmpDir, downloaded, totalDownloaded, onProgress)
+			n, err := r.downloadNewSegments(ctx, task, playlist, tmpDir, downloaded, inits, keys, totalDownloaded, onProgress)
 			if err != nil {
 				fmt.Printf("\nWarning: download failed: %v\n", err)
 				continue
@@ -116,13 +145,108 @@ func (r *LiveRecorder) Record(ctx context.Context, task *model.Task, stream *mod
 	}
 }
 
-// downloadNewSegments downloads segments that haven't been downloaded yet.
+// defaultRefreshInterval is how often a live playlist is reloaded: the
+// target duration of an HLS playlist, or the minimumUpdatePeriod of a
+// DASH MPD. New segments of a DASH template become available every
+// segment duration whatever the update period, so it is capped there.
+func defaultRefreshInterval(playlist *model.Playlist) time.Duration {
+	switch {
+	case playlist == nil:
+		return 5 * time.Second
+	case playlist.UpdatePeriod > 0:
+		period := playlist.UpdatePeriod
+		if playlist.TargetDuration > 0 {
+			period = min(period, playlist.TargetDuration)
+		}
+		return time.Duration(period * float64(time.Second))
+	case playlist.TargetDuration > 0:
+		return time.Duration(playlist.TargetDuration) * time.Second
+	default:
+		return 5 * time.Second
+	}
+}
+
+// refresh reloads the media playlist of stream. When the server supports
+// delta updates (CAN-SKIP-UNTIL) it asks for one with _HLS_skip=YES and
+// merges it into prev, falling back to a full reload if the delta skips
+// segments prev does not hold. It returns nil if the reload has no media
+// playlist.
+func (r *LiveRecorder) refresh(ctx context.Context, task *model.Task, reloadURL string, stream *model.StreamSpec, prev *model.Playlist) (*model.Playlist, error) {
+	if prev != nil && prev.ServerControl != nil && prev.ServerControl.CanSkipUntil > 0 {
+		delta, err := r.fetchPlaylist(ctx, task, withQuery(reloadURL, "_HLS_skip", "YES"), stream)
+		if err != nil || delta == nil {
+			return delta, err
+		}
+		merged, err := prev.ApplyDelta(delta)
+		if err == nil {
+			return merged, nil
+		}
+		r.logf("[live] %v, reloading full playlist", err)
+	}
+	return r.fetchPlaylist(ctx, task, reloadURL, stream)
+}
+
+// fetchPlaylist parses playlistURL and returns the playlist of the stream
+// in it that matches stream, or of its first stream. An MPD lists all its
+// representations, an HLS media playlist only one.
+func (r *LiveRecorder) fetchPlaylist(ctx context.Context, task *model.Task, playlistURL string, stream *model.StreamSpec) (*model.Playlist, error) {
+	result, err := r.Parser.Parse(ctx, playlistURL, task.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Streams) == 0 {
+		return nil, nil
+	}
+	for _, s := range result.Streams {
+		if stream != nil && s.MediaType == stream.MediaType && s.GroupID == stream.GroupID && s.Bandwidth == stream.Bandwidth {
+			return s.Playlist, nil
+		}
+	}
+	return result.Streams[0].Playlist, nil
+}
+
+// withQuery returns rawURL with the query parameter key set to value.
+func withQuery(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// recordingStopped reports the end of a recording whose context is done.
+// Reaching the maximum duration is a normal end.
+func recordingStopped(ctx context.Context, startTime time.Time, total int) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		elapsed := time.Since(startTime).Truncate(time.Second)
+		fmt.Printf("\nLive recording duration reached (%s), recorded %d segments\n", elapsed, total)
+		return nil
+	}
+	return ctx.Err()
+}
+
+// segmentKey identifies a segment or part across playlist refreshes.
+func segmentKey(seg *model.Segment) string {
+	if seg.HasRange() {
+		return fmt.Sprintf("%s@%d-%d", seg.URL, seg.StartRange, seg.StopRange)
+	}
+	return seg.URL
+}
+
+// downloadNewSegments downloads segments that haven't been downloaded yet and
+// decrypts them if a Decryptor is set.
 // Returns the number of newly downloaded segments.
-func (r *LiveRecorder) downloadNewSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, tmpDir string, downloaded map[string]bool, baseIndex int, onProgress func(model.ProgressEvent)) (int, error) {
+func (r *LiveRecorder) downloadNewSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, tmpDir string, downloaded map[string]bool, inits map[string]*model.Segment, keys map[string][]byte, baseIndex int, onProgress func(model.ProgressEvent)) (int, error) {
 	var newSegments []model.Segment
 
 	for _, seg := range playlist.Segments {
-		if !downloaded[seg.URL] {
+		if seg.Ad && task.AdMode == model.AdsDrop {
+			continue
+		}
+		if !seg.Gap && !downloaded[segmentKey(&seg)] {
 			seg.Index = baseIndex + len(newSegments)
 			newSegments = append(newSegments, seg)
 		}
@@ -132,6 +256,47 @@ func (r *LiveRecorder) downloadNewSegments(ctx context.Context, task *model.Task
 		return 0, nil
 	}
 
+	// Init sections (fMP4, DASH) are fetched once, when first used. Each
+	// playlist numbers them from -1, so they are given indexes that hold
+	// for the whole recording and a new EXT-X-MAP does not overwrite the
+	// file of an earlier one.
+	pending := make(map[string]*model.Segment)
+	var newInits []model.Segment
+	for i := range newSegments {
+		seg := &newSegments[i]
+		init := playlist.InitOf(seg)
+		if init == nil {
+			continue
+		}
+		key := segmentKey(init)
+		stable := inits[key]
+		if stable == nil {
+			stable = pending[key]
+		}
+		if stable == nil {
+			stable = new(model.Segment)
+			*stable = *init
+			stable.Index = -1 - len(inits) - len(pending)
+			pending[key] = stable
+			newInits = append(newInits, *stable)
+		}
+		seg.Init = stable
+	}
+	if len(newInits) > 0 {
+		err := r.Downloader.Download(ctx, newInits, downloader.Options{
+			TmpDir:      tmpDir,
+			Headers:     task.Headers,
+			Proxy:       task.Proxy,
+			Timeout:     task.Timeout,
+			ThreadCount: 1,
+			RetryCount:  task.RetryCount,
+		}, nil)
+		if err != nil {
+			return 0, fmt.Errorf("download init segment: %w", err)
+		}
+		maps.Copy(inits, pending)
+	}
+
 	err := r.Downloader.Download(ctx, newSegments, downloader.Options{
 		TmpDir:      tmpDir,
 		Headers:     task.Headers,
@@ -151,8 +316,26 @@ func (r *LiveRecorder) downloadNewSegments(ctx context.Context, task *model.Task
 		return 0, err
 	}
 
+	if r.Decryptor != nil {
+		provider := r.KeyProvider
+		if provider == nil {
+			provider = newKeyProvider(task)
+		}
+		for i := range newSegments {
+			seg := &newSegments[i]
+			segPath := downloader.SegmentFilePath(tmpDir, seg.Index)
+			repair, err := decryptSegment(ctx, r.Decryptor, seg, segPath, provider, keys)
+			if err != nil {
+				return 0, err
+			}
+			if repair != nil {
+				r.logf("[decrypt] repaired segment %d: %s", seg.Index, repair)
+			}
+		}
+	}
+
 	for _, seg := range newSegments {
-		downloaded[seg.URL] = true
+		downloaded[segmentKey(&seg)] = true
 	}
 
 	return len(newSegments), nil
@@ -6,12 +6,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/caorushizi/mediago-core/internal/crypto"
 	"github.com/caorushizi/mediago-core/internal/downloader"
 	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/dash"
 	"github.com/caorushizi/mediago-core/internal/parser/hls"
 )
 
@@ -233,6 +237,107 @@ seg1.ts
 	}
 }
 
+func TestLiveRecorder_DecryptsWithKeyRotation(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	iv := []byte("abcdef0123456789")
+	seg0Plain := []byte("live-segment-zero")
+	seg1Plain := []byte("live-segment-one")
+
+	var key1Fetches, key2Fetches, playlistCalls atomic.Int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		n := playlistCalls.Add(1)
+		if n >= 2 {
+			// Key rotates for seg1, then the stream ends
+			fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin",IV=0x61626364656630313233343536373839
+#EXTINF:2.0,
+seg0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin",IV=0x61626364656630313233343536373839
+#EXTINF:2.0,
+seg1.ts
+#EXT-X-ENDLIST
+`)
+			return
+		}
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin",IV=0x61626364656630313233343536373839
+#EXTINF:2.0,
+seg0.ts
+`)
+	})
+	mux.HandleFunc("/key1.bin", func(w http.ResponseWriter, r *http.Request) {
+		key1Fetches.Add(1)
+		w.Write(key1)
+	})
+	mux.HandleFunc("/key2.bin", func(w http.ResponseWriter, r *http.Request) {
+		key2Fetches.Add(1)
+		w.Write(key2)
+	})
+	mux.HandleFunc("/seg0.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testEncrypt(seg0Plain, key1, iv))
+	})
+	mux.HandleFunc("/seg1.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testEncrypt(seg1Plain, key2, iv))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	parser := &hls.Parser{Client: server.Client()}
+
+	initial, err := parser.Parse(context.Background(), server.URL+"/live.m3u8", nil)
+	if err != nil {
+		t.Fatalf("initial parse: %v", err)
+	}
+
+	recorder := &LiveRecorder{
+		Parser:     parser,
+		Downloader: &downloader.HTTPDownloader{},
+		Decryptor:  &crypto.AES128Decryptor{},
+		Opts: LiveOptions{
+			WaitTime: 300 * time.Millisecond,
+		},
+	}
+
+	task := &model.Task{
+		URL:         server.URL + "/live.m3u8",
+		TmpDir:      tmpDir,
+		ThreadCount: 1,
+		RetryCount:  1,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := recorder.Record(ctx, task, &initial.Streams[0], nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data0, _ := os.ReadFile(downloader.SegmentFilePath(tmpDir, 0))
+	data1, _ := os.ReadFile(downloader.SegmentFilePath(tmpDir, 1))
+	if string(data0) != string(seg0Plain) {
+		t.Errorf("seg0 decryption mismatch: got %q", string(data0))
+	}
+	if string(data1) != string(seg1Plain) {
+		t.Errorf("seg1 decryption mismatch: got %q", string(data1))
+	}
+
+	// Each key is fetched once despite repeated refreshes
+	if key1Fetches.Load() != 1 || key2Fetches.Load() != 1 {
+		t.Errorf("expected 1 fetch per key, got key1=%d key2=%d", key1Fetches.Load(), key2Fetches.Load())
+	}
+}
+
 func TestParseLiveDuration(t *testing.T) {
 	tests := []struct {
 		input string
@@ -254,3 +359,219 @@ func TestParseLiveDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestLiveRecorder_DeltaUpdates(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		served  int
+		queries []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, r.URL.RawQuery)
+
+		// Six segment window that moves on by one segment per request
+		start := 5 + served
+		served++
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=6.0\n#EXT-X-MEDIA-SEQUENCE:%d\n", start)
+		first := start
+		if r.URL.Query().Get("_HLS_skip") == "YES" {
+			fmt.Fprintf(w, "#EXT-X-SKIP:SKIPPED-SEGMENTS=4\n")
+			first += 4
+		}
+		for i := first; i < start+6; i++ {
+			fmt.Fprintf(w, "#EXTINF:1.0,\nseg%d.ts\n", i)
+		}
+		if served > 3 {
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s ", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var logs []string
+	tmpDir := t.TempDir()
+	recorder := &LiveRecorder{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{MaxDuration: 5 * time.Second, WaitTime: 50 * time.Millisecond},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	// The first delta skips segments this playlist never saw, so the
+	// recorder has to fall back to a full reload once
+	stream := &model.StreamSpec{
+		URL: server.URL + "/live.m3u8",
+		Playlist: &model.Playlist{
+			IsLive:        true,
+			ServerControl: &model.ServerControl{CanSkipUntil: 6},
+			Segments: []model.Segment{
+				{Index: 0, URL: server.URL + "/old0.ts", Duration: 1},
+				{Index: 1, URL: server.URL + "/old1.ts", Duration: 1},
+			},
+		},
+	}
+	task := &model.Task{TmpDir: tmpDir, ThreadCount: 1, RetryCount: 1}
+	if err := recorder.Record(context.Background(), task, stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got strings.Builder
+	for i := 0; ; i++ {
+		data, err := os.ReadFile(downloader.SegmentFilePath(tmpDir, i))
+		if err != nil {
+			break
+		}
+		got.Write(data)
+	}
+	if want := "old0 old1 seg6 seg7 seg8 seg9 seg10 seg11 seg12 seg13 "; got.String() != want {
+		t.Errorf("recorded %q, want %q", got.String(), want)
+	}
+	if fmt.Sprint(queries) != "[_HLS_skip=YES  _HLS_skip=YES _HLS_skip=YES]" {
+		t.Errorf("queries: %q", queries)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "delta update skips segment 5") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestLiveRecorder_DASH(t *testing.T) {
+	ast := time.Now().Add(-20 * time.Second).UTC().Format(time.RFC3339)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var mpdLoads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.mpd", func(w http.ResponseWriter, r *http.Request) {
+		mpdLoads.Add(1)
+		fmt.Fprintf(w, `<MPD type="dynamic" availabilityStartTime="%s" minimumUpdatePeriod="PT1S" timeShiftBufferDepth="PT4S">
+  <Period start="PT0S">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="500000">
+        <SegmentTemplate media="v_$Number$.m4s" initialization="v_init.mp4" duration="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`, ast)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[strings.TrimPrefix(r.URL.Path, "/")]++
+		mu.Unlock()
+		w.Write([]byte("data"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	parser := &dash.Parser{Client: server.Client()}
+	task := &model.Task{
+		URL:         server.URL + "/live.mpd",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+	}
+	result, err := parser.Parse(context.Background(), task.URL, nil)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	stream := result.Streams[0]
+	if got := defaultRefreshInterval(stream.Playlist); got != time.Second {
+		t.Errorf("refresh interval = %v, want 1s", got)
+	}
+
+	recorder := &LiveRecorder{
+		Parser:     parser,
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{MaxDuration: 2500 * time.Millisecond},
+	}
+	if err := recorder.Record(context.Background(), task, &stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if mpdLoads.Load() < 2 {
+		t.Errorf("MPD loaded %d times, want refreshes", mpdLoads.Load())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests["v_init.mp4"] != 1 {
+		t.Errorf("init requested %d times, want 1", requests["v_init.mp4"])
+	}
+	var segments int
+	for name, n := range requests {
+		if name == "v_init.mp4" {
+			continue
+		}
+		segments++
+		if n != 1 {
+			t.Errorf("%s requested %d times", name, n)
+		}
+	}
+	// The 4s window plus at least one new segment per refresh
+	if segments < 5 {
+		t.Errorf("recorded %d segments: %v", segments, requests)
+	}
+}
+
+func TestLiveRecorder_MapChangesAcrossRefreshes(t *testing.T) {
+	var loads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if loads.Add(1) == 1 {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:2\n#EXT-X-MAP:URI=\"init1.mp4\"\n#EXTINF:1.0,\na2.m4s\n#EXTINF:1.0,\na3.m4s\n")
+			return
+		}
+		// The old map has left the playlist, so the new one is numbered
+		// -1 in it too
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:4\n#EXT-X-MAP:URI=\"init2.mp4\"\n#EXTINF:1.0,\nb4.m4s\n#EXT-X-ENDLIST\n")
+	})
+	var initLoads atomic.Int32
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if strings.HasPrefix(name, "init") {
+			initLoads.Add(1)
+		}
+		w.Write([]byte(name))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	recorder := &LiveRecorder{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{WaitTime: 100 * time.Millisecond},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/live.m3u8",
+		TmpDir:      tmpDir,
+		ThreadCount: 1,
+		RetryCount:  1,
+	}
+	stream := &model.StreamSpec{URL: server.URL + "/live.m3u8"}
+	stream.Playlist, _ = recorder.fetchPlaylist(context.Background(), task, stream.URL, stream)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := recorder.Record(ctx, task, stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for index, want := range map[int]string{-1: "init1.mp4", -2: "init2.mp4", 0: "a2.m4s", 1: "a3.m4s", 2: "b4.m4s"} {
+		data, err := os.ReadFile(downloader.SegmentFilePath(tmpDir, index))
+		if err != nil {
+			t.Fatalf("segment %d: %v", index, err)
+		}
+		if string(data) != want {
+			t.Errorf("segment %d: got %q, want %q", index, data, want)
+		}
+	}
+	if n := initLoads.Load(); n != 2 {
+		t.Errorf("init sections fetched %d times, want 2", n)
+	}
+}
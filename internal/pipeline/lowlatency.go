@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// recordLowLatency records an LL-HLS stream with blocking playlist reloads
+// (_HLS_msn/_HLS_part). Near the live edge it downloads partial segments as
+// soon as they are published instead of waiting for whole segments.
+func (r *LiveRecorder) recordLowLatency(ctx context.Context, task *model.Task, stream *model.StreamSpec, tmpDir string, downloaded map[string]bool, inits map[string]*model.Segment, keys map[string][]byte, total int, startTime time.Time, onProgress func(model.ProgressEvent)) error {
+	playlist := stream.Playlist
+	r.logf("[live] low-latency mode: part_target=%.3fs", playlist.PartTarget)
+
+	for {
+		units, fromParts := lowLatencyUnits(playlist, downloaded)
+		n, err := r.downloadNewSegments(ctx, task, units, tmpDir, downloaded, inits, keys, total, onProgress)
+		if err != nil {
+			if ctx.Err() != nil {
+				return recordingStopped(ctx, startTime, total)
+			}
+			fmt.Printf("\nWarning: download failed: %v\n", err)
+		} else {
+			// Segments completed from their parts are not fetched again
+			// whole once the parts leave the playlist
+			for _, key := range fromParts {
+				downloaded[key] = true
+			}
+		}
+		total += n
+
+		if !playlist.IsLive {
+			elapsed := time.Since(startTime).Truncate(time.Second)
+			fmt.Printf("\nLive stream ended. Recorded %d segments in %s\n", total, elapsed)
+			return nil
+		}
+
+		// The server holds the response until the next part is available
+		next, err := r.refresh(ctx, task, blockingReloadURL(stream.URL, playlist), stream, playlist)
+		if err == nil && next != nil {
+			playlist = next
+			continue
+		}
+		if ctx.Err() != nil {
+			return recordingStopped(ctx, startTime, total)
+		}
+		if err != nil {
+			fmt.Printf("\nWarning: refresh failed: %v, retrying...\n", err)
+		}
+
+		wait := time.Second
+		if playlist.PartTarget > 0 {
+			wait = time.Duration(playlist.PartTarget * float64(time.Second))
+		}
+		select {
+		case <-ctx.Done():
+			return recordingStopped(ctx, startTime, total)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lowLatencyUnits lists what to download from an LL-HLS playlist: whole
+// segments, except segments already being fetched part by part, which are
+// completed from their parts; then the published parts of the next
+// segment and the part announced by the preload hint. Already downloaded
+// units are skipped by downloadNewSegments. It also returns the keys of
+// the segments completed from parts, to be marked as downloaded once the
+// units are.
+func lowLatencyUnits(playlist *model.Playlist, downloaded map[string]bool) (*model.Playlist, []string) {
+	units := &model.Playlist{MediaInit: playlist.MediaInit}
+	var fromParts []string
+
+	// AES-128 is chained across a whole segment, so its parts cannot be
+	// decrypted on their own
+	for _, seg := range playlist.Segments {
+		if seg.EncryptInfo != nil && seg.EncryptInfo.Method == model.EncryptAES128 {
+			units.Segments = playlist.Segments
+			return units, nil
+		}
+	}
+
+	for _, seg := range playlist.Segments {
+		if partsStarted(seg.Parts, downloaded) {
+			parts := partSegments(seg.Parts)
+			for i := range parts {
+				parts[i].Ad = seg.Ad
+				parts[i].Init = seg.Init
+			}
+			units.Segments = append(units.Segments, parts...)
+			fromParts = append(fromParts, segmentKey(&seg))
+		} else {
+			units.Segments = append(units.Segments, seg)
+		}
+	}
+	// Parts of the next segment follow the init section of the last one
+	var init *model.Segment
+	if n := len(playlist.Segments); n > 0 {
+		init = playlist.InitOf(&playlist.Segments[n-1])
+	}
+	pending := partSegments(playlist.PendingParts)
+	for i := range pending {
+		pending[i].Init = init
+	}
+	units.Segments = append(units.Segments, pending...)
+
+	// An open-ended byte range hint cannot be matched to the part it
+	// becomes, even from the start of the resource, so only whole
+	// resources and exact ranges are preloaded
+	if hint := playlist.PreloadHint; hint != nil && hint.Type == "PART" && (hint.Length > 0 || !hint.Ranged) {
+		seg := model.Segment{URL: hint.URL, Init: init}
+		if hint.Length > 0 {
+			seg.StartRange = hint.StartRange
+			seg.StopRange = hint.StartRange + hint.Length - 1
+		}
+		units.Segments = append(units.Segments, seg)
+	}
+	return units, fromParts
+}
+
+// partsStarted reports whether any part of a segment was downloaded.
+func partsStarted(parts []model.Part, downloaded map[string]bool) bool {
+	for _, seg := range partSegments(parts) {
+		if downloaded[segmentKey(&seg)] {
+			return true
+		}
+	}
+	return false
+}
+
+// partSegments converts parts to downloadable segments, leaving out gaps.
+func partSegments(parts []model.Part) []model.Segment {
+	var segs []model.Segment
+	for _, p := range parts {
+		if p.Gap {
+			continue
+		}
+		segs = append(segs, model.Segment{
+			URL:        p.URL,
+			Duration:   p.Duration,
+			StartRange: p.StartRange,
+			StopRange:  p.StopRange,
+		})
+	}
+	return segs
+}
+
+// blockingReloadURL adds the LL-HLS delivery directives asking for the
+// playlist that contains the next part, or the next segment when the
+// stream has no parts.
+func blockingReloadURL(rawURL string, playlist *model.Playlist) string {
+	if len(playlist.Segments) == 0 {
+		return rawURL
+	}
+	reloadURL := withQuery(rawURL, "_HLS_msn", strconv.Itoa(playlist.Segments[len(playlist.Segments)-1].Index+1))
+	if playlist.PartTarget > 0 {
+		reloadURL = withQuery(reloadURL, "_HLS_part", strconv.Itoa(len(playlist.PendingParts)))
+	}
+	return reloadURL
+}
@@ -0,0 +1,343 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+// llhlsServer simulates an LL-HLS origin with two parts per segment that
+// publishes parts as blocking reloads ask for them.
+type llhlsServer struct {
+	mu        sync.Mutex
+	published int // number of parts published so far
+	maxParts  int
+	reloads   []string
+}
+
+func (s *llhlsServer) playlist() string {
+	const partsPerSeg = 2
+	complete := s.published / partsPerSeg
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-VERSION:9\n")
+	b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.5\n")
+	b.WriteString("#EXT-X-PART-INF:PART-TARGET=0.5\n")
+	first := max(0, complete-3)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for m := first; m < complete; m++ {
+		// Parts are only listed for the most recent segments
+		if m >= complete-2 {
+			for k := 0; k < partsPerSeg; k++ {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=0.5,URI=\"part%d.%d.mp4\"\n", m, k)
+			}
+		}
+		fmt.Fprintf(&b, "#EXTINF:1.0,\nseg%d.mp4\n", m)
+	}
+	for k := 0; k < s.published-complete*partsPerSeg; k++ {
+		fmt.Fprintf(&b, "#EXT-X-PART:DURATION=0.5,URI=\"part%d.%d.mp4\"\n", complete, k)
+	}
+	if s.published >= s.maxParts {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.mp4\"\n", complete, s.published%partsPerSeg)
+	}
+	return b.String()
+}
+
+func (s *llhlsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case name == "live.m3u8":
+		s.reloads = append(s.reloads, r.URL.RawQuery)
+		if msn := r.URL.Query().Get("_HLS_msn"); msn != "" {
+			// Blocking reload: publish up to the requested part
+			m, _ := strconv.Atoi(msn)
+			k, _ := strconv.Atoi(r.URL.Query().Get("_HLS_part"))
+			s.published = min(s.maxParts, max(s.published, m*2+k+1))
+		}
+		fmt.Fprint(w, s.playlist())
+	case strings.HasPrefix(name, "part"):
+		fmt.Fprintf(w, "[%s]", strings.TrimSuffix(strings.TrimPrefix(name, "part"), ".mp4"))
+	case strings.HasPrefix(name, "seg"):
+		m, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".mp4"))
+		fmt.Fprintf(w, "[%d.0][%d.1]", m, m)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLiveRecorder_LowLatency(t *testing.T) {
+	origin := &llhlsServer{published: 3, maxParts: 10}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	parser := &hls.Parser{Client: server.Client()}
+	result, err := parser.Parse(context.Background(), server.URL+"/live.m3u8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &result.Streams[0]
+
+	var logs []string
+	tmpDir := t.TempDir()
+	recorder := &LiveRecorder{
+		Parser:     parser,
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{MaxDuration: 10 * time.Second, LowLatency: true},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	task := &model.Task{TmpDir: tmpDir, ThreadCount: 1, RetryCount: 1}
+	if err := recorder.Record(context.Background(), task, stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every part is recorded exactly once and in order, whether it came
+	// from a whole segment or from parts
+	var got strings.Builder
+	for i := 0; ; i++ {
+		data, err := os.ReadFile(downloader.SegmentFilePath(tmpDir, i))
+		if err != nil {
+			break
+		}
+		got.Write(data)
+	}
+	want := "[0.0][0.1][1.0][1.1][2.0][2.1][3.0][3.1][4.0][4.1]"
+	if got.String() != want {
+		t.Errorf("recorded %s, want %s", got.String(), want)
+	}
+
+	if len(origin.reloads) < 2 || origin.reloads[0] != "" {
+		t.Fatalf("reloads: %v", origin.reloads)
+	}
+	for _, q := range origin.reloads[1:] {
+		if !strings.Contains(q, "_HLS_msn=") || !strings.Contains(q, "_HLS_part=") {
+			t.Errorf("reload without blocking directives: %q", q)
+		}
+	}
+	if len(logs) == 0 || logs[0] != "[live] low-latency mode: part_target=0.500s" {
+		t.Errorf("logs: %v", logs)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(tmpDir, "seg_*")); len(entries) < 8 {
+		t.Errorf("expected part-level files, got %d", len(entries))
+	}
+}
+
+func TestLiveRecorder_LowLatencyFallsBackWithoutBlockingReload(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			t.Errorf("unexpected delivery directives: %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var logs []string
+	recorder := &LiveRecorder{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{MaxDuration: 5 * time.Second, WaitTime: 100 * time.Millisecond, LowLatency: true},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	stream := &model.StreamSpec{
+		URL:      server.URL + "/live.m3u8",
+		Playlist: &model.Playlist{IsLive: true, TargetDuration: 1},
+	}
+	task := &model.Task{TmpDir: t.TempDir(), ThreadCount: 1, RetryCount: 1}
+	if err := recorder.Record(context.Background(), task, stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logs) == 0 || !strings.Contains(logs[0], "using periodic refresh") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestBlockingReloadURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist *model.Playlist
+		want     string
+	}{
+		{"no segments", &model.Playlist{}, "http://x/live.m3u8?token=a"},
+		{
+			"segments only",
+			&model.Playlist{Segments: []model.Segment{{Index: 41}, {Index: 42}}},
+			"http://x/live.m3u8?_HLS_msn=43&token=a",
+		},
+		{
+			"pending parts",
+			&model.Playlist{PartTarget: 0.3, Segments: []model.Segment{{Index: 42}}, PendingParts: make([]model.Part, 2)},
+			"http://x/live.m3u8?_HLS_msn=43&_HLS_part=2&token=a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blockingReloadURL("http://x/live.m3u8?token=a", tt.playlist); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLowLatencyUnits_AES128UsesWholeSegments(t *testing.T) {
+	enc := &model.EncryptInfo{Method: model.EncryptAES128, KeyURL: "http://x/key"}
+	playlist := &model.Playlist{
+		Segments:     []model.Segment{{URL: "http://x/seg0.ts", EncryptInfo: enc, Parts: []model.Part{{URL: "http://x/p0.0.ts"}}}},
+		PendingParts: []model.Part{{URL: "http://x/p1.0.ts"}},
+	}
+	units, _ := lowLatencyUnits(playlist, map[string]bool{"http://x/p0.0.ts": true})
+	if len(units.Segments) != 1 || units.Segments[0].URL != "http://x/seg0.ts" {
+		t.Errorf("units: %+v", units.Segments)
+	}
+}
+
+func TestLowLatencyUnits_KeepInitSections(t *testing.T) {
+	init1 := &model.Segment{Index: -1, URL: "http://x/init1.mp4"}
+	init2 := &model.Segment{Index: -2, URL: "http://x/init2.mp4"}
+	playlist := &model.Playlist{
+		MediaInit: init1,
+		Segments: []model.Segment{
+			{URL: "http://x/seg0.m4s"},
+			{URL: "http://x/seg1.m4s", Init: init2, Parts: []model.Part{{URL: "http://x/p1.0.m4s"}}},
+		},
+		PendingParts: []model.Part{{URL: "http://x/p2.0.m4s"}},
+	}
+	units, _ := lowLatencyUnits(playlist, map[string]bool{"http://x/p1.0.m4s": true})
+	var got []string
+	for i := range units.Segments {
+		got = append(got, units.InitOf(&units.Segments[i]).URL)
+	}
+	if want := "[http://x/init1.mp4 http://x/init2.mp4 http://x/init2.mp4]"; fmt.Sprint(got) != want {
+		t.Errorf("inits: got %v, want %s", got, want)
+	}
+}
+
+func TestLowLatencyUnits_OpenEndedHint(t *testing.T) {
+	tests := []struct {
+		name string
+		hint string
+		want string // preloaded unit, "" for none
+	}{
+		{"whole resource", `URI="p1.1.mp4"`, "http://x/p1.1.mp4 0-0"},
+		{"exact range", `URI="p1.mp4",BYTERANGE-START=1000,BYTERANGE-LENGTH=500`, "http://x/p1.mp4 1000-1499"},
+		{"open range", `URI="p1.mp4",BYTERANGE-START=1000`, ""},
+		{"open range from start", `URI="p1.mp4",BYTERANGE-START=0`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist, err := hls.ParseMediaPlaylist("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PART-INF:PART-TARGET=0.5\n"+
+				"#EXT-X-PART:DURATION=0.5,URI=\"p1.0.mp4\"\n#EXT-X-PRELOAD-HINT:TYPE=PART,"+tt.hint+"\n", "http://x/live.m3u8")
+			if err != nil {
+				t.Fatal(err)
+			}
+			units, _ := lowLatencyUnits(playlist, map[string]bool{})
+			var got string
+			if n := len(units.Segments); n == 2 {
+				last := units.Segments[n-1]
+				got = fmt.Sprintf("%s %d-%d", last.URL, last.StartRange, last.StopRange)
+			} else if n != 1 {
+				t.Fatalf("units: %+v", units.Segments)
+			}
+			if got != tt.want {
+				t.Errorf("preloaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLowLatencyUnits_MarksSegmentsOnlyAfterDownload(t *testing.T) {
+	playlist := &model.Playlist{
+		Segments: []model.Segment{{URL: "http://x/seg1.m4s", Parts: []model.Part{{URL: "http://x/p1.0.m4s"}, {URL: "http://x/p1.1.m4s"}}}},
+	}
+	downloaded := map[string]bool{"http://x/p1.0.m4s": true}
+	_, fromParts := lowLatencyUnits(playlist, downloaded)
+	if fmt.Sprint(fromParts) != "[http://x/seg1.m4s]" {
+		t.Errorf("fromParts = %v", fromParts)
+	}
+	if len(downloaded) != 1 {
+		t.Errorf("downloaded changed before the parts were fetched: %v", downloaded)
+	}
+}
+
+func TestLiveRecorder_LowLatencyRetriesSegmentOfFailedParts(t *testing.T) {
+	const header = "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-VERSION:9\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n#EXT-X-PART-INF:PART-TARGET=0.5\n"
+	playlists := []string{
+		header + "#EXTINF:1.0,\nseg0.ts\n#EXT-X-PART:DURATION=0.5,URI=\"part1.0.ts\"\n",
+		header + "#EXTINF:1.0,\nseg0.ts\n#EXT-X-PART:DURATION=0.5,URI=\"part1.0.ts\"\n#EXT-X-PART:DURATION=0.5,URI=\"part1.1.ts\"\n#EXTINF:1.0,\nseg1.ts\n",
+		// The parts of segment 1 have left the playlist
+		header + "#EXTINF:1.0,\nseg0.ts\n#EXTINF:1.0,\nseg1.ts\n#EXT-X-ENDLIST\n",
+	}
+	var (
+		mu        sync.Mutex
+		reloads   int
+		requested []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, playlists[min(reloads, len(playlists)-1)])
+		reloads++
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		requested = append(requested, name)
+		mu.Unlock()
+		if name == "part1.1.ts" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(name))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	parser := &hls.Parser{Client: server.Client()}
+	result, err := parser.Parse(context.Background(), server.URL+"/live.m3u8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &LiveRecorder{
+		Parser:     parser,
+		Downloader: &downloader.HTTPDownloader{},
+		Opts:       LiveOptions{MaxDuration: 5 * time.Second, LowLatency: true},
+	}
+	task := &model.Task{TmpDir: t.TempDir(), ThreadCount: 1, RetryCount: 1}
+	if err := recorder.Record(context.Background(), task, &result.Streams[0], nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The segment whose parts failed is fetched whole instead of lost
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(requested, "seg1.ts") {
+		t.Errorf("seg1.ts never requested: %v", requested)
+	}
+}
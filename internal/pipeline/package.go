@@ -0,0 +1,612 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// Package formats for --package.
+const (
+	packageHLS  = "hls"
+	packageDASH = "dash"
+)
+
+// packagedStream is one stream written into a local package.
+type packagedStream struct {
+	stream *model.StreamSpec
+	dir    string   // directory of the stream inside the package
+	init   string   // first init section file name, empty without one
+	files  []string // file name per playlist segment
+	bytes  int64    // size of the segment files
+	// initFiles maps init section indices to their file names; there is
+	// more than one when the playlist changes init sections.
+	initFiles map[int]string
+	// keyFiles maps AES-128 key URLs to the key files saved next to the
+	// segments, when they are kept encrypted.
+	keyFiles map[string]string
+	// protections is the CENC signalling kept for encrypted segments.
+	protections []model.Protection
+}
+
+// processPackage downloads the selected streams into <save dir>/<name>
+// and writes a manifest that plays them from there: a master playlist and
+// one media playlist per stream for HLS, or a single MPD for DASH.
+// Segments keep their encryption, with AES-128 keys saved alongside,
+// unless task.PackageDecrypt is set.
+func (p *Pipeline) processPackage(ctx context.Context, task *model.Task, streams []model.StreamSpec, outputName string, sessionKeys map[string][]byte, onProgress func(model.ProgressEvent)) error {
+	format := strings.ToLower(task.Package)
+	if format != packageHLS && format != packageDASH {
+		return fmt.Errorf("unknown package format %q", task.Package)
+	}
+
+	root := filepath.Join(outputDir(task), outputName)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return fmt.Errorf("create package dir: %w", err)
+	}
+	p.logf("[package] format=%s dir=%s", format, root)
+
+	var packaged []*packagedStream
+	used := make(map[string]bool)
+	for i := range streams {
+		s := &streams[i]
+		if s.Playlist == nil || len(s.Playlist.Segments) == 0 {
+			continue
+		}
+		if format == packageDASH {
+			if s.MediaType == model.MediaSubtitle {
+				p.logf("[package] skipping subtitle stream %d: WebVTT segments cannot be packaged as DASH", i)
+				continue
+			}
+			if s.Playlist.MediaInit == nil {
+				return fmt.Errorf("stream %d: DASH packages need fMP4 segments with an init section", i)
+			}
+			if len(s.Playlist.Inits()) > 1 {
+				return fmt.Errorf("stream %d: DASH packages need a single init section, use --package hls", i)
+			}
+		}
+		ps, err := p.packageStream(ctx, task, s, root, streamDirName(s, used), format, sessionKeys, onProgress)
+		if err != nil {
+			return fmt.Errorf("stream %d: %w", i, err)
+		}
+		packaged = append(packaged, ps)
+	}
+	if len(packaged) == 0 {
+		return fmt.Errorf("no streams to package")
+	}
+
+	var manifest string
+	var err error
+	switch format {
+	case packageHLS:
+		manifest = "master.m3u8"
+		err = writeHLSPackage(root, packaged)
+	case packageDASH:
+		manifest = "manifest.mpd"
+		err = writeDASHPackage(filepath.Join(root, manifest), packaged)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", manifest, err)
+	}
+	p.logf("[package] output: %s", filepath.Join(outputName, manifest))
+	return nil
+}
+
+// packageStream downloads one stream into its package directory, decrypts
+// or saves its keys, and renames the segment files to their local names.
+func (p *Pipeline) packageStream(ctx context.Context, task *model.Task, stream *model.StreamSpec, root, dir, format string, sessionKeys map[string][]byte, onProgress func(model.ProgressEvent)) (*packagedStream, error) {
+	playlist := stream.Playlist
+	if _, err := p.trimPlaylist(task, playlist); err != nil {
+		return nil, err
+	}
+	// A decrypted package was asked for, so protection that cannot be
+	// removed fails instead of leaving the segments encrypted
+	if task.PackageDecrypt && len(task.Key) == 0 {
+		for _, prot := range stream.Protections {
+			if !strings.EqualFold(prot.Scheme, "AES-128") {
+				return nil, fmt.Errorf("--package-decrypt: %s is protected but %w", dir, errNoCENCKey)
+			}
+		}
+	}
+
+	segDir := filepath.Join(root, dir)
+	var segs []model.Segment
+	for _, init := range playlist.Inits() {
+		segs = append(segs, *init)
+	}
+	segs = append(segs, playlist.Segments...)
+	p.logf("[package] %s: %d segments", dir, len(playlist.Segments))
+	err := p.Downloader.Download(ctx, segs, downloader.Options{
+		TmpDir:      segDir,
+		Headers:     task.Headers,
+		Proxy:       task.Proxy,
+		Timeout:     task.Timeout,
+		ThreadCount: task.ThreadCount,
+		RetryCount:  task.RetryCount,
+	}, onProgress)
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+
+	ps := &packagedStream{stream: stream, dir: dir}
+	if task.PackageDecrypt {
+		if err := p.decryptSegments(ctx, task, playlist, segDir, sessionKeys); err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		if err := p.decryptCENC(task, playlist, segDir); errors.Is(err, errNoCENCKey) {
+			return nil, fmt.Errorf("--package-decrypt: %w", err)
+		} else if err != nil {
+			return nil, fmt.Errorf("decrypt cenc: %w", err)
+		}
+	} else {
+		if ps.keyFiles, err = p.saveKeys(ctx, task, playlist, segDir, sessionKeys); err != nil {
+			return nil, err
+		}
+	}
+	// CENC segments stay encrypted without --package-decrypt
+	if !task.PackageDecrypt {
+		for _, prot := range stream.Protections {
+			if !strings.EqualFold(prot.Scheme, "AES-128") {
+				ps.protections = append(ps.protections, prot)
+			}
+		}
+	}
+
+	if inits := playlist.Inits(); len(inits) > 0 {
+		ps.initFiles = make(map[int]string)
+		for i, init := range inits {
+			name := "init" + segmentExt(init.URL, ".mp4")
+			if i > 0 {
+				name = fmt.Sprintf("init%d%s", i+1, segmentExt(init.URL, ".mp4"))
+			}
+			if err := os.Rename(downloader.SegmentFilePath(segDir, init.Index), filepath.Join(segDir, name)); err != nil {
+				return nil, fmt.Errorf("rename init segment: %w", err)
+			}
+			ps.initFiles[init.Index] = name
+		}
+		ps.init = ps.initFiles[inits[0].Index]
+	}
+
+	defaultExt := ".ts"
+	switch {
+	case stream.MediaType == model.MediaSubtitle:
+		defaultExt = ".vtt"
+	case playlist.MediaInit != nil:
+		defaultExt = ".m4s"
+	}
+	ext := segmentExt(playlist.Segments[0].URL, defaultExt)
+
+	// DASH numbers segments consecutively from 1, so gaps are left out of
+	// the numbering; HLS files keep their media sequence number.
+	number := 1
+	for _, seg := range playlist.Segments {
+		var name string
+		if format == packageDASH {
+			if seg.Gap {
+				ps.files = append(ps.files, "")
+				continue
+			}
+			name = fmt.Sprintf("%05d%s", number, ext)
+			number++
+		} else {
+			name = fmt.Sprintf("%05d%s", seg.Index, segmentExt(seg.URL, defaultExt))
+		}
+		ps.files = append(ps.files, name)
+		if seg.Gap {
+			continue
+		}
+
+		dst := filepath.Join(segDir, name)
+		if err := os.Rename(downloader.SegmentFilePath(segDir, seg.Index), dst); err != nil {
+			return nil, fmt.Errorf("rename segment %d: %w", seg.Index, err)
+		}
+		if fi, err := os.Stat(dst); err == nil {
+			ps.bytes += fi.Size()
+		}
+	}
+	return ps, nil
+}
+
+// saveKeys fetches the AES-128 keys of a playlist and writes them next to
+// its segments, returning the key file name for each key URL. Keys in
+// sessionKeys are not fetched again.
+func (p *Pipeline) saveKeys(ctx context.Context, task *model.Task, playlist *model.Playlist, dir string, sessionKeys map[string][]byte) (map[string]string, error) {
+	provider := p.KeyProvider
+	if provider == nil {
+		provider = newKeyProvider(task)
+	}
+	files := make(map[string]string)
+	for _, seg := range playlist.Segments {
+		enc := seg.EncryptInfo
+		if enc == nil || enc.Method != model.EncryptAES128 {
+			continue
+		}
+		if _, ok := files[enc.KeyURL]; ok {
+			continue
+		}
+		key := enc.Key
+		if key == nil {
+			key = sessionKeys[enc.KeyURL]
+		}
+		if key == nil {
+			var err error
+			if key, err = provider.FetchKey(ctx, enc.KeyURL); err != nil {
+				return nil, fmt.Errorf("fetch key for segment %d: %w", seg.Index, err)
+			}
+		}
+		name := fmt.Sprintf("key%d.key", len(files))
+		if err := os.WriteFile(filepath.Join(dir, name), key, 0o644); err != nil {
+			return nil, fmt.Errorf("write key: %w", err)
+		}
+		files[enc.KeyURL] = name
+	}
+	return files, nil
+}
+
+// streamDirName names the package directory of a stream after its type
+// and language, e.g. "audio_en", keeping names unique.
+func streamDirName(s *model.StreamSpec, used map[string]bool) string {
+	base := s.MediaType.String()
+	if s.Language != "" {
+		base += "_" + s.Language
+	}
+	name := base
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s_%d", base, n)
+	}
+	used[name] = true
+	return name
+}
+
+// segmentExt returns the file extension of a segment URL, or def if it
+// has none.
+func segmentExt(rawURL, def string) string {
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		p = u.Path
+	}
+	if ext := path.Ext(p); ext != "" && len(ext) <= 5 {
+		return strings.ToLower(ext)
+	}
+	return def
+}
+
+// bandwidth returns the stream's advertised bandwidth, or the average bit
+// rate of its packaged files if none is known.
+func (ps *packagedStream) bandwidth() int64 {
+	if ps.stream.Bandwidth > 0 {
+		return ps.stream.Bandwidth
+	}
+	if d := ps.stream.Playlist.TotalDuration; d > 0 {
+		return int64(float64(ps.bytes*8) / d)
+	}
+	return 1
+}
+
+// writeHLSPackage writes <dir>/index.m3u8 for every stream and a master
+// playlist that groups audio and subtitle streams as renditions of the
+// video streams.
+func writeHLSPackage(root string, streams []*packagedStream) error {
+	var videos, audios, subs []*packagedStream
+	for _, ps := range streams {
+		if err := os.WriteFile(filepath.Join(root, ps.dir, "index.m3u8"), hlsMediaPlaylist(ps), 0o644); err != nil {
+			return err
+		}
+		switch ps.stream.MediaType {
+		case model.MediaAudio:
+			audios = append(audios, ps)
+		case model.MediaSubtitle:
+			subs = append(subs, ps)
+		default:
+			videos = append(videos, ps)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	// Audio-only packages list their audio streams as variants
+	if len(videos) == 0 {
+		videos, audios = audios, nil
+	}
+	for i, ps := range audios {
+		writeRendition(&b, "AUDIO", "audio", ps, i == 0)
+	}
+	for i, ps := range subs {
+		writeRendition(&b, "SUBTITLES", "subs", ps, i == 0)
+	}
+	for _, ps := range videos {
+		bw := ps.bandwidth()
+		codecs := ps.stream.Codecs
+		for _, a := range audios {
+			if a.stream.Codecs != "" && codecs != "" && !strings.Contains(codecs, a.stream.Codecs) {
+				codecs += "," + a.stream.Codecs
+			}
+		}
+		if len(audios) > 0 {
+			bw += audios[0].bandwidth()
+		}
+
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bw)
+		if ps.stream.Resolution != "" {
+			fmt.Fprintf(&b, ",RESOLUTION=%s", ps.stream.Resolution)
+		}
+		if codecs != "" {
+			fmt.Fprintf(&b, ",CODECS=%q", codecs)
+		}
+		if len(audios) > 0 {
+			b.WriteString(`,AUDIO="audio"`)
+		}
+		if len(subs) > 0 {
+			b.WriteString(`,SUBTITLES="subs"`)
+		}
+		fmt.Fprintf(&b, "\n%s/index.m3u8\n", ps.dir)
+	}
+	return os.WriteFile(filepath.Join(root, "master.m3u8"), b.Bytes(), 0o644)
+}
+
+func writeRendition(b *bytes.Buffer, typ, group string, ps *packagedStream, first bool) {
+	name := ps.stream.Name
+	if name == "" {
+		name = ps.dir
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA:TYPE=%s,GROUP-ID=%q,NAME=%q", typ, group, name)
+	if ps.stream.Language != "" {
+		fmt.Fprintf(b, ",LANGUAGE=%q", ps.stream.Language)
+	}
+	def := "NO"
+	if first {
+		def = "YES"
+	}
+	fmt.Fprintf(b, ",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s/index.m3u8\"\n", def, ps.dir)
+}
+
+// hlsMediaPlaylist renders the media playlist of a packaged stream. Keys
+// always carry an explicit IV, since the local playlist is self-contained.
+func hlsMediaPlaylist(ps *packagedStream) []byte {
+	playlist := ps.stream.Playlist
+	segs := playlist.Segments
+
+	target := playlist.TargetDuration
+	for _, seg := range segs {
+		target = math.Max(target, seg.Duration)
+	}
+	version := 3
+	if ps.init != "" {
+		version = 7
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].Index)
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for _, line := range hlsProtectionKeys(ps.protections) {
+		b.WriteString(line + "\n")
+	}
+
+	var lastKey, lastInit string
+	for i, seg := range segs {
+		disc := i > 0 && seg.Discontinuity != segs[i-1].Discontinuity
+		if disc {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if init := playlist.InitOf(&seg); init != nil && ps.initFiles[init.Index] != lastInit {
+			lastInit = ps.initFiles[init.Index]
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", lastInit)
+		}
+		if !seg.ProgramDateTime.IsZero() && (i == 0 || disc) {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.ProgramDateTime.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		}
+
+		key := ""
+		if enc := seg.EncryptInfo; enc != nil && enc.Method == model.EncryptAES128 && ps.keyFiles != nil {
+			key = fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=%q,IV=0x%s", ps.keyFiles[enc.KeyURL], hex.EncodeToString(enc.IV))
+		} else if lastKey != "" {
+			key = "#EXT-X-KEY:METHOD=NONE"
+		}
+		if key != lastKey {
+			b.WriteString(key + "\n")
+			lastKey = key
+		}
+
+		if seg.Gap {
+			b.WriteString("#EXT-X-GAP\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, ps.files[i])
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.Bytes()
+}
+
+// hlsProtectionKeys returns #EXT-X-KEY tags for CENC protections that carry
+// a pssh box, so a DRM-aware player can still request a license.
+func hlsProtectionKeys(prots []model.Protection) []string {
+	method := "SAMPLE-AES"
+	for _, prot := range prots {
+		if s := strings.ToLower(prot.Scheme); s == "cenc" || s == "sample-aes-ctr" {
+			method = "SAMPLE-AES-CTR"
+		}
+	}
+	var lines []string
+	for _, prot := range prots {
+		if len(prot.PSSH) == 0 || prot.SystemID == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`#EXT-X-KEY:METHOD=%s,URI="data:text/plain;base64,%s",KEYFORMAT="urn:uuid:%s",KEYFORMATVERSIONS="1"`,
+			method, base64.StdEncoding.EncodeToString(prot.PSSH), prot.SystemID))
+	}
+	return lines
+}
+
+// MPD output types. Only what a static, single-period package needs.
+type mpdPackage struct {
+	XMLName  xml.Name `xml:"MPD"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	XmlnsC   string   `xml:"xmlns:cenc,attr"`
+	Type     string   `xml:"type,attr"`
+	Profiles string   `xml:"profiles,attr"`
+	MinBuf   string   `xml:"minBufferTime,attr"`
+	Duration string   `xml:"mediaPresentationDuration,attr"`
+	Period   struct {
+		ID   string      `xml:"id,attr"`
+		Sets []mpdOutSet `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+type mpdOutSet struct {
+	ID          int                `xml:"id,attr"`
+	ContentType string             `xml:"contentType,attr"`
+	MimeType    string             `xml:"mimeType,attr"`
+	Lang        string             `xml:"lang,attr,omitempty"`
+	Protections []mpdOutProtection `xml:"ContentProtection"`
+	Rep         mpdOutRep          `xml:"Representation"`
+}
+
+type mpdOutProtection struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr,omitempty"`
+	DefaultKID  string `xml:"cenc:default_KID,attr,omitempty"`
+	PSSH        string `xml:"cenc:pssh,omitempty"`
+}
+
+type mpdOutRep struct {
+	ID        string `xml:"id,attr"`
+	Bandwidth int64  `xml:"bandwidth,attr"`
+	Codecs    string `xml:"codecs,attr,omitempty"`
+	Width     int    `xml:"width,attr,omitempty"`
+	Height    int    `xml:"height,attr,omitempty"`
+	Template  struct {
+		Timescale      int       `xml:"timescale,attr"`
+		Initialization string    `xml:"initialization,attr"`
+		Media          string    `xml:"media,attr"`
+		StartNumber    int       `xml:"startNumber,attr"`
+		Timeline       []mpdOutS `xml:"SegmentTimeline>S"`
+	} `xml:"SegmentTemplate"`
+}
+
+type mpdOutS struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// mpdTimescale is the timescale of packaged segment timelines (ms).
+const mpdTimescale = 1000
+
+// writeDASHPackage writes a static MPD with one adaptation set per stream,
+// addressing the local files with a SegmentTemplate and SegmentTimeline.
+func writeDASHPackage(file string, streams []*packagedStream) error {
+	mpd := mpdPackage{
+		Xmlns:    "urn:mpeg:dash:schema:mpd:2011",
+		XmlnsC:   "urn:mpeg:cenc:2013",
+		Type:     "static",
+		Profiles: "urn:mpeg:dash:profile:isoff-live:2011",
+		MinBuf:   "PT2S",
+	}
+	mpd.Period.ID = "0"
+
+	var longest float64
+	for i, ps := range streams {
+		set := mpdOutSet{
+			ID:          i,
+			ContentType: ps.stream.MediaType.String(),
+			MimeType:    ps.stream.MediaType.String() + "/mp4",
+			Lang:        ps.stream.Language,
+		}
+		for _, prot := range ps.protections {
+			set.Protections = append(set.Protections, mpdProtection(prot))
+		}
+
+		rep := &set.Rep
+		rep.ID = ps.dir
+		rep.Bandwidth = ps.bandwidth()
+		rep.Codecs = ps.stream.Codecs
+		if w, h, ok := strings.Cut(ps.stream.Resolution, "x"); ok {
+			fmt.Sscan(w, &rep.Width)
+			fmt.Sscan(h, &rep.Height)
+		}
+		rep.Template.Timescale = mpdTimescale
+		rep.Template.StartNumber = 1
+		rep.Template.Initialization = ps.dir + "/" + ps.init
+		rep.Template.Media = ps.dir + "/$Number%05d$" + path.Ext(firstFile(ps.files))
+
+		var at float64
+		needT := true
+		for j, seg := range ps.stream.Playlist.Segments {
+			if ps.files[j] == "" {
+				needT = true
+				at += seg.Duration
+				continue
+			}
+			d := int64(math.Round(seg.Duration * mpdTimescale))
+			tl := rep.Template.Timeline
+			if !needT && len(tl) > 0 && tl[len(tl)-1].D == d {
+				tl[len(tl)-1].R++
+			} else {
+				s := mpdOutS{D: d}
+				if needT {
+					t := int64(math.Round(at * mpdTimescale))
+					s.T = &t
+				}
+				rep.Template.Timeline = append(tl, s)
+			}
+			needT = false
+			at += seg.Duration
+		}
+		longest = math.Max(longest, at)
+		mpd.Period.Sets = append(mpd.Period.Sets, set)
+	}
+	mpd.Duration = fmt.Sprintf("PT%.3fS", longest)
+
+	out, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append([]byte(xml.Header), append(out, '\n')...), 0o644)
+}
+
+// mpdProtection converts a protection back to a ContentProtection element.
+func mpdProtection(prot model.Protection) mpdOutProtection {
+	cp := mpdOutProtection{DefaultKID: kidUUID(prot.KID)}
+	if prot.SystemID != "" {
+		cp.SchemeIdUri = "urn:uuid:" + prot.SystemID
+	} else {
+		cp.SchemeIdUri = "urn:mpeg:dash:mp4protection:2011"
+		cp.Value = strings.ToLower(prot.Scheme)
+	}
+	if len(prot.PSSH) > 0 {
+		cp.PSSH = base64.StdEncoding.EncodeToString(prot.PSSH)
+	}
+	return cp
+}
+
+// kidUUID formats a 32-character hex KID as a UUID.
+func kidUUID(kid string) string {
+	if len(kid) != 32 {
+		return kid
+	}
+	return kid[:8] + "-" + kid[8:12] + "-" + kid[12:16] + "-" + kid[16:20] + "-" + kid[20:]
+}
+
+func firstFile(files []string) string {
+	for _, f := range files {
+		if f != "" {
+			return f
+		}
+	}
+	return ""
+}
@@ -0,0 +1,309 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/crypto"
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/dash"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+func newAESPackageServer(t *testing.T, key, iv []byte, plain [][]byte) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x%x
+#EXTINF:4.0,
+seg0.ts
+#EXTINF:3.5,
+seg1.ts
+#EXT-X-ENDLIST
+`, iv)
+	})
+	mux.HandleFunc("/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(key)
+	})
+	for i, p := range plain {
+		enc := testAESEncrypt(p, key, iv)
+		mux.HandleFunc(fmt.Sprintf("/seg%d.ts", i), func(w http.ResponseWriter, r *http.Request) {
+			w.Write(enc)
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPipeline_PackageHLS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+	plain := [][]byte{[]byte("segment-zero-plaintext"), []byte("segment-one-plaintext")}
+	server := newAESPackageServer(t, key, iv, plain)
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Decryptor:  &crypto.AES128Decryptor{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/video.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "pkg",
+		ThreadCount: 1,
+		RetryCount:  1,
+		Package:     "hls",
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	root := filepath.Join(saveDir, "pkg")
+	master, err := os.ReadFile(filepath.Join(root, "master.m3u8"))
+	if err != nil {
+		t.Fatalf("master playlist missing: %v", err)
+	}
+	if !strings.Contains(string(master), "\nvideo/index.m3u8\n") {
+		t.Errorf("master playlist does not reference video/index.m3u8:\n%s", master)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(root, "video", "key0.key")); string(got) != string(key) {
+		t.Errorf("key file = %q, want %q", got, key)
+	}
+
+	media, err := os.ReadFile(filepath.Join(root, "video", "index.m3u8"))
+	if err != nil {
+		t.Fatalf("media playlist missing: %v", err)
+	}
+	playlist, err := hls.ParseMediaPlaylist(string(media), "file:///pkg/video/index.m3u8")
+	if err != nil {
+		t.Fatalf("parse packaged playlist: %v", err)
+	}
+	if len(playlist.Segments) != 2 || playlist.IsLive {
+		t.Fatalf("segments = %d, live = %v", len(playlist.Segments), playlist.IsLive)
+	}
+	for i, seg := range playlist.Segments {
+		name := strings.TrimPrefix(seg.URL, "file:///pkg/video/")
+		data, err := os.ReadFile(filepath.Join(root, "video", name))
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		if want := testAESEncrypt(plain[i], key, iv); string(data) != string(want) {
+			t.Errorf("segment %d was not kept encrypted", i)
+		}
+		enc := seg.EncryptInfo
+		if enc == nil || enc.Method != model.EncryptAES128 || !strings.HasSuffix(enc.KeyURL, "/video/key0.key") || string(enc.IV) != string(iv) {
+			t.Errorf("segment %d key = %+v", i, enc)
+		}
+	}
+}
+
+func TestPipeline_PackageDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+	plain := [][]byte{[]byte("segment-zero-plaintext"), []byte("segment-one-plaintext")}
+	server := newAESPackageServer(t, key, iv, plain)
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Decryptor:  &crypto.AES128Decryptor{},
+	}
+	task := &model.Task{
+		URL:            server.URL + "/video.m3u8",
+		SaveDir:        saveDir,
+		SaveName:       "pkg",
+		ThreadCount:    1,
+		RetryCount:     1,
+		Package:        "hls",
+		PackageDecrypt: true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	dir := filepath.Join(saveDir, "pkg", "video")
+	media, err := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatalf("media playlist missing: %v", err)
+	}
+	if strings.Contains(string(media), "#EXT-X-KEY") {
+		t.Errorf("decrypted package still signals a key:\n%s", media)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "key0.key")); !os.IsNotExist(err) {
+		t.Errorf("key file written for a decrypted package")
+	}
+	for i, p := range plain {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%05d.ts", i)))
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		if string(data) != string(p) {
+			t.Errorf("segment %d = %q, want %q", i, data, p)
+		}
+	}
+}
+
+func TestPipeline_PackageDecryptNeedsKey(t *testing.T) {
+	var fetched atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+seg0.m4s
+#EXT-X-ENDLIST
+`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		fmt.Fprint(w, "data")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:            server.URL + "/index.m3u8",
+		SaveDir:        t.TempDir(),
+		SaveName:       "pkg",
+		ThreadCount:    1,
+		RetryCount:     1,
+		AutoSelect:     true,
+		Package:        "hls",
+		PackageDecrypt: true,
+	}
+	err := pipe.Run(context.Background(), task, nil)
+	if err == nil || !strings.Contains(err.Error(), "--key") {
+		t.Fatalf("Run error = %v, want missing --key", err)
+	}
+	if n := fetched.Load(); n != 0 {
+		t.Errorf("fetched %d segments before failing", n)
+	}
+}
+
+func TestPipeline_PackageDASH(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud"
+video.m3u8
+`)
+	})
+	for _, name := range []string{"video", "audio"} {
+		mux.HandleFunc("/"+name+".m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="%[1]s_init.mp4"
+#EXTINF:4.0,
+%[1]s_0.m4s
+#EXTINF:4.0,
+%[1]s_1.m4s
+#EXTINF:2.0,
+%[1]s_2.m4s
+#EXT-X-ENDLIST
+`, name)
+		})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data:"+r.URL.Path)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/master.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "pkg",
+		ThreadCount: 1,
+		RetryCount:  1,
+		AutoSelect:  true,
+		Package:     "dash",
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	root := filepath.Join(saveDir, "pkg")
+	manifest, err := os.ReadFile(filepath.Join(root, "manifest.mpd"))
+	if err != nil {
+		t.Fatalf("manifest missing: %v", err)
+	}
+	result, err := dash.ParseMPD(string(manifest), "http://local/pkg/manifest.mpd")
+	if err != nil {
+		t.Fatalf("parse packaged MPD: %v", err)
+	}
+	if result.IsLive || len(result.Streams) != 2 {
+		t.Fatalf("streams = %d, live = %v", len(result.Streams), result.IsLive)
+	}
+
+	local := func(u string) string {
+		return filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(u, "http://local/pkg/")))
+	}
+	for _, s := range result.Streams {
+		p := s.Playlist
+		if p == nil || p.MediaInit == nil || len(p.Segments) != 3 {
+			t.Fatalf("%s stream playlist = %+v", s.MediaType, p)
+		}
+		name := s.MediaType.String()
+		if data, err := os.ReadFile(local(p.MediaInit.URL)); err != nil || string(data) != "data:/"+name+"_init.mp4" {
+			t.Errorf("%s init %s = %q, %v", name, p.MediaInit.URL, data, err)
+		}
+		for i, seg := range p.Segments {
+			data, err := os.ReadFile(local(seg.URL))
+			if err != nil {
+				t.Fatalf("%s segment %d: %v", name, i, err)
+			}
+			if want := fmt.Sprintf("data:/%s_%d.m4s", name, i); string(data) != want {
+				t.Errorf("%s segment %d = %q, want %q", name, i, data, want)
+			}
+		}
+		if d := p.TotalDuration; d < 9.9 || d > 10.1 {
+			t.Errorf("%s duration = %v, want 10", name, d)
+		}
+	}
+}
+
+func TestPipeline_PackageRejectsLive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nseg0.ts\n")
+	}))
+	defer server.Close()
+
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{URL: server.URL + "/live.m3u8", SaveDir: t.TempDir(), Package: "hls"}
+	err := pipe.Run(context.Background(), task, nil)
+	if err == nil || !strings.Contains(err.Error(), "live") {
+		t.Fatalf("err = %v, want live streams rejected", err)
+	}
+}
@@ -2,11 +2,12 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,8 +25,24 @@ type Pipeline struct {
 	Parser     parser.Parser
 	Downloader downloader.Downloader
 	Decryptor  *crypto.AES128Decryptor
-	Merger     merger.Merger
-	OnLog      func(format string, args ...any) // nil = silent
+	// CENCDecryptor decrypts Common Encryption protected fMP4 with --key.
+	CENCDecryptor *crypto.CENCDecryptor
+	// KeyProvider resolves AES-128 key URIs; nil builds one from the task.
+	KeyProvider crypto.KeyProvider
+	Merger      merger.Merger
+	OnLog       func(format string, args ...any) // nil = silent
+}
+
+// runState is the state shared by the streams written in one Run. It is
+// kept off Pipeline, so concurrent runs on one Pipeline stay apart.
+type runState struct {
+	// sessionKeys are the keys prefetched from EXT-X-SESSION-KEY, by key
+	// URL.
+	sessionKeys map[string][]byte
+	// mediaStart is where the first media stream written begins on its
+	// playlist timeline, in seconds; subtitles are timed from there. Nil
+	// until a media stream is done.
+	mediaStart *float64
 }
 
 func (p *Pipeline) logf(format string, args ...any) {
@@ -46,20 +63,6 @@ func formatSpeed(bytesPerSec int64) string {
 	}
 }
 
-// mediaTypeName returns a human-readable name for a MediaType.
-func mediaTypeName(mt model.MediaType) string {
-	switch mt {
-	case model.MediaVideo:
-		return "video"
-	case model.MediaAudio:
-		return "audio"
-	case model.MediaSubtitle:
-		return "subtitle"
-	default:
-		return "unknown"
-	}
-}
-
 // Run executes the full pipeline for a given task.
 func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(model.ProgressEvent)) error {
 	// 1. Parse
@@ -68,6 +71,9 @@ func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(mo
 	if err != nil {
 		return fmt.Errorf("parse: %w", err)
 	}
+	if len(result.Redirects) > 0 {
+		p.logf("[parse] redirected: %s -> %s", strings.Join(result.Redirects, " -> "), result.URL)
+	}
 
 	p.logf("[parse] streams: %d, merge_type: %d, is_live: %v", len(result.Streams), result.MergeType, result.IsLive)
 	for i, s := range result.Streams {
@@ -77,7 +83,32 @@ func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(mo
 			segCount = len(s.Playlist.Segments)
 			hasInit = s.Playlist.MediaInit != nil
 		}
-		p.logf("[parse]   stream[%d]: type=%s bandwidth=%d segments=%d has_init=%v", i, mediaTypeName(s.MediaType), s.Bandwidth, segCount, hasInit)
+		p.logf("[parse]   stream[%d]: type=%s bandwidth=%d segments=%d has_init=%v", i, s.MediaType, s.Bandwidth, segCount, hasInit)
+	}
+	for _, f := range result.Failed {
+		p.logf("[parse] skipping %s stream %s: %v", f.Stream.MediaType, f.Stream.URL, f.Err)
+	}
+	for _, w := range result.Warnings {
+		p.logf("[parse] warning: %s", w)
+	}
+	state := &runState{sessionKeys: p.prefetchKeys(ctx, task, result.SessionKeys)}
+
+	// Thumbnail mode downloads only an image or I-frame stream
+	if task.Thumbnails {
+		stream := thumbnailStream(result.Streams)
+		if stream == nil {
+			return fmt.Errorf("no I-frame or image stream for thumbnails")
+		}
+		selected := []model.StreamSpec{*stream}
+		if err := p.resolvePlaylists(ctx, task, result, selected); err != nil {
+			return err
+		}
+		stream = &selected[0]
+		outputName := task.SaveName
+		if outputName == "" {
+			outputName = "output"
+		}
+		return p.processThumbnails(ctx, task, stream, outputName, state.sessionKeys)
 	}
 
 	// 2. Select streams
@@ -85,22 +116,48 @@ func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(mo
 	if len(streams) == 0 {
 		return fmt.Errorf("no streams selected")
 	}
+	if err := p.resolvePlaylists(ctx, task, result, streams); err != nil {
+		return err
+	}
+
+	task = p.applySession(task, result, streams)
 
 	if task.AutoSelect && len(result.Streams) > 1 {
 		for i, s := range streams {
-			p.logf("[select] auto_select: stream[%d] type=%s (bandwidth=%d)", i, mediaTypeName(s.MediaType), s.Bandwidth)
+			p.logf("[select] auto_select: stream[%d] type=%s (bandwidth=%d)", i, s.MediaType, s.Bandwidth)
 		}
 	}
 
-	// 3. Live recording mode
+	// 3. Local package mode
+	if task.Package != "" {
+		if result.IsLive || task.Live {
+			return fmt.Errorf("packaging live streams is not supported")
+		}
+		outputName := task.SaveName
+		if outputName == "" {
+			outputName = "output"
+		}
+		return p.processPackage(ctx, task, streams, outputName, state.sessionKeys, onProgress)
+	}
+
+	// 4. Live recording mode
 	if result.IsLive || task.Live {
 		p.logf("[live] starting live recording")
-		return p.runLive(ctx, task, &streams[0], onProgress)
+		return p.runLive(ctx, task, &streams[0], state.sessionKeys, onProgress)
 	}
 
-	// 4. Process each selected stream
+	// 5. Process each selected stream
+	// WebVTT subtitles are named by language, so only the other streams
+	// are numbered
+	mediaStreams := 0
+	for _, s := range streams {
+		if !isWebVTT(&s) {
+			mediaStreams++
+		}
+	}
+	mediaIdx := -1
 	for i, stream := range streams {
-		if stream.Playlist == nil || len(stream.Playlist.Segments) == 0 {
+		if stream.Playlist == nil || len(stream.Playlist.Segments) == 0 || isWebVTT(&stream) {
 			continue
 		}
 
@@ -108,21 +165,38 @@ func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(mo
 		if outputName == "" {
 			outputName = "output"
 		}
+
 		// Append stream type suffix for multi-stream
-		if len(streams) > 1 {
+		mediaIdx++
+		if mediaStreams > 1 {
 			switch stream.MediaType {
 			case model.MediaAudio:
 				outputName += "_audio"
-			case model.MediaSubtitle:
-				outputName += "_sub"
 			default:
-				if i > 0 {
-					outputName += fmt.Sprintf("_%d", i)
+				if mediaIdx > 0 {
+					outputName += fmt.Sprintf("_%d", mediaIdx)
 				}
 			}
 		}
 
-		if err := p.processStream(ctx, task, &stream, result.MergeType, outputName, onProgress); err != nil {
+		if err := p.processWithFallback(ctx, task, result, &stream, outputName, state, onProgress); err != nil {
+			return fmt.Errorf("stream %d: %w", i, err)
+		}
+	}
+
+	// WebVTT subtitles are stitched into a text file per language, after
+	// the media they are timed against
+	subtitleNames := make(map[string]bool)
+	for i, stream := range streams {
+		if stream.Playlist == nil || len(stream.Playlist.Segments) == 0 || !isWebVTT(&stream) {
+			continue
+		}
+		outputName := task.SaveName
+		if outputName == "" {
+			outputName = "output"
+		}
+		name := subtitleName(outputName, &stream, subtitleNames)
+		if err := p.processSubtitle(ctx, task, &stream, name, state); err != nil {
 			return fmt.Errorf("stream %d: %w", i, err)
 		}
 	}
@@ -130,19 +204,88 @@ func (p *Pipeline) Run(ctx context.Context, task *model.Task, onProgress func(mo
 	return nil
 }
 
-func (p *Pipeline) processStream(ctx context.Context, task *model.Task, stream *model.StreamSpec, mergeType model.MergeType, outputName string, onProgress func(model.ProgressEvent)) error {
+// processWithFallback processes a stream and, with task.FallbackLower,
+// retries a video stream whose segments failed on every mirror with the
+// next-lower variant, until one succeeds or none is left.
+func (p *Pipeline) processWithFallback(ctx context.Context, task *model.Task, result *model.ParseResult, stream *model.StreamSpec, outputName string, state *runState, onProgress func(model.ProgressEvent)) error {
+	for {
+		err := p.processStream(ctx, task, stream, result.MergeType, outputName, state, onProgress)
+		var segErr *downloader.SegmentError
+		if err == nil || !task.FallbackLower || stream.MediaType != model.MediaVideo || !errors.As(err, &segErr) {
+			return err
+		}
+		lower := nextLowerVariant(result.Streams, stream.Bandwidth)
+		if lower == nil {
+			return err
+		}
+		p.logf("[download] segment %d failed: %v, falling back to variant bandwidth=%d", segErr.Index, segErr.Err, lower.Bandwidth)
+
+		// The playlist is trimmed in place, so work on a copy
+		next := []model.StreamSpec{*lower}
+		if err := p.resolvePlaylists(ctx, task, result, next); err != nil {
+			return err
+		}
+		if next[0].Playlist == nil || len(next[0].Playlist.Segments) == 0 {
+			return err
+		}
+		playlist := *next[0].Playlist
+		playlist.Segments = slices.Clone(playlist.Segments)
+		next[0].Playlist = &playlist
+		stream = &next[0]
+	}
+}
+
+// nextLowerVariant returns the video stream with the highest bandwidth
+// below bandwidth, or nil if there is none.
+func nextLowerVariant(streams []model.StreamSpec, bandwidth int64) *model.StreamSpec {
+	var best *model.StreamSpec
+	for i := range streams {
+		s := &streams[i]
+		if s.MediaType != model.MediaVideo || s.Bandwidth >= bandwidth {
+			continue
+		}
+		if best == nil || s.Bandwidth > best.Bandwidth {
+			best = s
+		}
+	}
+	return best
+}
+
+func (p *Pipeline) processStream(ctx context.Context, task *model.Task, stream *model.StreamSpec, mergeType model.MergeType, outputName string, state *runState, onProgress func(model.ProgressEvent)) error {
 	playlist := stream.Playlist
 
+	starts := segmentStarts(playlist.Segments)
+	cut, err := p.trimPlaylist(task, playlist)
+	if err != nil {
+		return err
+	}
+	// Gaps are dropped after trimming, which needs them on the timeline
+	if n := playlist.DropGaps(); n > 0 {
+		p.logf("[download] skipping %d gap segments", n)
+	}
+	start := outputStart(task, playlist, starts, cut)
+	chapters, err := p.applyAdMode(task, playlist)
+	if err != nil {
+		return err
+	}
+
 	// Setup tmp dir
 	tmpDir := task.TmpDir
 	if tmpDir == "" {
 		tmpDir = filepath.Join(os.TempDir(), "mediago", outputName)
 	}
 
-	// Download init segment if present (fMP4)
-	if playlist.MediaInit != nil {
-		p.logf("[download] init segment")
-		initSegs := []model.Segment{*playlist.MediaInit}
+	// Download init segments if present (fMP4), each distinct one once
+	if inits := playlist.Inits(); len(inits) > 0 {
+		initSegs := make([]model.Segment, len(inits))
+		for i, init := range inits {
+			initSegs[i] = *init
+		}
+		if len(inits) == 1 {
+			p.logf("[download] init segment")
+		} else {
+			p.logf("[download] %d init segments", len(inits))
+		}
 		err := p.Downloader.Download(ctx, initSegs, downloader.Options{
 			TmpDir:      tmpDir,
 			Headers:     task.Headers,
@@ -158,7 +301,7 @@ func (p *Pipeline) processStream(ctx context.Context, task *model.Task, stream *
 
 	// Download segments
 	p.logf("[download] %d segments, thread_count=%d", len(playlist.Segments), task.ThreadCount)
-	err := p.Downloader.Download(ctx, playlist.Segments, downloader.Options{
+	err = p.Downloader.Download(ctx, playlist.Segments, downloader.Options{
 		TmpDir:      tmpDir,
 		Headers:     task.Headers,
 		Proxy:       task.Proxy,
@@ -177,15 +320,40 @@ func (p *Pipeline) processStream(ctx context.Context, task *model.Task, stream *
 	p.logf("[download] complete: %d segments", len(playlist.Segments))
 
 	// Decrypt if needed
-	if err := p.decryptSegments(ctx, task, playlist, tmpDir); err != nil {
+	if err := p.decryptSegments(ctx, task, playlist, tmpDir, state.sessionKeys); err != nil {
 		return fmt.Errorf("decrypt: %w", err)
 	}
+	if err := p.decryptCENC(task, playlist, tmpDir); errors.Is(err, errNoCENCKey) {
+		p.logf("[decrypt] %v, leaving segments encrypted", err)
+	} else if err != nil {
+		return fmt.Errorf("decrypt cenc: %w", err)
+	}
 
 	// Merge
 	if !task.NoMerge {
-		if err := p.mergeSegments(ctx, task, playlist, mergeType, tmpDir, outputName); err != nil {
+		precise := cut != nil && task.PreciseCut
+		if precise {
+			chapters = cutChapters(chapters, cut)
+		}
+		var chapterFile string
+		if len(chapters) > 0 {
+			if chapterFile, err = p.writeChapters(task, outputName, chapters); err != nil {
+				return fmt.Errorf("write chapters: %w", err)
+			}
+		}
+		// Chapters on the cut timeline are added by the cut itself
+		mergeChapters := chapterFile
+		if precise {
+			mergeChapters = ""
+		}
+		if err := p.mergeSegments(ctx, task, playlist, mergeType, tmpDir, outputName, mergeChapters); err != nil {
 			return fmt.Errorf("merge: %w", err)
 		}
+		if precise {
+			if err := p.preciseCut(ctx, task, mergeType, outputName, cut, chapterFile); err != nil {
+				return fmt.Errorf("trim: %w", err)
+			}
+		}
 	}
 
 	// Cleanup
@@ -194,10 +362,15 @@ func (p *Pipeline) processStream(ctx context.Context, task *model.Task, stream *
 		p.logf("[cleanup] removed tmp dir")
 	}
 
+	if state.mediaStart == nil {
+		state.mediaStart = &start
+	}
 	return nil
 }
 
-func (p *Pipeline) decryptSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, tmpDir string) error {
+// decryptSegments decrypts the downloaded AES-128 segments of playlist in
+// place, using the keys in sessionKeys before fetching any.
+func (p *Pipeline) decryptSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, tmpDir string, sessionKeys map[string][]byte) error {
 	if p.Decryptor == nil {
 		return nil
 	}
@@ -205,7 +378,7 @@ func (p *Pipeline) decryptSegments(ctx context.Context, task *model.Task, playli
 	// Count encrypted segments
 	encCount := 0
 	for _, seg := range playlist.Segments {
-		if seg.EncryptInfo != nil && seg.EncryptInfo.Method != model.EncryptNone {
+		if seg.EncryptInfo != nil && seg.EncryptInfo.Method == model.EncryptAES128 {
 			encCount++
 		}
 	}
@@ -213,107 +386,437 @@ func (p *Pipeline) decryptSegments(ctx context.Context, task *model.Task, playli
 		p.logf("[decrypt] %d segments, method=AES-128", encCount)
 	}
 
-	for _, seg := range playlist.Segments {
-		if seg.EncryptInfo == nil || seg.EncryptInfo.Method == model.EncryptNone {
-			continue
+	provider := p.KeyProvider
+	if provider == nil {
+		provider = newKeyProvider(task)
+	}
+	keys := maps.Clone(sessionKeys)
+	if keys == nil {
+		keys = make(map[string][]byte)
+	}
+	repaired := 0
+	for i := range playlist.Segments {
+		seg := &playlist.Segments[i]
+		segPath := downloader.SegmentFilePath(tmpDir, seg.Index)
+		repair, err := decryptSegment(ctx, p.Decryptor, seg, segPath, provider, keys)
+		if err != nil {
+			return err
 		}
+		if repair != nil {
+			p.logf("[decrypt] repaired segment %d: %s", seg.Index, repair)
+			repaired++
+		}
+	}
+	if repaired > 0 {
+		p.logf("[decrypt] %d segments repaired in lenient mode", repaired)
+	}
 
-		key := seg.EncryptInfo.Key
-		// If key not yet fetched, download it
-		if key == nil && seg.EncryptInfo.KeyURL != "" {
+	return nil
+}
+
+// decryptSegment decrypts a downloaded segment file in place. Keys are cached
+// in keys by URL, so a key shared by many segments (or by many refreshes of a
+// live playlist) is only fetched once. It returns what lenient decryption
+// repaired, if anything.
+func decryptSegment(ctx context.Context, d *crypto.AES128Decryptor, seg *model.Segment, segPath string, provider crypto.KeyProvider, keys map[string][]byte) (*crypto.Repair, error) {
+	if seg.EncryptInfo == nil || seg.EncryptInfo.Method != model.EncryptAES128 {
+		return nil, nil
+	}
+
+	key := seg.EncryptInfo.Key
+	// If key not yet fetched, download it
+	if key == nil && seg.EncryptInfo.KeyURL != "" {
+		key = keys[seg.EncryptInfo.KeyURL]
+		if key == nil {
 			var err error
-			key, err = fetchKey(ctx, seg.EncryptInfo.KeyURL, task.Headers)
+			key, err = provider.FetchKey(ctx, seg.EncryptInfo.KeyURL)
 			if err != nil {
-				return fmt.Errorf("fetch key for segment %d: %w", seg.Index, err)
+				return nil, fmt.Errorf("fetch key for segment %d: %w", seg.Index, err)
 			}
-			seg.EncryptInfo.Key = key
+			keys[seg.EncryptInfo.KeyURL] = key
 		}
+		seg.EncryptInfo.Key = key
+	}
 
-		if key == nil {
+	if key == nil {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(segPath)
+	if err != nil {
+		return nil, fmt.Errorf("read segment %d: %w", seg.Index, err)
+	}
+
+	decrypted, repair, err := d.DecryptReport(data, key, seg.EncryptInfo.IV)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt segment %d: %w", seg.Index, err)
+	}
+
+	if err := os.WriteFile(segPath, decrypted, 0o644); err != nil {
+		return nil, fmt.Errorf("write decrypted segment %d: %w", seg.Index, err)
+	}
+
+	return repair, nil
+}
+
+// errNoCENCKey is returned by decryptCENC for protected segments when no
+// --key is given.
+var errNoCENCKey = errors.New("no --key given")
+
+// decryptCENC decrypts Common Encryption protected fMP4 segments in place
+// and strips the protection boxes from their init segments, so the merged
+// output plays as clear content. Protection is detected from each init
+// segment and applies to the segments that use it.
+func (p *Pipeline) decryptCENC(task *model.Task, playlist *model.Playlist, tmpDir string) error {
+	if p.CENCDecryptor == nil {
+		return nil
+	}
+	var keys crypto.KeyMap
+	for _, init := range playlist.Inits() {
+		initPath := downloader.SegmentFilePath(tmpDir, init.Index)
+		initData, err := os.ReadFile(initPath)
+		if err != nil {
+			return fmt.Errorf("read init segment: %w", err)
+		}
+		clearInit, info, err := p.CENCDecryptor.DecryptInit(initData)
+		if err != nil {
+			return fmt.Errorf("parse init segment: %w", err)
+		}
+		if info == nil {
 			continue
 		}
 
-		segPath := downloader.SegmentFilePath(tmpDir, seg.Index)
-		data, err := os.ReadFile(segPath)
-		if err != nil {
-			return fmt.Errorf("read segment %d: %w", seg.Index, err)
+		if keys == nil {
+			if keys, err = crypto.ParseKeys(task.Key); err != nil {
+				return err
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("init segment is %s protected but %w", info.Scheme(), errNoCENCKey)
 		}
 
-		decrypted, err := p.Decryptor.Decrypt(data, key, seg.EncryptInfo.IV)
-		if err != nil {
-			return fmt.Errorf("decrypt segment %d: %w", seg.Index, err)
+		var segs []model.Segment
+		for _, seg := range playlist.Segments {
+			if playlist.InitOf(&seg) == init {
+				segs = append(segs, seg)
+			}
+		}
+		p.logf("[decrypt] %d segments, method=%s", len(segs), info.Scheme())
+		for _, seg := range segs {
+			segPath := downloader.SegmentFilePath(tmpDir, seg.Index)
+			data, err := os.ReadFile(segPath)
+			if err != nil {
+				return fmt.Errorf("read segment %d: %w", seg.Index, err)
+			}
+			decrypted, err := p.CENCDecryptor.DecryptSegment(data, info, keys)
+			if err != nil {
+				return fmt.Errorf("decrypt segment %d: %w", seg.Index, err)
+			}
+			if err := os.WriteFile(segPath, decrypted, 0o644); err != nil {
+				return fmt.Errorf("write decrypted segment %d: %w", seg.Index, err)
+			}
 		}
 
-		if err := os.WriteFile(segPath, decrypted, 0o644); err != nil {
-			return fmt.Errorf("write decrypted segment %d: %w", seg.Index, err)
+		if err := os.WriteFile(initPath, clearInit, 0o644); err != nil {
+			return fmt.Errorf("write init segment: %w", err)
 		}
 	}
-
 	return nil
 }
 
-func (p *Pipeline) mergeSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, mergeType model.MergeType, tmpDir string, outputName string) error {
-	// Build ordered file list
-	var files []string
+// mergeSegments merges the downloaded segments of playlist into the
+// output, or one output per discontinuity group when split. chapters is
+// an FFmpeg metadata file to embed in the output, if any.
+func (p *Pipeline) mergeSegments(ctx context.Context, task *model.Task, playlist *model.Playlist, mergeType model.MergeType, tmpDir string, outputName string, chapters string) error {
+	mode := task.DiscontinuityMode
+	switch mode {
+	case "", model.DiscontinuityConcat, model.DiscontinuityRetimestamp, model.DiscontinuitySplit:
+	default:
+		return fmt.Errorf("unknown discontinuity mode %q", mode)
+	}
+
+	m, ext, mergeTypeName := newMerger(task, mergeType)
+	if fm, ok := m.(*merger.FFmpegMerger); ok && mode == model.DiscontinuityRetimestamp {
+		fm.Retimestamp = true
+	}
+
+	saveDir := outputDir(task)
+	if err := os.MkdirAll(saveDir, 0o755); err != nil {
+		return fmt.Errorf("create save dir: %w", err)
+	}
 
-	// Init segment first (for fMP4)
-	if playlist.MediaInit != nil {
-		initPath := downloader.SegmentFilePath(tmpDir, playlist.MediaInit.Index)
-		files = append(files, initPath)
+	groups := playlist.DiscontinuityGroups()
+	if len(groups) > 0 && len(playlist.Inits()) > 1 && mode != "" && mode != model.DiscontinuityConcat {
+		// Split and retimestamped parts need a single init section each
+		groups = splitAtInits(playlist, groups)
+	}
+	if len(groups) > 1 && mode != "" && mode != model.DiscontinuityConcat {
+		p.logf("[merge] %d discontinuity groups, mode=%s", len(groups), mode)
+		switch mode {
+		case model.DiscontinuitySplit:
+			for i, group := range groups {
+				files := segmentFiles(playlist.MediaInit, group, tmpDir)
+				p.logf("[merge] type=%s, files=%d", mergeTypeName, len(files))
+				if err := p.mergeFiles(ctx, m, files, saveDir, fmt.Sprintf("%s_part%d%s", outputName, i+1, ext)); err != nil {
+					return fmt.Errorf("part %d: %w", i+1, err)
+				}
+			}
+			return nil
+
+		case model.DiscontinuityRetimestamp:
+			// Merge each group on its own, then let the ffmpeg concat demuxer
+			// join the parts: it rebases every part's timestamps to follow on
+			// from the previous one, and timestamps are regenerated where
+			// the groups leave them broken.
+			var parts []string
+			for i, group := range groups {
+				files := segmentFiles(playlist.MediaInit, group, tmpDir)
+				part := filepath.Join(tmpDir, fmt.Sprintf("part_%03d%s", i, ext))
+				if err := m.Merge(ctx, files, part); err != nil {
+					return fmt.Errorf("part %d: %w", i+1, err)
+				}
+				parts = append(parts, part)
+			}
+			p.logf("[merge] type=ffmpeg, files=%d", len(parts))
+			join := &merger.FFmpegMerger{FFmpegPath: task.FfmpegPath, Metadata: task.Metadata, Chapters: chapters, Retimestamp: true}
+			return p.mergeFiles(ctx, join, parts, saveDir, outputName+ext)
+		}
 	}
 
+	if chapters != "" {
+		if fm, ok := m.(*merger.FFmpegMerger); ok {
+			fm.Chapters = chapters
+		} else {
+			p.logf("[ads] binary merge cannot embed chapters, apply %s with ffmpeg", filepath.Base(chapters))
+		}
+	}
+	files := segmentFiles(playlist.MediaInit, playlist.Segments, tmpDir)
+	p.logf("[merge] type=%s, files=%d", mergeTypeName, len(files))
+	return p.mergeFiles(ctx, m, files, saveDir, outputName+ext)
+}
+
+// outputDir returns the directory merged outputs are written to.
+func outputDir(task *model.Task) string {
+	if task.SaveDir == "" {
+		return "."
+	}
+	return task.SaveDir
+}
+
+// timeCut is the part of the merged output to keep after trimming to whole
+// segments, relative to the start of the first kept segment.
+type timeCut struct {
+	Start    float64
+	Duration float64 // 0 = to the end
+}
+
+// trimPlaylist applies --start/--end to the playlist and returns the cut
+// still needed inside the merged output, or nil when no range is set.
+func (p *Pipeline) trimPlaylist(task *model.Task, playlist *model.Playlist) (*timeCut, error) {
+	if task.FromTime != "" || task.ToTime != "" {
+		if task.Start != "" || task.End != "" {
+			return nil, fmt.Errorf("--from-time/--to-time cannot be combined with --start/--end")
+		}
+		return p.trimWallClock(task, playlist)
+	}
+	if task.Start == "" && task.End == "" {
+		return nil, nil
+	}
+
+	var start, end float64
+	var err error
+	if task.Start != "" {
+		if start, err = parseMediaTime(task.Start); err != nil {
+			return nil, fmt.Errorf("start: %w", err)
+		}
+	}
+	if task.End != "" {
+		if end, err = parseMediaTime(task.End); err != nil {
+			return nil, fmt.Errorf("end: %w", err)
+		}
+		if end <= start {
+			return nil, fmt.Errorf("end %s is not after start %s", task.End, task.Start)
+		}
+	}
+
+	total := len(playlist.Segments)
+	offset := playlist.Trim(start, end)
+	if len(playlist.Segments) == 0 {
+		return nil, fmt.Errorf("no segments in time range %s-%s", task.Start, task.End)
+	}
+	p.logf("[trim] range %.3fs-%.3fs: %d/%d segments, from %.3fs", start, end, len(playlist.Segments), total, offset)
+
+	// A range starting in a gap begins with the first segment after it
+	cut := &timeCut{Start: max(start-offset, 0)}
+	if end > 0 {
+		cut.Duration = end - max(start, offset)
+	}
+	return cut, nil
+}
+
+// trimWallClock applies --from-time/--to-time using segment program date
+// times and returns the cut still needed inside the merged output.
+func (p *Pipeline) trimWallClock(task *model.Task, playlist *model.Playlist) (*timeCut, error) {
+	var from, to time.Time
+	var err error
+	if task.FromTime != "" {
+		if from, err = time.Parse(time.RFC3339, task.FromTime); err != nil {
+			return nil, fmt.Errorf("from-time: %w", err)
+		}
+	}
+	if task.ToTime != "" {
+		if to, err = time.Parse(time.RFC3339, task.ToTime); err != nil {
+			return nil, fmt.Errorf("to-time: %w", err)
+		}
+		if !from.IsZero() && !to.After(from) {
+			return nil, fmt.Errorf("to-time %s is not after from-time %s", task.ToTime, task.FromTime)
+		}
+	}
+	if len(playlist.Segments) == 0 || playlist.Segments[0].ProgramDateTime.IsZero() {
+		return nil, fmt.Errorf("stream has no program date time to clip by wall clock")
+	}
+
+	total := len(playlist.Segments)
+	playlist.TrimWallClock(from, to)
+	if len(playlist.Segments) == 0 {
+		return nil, fmt.Errorf("no segments between %s and %s", task.FromTime, task.ToTime)
+	}
+	first := playlist.Segments[0].ProgramDateTime
+	p.logf("[trim] wall clock %s-%s: %d/%d segments, from %s", task.FromTime, task.ToTime, len(playlist.Segments), total, first.UTC().Format(time.RFC3339Nano))
+
+	cut := &timeCut{}
+	start := first
+	if from.After(first) {
+		cut.Start = from.Sub(first).Seconds()
+		start = from
+	}
+	if !to.IsZero() {
+		cut.Duration = to.Sub(start).Seconds()
+	}
+	return cut, nil
+}
+
+// preciseCut trims the merged output to the exact requested range,
+// embedding the chapters of the FFmpeg metadata file chapters if set.
+func (p *Pipeline) preciseCut(ctx context.Context, task *model.Task, mergeType model.MergeType, outputName string, cut *timeCut, chapters string) error {
+	if task.DiscontinuityMode == model.DiscontinuitySplit {
+		p.logf("[trim] precise cut skipped for split output")
+		return nil
+	}
+
+	_, ext, _ := newMerger(task, mergeType)
+	output := filepath.Join(outputDir(task), outputName+ext)
+	trimmed := filepath.Join(outputDir(task), outputName+".trim"+ext)
+
+	p.logf("[trim] precise cut: ss=%.3f t=%.3f", cut.Start, cut.Duration)
+	m := &merger.FFmpegMerger{FFmpegPath: task.FfmpegPath, Chapters: chapters}
+	if err := m.Trim(ctx, output, trimmed, cut.Start, cut.Duration); err != nil {
+		os.Remove(trimmed)
+		return err
+	}
+	return os.Rename(trimmed, output)
+}
+
+// parseMediaTime parses a media time as seconds ("90", "90.5"), HH:mm:ss
+// or mm:ss with optional fractional seconds, or a Go duration ("1h30m").
+func parseMediaTime(s string) (float64, error) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil && v >= 0 {
+		return v, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d.Seconds(), nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 || len(parts) == 3 {
+		var total float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil || v < 0 || (i < len(parts)-1 && strings.Contains(part, ".")) {
+				total = -1
+				break
+			}
+			total = total*60 + v
+		}
+		if total >= 0 {
+			return total, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q (use seconds, HH:mm:ss or mm:ss)", s)
+}
+
+// segmentFiles returns the segment file paths in merge order, with the init
+// segment (for fMP4) first.
+func segmentFiles(init *model.Segment, segments []model.Segment, tmpDir string) []string {
 	// Sort segments by index
-	sorted := make([]model.Segment, len(playlist.Segments))
-	copy(sorted, playlist.Segments)
+	sorted := make([]model.Segment, len(segments))
+	copy(sorted, segments)
 	sort.Slice(sorted, func(i, j int) bool {
 		return sorted[i].Index < sorted[j].Index
 	})
 
+	var files []string
+	if len(sorted) == 0 && init != nil {
+		files = append(files, downloader.SegmentFilePath(tmpDir, init.Index))
+	}
+	// An init section goes before the first segment that uses it, and
+	// again wherever the init section changes
+	var current *model.Segment
 	for _, seg := range sorted {
+		segInit := init
+		if seg.Init != nil {
+			segInit = seg.Init
+		}
+		if segInit != nil && (current == nil || segInit.Index != current.Index) {
+			files = append(files, downloader.SegmentFilePath(tmpDir, segInit.Index))
+			current = segInit
+		}
 		files = append(files, downloader.SegmentFilePath(tmpDir, seg.Index))
 	}
+	return files
+}
 
-	// Determine output extension and merger
-	var m merger.Merger
-	var ext string
-	var mergeTypeName string
-
-	if task.BinaryMerge || mergeType == model.MergeBinary {
-		m = &merger.BinaryMerger{}
-		ext = ".mp4"
-		mergeTypeName = "binary"
-	} else {
-		m = &merger.FFmpegMerger{FFmpegPath: task.FfmpegPath}
-		ext = ".mp4"
-		mergeTypeName = "ffmpeg"
+// splitAtInits splits groups further wherever the init section of the
+// segments changes, so that each part has a single init section.
+func splitAtInits(playlist *model.Playlist, groups [][]model.Segment) [][]model.Segment {
+	var out [][]model.Segment
+	for _, group := range groups {
+		start := 0
+		for i := 1; i < len(group); i++ {
+			if playlist.InitOf(&group[i]) != playlist.InitOf(&group[i-1]) {
+				out = append(out, group[start:i])
+				start = i
+			}
+		}
+		out = append(out, group[start:])
 	}
+	return out
+}
 
-	p.logf("[merge] type=%s, files=%d", mergeTypeName, len(files))
-
-	saveDir := task.SaveDir
-	if saveDir == "" {
-		saveDir = "."
-	}
-	if err := os.MkdirAll(saveDir, 0o755); err != nil {
-		return fmt.Errorf("create save dir: %w", err)
+// newMerger picks the merger and output extension for a task.
+func newMerger(task *model.Task, mergeType model.MergeType) (merger.Merger, string, string) {
+	if task.BinaryMerge || mergeType == model.MergeBinary {
+		return &merger.BinaryMerger{}, ".mp4", "binary"
 	}
+	return &merger.FFmpegMerger{FFmpegPath: task.FfmpegPath, Metadata: task.Metadata}, ".mp4", "ffmpeg"
+}
 
-	output := filepath.Join(saveDir, outputName+ext)
-
+// mergeFiles merges files into saveDir/name and logs the output size.
+func (p *Pipeline) mergeFiles(ctx context.Context, m merger.Merger, files []string, saveDir, name string) error {
+	output := filepath.Join(saveDir, name)
 	if err := m.Merge(ctx, files, output); err != nil {
 		return err
 	}
 
 	// Log output file size
 	if info, statErr := os.Stat(output); statErr == nil {
-		p.logf("[merge] output: %s (%d bytes)", outputName+ext, info.Size())
+		p.logf("[merge] output: %s (%d bytes)", name, info.Size())
 	}
-
 	return nil
 }
 
 // runLive handles live stream recording.
-func (p *Pipeline) runLive(ctx context.Context, task *model.Task, stream *model.StreamSpec, onProgress func(model.ProgressEvent)) error {
+func (p *Pipeline) runLive(ctx context.Context, task *model.Task, stream *model.StreamSpec, sessionKeys map[string][]byte, onProgress func(model.ProgressEvent)) error {
 	opts := LiveOptions{}
 
 	if task.LiveDuration != "" {
@@ -327,12 +830,16 @@ func (p *Pipeline) runLive(ctx context.Context, task *model.Task, stream *model.
 	if task.LiveWaitTime > 0 {
 		opts.WaitTime = time.Duration(task.LiveWaitTime) * time.Second
 	}
+	opts.LowLatency = task.LowLatency
 
 	recorder := &LiveRecorder{
-		Parser:     p.Parser,
-		Downloader: p.Downloader,
-		Decryptor:  p.Decryptor,
-		Opts:       opts,
+		Parser:      p.Parser,
+		Downloader:  p.Downloader,
+		Decryptor:   p.Decryptor,
+		KeyProvider: p.KeyProvider,
+		Keys:        sessionKeys,
+		Opts:        opts,
+		OnLog:       p.OnLog,
 	}
 
 	return recorder.Record(ctx, task, stream, onProgress)
@@ -355,8 +862,40 @@ func parseLiveDuration(s string) (time.Duration, error) {
 	return 0, fmt.Errorf("invalid duration format: %s (use HH:mm:ss or Go duration like 1h30m)", s)
 }
 
+// resolvePlaylists loads the media playlists a lazy parser left out, for
+// the selected streams only.
+func (p *Pipeline) resolvePlaylists(ctx context.Context, task *model.Task, result *model.ParseResult, streams []model.StreamSpec) error {
+	r, ok := p.Parser.(parser.PlaylistResolver)
+	if !ok {
+		return nil
+	}
+	pending := 0
+	for _, s := range streams {
+		if s.Playlist == nil && s.URL != "" {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	p.logf("[parse] fetching %d selected media playlists", pending)
+	if err := r.ResolvePlaylists(ctx, result, streams, task.Headers); err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+	return nil
+}
+
 // selectStreams filters streams based on user selection.
 func selectStreams(streams []model.StreamSpec, task *model.Task) []model.StreamSpec {
+	// I-frame and image streams are only used in thumbnail mode
+	var media []model.StreamSpec
+	for _, s := range streams {
+		if !s.MediaType.IsTrickPlay() {
+			media = append(media, s)
+		}
+	}
+	streams = media
+
 	if len(streams) == 0 {
 		return nil
 	}
@@ -366,7 +905,7 @@ func selectStreams(streams []model.StreamSpec, task *model.Task) []model.StreamS
 		return streams
 	}
 
-	// Auto-select: pick highest bandwidth video + first audio
+	// Auto-select: pick highest bandwidth video + its audio rendition
 	if task.AutoSelect {
 		return autoSelect(streams)
 	}
@@ -399,31 +938,66 @@ func autoSelect(streams []model.StreamSpec) []model.StreamSpec {
 	}
 
 	if len(audios) > 0 {
-		selected = append(selected, audios[0])
+		group := ""
+		if len(selected) > 0 {
+			group = selected[0].AudioGroup
+		}
+		selected = append(selected, pickAudio(audios, group))
 	}
 
 	return selected
 }
 
-// fetchKey downloads an encryption key from a URL.
-func fetchKey(ctx context.Context, keyURL string, headers map[string]string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
+// pickAudio picks the audio rendition for a variant's audio group,
+// preferring DEFAULT=YES, then AUTOSELECT=YES, then the first listed.
+// Audios outside the group are only considered if the group has none.
+func pickAudio(audios []model.StreamSpec, group string) model.StreamSpec {
+	candidates := audios
+	if group != "" {
+		var inGroup []model.StreamSpec
+		for _, a := range audios {
+			if a.GroupID == group {
+				inGroup = append(inGroup, a)
+			}
+		}
+		if len(inGroup) > 0 {
+			candidates = inGroup
+		}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	for _, a := range candidates {
+		if a.Default {
+			return a
+		}
+	}
+	for _, a := range candidates {
+		if a.AutoSelect {
+			return a
+		}
 	}
-	defer resp.Body.Close()
+	return candidates[0]
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d fetching key", resp.StatusCode)
+// newKeyProvider builds the key provider chain for a task: data: URIs in
+// the playlist, then the local key file or directory, then the key server.
+func newKeyProvider(task *model.Task) crypto.KeyProvider {
+	chain := crypto.KeyChain{&crypto.DataURIKeyProvider{JSONField: task.KeyJSONField}}
+	if task.KeyFile != "" {
+		chain = append(chain, &crypto.FileKeyProvider{Path: task.KeyFile, JSONField: task.KeyJSONField})
 	}
 
-	return io.ReadAll(resp.Body)
+	headers := make(map[string]string, len(task.Headers))
+	for k, v := range task.Headers {
+		headers[k] = v
+	}
+	for k, v := range task.KeyHeaders[""] {
+		headers[k] = v
+	}
+	return append(chain, &crypto.HTTPKeyProvider{
+		Headers:     headers,
+		HostHeaders: task.KeyHeaders,
+		Method:      task.KeyMethod,
+		Body:        task.KeyBody,
+		JSONField:   task.KeyJSONField,
+	})
 }
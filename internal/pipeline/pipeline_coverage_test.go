@@ -78,62 +78,6 @@ func TestSelectStreams_Empty(t *testing.T) {
 	}
 }
 
-func TestFetchKey_Success(t *testing.T) {
-	key := []byte("0123456789abcdef")
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write(key)
-	}))
-	defer server.Close()
-
-	got, err := fetchKey(context.Background(), server.URL+"/key.bin", nil)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if string(got) != string(key) {
-		t.Errorf("key mismatch")
-	}
-}
-
-func TestFetchKey_HTTP404(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotFound)
-	}))
-	defer server.Close()
-
-	_, err := fetchKey(context.Background(), server.URL+"/key.bin", nil)
-	if err == nil {
-		t.Fatal("expected error for 404")
-	}
-}
-
-func TestFetchKey_ServerDown(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
-	server.Close()
-
-	_, err := fetchKey(context.Background(), server.URL+"/key.bin", nil)
-	if err == nil {
-		t.Fatal("expected error when server is down")
-	}
-}
-
-func TestFetchKey_WithHeaders(t *testing.T) {
-	var gotAuth string
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gotAuth = r.Header.Get("Authorization")
-		w.Write([]byte("key"))
-	}))
-	defer server.Close()
-
-	headers := map[string]string{"Authorization": "Bearer token"}
-	_, err := fetchKey(context.Background(), server.URL+"/key.bin", headers)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if gotAuth != "Bearer token" {
-		t.Errorf("expected auth header, got %q", gotAuth)
-	}
-}
-
 func TestPipeline_RunLive_WithDurationAndWaitTime(t *testing.T) {
 	var callCount int
 	mux := http.NewServeMux()
@@ -272,7 +216,7 @@ seg0.m4s
 
 func TestPipeline_DecryptSegments_NilDecryptor(t *testing.T) {
 	pipe := &Pipeline{}
-	err := pipe.decryptSegments(context.Background(), &model.Task{}, &model.Playlist{}, "/tmp")
+	err := pipe.decryptSegments(context.Background(), &model.Task{}, &model.Playlist{}, "/tmp", nil)
 	if err != nil {
 		t.Fatalf("expected nil error for nil decryptor, got: %v", err)
 	}
@@ -286,7 +230,7 @@ func TestPipeline_DecryptSegments_NoEncryption(t *testing.T) {
 			{Index: 1, EncryptInfo: &model.EncryptInfo{Method: model.EncryptNone}},
 		},
 	}
-	err := pipe.decryptSegments(context.Background(), &model.Task{}, playlist, "/tmp")
+	err := pipe.decryptSegments(context.Background(), &model.Task{}, playlist, "/tmp", nil)
 	if err != nil {
 		t.Fatalf("expected nil error for non-encrypted segments, got: %v", err)
 	}
@@ -334,7 +278,7 @@ func TestPipeline_DecryptSegments_FetchKeyAndDecrypt(t *testing.T) {
 		},
 	}
 
-	err := pipe.decryptSegments(context.Background(), &model.Task{}, playlist, tmpDir)
+	err := pipe.decryptSegments(context.Background(), &model.Task{}, playlist, tmpDir, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -414,3 +358,114 @@ aseg0.m4s
 		t.Errorf("audio output missing: %v", err)
 	}
 }
+
+func TestPipeline_DecryptCENC_UnprotectedInit(t *testing.T) {
+	tmpDir := t.TempDir()
+	// moov containing only an empty trak: valid MP4, no protection
+	initData := []byte{0, 0, 0, 16, 'm', 'o', 'o', 'v', 0, 0, 0, 8, 't', 'r', 'a', 'k'}
+	os.WriteFile(downloader.SegmentFilePath(tmpDir, -1), initData, 0o644)
+	os.WriteFile(downloader.SegmentFilePath(tmpDir, 0), []byte("SEG0"), 0o644)
+
+	pipe := &Pipeline{CENCDecryptor: &crypto.CENCDecryptor{}}
+	playlist := &model.Playlist{
+		MediaInit: &model.Segment{Index: -1},
+		Segments:  []model.Segment{{Index: 0}},
+	}
+
+	err := pipe.decryptCENC(&model.Task{Key: []string{"00112233445566778899aabbccddeeff"}}, playlist, tmpDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, _ := os.ReadFile(downloader.SegmentFilePath(tmpDir, 0))
+	if string(data) != "SEG0" {
+		t.Errorf("segment modified: got %q", string(data))
+	}
+}
+
+func TestPipeline_DecryptCENC_InvalidInit(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(downloader.SegmentFilePath(tmpDir, -1), []byte("garbage"), 0o644)
+
+	pipe := &Pipeline{CENCDecryptor: &crypto.CENCDecryptor{}}
+	playlist := &model.Playlist{MediaInit: &model.Segment{Index: -1}}
+
+	if err := pipe.decryptCENC(&model.Task{}, playlist, tmpDir); err == nil {
+		t.Fatal("expected error for unparseable init segment")
+	}
+}
+
+func TestNewKeyProvider_KeyHeadersAndFile(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var gotAuth, gotReferer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotReferer = r.Header.Get("Referer")
+		w.Write(key)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local.key"), []byte("30313233343536373839616263646566"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	task := &model.Task{
+		Headers:    map[string]string{"Referer": "https://example.com", "Authorization": "Bearer task"},
+		KeyHeaders: map[string]map[string]string{"": {"Authorization": "Bearer key"}},
+		KeyFile:    dir,
+	}
+	provider := newKeyProvider(task)
+
+	got, err := provider.FetchKey(context.Background(), server.URL+"/remote.key")
+	if err != nil || string(got) != string(key) {
+		t.Fatalf("remote key: got %x, %v", got, err)
+	}
+	if gotAuth != "Bearer key" || gotReferer != "https://example.com" {
+		t.Errorf("headers: auth=%q referer=%q", gotAuth, gotReferer)
+	}
+
+	got, err = provider.FetchKey(context.Background(), server.URL+"/local.key")
+	if err != nil || string(got) != string(key) {
+		t.Errorf("local key: got %x, %v", got, err)
+	}
+}
+
+func TestPipeline_DecryptSegments_LenientReportsRepairs(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+
+	tmpDir := t.TempDir()
+	os.WriteFile(downloader.SegmentFilePath(tmpDir, 0), testEncrypt([]byte("clean segment"), key, iv), 0o644)
+	os.WriteFile(downloader.SegmentFilePath(tmpDir, 1), append(testEncrypt([]byte("broken segment"), key, iv), "tail"...), 0o644)
+
+	var logs []string
+	pipe := &Pipeline{
+		Decryptor: &crypto.AES128Decryptor{Lenient: true, DropRemainder: true},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	enc := &model.EncryptInfo{Method: model.EncryptAES128, Key: key, IV: iv}
+	playlist := &model.Playlist{
+		Segments: []model.Segment{{Index: 0, EncryptInfo: enc}, {Index: 1, EncryptInfo: enc}},
+	}
+
+	if err := pipe.decryptSegments(context.Background(), &model.Task{}, playlist, tmpDir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, _ := os.ReadFile(downloader.SegmentFilePath(tmpDir, 1))
+	if string(data) != "broken segment" {
+		t.Errorf("repaired segment: got %q", data)
+	}
+
+	want := []string{
+		"[decrypt] 2 segments, method=AES-128",
+		"[decrypt] repaired segment 1: 4 unaligned bytes dropped",
+		"[decrypt] 1 segments repaired in lenient mode",
+	}
+	if fmt.Sprint(logs) != fmt.Sprint(want) {
+		t.Errorf("logs:\n got %q\nwant %q", logs, want)
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/caorushizi/mediago-core/internal/crypto"
@@ -149,6 +152,267 @@ seg1.m4s
 	}
 }
 
+func TestPipeline_DiscontinuitySplit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:10.0,
+seg0.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:10.0,
+seg1.m4s
+#EXTINF:10.0,
+seg2.m4s
+#EXT-X-ENDLIST
+`)
+	})
+	for _, name := range []string{"init.mp4", "seg0.m4s", "seg1.m4s", "seg2.m4s"} {
+		body := strings.ToUpper(strings.Split(name, ".")[0])
+		mux.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	saveDir := t.TempDir()
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		// Progress is logged from the download workers
+		OnLog: func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+
+	task := &model.Task{
+		URL:               server.URL + "/video.m3u8",
+		SaveDir:           saveDir,
+		SaveName:          "show",
+		TmpDir:            t.TempDir(),
+		ThreadCount:       2,
+		RetryCount:        1,
+		BinaryMerge:       true,
+		DiscontinuityMode: model.DiscontinuitySplit,
+	}
+
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, want := range map[string]string{"show_part1.mp4": "INITSEG0", "show_part2.mp4": "INITSEG1SEG2"} {
+		data, err := os.ReadFile(filepath.Join(saveDir, name))
+		if err != nil {
+			t.Fatalf("%s missing: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, "show.mp4")); !os.IsNotExist(err) {
+		t.Error("expected no single merged output in split mode")
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "[merge] 2 discontinuity groups, mode=split") {
+		t.Errorf("missing discontinuity log in %q", logs)
+	}
+}
+
+func TestPipeline_MultipleInits(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="inita.mp4"
+#EXTINF:10.0,
+seg0.m4s
+#EXT-X-MAP:URI="initb.mp4"
+#EXTINF:10.0,
+seg1.m4s
+#EXTINF:10.0,
+seg2.m4s
+#EXT-X-MAP:URI="inita.mp4"
+#EXTINF:10.0,
+seg3.m4s
+#EXT-X-ENDLIST
+`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		requests[name]++
+		mu.Unlock()
+		w.Write([]byte(strings.ToUpper(strings.Split(name, ".")[0])))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		mode  string
+		files map[string]string
+	}{
+		{
+			name:  "concat inserts init sections",
+			mode:  model.DiscontinuityConcat,
+			files: map[string]string{"out.mp4": "INITASEG0INITBSEG1SEG2INITASEG3"},
+		},
+		{
+			name: "split at init changes",
+			mode: model.DiscontinuitySplit,
+			files: map[string]string{
+				"out_part1.mp4": "INITASEG0",
+				"out_part2.mp4": "INITBSEG1SEG2",
+				"out_part3.mp4": "INITASEG3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(requests)
+			saveDir := t.TempDir()
+			pipe := &Pipeline{
+				Parser:     &hls.Parser{Client: server.Client()},
+				Downloader: &downloader.HTTPDownloader{},
+			}
+			task := &model.Task{
+				URL:               server.URL + "/video.m3u8",
+				SaveDir:           saveDir,
+				SaveName:          "out",
+				TmpDir:            t.TempDir(),
+				ThreadCount:       2,
+				RetryCount:        1,
+				BinaryMerge:       true,
+				DiscontinuityMode: tt.mode,
+			}
+			if err := pipe.Run(context.Background(), task, nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for name, want := range tt.files {
+				data, err := os.ReadFile(filepath.Join(saveDir, name))
+				if err != nil {
+					t.Fatalf("%s missing: %v", name, err)
+				}
+				if string(data) != want {
+					t.Errorf("%s: expected %q, got %q", name, want, data)
+				}
+			}
+			if requests["inita.mp4"] != 1 || requests["initb.mp4"] != 1 {
+				t.Errorf("init requests = %v, want each init once", requests)
+			}
+		})
+	}
+}
+
+func TestPipeline_DiscontinuityRetimestamp(t *testing.T) {
+	// Fake ffmpeg that writes its concat list to the output file, so the
+	// test can check which parts were joined and in what order.
+	dir := t.TempDir()
+	fakeFFmpeg := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\nwhile [ \"$1\" != \"-i\" ]; do shift; done\nlist=$2\nfor a; do out=$a; done\ncp \"$list\" \"$out\"\n"
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	for i, body := range []string{"INIT", "SEG0", "SEG1"} {
+		os.WriteFile(downloader.SegmentFilePath(tmpDir, i-1), []byte(body), 0o644)
+	}
+
+	saveDir := t.TempDir()
+	task := &model.Task{
+		SaveDir:           saveDir,
+		FfmpegPath:        fakeFFmpeg,
+		BinaryMerge:       true,
+		DiscontinuityMode: model.DiscontinuityRetimestamp,
+	}
+	playlist := &model.Playlist{
+		MediaInit:       &model.Segment{Index: -1},
+		Segments:        []model.Segment{{Index: 0}, {Index: 1, Discontinuity: 1}},
+		Discontinuities: []int{1},
+	}
+
+	pipe := &Pipeline{}
+	if err := pipe.mergeSegments(context.Background(), task, playlist, model.MergeBinary, tmpDir, "out", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	list, err := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+	if err != nil {
+		t.Fatalf("output missing: %v", err)
+	}
+	want := fmt.Sprintf("file '%s'\nfile '%s'\n", filepath.Join(tmpDir, "part_000.mp4"), filepath.Join(tmpDir, "part_001.mp4"))
+	if string(list) != want {
+		t.Errorf("concat list:\n got %q\nwant %q", list, want)
+	}
+	part, _ := os.ReadFile(filepath.Join(tmpDir, "part_001.mp4"))
+	if string(part) != "INITSEG1" {
+		t.Errorf("second part: got %q", part)
+	}
+}
+
+func TestPipeline_DiscontinuityModeFFmpegArgs(t *testing.T) {
+	// Fake ffmpeg that logs each call's arguments
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	fakeFFmpeg := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nfor a; do out=$a; done\n: > \"$out\"\n", argsFile)
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make(map[string][]string)
+	for _, mode := range []string{model.DiscontinuityConcat, model.DiscontinuityRetimestamp} {
+		os.Remove(argsFile)
+		task := &model.Task{SaveDir: t.TempDir(), FfmpegPath: fakeFFmpeg, DiscontinuityMode: mode}
+		playlist := &model.Playlist{
+			Segments:        []model.Segment{{Index: 0}, {Index: 1, Discontinuity: 1}},
+			Discontinuities: []int{1},
+		}
+		pipe := &Pipeline{}
+		if err := pipe.mergeSegments(context.Background(), task, playlist, model.MergeFFmpeg, t.TempDir(), "out", ""); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		data, _ := os.ReadFile(argsFile)
+		calls[mode] = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	if got := calls[model.DiscontinuityConcat]; len(got) != 1 || strings.Contains(got[0], "genpts") {
+		t.Errorf("concat calls: %q", got)
+	}
+	// One call per group, then the join, all regenerating timestamps
+	got := calls[model.DiscontinuityRetimestamp]
+	if len(got) != 3 {
+		t.Fatalf("retimestamp calls: %q", got)
+	}
+	for _, args := range got {
+		if !strings.HasPrefix(args, "-y -fflags +genpts -f concat ") || !strings.Contains(args, " -avoid_negative_ts make_zero ") {
+			t.Errorf("retimestamp call: %q", args)
+		}
+	}
+}
+
+func TestPipeline_UnknownDiscontinuityMode(t *testing.T) {
+	pipe := &Pipeline{}
+	task := &model.Task{SaveDir: t.TempDir(), DiscontinuityMode: "bogus"}
+	playlist := &model.Playlist{Segments: []model.Segment{{Index: 0}}}
+	if err := pipe.mergeSegments(context.Background(), task, playlist, model.MergeBinary, t.TempDir(), "out", ""); err == nil {
+		t.Fatal("expected error for unknown discontinuity mode")
+	}
+}
+
 func TestPipeline_WithDecryption(t *testing.T) {
 	key := []byte("0123456789abcdef")
 	iv := []byte("abcdef0123456789")
@@ -247,3 +511,212 @@ func testAESEncrypt(plaintext, key, iv []byte) []byte {
 	mode.CryptBlocks(encrypted, padded)
 	return encrypted
 }
+
+func TestAutoSelect_AudioGroup(t *testing.T) {
+	streams := []model.StreamSpec{
+		{MediaType: model.MediaVideo, Bandwidth: 800000, AudioGroup: "aac-lo"},
+		{MediaType: model.MediaVideo, Bandwidth: 6000000, AudioGroup: "aac-hi"},
+		{MediaType: model.MediaAudio, GroupID: "aac-lo", Language: "en", Default: true},
+		{MediaType: model.MediaAudio, GroupID: "aac-hi", Language: "ja", AutoSelect: true},
+		{MediaType: model.MediaAudio, GroupID: "aac-hi", Language: "en", Default: true, AutoSelect: true},
+	}
+
+	selected := autoSelect(streams)
+	if len(selected) != 2 {
+		t.Fatalf("expected 2, got %d", len(selected))
+	}
+	if a := selected[1]; a.GroupID != "aac-hi" || a.Language != "en" {
+		t.Errorf("expected default audio of group aac-hi, got %s/%s", a.GroupID, a.Language)
+	}
+}
+
+func TestPickAudio(t *testing.T) {
+	audios := []model.StreamSpec{
+		{GroupID: "a", Language: "de"},
+		{GroupID: "a", Language: "fr", AutoSelect: true},
+		{GroupID: "b", Language: "en", Default: true},
+	}
+	tests := []struct {
+		group, want string
+	}{
+		{"a", "fr"},       // no DEFAULT in group, AUTOSELECT wins
+		{"b", "en"},       // DEFAULT in group
+		{"missing", "en"}, // unknown group falls back to all audios
+		{"", "en"},
+	}
+	for _, tt := range tests {
+		if got := pickAudio(audios, tt.group).Language; got != tt.want {
+			t.Errorf("pickAudio(group=%q) = %s, want %s", tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestPipeline_SkipsGapSegments(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nseg0.ts\n#EXT-X-GAP\n#EXTINF:4.0,\nseg1.ts\n#EXTINF:4.0,\nseg2.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/seg1.ts", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("gap segment was requested")
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var logs []string
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/video.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "out",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+		BinaryMerge: true,
+		Start:       "5",
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The gap still counts on the timeline: --start 5 lands inside it
+	data, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+	if string(data) != "seg2.ts" {
+		t.Errorf("output: %q", data)
+	}
+	if !slices.Contains(logs, "[download] skipping 1 gap segments") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestPipeline_LazyPlaylists(t *testing.T) {
+	var fetched []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000
+high.m3u8
+`)
+	})
+	mux.HandleFunc("/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unselected playlist was requested")
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/high.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nseg0.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var logs []string
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client(), Lazy: true},
+		Downloader: &downloader.HTTPDownloader{},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/master.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "out",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+		AutoSelect:  true,
+		BinaryMerge: true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fetched) != 1 {
+		t.Errorf("expected one media playlist request, got %v", fetched)
+	}
+	data, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+	if string(data) != "seg0.ts" {
+		t.Errorf("output: %q", data)
+	}
+	if !slices.Contains(logs, "[parse] fetching 1 selected media playlists") {
+		t.Errorf("logs: %v", logs)
+	}
+}
+
+func TestPipeline_FallbackLower(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1600000\nhigh.m3u8\n")
+	})
+	for _, name := range []string{"low", "high"} {
+		mux.HandleFunc("/"+name+".m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\n%[1]s0.ts\n#EXTINF:4.0,\n%[1]s1.ts\n#EXT-X-ENDLIST\n", name)
+		})
+	}
+	mux.HandleFunc("/high1.ts", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	run := func(fallback bool) ([]string, string, error) {
+		var logs []string
+		saveDir := t.TempDir()
+		pipe := &Pipeline{
+			Parser:     &hls.Parser{Client: server.Client()},
+			Downloader: &downloader.HTTPDownloader{},
+			OnLog: func(format string, args ...any) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			},
+		}
+		task := &model.Task{
+			URL:           server.URL + "/master.m3u8",
+			SaveDir:       saveDir,
+			SaveName:      "out",
+			TmpDir:        t.TempDir(),
+			ThreadCount:   1,
+			AutoSelect:    true,
+			BinaryMerge:   true,
+			FallbackLower: fallback,
+		}
+		err := pipe.Run(context.Background(), task, nil)
+		data, _ := os.ReadFile(filepath.Join(saveDir, "out.mp4"))
+		return logs, string(data), err
+	}
+
+	if _, _, err := run(false); err == nil {
+		t.Fatal("expected the failing segment to fail the download")
+	}
+
+	logs, output, err := run(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output != "low0.tslow1.ts" {
+		t.Errorf("output: %q", output)
+	}
+	if !slices.ContainsFunc(logs, func(l string) bool {
+		return strings.HasPrefix(l, "[download] segment 1 failed: ") && strings.HasSuffix(l, "falling back to variant bandwidth=800000")
+	}) {
+		t.Errorf("logs: %v", logs)
+	}
+}
@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/caorushizi/mediago-core/internal/model"
+)
+
+// sessionMetadataKeys are the container metadata keys filled from session
+// data whose DATA-ID ends in the same name, as in "com.apple.hls.title".
+var sessionMetadataKeys = map[string]bool{
+	"title": true, "description": true, "artist": true, "album": true,
+	"genre": true, "date": true, "comment": true, "copyright": true,
+}
+
+// applySession returns a copy of task with defaults taken from the
+// session-level tags of the manifest: container metadata and the output
+// name from session data, and the start offset from EXT-X-START. Options
+// given by the user are kept.
+func (p *Pipeline) applySession(task *model.Task, result *model.ParseResult, streams []model.StreamSpec) *model.Task {
+	t := *task
+
+	if meta := sessionMetadata(result.SessionData); len(meta) > 0 {
+		maps.Copy(meta, task.Metadata)
+		t.Metadata = meta
+		if title := safeFileName(meta["title"]); t.SaveName == "" && title != "" {
+			t.SaveName = title
+			p.logf("[session] output named after title %q", meta["title"])
+		}
+	}
+
+	start := result.Start
+	if start == nil || result.IsLive || t.Live || t.Start != "" || t.End != "" || t.FromTime != "" || t.ToTime != "" {
+		return &t
+	}
+	offset := start.TimeOffset
+	if offset < 0 && len(streams) > 0 && streams[0].Playlist != nil {
+		offset = max(streams[0].Playlist.TotalDuration+offset, 0)
+	}
+	if offset > 0 {
+		t.Start = strconv.FormatFloat(offset, 'f', -1, 64)
+		p.logf("[session] EXT-X-START: starting at %.3fs (precise=%v)", offset, start.Precise)
+	}
+	return &t
+}
+
+// sessionMetadata returns the container metadata found in session data,
+// using the first entry of each name.
+func sessionMetadata(data []model.SessionData) map[string]string {
+	meta := make(map[string]string)
+	for _, sd := range data {
+		name := strings.ToLower(sd.ID[strings.LastIndexByte(sd.ID, '.')+1:])
+		if sd.Value == "" || !sessionMetadataKeys[name] {
+			continue
+		}
+		if _, ok := meta[name]; !ok {
+			meta[name] = sd.Value
+		}
+	}
+	return meta
+}
+
+// safeFileName turns a title into a file name, replacing path separators
+// and characters that are invalid on common file systems.
+func safeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.Trim(s, " .")
+}
+
+// prefetchKeys fetches the AES-128 keys announced by EXT-X-SESSION-KEY
+// before any segment needs them, returning them by key URL. A key that
+// fails is fetched again on first use.
+func (p *Pipeline) prefetchKeys(ctx context.Context, task *model.Task, sessionKeys []model.EncryptInfo) map[string][]byte {
+	provider := p.KeyProvider
+	if provider == nil {
+		provider = newKeyProvider(task)
+	}
+	keys := make(map[string][]byte)
+	for _, enc := range sessionKeys {
+		if enc.Method != model.EncryptAES128 || enc.KeyURL == "" || keys[enc.KeyURL] != nil {
+			continue
+		}
+		key := enc.Key
+		if key == nil {
+			var err error
+			if key, err = provider.FetchKey(ctx, enc.KeyURL); err != nil {
+				p.logf("[decrypt] prefetch session key %s: %v", enc.KeyURL, err)
+				continue
+			}
+		}
+		keys[enc.KeyURL] = key
+	}
+	if len(keys) > 0 {
+		p.logf("[decrypt] prefetched %d session keys", len(keys))
+	}
+	return keys
+}
@@ -0,0 +1,226 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caorushizi/mediago-core/internal/crypto"
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+func TestPipeline_SessionDefaults(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("abcdef0123456789")
+
+	var mu sync.Mutex
+	var requested []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-SESSION-DATA:DATA-ID="com.apple.hls.title",VALUE="My Show: Pilot"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="key.bin"
+#EXT-X-START:TIME-OFFSET=-10
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+video.m3u8
+`)
+	})
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x61626364656630313233343536373839
+#EXTINF:10.0,
+seg0.ts
+#EXTINF:10.0,
+seg1.ts
+#EXTINF:10.0,
+seg2.ts
+#EXT-X-ENDLIST
+`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		requested = append(requested, name)
+		mu.Unlock()
+		if name == "key.bin" {
+			w.Write(key)
+			return
+		}
+		w.Write(testAESEncrypt([]byte(name), key, iv))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var logs []string
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Decryptor:  &crypto.AES128Decryptor{},
+		OnLog: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/master.m3u8",
+		SaveDir:     saveDir,
+		TmpDir:      t.TempDir(),
+		ThreadCount: 1,
+		RetryCount:  1,
+		BinaryMerge: true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Named after the title, starting 10s before the end
+	data, err := os.ReadFile(filepath.Join(saveDir, "My Show_ Pilot.mp4"))
+	if err != nil {
+		t.Fatalf("output missing: %v", err)
+	}
+	if string(data) != "seg2.ts" {
+		t.Errorf("output: %q", data)
+	}
+	if want := []string{"key.bin", "seg2.ts"}; !slices.Equal(requested, want) {
+		t.Errorf("requests = %v, want %v", requested, want)
+	}
+	if !slices.Contains(logs, "[decrypt] prefetched 1 session keys") {
+		t.Errorf("logs: %v", logs)
+	}
+	if task.SaveName != "" || task.Start != "" {
+		t.Error("task was modified")
+	}
+}
+
+func TestPipeline_ConcurrentRunsKeepSessionKeys(t *testing.T) {
+	iv := []byte("abcdef0123456789")
+	keys := map[string][]byte{"a": []byte("aaaaaaaaaaaaaaaa"), "b": []byte("bbbbbbbbbbbbbbbb")}
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	mux := http.NewServeMux()
+	for name, key := range keys {
+		mux.HandleFunc("/"+name+"/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-SESSION-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nvideo.m3u8\n")
+		})
+		mux.HandleFunc("/"+name+"/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x61626364656630313233343536373839
+#EXTINF:10.0,
+seg0.ts
+#EXTINF:10.0,
+seg1.ts
+#EXT-X-ENDLIST
+`)
+		})
+		mux.HandleFunc("/"+name+"/", func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests[r.URL.Path]++
+			mu.Unlock()
+			if strings.HasSuffix(r.URL.Path, "key.bin") {
+				w.Write(key)
+				return
+			}
+			w.Write(testAESEncrypt([]byte(r.URL.Path), key, iv))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// One Pipeline shared by both runs, as a batch or GUI caller would
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+		Decryptor:  &crypto.AES128Decryptor{},
+	}
+	saveDir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	for name := range keys {
+		wg.Go(func() {
+			task := &model.Task{
+				URL:         server.URL + "/" + name + "/master.m3u8",
+				SaveDir:     saveDir,
+				SaveName:    name,
+				TmpDir:      t.TempDir(),
+				ThreadCount: 2,
+				RetryCount:  1,
+				BinaryMerge: true,
+			}
+			err := pipe.Run(context.Background(), task, nil)
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for name := range keys {
+		if errs[name] != nil {
+			t.Fatalf("run %s: %v", name, errs[name])
+		}
+		data, _ := os.ReadFile(filepath.Join(saveDir, name+".mp4"))
+		if want := "/" + name + "/seg0.ts/" + name + "/seg1.ts"; string(data) != want {
+			t.Errorf("%s output: %q, want %q", name, data, want)
+		}
+		// Each run decrypts with the key it prefetched
+		if n := requests["/"+name+"/key.bin"]; n != 1 {
+			t.Errorf("%s key fetched %d times", name, n)
+		}
+	}
+}
+
+func TestApplySession(t *testing.T) {
+	result := &model.ParseResult{
+		SessionData: []model.SessionData{
+			{ID: "com.apple.hls.title", Value: "Title"},
+			{ID: "com.example.title", Value: "Second title"},
+			{ID: "com.example.artist", Value: "Artist"},
+			{ID: "com.example.info", URI: "http://example.com/info.json"},
+		},
+		Start: &model.StartOffset{TimeOffset: 5},
+	}
+	tests := []struct {
+		name  string
+		task  model.Task
+		want  map[string]string
+		save  string
+		start string
+	}{
+		{
+			name:  "defaults",
+			want:  map[string]string{"title": "Title", "artist": "Artist"},
+			save:  "Title",
+			start: "5",
+		},
+		{
+			name:  "user options win",
+			task:  model.Task{SaveName: "mine", End: "60", Metadata: map[string]string{"title": "Mine"}},
+			want:  map[string]string{"title": "Mine", "artist": "Artist"},
+			save:  "mine",
+			start: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&Pipeline{}).applySession(&tt.task, result, nil)
+			if fmt.Sprint(got.Metadata) != fmt.Sprint(tt.want) {
+				t.Errorf("Metadata = %v, want %v", got.Metadata, tt.want)
+			}
+			if got.SaveName != tt.save || got.Start != tt.start {
+				t.Errorf("SaveName, Start = %q, %q, want %q, %q", got.SaveName, got.Start, tt.save, tt.start)
+			}
+		})
+	}
+}
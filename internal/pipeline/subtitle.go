@@ -0,0 +1,260 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/subtitle"
+)
+
+// isWebVTT reports whether stream is a subtitle stream of plain-text
+// WebVTT segments. Subtitles in fMP4 (DASH stpp, wvtt) have an init
+// section and are merged like any other stream.
+func isWebVTT(stream *model.StreamSpec) bool {
+	p := stream.Playlist
+	return stream.MediaType == model.MediaSubtitle && p != nil && p.MediaInit == nil && len(p.Inits()) == 0
+}
+
+// subtitleName returns the output base name for a subtitle stream, e.g.
+// "output.en", keeping names unique across streams with the same language.
+func subtitleName(outputName string, stream *model.StreamSpec, used map[string]bool) string {
+	label := stream.Language
+	if label == "" {
+		label = stream.Name
+	}
+	if label == "" {
+		label = "sub"
+	}
+
+	name := outputName + "." + label
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s.%s_%d", outputName, label, n)
+	}
+	used[name] = true
+	return name
+}
+
+// processSubtitle downloads the WebVTT segments of a subtitle stream and
+// writes them as a single .vtt or .srt file next to the video.
+func (p *Pipeline) processSubtitle(ctx context.Context, task *model.Task, stream *model.StreamSpec, name string, state *runState) error {
+	format := task.SubtitleFormat
+	if format == "" {
+		format = "vtt"
+	}
+	if format != "vtt" && format != "srt" {
+		return fmt.Errorf("unknown subtitle format %q", format)
+	}
+
+	playlist := stream.Playlist
+
+	// Subtitles are cut like the media they go with, so their cues stay
+	// in sync with it
+	starts := segmentStarts(playlist.Segments)
+	trimTask := task
+	if (task.FromTime != "" || task.ToTime != "") && playlist.Segments[0].ProgramDateTime.IsZero() {
+		// Without program date times the cues are only placed against
+		// the media start
+		p.logf("[subtitle] %s: no program date times, not clipped by wall clock", name)
+		t := *task
+		t.FromTime, t.ToTime = "", ""
+		trimTask = &t
+	}
+	cut, err := p.trimPlaylist(trimTask, playlist)
+	if err != nil {
+		return err
+	}
+	if n := playlist.DropGaps(); n > 0 {
+		p.logf("[subtitle] %s: skipping %d gap segments", name, n)
+	}
+	start := outputStart(task, playlist, starts, cut)
+	if state.mediaStart != nil {
+		start = *state.mediaStart
+	}
+	var dropped []span
+	if task.AdMode == model.AdsDrop {
+		dropped = adSpans(playlist.Segments, starts)
+		if n := playlist.DropAds(); n > 0 {
+			p.logf("[subtitle] %s: dropping %d ad segments", name, n)
+		}
+		if len(playlist.Segments) == 0 {
+			return fmt.Errorf("all subtitle segments are in ad breaks")
+		}
+	}
+	var duration float64
+	if cut != nil && task.PreciseCut {
+		duration = cut.Duration
+	}
+
+	// Subtitle segments get their own tmp dir so they do not overwrite the
+	// video's segment files
+	tmpDir := filepath.Join(os.TempDir(), "mediago", name)
+	if task.TmpDir != "" {
+		tmpDir = filepath.Join(task.TmpDir, name)
+	}
+
+	p.logf("[subtitle] %s: %d segments", name, len(playlist.Segments))
+	err = p.Downloader.Download(ctx, playlist.Segments, downloader.Options{
+		TmpDir:      tmpDir,
+		Headers:     task.Headers,
+		Proxy:       task.Proxy,
+		Timeout:     task.Timeout,
+		ThreadCount: task.ThreadCount,
+		RetryCount:  task.RetryCount,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("download subtitles: %w", err)
+	}
+	if err := p.decryptSegments(ctx, task, playlist, tmpDir, state.sessionKeys); err != nil {
+		return fmt.Errorf("decrypt subtitles: %w", err)
+	}
+
+	if task.NoMerge {
+		return nil
+	}
+
+	sorted := make([]model.Segment, len(playlist.Segments))
+	copy(sorted, playlist.Segments)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	var segments []*subtitle.Segment
+	for _, seg := range sorted {
+		data, err := os.ReadFile(downloader.SegmentFilePath(tmpDir, seg.Index))
+		if err != nil {
+			return fmt.Errorf("read subtitle segment %d: %w", seg.Index, err)
+		}
+		vtt, err := subtitle.ParseWebVTT(data)
+		if err != nil {
+			return fmt.Errorf("parse subtitle segment %d: %w", seg.Index, err)
+		}
+		segments = append(segments, vtt)
+	}
+	origin := cueOrigin(segments, starts[sorted[0].Index])
+	cues := retime(subtitle.Stitch(segments), origin, start, dropped, duration)
+
+	saveDir := outputDir(task)
+	if err := os.MkdirAll(saveDir, 0o755); err != nil {
+		return fmt.Errorf("create save dir: %w", err)
+	}
+	output := filepath.Join(saveDir, name+"."+format)
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("create subtitle output: %w", err)
+	}
+	if format == "srt" {
+		err = subtitle.WriteSRT(f, cues)
+	} else {
+		err = subtitle.WriteVTT(f, cues)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write subtitle output: %w", err)
+	}
+	p.logf("[subtitle] output: %s (%d cues)", name+"."+format, len(cues))
+
+	if task.DelAfterDone {
+		os.RemoveAll(tmpDir)
+	}
+	return nil
+}
+
+// span is a stretch of a playlist timeline, in seconds.
+type span struct {
+	Start, End float64
+}
+
+// segmentStarts returns the start of each segment on the playlist
+// timeline by Index, before any segment is trimmed or dropped.
+func segmentStarts(segs []model.Segment) map[int]float64 {
+	starts := make(map[int]float64, len(segs))
+	var pos float64
+	for _, seg := range segs {
+		starts[seg.Index] = pos
+		pos += seg.Duration
+	}
+	return starts
+}
+
+// outputStart returns where the output written from the remaining
+// segments of playlist begins on the playlist timeline: at its first
+// segment, or inside it after a precise cut.
+func outputStart(task *model.Task, playlist *model.Playlist, starts map[int]float64, cut *timeCut) float64 {
+	if len(playlist.Segments) == 0 {
+		return 0
+	}
+	start := starts[playlist.Segments[0].Index]
+	if cut != nil && task.PreciseCut {
+		start += cut.Start
+	}
+	return start
+}
+
+// adSpans returns the playlist timeline spans of the ad segments in segs.
+func adSpans(segs []model.Segment, starts map[int]float64) []span {
+	var spans []span
+	for _, seg := range segs {
+		if seg.Ad {
+			start := starts[seg.Index]
+			spans = append(spans, span{start, start + seg.Duration})
+		}
+	}
+	return spans
+}
+
+// cueOrigin returns where on the playlist timeline the stitched cues of
+// segs are timed from, given the start of the first of them. Segments that
+// share one X-TIMESTAMP-MAP, or have none, carry cue times from the start
+// of the presentation, as packagers usually write them; segments mapped
+// each to their own start carry times from the first one.
+func cueOrigin(segs []*subtitle.Segment, first float64) float64 {
+	for _, seg := range segs[1:] {
+		if seg.HasTimestampMap != segs[0].HasTimestampMap || seg.MPEGTS != segs[0].MPEGTS || seg.Local != segs[0].Local {
+			return first
+		}
+	}
+	return 0
+}
+
+// retime moves cues timed from first on the playlist timeline onto an
+// output that begins at start and leaves out the dropped spans. Cues
+// outside the output are removed and those crossing its edges clipped;
+// duration 0 leaves the end of the output open.
+func retime(cues []subtitle.Cue, first, start float64, dropped []span, duration float64) []subtitle.Cue {
+	// at maps a playlist time to output time
+	at := func(t float64) float64 {
+		out := t - start
+		for _, s := range dropped {
+			out -= max(min(s.End, t)-max(s.Start, start), 0)
+		}
+		return out
+	}
+	toTime := func(sec float64) time.Duration {
+		return time.Duration(math.Round(sec*1000)) * time.Millisecond
+	}
+
+	var out []subtitle.Cue
+	for _, c := range cues {
+		from := at(first + c.Start.Seconds())
+		to := at(first + c.End.Seconds())
+		from = max(from, 0)
+		if duration > 0 {
+			to = min(to, duration)
+		}
+		if to <= from {
+			continue
+		}
+		c.Start, c.End = toTime(from), toTime(to)
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,309 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/dash"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+	"github.com/caorushizi/mediago-core/internal/subtitle"
+)
+
+func TestPipeline_WebVTTSubtitles(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subs/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Deutsch",LANGUAGE="de",URI="subs/de.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,SUBTITLES="subs"
+video.m3u8
+`)
+	})
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nv0.m4s\n#EXTINF:6.0,\nv1.m4s\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/v0.m4s", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("V0")) })
+	mux.HandleFunc("/v1.m4s", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("V1")) })
+	for _, lang := range []string{"en", "de"} {
+		mux.HandleFunc("/subs/"+lang+".m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\n"+lang+"0.vtt\n#EXTINF:6.0,\n"+lang+"1.vtt\n#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/subs/"+lang+"0.vtt", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:04.000 --> 00:00:06.000\n"+lang+" one\n")
+		})
+		mux.HandleFunc("/subs/"+lang+"1.vtt", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1440000,LOCAL:00:00:00.000\n\n00:00:00.000 --> 00:00:01.000\n"+lang+" one\n\n00:00:02.000 --> 00:00:03.000\n"+lang+" two\n")
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:            server.URL + "/master.m3u8",
+		SaveDir:        saveDir,
+		SaveName:       "movie",
+		TmpDir:         t.TempDir(),
+		ThreadCount:    2,
+		RetryCount:     1,
+		BinaryMerge:    true,
+		SubtitleFormat: "srt",
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, lang := range []string{"en", "de"} {
+		data, err := os.ReadFile(filepath.Join(saveDir, "movie."+lang+".srt"))
+		if err != nil {
+			t.Fatalf("%s subtitles missing: %v", lang, err)
+		}
+		want := "1\n00:00:04,000 --> 00:00:07,000\n" + lang + " one\n\n2\n00:00:08,000 --> 00:00:09,000\n" + lang + " two\n"
+		if string(data) != want {
+			t.Errorf("%s subtitles:\n%s\nwant:\n%s", lang, data, want)
+		}
+	}
+
+	video, _ := os.ReadFile(filepath.Join(saveDir, "movie.mp4"))
+	if string(video) != "V0V1" {
+		t.Errorf("video output: got %q", video)
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, "movie_sub.mp4")); !os.IsNotExist(err) {
+		t.Error("subtitles should no longer go through the segment merger")
+	}
+}
+
+func TestPipeline_SubtitlesFollowTrimAndAds(t *testing.T) {
+	// Video: 3 segments of 6s, the middle one an ad break. Subtitles: 6
+	// segments of 3s, each with one cue 1s into it, the same two in the
+	// ad break.
+	video := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nv0.ts\n#EXT-X-CUE-OUT:6\n#EXTINF:6.0,\nv1.ts\n#EXT-X-CUE-IN\n#EXTINF:6.0,\nv2.ts\n#EXT-X-ENDLIST\n"
+	subs := "#EXTM3U\n#EXT-X-TARGETDURATION:3\n"
+	for i := range 6 {
+		switch i {
+		case 2:
+			subs += "#EXT-X-CUE-OUT:6\n"
+		case 4:
+			subs += "#EXT-X-CUE-IN\n"
+		}
+		subs += fmt.Sprintf("#EXTINF:3.0,\ns%d.vtt\n", i)
+	}
+	subs += "#EXT-X-ENDLIST\n"
+
+	// Subtitle segments are timed either each from its own start or all
+	// from the start of the presentation
+	var presentationTimes atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,SUBTITLES="subs"
+video.m3u8
+`)
+	})
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, video) })
+	mux.HandleFunc("/subs.m3u8", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, subs) })
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		var i int
+		if _, err := fmt.Sscanf(name, "s%d.vtt", &i); err != nil {
+			fmt.Fprint(w, name)
+			return
+		}
+		if presentationTimes.Load() {
+			// One map for all segments, cues timed from the start
+			fmt.Fprintf(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:%02d.000 --> 00:00:%02d.000\ncue %d\n", i*3+1, i*3+2, i)
+			return
+		}
+		fmt.Fprintf(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.000\ncue %d\n", 900000+i*270000, i)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		setup func(*model.Task)
+		want  string
+	}{
+		{
+			name:  "full",
+			setup: func(*model.Task) {},
+			want:  "0:01-0:02 cue 0|0:04-0:05 cue 1|0:07-0:08 cue 2|0:10-0:11 cue 3|0:13-0:14 cue 4|0:16-0:17 cue 5",
+		},
+		{
+			// The video starts at its second segment, 6s in
+			name:  "time range",
+			setup: func(task *model.Task) { task.Start, task.End = "7", "12" },
+			want:  "0:01-0:02 cue 2|0:04-0:05 cue 3",
+		},
+		{
+			name:  "ads dropped",
+			setup: func(task *model.Task) { task.AdMode = model.AdsDrop },
+			want:  "0:01-0:02 cue 0|0:04-0:05 cue 1|0:07-0:08 cue 4|0:10-0:11 cue 5",
+		},
+		{
+			// The video keeps its first segment, the subtitles from 3s
+			name:  "time range and ads dropped",
+			setup: func(task *model.Task) { task.Start, task.AdMode = "5", model.AdsDrop },
+			want:  "0:04-0:05 cue 1|0:07-0:08 cue 4|0:10-0:11 cue 5",
+		},
+	}
+	for _, layout := range []string{"segment times", "presentation times"} {
+		presentationTimes.Store(layout == "presentation times")
+		for _, tt := range tests {
+			t.Run(layout+"/"+tt.name, func(t *testing.T) {
+				saveDir := t.TempDir()
+				pipe := &Pipeline{
+					Parser:     &hls.Parser{Client: server.Client()},
+					Downloader: &downloader.HTTPDownloader{},
+				}
+				task := &model.Task{
+					URL:         server.URL + "/master.m3u8",
+					SaveDir:     saveDir,
+					SaveName:    "movie",
+					TmpDir:      t.TempDir(),
+					ThreadCount: 2,
+					RetryCount:  1,
+					BinaryMerge: true,
+				}
+				tt.setup(task)
+				if err := pipe.Run(context.Background(), task, nil); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				data, err := os.ReadFile(filepath.Join(saveDir, "movie.en.vtt"))
+				if err != nil {
+					t.Fatalf("subtitles missing: %v", err)
+				}
+				var got []string
+				for _, block := range strings.Split(strings.TrimSpace(string(data)), "\n\n")[1:] {
+					var from, to, text string
+					lines := strings.Split(block, "\n")
+					fmt.Sscanf(lines[0], "00:0%s --> 00:0%s", &from, &to)
+					text = lines[1]
+					got = append(got, strings.TrimSuffix(from, ".000")+"-"+strings.TrimSuffix(to, ".000")+" "+text)
+				}
+				if strings.Join(got, "|") != tt.want {
+					t.Errorf("cues:\n got %s\nwant %s\nfile:\n%s", strings.Join(got, "|"), tt.want, data)
+				}
+			})
+		}
+	}
+}
+
+func TestPipeline_DASHStppSubtitles(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.mpd", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT4S">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v" bandwidth="1000000">
+        <SegmentTemplate media="v$Number$.m4s" initialization="v_init.mp4" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet contentType="text" mimeType="application/mp4" codecs="stpp" lang="en">
+      <Representation id="t" bandwidth="1000">
+        <SegmentTemplate media="t$Number$.m4s" initialization="t_init.mp4" duration="2"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.ToUpper(strings.TrimSuffix(path.Base(r.URL.Path), ".m4s")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &dash.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/manifest.mpd",
+		SaveDir:     saveDir,
+		SaveName:    "movie",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+		BinaryMerge: true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// TTML in fMP4 is merged with its init section, not parsed as WebVTT
+	for name, want := range map[string]string{
+		"movie.mp4":   "V_INIT.MP4V1V2",
+		"movie_1.mp4": "T_INIT.MP4T1T2",
+	} {
+		data, err := os.ReadFile(filepath.Join(saveDir, name))
+		if err != nil {
+			t.Fatalf("%s missing: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestSubtitleName(t *testing.T) {
+	used := make(map[string]bool)
+	names := []string{
+		subtitleName("out", &model.StreamSpec{Language: "en"}, used),
+		subtitleName("out", &model.StreamSpec{Language: "en", Name: "English SDH"}, used),
+		subtitleName("out", &model.StreamSpec{Name: "Commentary"}, used),
+		subtitleName("out", &model.StreamSpec{}, used),
+	}
+	if fmt.Sprint(names) != "[out.en out.en_2 out.Commentary out.sub]" {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestRetime(t *testing.T) {
+	cue := func(from, to float64) subtitle.Cue {
+		return subtitle.Cue{Start: time.Duration(from * float64(time.Second)), End: time.Duration(to * float64(time.Second))}
+	}
+	cues := []subtitle.Cue{cue(0, 1), cue(2, 4), cue(5, 6), cue(9, 11)}
+	tests := []struct {
+		name     string
+		first    float64
+		start    float64
+		dropped  []span
+		duration float64
+		want     string
+	}{
+		{name: "unchanged", want: "[0s-1s 2s-4s 5s-6s 9s-11s]"},
+		{name: "timed from a later segment", first: 10, start: 12, want: "[0s-2s 3s-4s 7s-9s]"},
+		{name: "precise cut", start: 3, duration: 6, want: "[0s-1s 2s-3s]"},
+		{name: "dropped span", dropped: []span{{4.5, 8}}, want: "[0s-1s 2s-4s 5.5s-7.5s]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range retime(cues, tt.first, tt.start, tt.dropped, tt.duration) {
+				got = append(got, fmt.Sprintf("%v-%v", c.Start, c.End))
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
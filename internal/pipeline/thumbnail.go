@@ -0,0 +1,250 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/merger"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/subtitle"
+)
+
+// thumbnailStream picks the stream for thumbnail mode: the image stream
+// with the highest bandwidth (the largest tiles), or else the I-frame
+// stream with the lowest bandwidth, which is the cheapest to download.
+// A lone media playlist is used if it is itself I-frame or image only.
+// Streams whose playlist is not fetched yet are judged by type alone.
+func thumbnailStream(streams []model.StreamSpec) *model.StreamSpec {
+	var image, iframe *model.StreamSpec
+	for i := range streams {
+		s := &streams[i]
+		pl := s.Playlist
+		if pl == nil && s.URL == "" || pl != nil && len(pl.Segments) == 0 {
+			continue
+		}
+		switch {
+		case s.MediaType == model.MediaImage || pl != nil && pl.ImagesOnly:
+			if image == nil || s.Bandwidth > image.Bandwidth {
+				image = s
+			}
+		case s.MediaType == model.MediaIFrame || pl != nil && pl.IFramesOnly:
+			if iframe == nil || s.Bandwidth < iframe.Bandwidth {
+				iframe = s
+			}
+		}
+	}
+	if image != nil {
+		return image
+	}
+	return iframe
+}
+
+// processThumbnails downloads an image or I-frame stream and saves one
+// JPEG per image segment or I-frame in <name>_thumbs, along with a
+// thumbnails.vtt track mapping media time to each thumbnail.
+func (p *Pipeline) processThumbnails(ctx context.Context, task *model.Task, stream *model.StreamSpec, outputName string, sessionKeys map[string][]byte) error {
+	playlist := stream.Playlist
+	images := stream.MediaType == model.MediaImage || playlist.ImagesOnly
+
+	// Cue times stay on the source timeline when a range is selected
+	starts := make(map[int]float64, len(playlist.Segments))
+	var pos float64
+	for _, seg := range playlist.Segments {
+		starts[seg.Index] = pos
+		pos += seg.Duration
+	}
+	if _, err := p.trimPlaylist(task, playlist); err != nil {
+		return err
+	}
+	if n := playlist.DropGaps(); n > 0 {
+		p.logf("[thumbnail] skipping %d gap segments", n)
+	}
+
+	name := outputName + "_thumbs"
+	tmpDir := filepath.Join(os.TempDir(), "mediago", name)
+	if task.TmpDir != "" {
+		tmpDir = filepath.Join(task.TmpDir, name)
+	}
+
+	kind := "iframe"
+	if images {
+		kind = "image"
+	}
+	p.logf("[thumbnail] %s stream: %d segments", kind, len(playlist.Segments))
+
+	var segs []model.Segment
+	for _, init := range playlist.Inits() {
+		segs = append(segs, *init)
+	}
+	segs = append(segs, playlist.Segments...)
+	err := p.Downloader.Download(ctx, segs, downloader.Options{
+		TmpDir:      tmpDir,
+		Headers:     task.Headers,
+		Proxy:       task.Proxy,
+		Timeout:     task.Timeout,
+		ThreadCount: task.ThreadCount,
+		RetryCount:  task.RetryCount,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("download thumbnails: %w", err)
+	}
+	if err := p.decryptSegments(ctx, task, playlist, tmpDir, sessionKeys); err != nil {
+		return fmt.Errorf("decrypt thumbnails: %w", err)
+	}
+
+	if task.NoMerge {
+		return nil
+	}
+
+	outDir := filepath.Join(outputDir(task), name)
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return fmt.Errorf("create thumbnail dir: %w", err)
+	}
+
+	sorted := make([]model.Segment, len(playlist.Segments))
+	copy(sorted, playlist.Segments)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	var cues []subtitle.Cue
+	if images {
+		cues, err = saveImageThumbnails(sorted, starts, tmpDir, outDir)
+	} else {
+		cues, err = p.extractIFrames(ctx, task, playlist.MediaInit, sorted, starts, tmpDir, outDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(outDir, "thumbnails.vtt"))
+	if err != nil {
+		return fmt.Errorf("create thumbnail track: %w", err)
+	}
+	err = subtitle.WriteVTT(f, cues)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write thumbnail track: %w", err)
+	}
+	p.logf("[thumbnail] output: %s (%d thumbnails)", name, len(cues))
+
+	if task.DelAfterDone {
+		os.RemoveAll(tmpDir)
+	}
+	return nil
+}
+
+// saveImageThumbnails copies image segments to outDir and returns one cue
+// per tile, addressing it with a #xywh media fragment when the segment is
+// a tile sheet of known resolution.
+func saveImageThumbnails(segs []model.Segment, starts map[int]float64, tmpDir, outDir string) ([]subtitle.Cue, error) {
+	var cues []subtitle.Cue
+	for i, seg := range segs {
+		file := fmt.Sprintf("%04d%s", i+1, imageExt(seg.URL))
+		data, err := os.ReadFile(downloader.SegmentFilePath(tmpDir, seg.Index))
+		if err != nil {
+			return nil, fmt.Errorf("read image segment %d: %w", seg.Index, err)
+		}
+		if err := os.WriteFile(filepath.Join(outDir, file), data, 0o644); err != nil {
+			return nil, fmt.Errorf("write thumbnail: %w", err)
+		}
+
+		segStart := starts[seg.Index]
+		segEnd := segStart + seg.Duration
+		w, h := parseResolution(seg.Tiles)
+		if w == 0 || h == 0 {
+			cues = append(cues, thumbnailCue(segStart, segEnd, file))
+			continue
+		}
+
+		tiles := seg.Tiles
+		count := tiles.Columns * tiles.Rows
+		tileDur := tiles.Duration
+		if tileDur <= 0 {
+			tileDur = seg.Duration / float64(count)
+		}
+		for n := 0; n < count; n++ {
+			start := segStart + float64(n)*tileDur
+			if start >= segEnd {
+				break
+			}
+			end := min(start+tileDur, segEnd)
+			x, y := n%tiles.Columns*w, n/tiles.Columns*h
+			cues = append(cues, thumbnailCue(start, end, fmt.Sprintf("%s#xywh=%d,%d,%d,%d", file, x, y, w, h)))
+		}
+	}
+	return cues, nil
+}
+
+// extractIFrames joins the I-frame byte ranges behind their init section
+// and decodes them to one JPEG per I-frame with ffmpeg.
+func (p *Pipeline) extractIFrames(ctx context.Context, task *model.Task, init *model.Segment, segs []model.Segment, starts map[int]float64, tmpDir, outDir string) ([]subtitle.Cue, error) {
+	ext := ".ts"
+	if init != nil {
+		ext = ".mp4"
+	}
+	joined := filepath.Join(tmpDir, "iframes"+ext)
+	if err := (&merger.BinaryMerger{}).Merge(ctx, segmentFiles(init, segs, tmpDir), joined); err != nil {
+		return nil, fmt.Errorf("join I-frames: %w", err)
+	}
+
+	ffmpeg := &merger.FFmpegMerger{FFmpegPath: task.FfmpegPath}
+	if err := ffmpeg.ExtractFrames(ctx, joined, filepath.Join(outDir, "%04d.jpg")); err != nil {
+		return nil, err
+	}
+
+	cues := make([]subtitle.Cue, 0, len(segs))
+	for i, seg := range segs {
+		start := starts[seg.Index]
+		cues = append(cues, thumbnailCue(start, start+seg.Duration, fmt.Sprintf("%04d.jpg", i+1)))
+	}
+	return cues, nil
+}
+
+func thumbnailCue(start, end float64, text string) subtitle.Cue {
+	return subtitle.Cue{
+		Start: time.Duration(start * float64(time.Second)),
+		End:   time.Duration(end * float64(time.Second)),
+		Text:  text,
+	}
+}
+
+// parseResolution returns the tile size of a thumbnail sheet, or zeros.
+func parseResolution(tiles *model.Tiles) (int, int) {
+	if tiles == nil {
+		return 0, 0
+	}
+	ws, hs, ok := strings.Cut(tiles.Resolution, "x")
+	if !ok {
+		return 0, 0
+	}
+	w, _ := strconv.Atoi(ws)
+	h, _ := strconv.Atoi(hs)
+	return w, h
+}
+
+// imageExt returns the file extension of an image segment URL, defaulting
+// to .jpg.
+func imageExt(rawURL string) string {
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		p = u.Path
+	}
+	switch ext := strings.ToLower(path.Ext(p)); ext {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return ext
+	default:
+		return ".jpg"
+	}
+}
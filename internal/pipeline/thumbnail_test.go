@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+const trickPlayMaster = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720
+video.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=640x360,URI="iframe.m3u8"
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=40000,RESOLUTION=320x180,URI="iframe_low.m3u8"
+`
+
+func newTrickPlayServer(t *testing.T, master string, requests *[]string) *httptest.Server {
+	var mu sync.Mutex
+	media := bytes.Repeat([]byte("0123456789"), 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*requests = append(*requests, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/master.m3u8":
+			fmt.Fprint(w, master)
+		case "/video.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.0,\nv0.ts\n#EXT-X-ENDLIST\n")
+		case "/iframe.m3u8", "/iframe_low.m3u8":
+			fmt.Fprint(w, `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-I-FRAMES-ONLY
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:10@0
+main.mp4
+#EXTINF:6.0,
+#EXT-X-BYTERANGE:5@50
+main.mp4
+#EXT-X-ENDLIST
+`)
+		case "/tiles.m3u8":
+			fmt.Fprint(w, `#EXTM3U
+#EXT-X-TARGETDURATION:20
+#EXT-X-IMAGES-ONLY
+#EXTINF:20.0,
+#EXT-X-TILES:RESOLUTION=160x90,LAYOUT=2x2,DURATION=5.0
+tile1.jpg
+#EXTINF:7.0,
+#EXT-X-TILES:RESOLUTION=160x90,LAYOUT=2x2,DURATION=5.0
+tile2.jpg
+#EXT-X-ENDLIST
+`)
+		case "/init.mp4":
+			w.Write([]byte("INIT"))
+		case "/main.mp4":
+			http.ServeContent(w, r, "main.mp4", time.Time{}, bytes.NewReader(media))
+		case "/tile1.jpg", "/tile2.jpg":
+			w.Write([]byte("JPEG" + r.URL.Path))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPipeline_Thumbnails_ImageTiles(t *testing.T) {
+	var requests []string
+	master := trickPlayMaster + "#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=10000,RESOLUTION=320x180,CODECS=\"jpeg\",URI=\"tiles.m3u8\"\n"
+	server := newTrickPlayServer(t, master, &requests)
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/master.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "review",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+		Thumbnails:  true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, r := range requests {
+		if r == "/v0.ts" || r == "/main.mp4" {
+			t.Errorf("thumbnail mode downloaded %s", r)
+		}
+	}
+
+	outDir := filepath.Join(saveDir, "review_thumbs")
+	if data, _ := os.ReadFile(filepath.Join(outDir, "0002.jpg")); string(data) != "JPEG/tile2.jpg" {
+		t.Errorf("0002.jpg: %q", data)
+	}
+	vtt, err := os.ReadFile(filepath.Join(outDir, "thumbnails.vtt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `WEBVTT
+
+00:00:00.000 --> 00:00:05.000
+0001.jpg#xywh=0,0,160,90
+
+00:00:05.000 --> 00:00:10.000
+0001.jpg#xywh=160,0,160,90
+
+00:00:10.000 --> 00:00:15.000
+0001.jpg#xywh=0,90,160,90
+
+00:00:15.000 --> 00:00:20.000
+0001.jpg#xywh=160,90,160,90
+
+00:00:20.000 --> 00:00:25.000
+0002.jpg#xywh=0,0,160,90
+
+00:00:25.000 --> 00:00:27.000
+0002.jpg#xywh=160,0,160,90
+`
+	if string(vtt) != want {
+		t.Errorf("thumbnails.vtt:\n%s\nwant:\n%s", vtt, want)
+	}
+}
+
+func TestPipeline_Thumbnails_IFrames(t *testing.T) {
+	var requests []string
+	server := newTrickPlayServer(t, trickPlayMaster, &requests)
+
+	// Fake ffmpeg that records its arguments and keeps a copy of the input
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	inputCopy := filepath.Join(dir, "input")
+	fakeFFmpeg := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\ncp \"$3\" %s\n", argsFile, inputCopy)
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/master.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "review",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 2,
+		RetryCount:  1,
+		FfmpegPath:  fakeFFmpeg,
+		Thumbnails:  true,
+		Start:       "5",
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only the low bandwidth I-frame stream's second range is fetched
+	input, _ := os.ReadFile(inputCopy)
+	if string(input) != "INIT01234" {
+		t.Errorf("joined I-frames: %q", input)
+	}
+	args, _ := os.ReadFile(argsFile)
+	outDir := filepath.Join(saveDir, "review_thumbs")
+	if !strings.HasSuffix(strings.TrimSpace(string(args)), filepath.Join(outDir, "%04d.jpg")) {
+		t.Errorf("ffmpeg args: %s", args)
+	}
+	vtt, _ := os.ReadFile(filepath.Join(outDir, "thumbnails.vtt"))
+	if string(vtt) != "WEBVTT\n\n00:00:04.000 --> 00:00:10.000\n0001.jpg\n" {
+		t.Errorf("thumbnails.vtt:\n%s", vtt)
+	}
+}
+
+func TestPipeline_Thumbnails_NoTrickPlayStream(t *testing.T) {
+	var requests []string
+	server := newTrickPlayServer(t, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nvideo.m3u8\n", &requests)
+
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{URL: server.URL + "/master.m3u8", SaveDir: t.TempDir(), Thumbnails: true}
+	err := pipe.Run(context.Background(), task, nil)
+	if err == nil || !strings.Contains(err.Error(), "no I-frame or image stream") {
+		t.Errorf("expected missing stream error, got %v", err)
+	}
+}
+
+func TestSelectStreams_SkipsTrickPlay(t *testing.T) {
+	streams := []model.StreamSpec{
+		{MediaType: model.MediaVideo, Bandwidth: 1000},
+		{MediaType: model.MediaIFrame, Bandwidth: 100},
+		{MediaType: model.MediaImage, Bandwidth: 10},
+	}
+	got := selectStreams(streams, &model.Task{})
+	if len(got) != 1 || got[0].MediaType != model.MediaVideo {
+		t.Errorf("got %+v", got)
+	}
+}
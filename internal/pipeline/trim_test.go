@@ -0,0 +1,236 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caorushizi/mediago-core/internal/downloader"
+	"github.com/caorushizi/mediago-core/internal/model"
+	"github.com/caorushizi/mediago-core/internal/parser/dash"
+	"github.com/caorushizi/mediago-core/internal/parser/hls"
+)
+
+func TestParseMediaTime(t *testing.T) {
+	tests := map[string]float64{
+		"90":         90,
+		"12.5":       12.5,
+		"01:30":      90,
+		"1:02:03.25": 3723.25,
+		"1h30m":      5400,
+	}
+	for in, want := range tests {
+		got, err := parseMediaTime(in)
+		if err != nil || got != want {
+			t.Errorf("parseMediaTime(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"", "abc", "-5", "1.5:30", "1:2:3:4"} {
+		if _, err := parseMediaTime(bad); err == nil {
+			t.Errorf("parseMediaTime(%q): expected error", bad)
+		}
+	}
+}
+
+func TestTrimPlaylist(t *testing.T) {
+	playlist := &model.Playlist{}
+	for i := 0; i < 6; i++ {
+		playlist.Segments = append(playlist.Segments, model.Segment{Index: i, Duration: 10, Discontinuity: i / 4})
+	}
+
+	cut, err := (&Pipeline{}).trimPlaylist(&model.Task{Start: "25", End: "00:42"}, playlist)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var kept []int
+	for _, seg := range playlist.Segments {
+		kept = append(kept, seg.Index)
+	}
+	if fmt.Sprint(kept) != "[2 3 4]" {
+		t.Errorf("kept segments: got %v", kept)
+	}
+	if playlist.TotalDuration != 30 || fmt.Sprint(playlist.Discontinuities) != "[2]" {
+		t.Errorf("total=%v discontinuities=%v", playlist.TotalDuration, playlist.Discontinuities)
+	}
+	if cut.Start != 5 || cut.Duration != 17 {
+		t.Errorf("cut: got %+v", cut)
+	}
+}
+
+func TestTrimPlaylist_Errors(t *testing.T) {
+	newPlaylist := func() *model.Playlist {
+		return &model.Playlist{Segments: []model.Segment{{Index: 0, Duration: 10}}}
+	}
+	tasks := map[string]*model.Task{
+		"end before start": {Start: "30", End: "20"},
+		"past the end":     {Start: "60"},
+		"bad start":        {Start: "soon"},
+	}
+	for name, task := range tasks {
+		if _, err := (&Pipeline{}).trimPlaylist(task, newPlaylist()); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	cut, err := (&Pipeline{}).trimPlaylist(&model.Task{}, newPlaylist())
+	if err != nil || cut != nil {
+		t.Errorf("no range: got %+v, %v", cut, err)
+	}
+}
+
+func TestTrimPlaylist_DASHTemplate(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT3H">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="v1" bandwidth="1000000">
+        <SegmentTemplate media="v_$Number$.m4s" initialization="v_init.mp4" duration="4" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := dash.ParseMPD(mpd, "https://example.com/manifest.mpd")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	playlist := result.Streams[0].Playlist
+
+	// Five minutes from the one-hour mark
+	if _, err := (&Pipeline{}).trimPlaylist(&model.Task{Start: "01:00:00", End: "01:05:00"}, playlist); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	segs := playlist.Segments
+	if len(segs) != 75 {
+		t.Fatalf("expected 75 segments, got %d", len(segs))
+	}
+	if segs[0].URL != "https://example.com/v_901.m4s" || segs[74].URL != "https://example.com/v_975.m4s" {
+		t.Errorf("unexpected range: %s .. %s", segs[0].URL, segs[74].URL)
+	}
+}
+
+func TestPipeline_TimeRangeWithPreciseCut(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "#EXTINF:10.0,\nseg%d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	})
+	var (
+		mu        sync.Mutex
+		requested []string
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(strings.ToUpper(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Fake ffmpeg that records its arguments and copies the input through
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	fakeFFmpeg := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nwhile [ \"$1\" != \"-i\" ]; do shift; done\nin=$2\nfor a; do out=$a; done\ncp \"$in\" \"$out\"\n", argsFile)
+	if err := os.WriteFile(fakeFFmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	saveDir := t.TempDir()
+	pipe := &Pipeline{
+		Parser:     &hls.Parser{Client: server.Client()},
+		Downloader: &downloader.HTTPDownloader{},
+	}
+	task := &model.Task{
+		URL:         server.URL + "/video.m3u8",
+		SaveDir:     saveDir,
+		SaveName:    "clip",
+		TmpDir:      t.TempDir(),
+		ThreadCount: 1,
+		RetryCount:  1,
+		BinaryMerge: true,
+		FfmpegPath:  fakeFFmpeg,
+		Start:       "15",
+		End:         "28.5",
+		PreciseCut:  true,
+	}
+	if err := pipe.Run(context.Background(), task, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sort.Strings(requested)
+	if fmt.Sprint(requested) != "[/seg1.ts /seg2.ts]" {
+		t.Errorf("expected only overlapping segments to be fetched, got %v", requested)
+	}
+	data, _ := os.ReadFile(filepath.Join(saveDir, "clip.mp4"))
+	if string(data) != "SEG1SEG2" {
+		t.Errorf("output: got %q", data)
+	}
+	args, _ := os.ReadFile(argsFile)
+	if !strings.HasPrefix(string(args), "-y -ss 5.000 -i ") || !strings.Contains(string(args), "-t 13.500") {
+		t.Errorf("ffmpeg args: %s", args)
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, "clip.trim.mp4")); !os.IsNotExist(err) {
+		t.Error("expected trimmed temp file to be renamed over the output")
+	}
+}
+
+func TestTrimPlaylist_WallClock(t *testing.T) {
+	base := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	newPlaylist := func() *model.Playlist {
+		playlist := &model.Playlist{}
+		for i := 0; i < 40; i++ {
+			playlist.Segments = append(playlist.Segments, model.Segment{
+				Index:           i,
+				Duration:        60,
+				ProgramDateTime: base.Add(time.Duration(i) * time.Minute),
+			})
+		}
+		return playlist
+	}
+
+	// "14:02 to 14:17 UTC", asked for in a different zone
+	playlist := newPlaylist()
+	task := &model.Task{FromTime: "2024-05-01T16:02:30+02:00", ToTime: "2024-05-01T14:17:00Z"}
+	cut, err := (&Pipeline{}).trimPlaylist(task, playlist)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	segs := playlist.Segments
+	if len(segs) != 15 || segs[0].Index != 2 || segs[14].Index != 16 {
+		t.Errorf("kept %d segments, %d..%d", len(segs), segs[0].Index, segs[len(segs)-1].Index)
+	}
+	if cut.Start != 30 || cut.Duration != 14*60+30 {
+		t.Errorf("cut: got %+v", cut)
+	}
+
+	errTasks := map[string]*model.Task{
+		"mixed with start": {FromTime: "2024-05-01T14:02:00Z", Start: "10"},
+		"bad format":       {FromTime: "14:02"},
+		"to before from":   {FromTime: "2024-05-01T14:02:00Z", ToTime: "2024-05-01T14:01:00Z"},
+		"outside window":   {FromTime: "2024-05-02T00:00:00Z"},
+	}
+	for name, task := range errTasks {
+		if _, err := (&Pipeline{}).trimPlaylist(task, newPlaylist()); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	noPDT := &model.Playlist{Segments: []model.Segment{{Index: 0, Duration: 6}}}
+	if _, err := (&Pipeline{}).trimPlaylist(&model.Task{FromTime: "2024-05-01T14:02:00Z"}, noPDT); err == nil {
+		t.Error("expected error for a stream without program date times")
+	}
+}
@@ -0,0 +1,243 @@
+package subtitle
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is a single timed subtitle cue.
+type Cue struct {
+	ID       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string // WebVTT cue settings after the timing, e.g. "line:90%"
+	Text     string
+}
+
+// Segment is one parsed WebVTT file, usually one HLS subtitle segment.
+type Segment struct {
+	Cues []Cue
+	// MPEGTS and Local come from X-TIMESTAMP-MAP, which ties the cue
+	// timeline to the 90kHz MPEG-TS clock of the video.
+	HasTimestampMap bool
+	MPEGTS          int64
+	Local           time.Duration
+}
+
+// ParseWebVTT parses a WebVTT file.
+func ParseWebVTT(data []byte) (*Segment, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if !strings.HasPrefix(text, "WEBVTT") {
+		return nil, fmt.Errorf("not a WebVTT file")
+	}
+
+	seg := &Segment{}
+	blocks := strings.Split(text, "\n\n")
+
+	// Header block: WEBVTT line plus metadata such as X-TIMESTAMP-MAP
+	for _, line := range strings.Split(blocks[0], "\n") {
+		if v, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP="); ok {
+			if err := seg.parseTimestampMap(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if len(lines) == 0 || lines[0] == "" {
+			continue
+		}
+		if strings.HasPrefix(lines[0], "NOTE") || lines[0] == "STYLE" || lines[0] == "REGION" {
+			continue
+		}
+
+		cue := Cue{}
+		if !strings.Contains(lines[0], "-->") {
+			cue.ID = lines[0]
+			lines = lines[1:]
+			if len(lines) == 0 {
+				continue
+			}
+		}
+		if err := cue.parseTiming(lines[0]); err != nil {
+			return nil, err
+		}
+		cue.Text = strings.Join(lines[1:], "\n")
+		seg.Cues = append(seg.Cues, cue)
+	}
+	return seg, nil
+}
+
+func (s *Segment) parseTimestampMap(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(part), ":")
+		switch key {
+		case "MPEGTS":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("X-TIMESTAMP-MAP MPEGTS: %w", err)
+			}
+			s.MPEGTS = n
+		case "LOCAL":
+			d, err := parseTimestamp(val)
+			if err != nil {
+				return fmt.Errorf("X-TIMESTAMP-MAP LOCAL: %w", err)
+			}
+			s.Local = d
+		}
+	}
+	s.HasTimestampMap = true
+	return nil
+}
+
+func (c *Cue) parseTiming(line string) error {
+	start, rest, ok := strings.Cut(line, "-->")
+	if !ok {
+		return fmt.Errorf("invalid cue timing %q", line)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return fmt.Errorf("invalid cue timing %q", line)
+	}
+
+	var err error
+	if c.Start, err = parseTimestamp(strings.TrimSpace(start)); err != nil {
+		return err
+	}
+	if c.End, err = parseTimestamp(fields[0]); err != nil {
+		return err
+	}
+	c.Settings = strings.Join(fields[1:], " ")
+	return nil
+}
+
+// parseTimestamp parses "hh:mm:ss.ttt" or "mm:ss.ttt".
+func parseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var minutes int64
+	for _, p := range parts[:len(parts)-1] {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		minutes = minutes*60 + n
+	}
+	sec, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || sec < 0 || sec >= 60 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(math.Round(sec*1000))*time.Millisecond, nil
+}
+
+// mpegTSWrap is the 33-bit MPEG-TS timestamp range.
+const mpegTSWrap = 1 << 33
+
+// Stitch combines segments into one cue list on a timeline starting at the
+// first segment's X-TIMESTAMP-MAP: cue times are moved by each segment's
+// MPEGTS/LOCAL offset relative to the first one. Cues repeated across
+// segment boundaries are removed, and cues with the same text that continue
+// one another are joined.
+func Stitch(segments []*Segment) []Cue {
+	var (
+		cues    []Cue
+		base    int64
+		hasBase bool
+	)
+	for _, seg := range segments {
+		var offset time.Duration
+		if seg.HasTimestampMap {
+			if !hasBase {
+				base, hasBase = seg.MPEGTS, true
+			}
+			ts := seg.MPEGTS
+			if ts < base {
+				ts += mpegTSWrap
+			}
+			offset = time.Duration(ts-base)*time.Second/90000 - seg.Local
+		}
+		for _, c := range seg.Cues {
+			c.Start += offset
+			c.End += offset
+			cues = append(cues, c)
+		}
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return dedupe(cues)
+}
+
+// joinTolerance is how close two same-text cues must be to be joined.
+const joinTolerance = 50 * time.Millisecond
+
+func dedupe(cues []Cue) []Cue {
+	var out []Cue
+	for _, c := range cues {
+		merged := false
+		// Look back over cues that may still overlap c
+		for i := len(out) - 1; i >= 0 && out[i].End+joinTolerance >= c.Start; i-- {
+			prev := &out[i]
+			if prev.Text != c.Text {
+				continue
+			}
+			if c.End > prev.End {
+				prev.End = c.End
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// WriteVTT writes cues as a WebVTT file.
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	for _, c := range cues {
+		bw.WriteString("\n")
+		if c.ID != "" {
+			fmt.Fprintf(bw, "%s\n", c.ID)
+		}
+		fmt.Fprintf(bw, "%s --> %s", formatTimestamp(c.Start, '.'), formatTimestamp(c.End, '.'))
+		if c.Settings != "" {
+			fmt.Fprintf(bw, " %s", c.Settings)
+		}
+		fmt.Fprintf(bw, "\n%s\n", c.Text)
+	}
+	return bw.Flush()
+}
+
+// WriteSRT writes cues as a SubRip file. Cue settings are dropped.
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cues {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n", i+1, formatTimestamp(c.Start, ','), formatTimestamp(c.End, ','), c.Text)
+	}
+	return bw.Flush()
+}
+
+func formatTimestamp(d time.Duration, sep byte) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
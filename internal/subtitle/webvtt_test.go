@@ -0,0 +1,108 @@
+package subtitle
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWebVTT(t *testing.T) {
+	data := "\xef\xbb\xbfWEBVTT\r\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\r\n\r\n" +
+		"NOTE a comment\r\n\r\n" +
+		"intro\r\n00:00:01.000 --> 00:00:02.500 line:90% align:center\r\nHello\r\nworld\r\n\r\n" +
+		"01:02.000 --> 01:03.000\r\nShort form\r\n"
+
+	seg, err := ParseWebVTT([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !seg.HasTimestampMap || seg.MPEGTS != 900000 || seg.Local != 0 {
+		t.Errorf("timestamp map: %+v", seg)
+	}
+	if len(seg.Cues) != 2 {
+		t.Fatalf("expected 2 cues, got %d", len(seg.Cues))
+	}
+
+	c := seg.Cues[0]
+	if c.ID != "intro" || c.Start != time.Second || c.End != 2500*time.Millisecond {
+		t.Errorf("unexpected first cue: %+v", c)
+	}
+	if c.Settings != "line:90% align:center" || c.Text != "Hello\nworld" {
+		t.Errorf("unexpected first cue body: %+v", c)
+	}
+	if seg.Cues[1].Start != 62*time.Second {
+		t.Errorf("short timestamp: got %v", seg.Cues[1].Start)
+	}
+}
+
+func TestParseWebVTT_Invalid(t *testing.T) {
+	inputs := map[string]string{
+		"no header":  "00:00:01.000 --> 00:00:02.000\nhi\n",
+		"bad timing": "WEBVTT\n\n00:00:xx --> 00:00:02.000\nhi\n",
+		"bad map":    "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:abc,LOCAL:00:00:00.000\n",
+	}
+	for name, in := range inputs {
+		if _, err := ParseWebVTT([]byte(in)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestStitch_PerSegmentTimestampMap(t *testing.T) {
+	// Each segment's cues are relative to the segment, anchored by MPEGTS
+	seg := func(mpegts string, body string) *Segment {
+		s, err := ParseWebVTT([]byte("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:" + mpegts + ",LOCAL:00:00:00.000\n\n" + body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	segments := []*Segment{
+		seg("900000", "00:00:01.000 --> 00:00:03.000\nFirst\n\n00:00:05.000 --> 00:00:06.000\nSpans\n"),
+		// Same cue continued in the next segment, plus a repeated copy
+		seg("1440000", "00:00:00.000 --> 00:00:01.000\nSpans\n\n00:00:02.000 --> 00:00:03.000\nSecond\n"),
+		seg("1440000", "00:00:02.000 --> 00:00:03.000\nSecond\n"),
+	}
+
+	cues := Stitch(segments)
+	var b strings.Builder
+	if err := WriteSRT(&b, cues); err != nil {
+		t.Fatal(err)
+	}
+	want := "1\n00:00:01,000 --> 00:00:03,000\nFirst\n\n" +
+		"2\n00:00:05,000 --> 00:00:07,000\nSpans\n\n" +
+		"3\n00:00:08,000 --> 00:00:09,000\nSecond\n"
+	if b.String() != want {
+		t.Errorf("SRT output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestStitch_LocalOffsetAndRollover(t *testing.T) {
+	segments := []*Segment{
+		{HasTimestampMap: true, MPEGTS: mpegTSWrap - 90000, Local: 10 * time.Second,
+			Cues: []Cue{{Start: 10 * time.Second, End: 11 * time.Second, Text: "a"}}},
+		// MPEGTS wrapped around: 2s after the first segment's anchor
+		{HasTimestampMap: true, MPEGTS: 90000, Local: 10 * time.Second,
+			Cues: []Cue{{Start: 10 * time.Second, End: 11 * time.Second, Text: "b"}}},
+	}
+
+	cues := Stitch(segments)
+	if len(cues) != 2 || cues[0].Start != 0 || cues[1].Start != 2*time.Second {
+		t.Errorf("unexpected cues: %+v", cues)
+	}
+}
+
+func TestWriteVTT(t *testing.T) {
+	cues := []Cue{
+		{ID: "1", Start: 3723456 * time.Millisecond, End: 3724 * time.Second, Settings: "align:start", Text: "Hi"},
+		{Start: 3725 * time.Second, End: 3726 * time.Second, Text: "There"},
+	}
+	var b strings.Builder
+	if err := WriteVTT(&b, cues); err != nil {
+		t.Fatal(err)
+	}
+	want := "WEBVTT\n\n1\n01:02:03.456 --> 01:02:04.000 align:start\nHi\n\n01:02:05.000 --> 01:02:06.000\nThere\n"
+	if b.String() != want {
+		t.Errorf("VTT output:\n%q\nwant:\n%q", b.String(), want)
+	}
+}